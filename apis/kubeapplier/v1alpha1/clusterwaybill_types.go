@@ -0,0 +1,225 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterWaybillSpec defines the desired state of ClusterWaybill
+type ClusterWaybillSpec struct {
+	// AutoApply determines whether this ClusterWaybill will be automatically
+	// applied by scheduled or polling runs.
+	// +optional
+	// +kubebuilder:default=true
+	AutoApply *bool `json:"autoApply,omitempty"`
+
+	// DelegateServiceAccountRef references a ServiceAccount that kube-applier
+	// requests a short-lived token for through the TokenRequest API for each
+	// apply run, instead of using DelegateServiceAccountSecretRef. The
+	// ServiceAccount is looked up in the namespace configured for
+	// ClusterWaybills in kube-applier.
+	// +optional
+	DelegateServiceAccountRef string `json:"delegateServiceAccountRef,omitempty"`
+
+	// DelegateServiceAccountSecretRef references a Secret of type
+	// kubernetes.io/service-account-token that will be passed by kube-applier
+	// to kubectl when performing apply runs. The Secret is looked up in the
+	// namespace configured for ClusterWaybills in kube-applier. It is ignored
+	// if DelegateServiceAccountRef is set.
+	// +optional
+	// +kubebuilder:default=kube-applier-delegate-token
+	// +kubebuilder:validation:MinLength=1
+	DelegateServiceAccountSecretRef string `json:"delegateServiceAccountSecretRef,omitempty"`
+
+	// DryRun enables the dry-run flag when applying this ClusterWaybill.
+	// +optional
+	// +kubebuilder:default=false
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// GitSSHSecretRef will override the default Git SSH key passed as a
+	// flag. See the WaybillSpec for details. If the namespace is not
+	// specified, it defaults to the namespace configured for ClusterWaybills
+	// in kube-applier.
+	// +optional
+	GitSSHSecretRef *ObjectReference `json:"gitSSHSecretRef,omitempty"`
+
+	// GitHTTPSSecretRef references a Secret with the credentials that are
+	// used when cloning remote bases over HTTPS. See the WaybillSpec for
+	// details. If the namespace is not specified, it defaults to the
+	// namespace configured for ClusterWaybills in kube-applier.
+	// +optional
+	GitHTTPSSecretRef *ObjectReference `json:"gitHTTPSSecretRef,omitempty"`
+
+	// Notifications configures targets that are notified when the outcome of
+	// the apply runs for this ClusterWaybill changes.
+	// +optional
+	Notifications []WaybillNotification `json:"notifications,omitempty"`
+
+	// Priority adjusts the priority of the run requests for this
+	// ClusterWaybill in the run queue. See the WaybillSpec for details.
+	// +optional
+	// +kubebuilder:validation:Minimum=-50
+	// +kubebuilder:validation:Maximum=50
+	Priority int `json:"priority,omitempty"`
+
+	// Prune determines whether pruning is enabled for this ClusterWaybill.
+	// Only cluster resources are pruned.
+	// +optional
+	// +kubebuilder:default=true
+	Prune *bool `json:"prune,omitempty"`
+
+	// PruneBlacklist can be used to specify a list of resources that are exempt
+	// from pruning.
+	// +optional
+	PruneBlacklist []string `json:"pruneBlacklist,omitempty"`
+
+	// RepositoryPath defines the relative path inside the Repository where the
+	// configuration for this ClusterWaybill is stored. Accepted values are the
+	// same as for Waybills, but since a ClusterWaybill does not belong to a
+	// namespace there is no default value.
+	// +kubebuilder:validation:Pattern=^(\/?[a-zA-Z0-9.\_\-]+(\/[a-zA-Z0-9.\_\-]+)*\/?)?$
+	RepositoryPath string `json:"repositoryPath"`
+
+	// Revision overrides the revision of the repository that is applied for
+	// this ClusterWaybill. Accepted values are the same as for Waybills.
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
+	// RunInterval determines how often this ClusterWaybill is applied in
+	// seconds.
+	// +optional
+	// +kubebuilder:default=3600
+	RunInterval int `json:"runInterval,omitempty"`
+
+	// RunTimeout specifies the timeout for performing an apply run.
+	// +optional
+	// +kubebuilder:default=900
+	RunTimeout int `json:"runTimeout,omitempty"`
+
+	// ServerSideApply determines whether the server-side apply flag is enabled
+	// for this ClusterWaybill.
+	// +optional
+	// +kubebuilder:default=false
+	ServerSideApply bool `json:"serverSideApply,omitempty"`
+
+	// StrongboxKeyringSecretRef references a Secret that contains an item named
+	// '.strongbox_keyring' with any strongbox keys required to decrypt the
+	// files before applying. If the namespace is not specified, it defaults
+	// to the namespace configured for ClusterWaybills in kube-applier.
+	// +optional
+	StrongboxKeyringSecretRef *ObjectReference `json:"strongboxKeyringSecretRef,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterWaybill is the Schema for the ClusterWaybills API of kube-applier. A
+// ClusterWaybill is the cluster-scoped counterpart of a Waybill, used to
+// apply cluster resources (such as ClusterRoles or CustomResourceDefinitions)
+// stored in a path in a remote git repository.
+// +kubebuilder:resource:scope=Cluster,shortName=cwb;cwbs
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Success",type=boolean,JSONPath=`.status.lastRun.success`
+// +kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.lastRun.type`
+// +kubebuilder:printcolumn:name="Commit",type=string,JSONPath=`.status.lastRun.commit`
+// +kubebuilder:printcolumn:name="Last Applied",type=date,JSONPath=`.status.lastRun.finished`
+// +kubebuilder:printcolumn:name="Auto Apply",type=boolean,JSONPath=`.spec.autoApply`,priority=10
+// +kubebuilder:printcolumn:name="Dry Run",type=boolean,JSONPath=`.spec.dryRun`,priority=10
+// +kubebuilder:printcolumn:name="Prune",type=boolean,JSONPath=`.spec.prune`,priority=10
+// +kubebuilder:printcolumn:name="Run Interval",type=number,JSONPath=`.spec.runInterval`,priority=10
+// +kubebuilder:printcolumn:name="Repository Path",type=string,JSONPath=`.spec.repositoryPath`,priority=20
+type ClusterWaybill struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterWaybillSpec `json:"spec"`
+	Status WaybillStatus      `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterWaybillList contains a list of ClusterWaybill
+type ClusterWaybillList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ClusterWaybill `json:"items"`
+}
+
+// Waybill returns a Waybill with the metadata, spec and status of the
+// ClusterWaybill, which allows ClusterWaybills to be scheduled, applied and
+// displayed in the same way as Waybills. The returned Waybill has an empty
+// namespace and only prunes cluster resources.
+func (in *ClusterWaybill) Waybill() *Waybill {
+	out := &Waybill{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: GroupVersion.String(),
+			Kind:       "ClusterWaybill",
+		},
+		Spec: WaybillSpec{
+			AutoApply:                       in.Spec.AutoApply,
+			DelegateServiceAccountRef:       in.Spec.DelegateServiceAccountRef,
+			DelegateServiceAccountSecretRef: in.Spec.DelegateServiceAccountSecretRef,
+			DryRun:                          in.Spec.DryRun,
+			GitHTTPSSecretRef:               in.Spec.GitHTTPSSecretRef,
+			GitSSHSecretRef:                 in.Spec.GitSSHSecretRef,
+			Notifications:                   in.Spec.Notifications,
+			Priority:                        in.Spec.Priority,
+			Prune:                           in.Spec.Prune,
+			PruneClusterResources:           true,
+			PruneBlacklist:                  in.Spec.PruneBlacklist,
+			RepositoryPath:                  in.Spec.RepositoryPath,
+			Revision:                        in.Spec.Revision,
+			RunInterval:                     in.Spec.RunInterval,
+			RunTimeout:                      in.Spec.RunTimeout,
+			ServerSideApply:                 in.Spec.ServerSideApply,
+			StrongboxKeyringSecretRef:       in.Spec.StrongboxKeyringSecretRef,
+		},
+		Status: in.Status,
+	}
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.ObjectMeta.Namespace = ""
+	return out.DeepCopy()
+}
+
+// IsClusterWaybill returns true if the Waybill was created from a
+// ClusterWaybill, using ClusterWaybill.Waybill(). Waybills are namespaced, so
+// this is the case when the namespace is empty.
+func (in *Waybill) IsClusterWaybill() bool {
+	return in.Namespace == ""
+}
+
+// ClusterWaybill returns a ClusterWaybill with the metadata, spec and status
+// of a Waybill that was created from a ClusterWaybill. It is the inverse of
+// ClusterWaybill.Waybill().
+func (in *Waybill) ClusterWaybill() *ClusterWaybill {
+	out := &ClusterWaybill{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: GroupVersion.String(),
+			Kind:       "ClusterWaybill",
+		},
+		Spec: ClusterWaybillSpec{
+			AutoApply:                       in.Spec.AutoApply,
+			DelegateServiceAccountRef:       in.Spec.DelegateServiceAccountRef,
+			DelegateServiceAccountSecretRef: in.Spec.DelegateServiceAccountSecretRef,
+			DryRun:                          in.Spec.DryRun,
+			GitHTTPSSecretRef:               in.Spec.GitHTTPSSecretRef,
+			GitSSHSecretRef:                 in.Spec.GitSSHSecretRef,
+			Notifications:                   in.Spec.Notifications,
+			Priority:                        in.Spec.Priority,
+			Prune:                           in.Spec.Prune,
+			PruneBlacklist:                  in.Spec.PruneBlacklist,
+			RepositoryPath:                  in.Spec.RepositoryPath,
+			Revision:                        in.Spec.Revision,
+			RunInterval:                     in.Spec.RunInterval,
+			RunTimeout:                      in.Spec.RunTimeout,
+			ServerSideApply:                 in.Spec.ServerSideApply,
+			StrongboxKeyringSecretRef:       in.Spec.StrongboxKeyringSecretRef,
+		},
+		Status: in.Status,
+	}
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	return out.DeepCopy()
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterWaybill{}, &ClusterWaybillList{})
+}
@@ -4,6 +4,40 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	// LastActionAnnotation records the last action (such as pausing or
+	// resuming) that was performed on a Waybill through the kube-applier API.
+	LastActionAnnotation = "kube-applier.io/last-action"
+	// LastActionByAnnotation records the user that performed the last action.
+	LastActionByAnnotation = "kube-applier.io/last-action-by"
+	// LastActionReasonAnnotation records the reason given for the last
+	// action.
+	LastActionReasonAnnotation = "kube-applier.io/last-action-reason"
+	// LastActionTimeAnnotation records when the last action was performed, in
+	// RFC3339 format.
+	LastActionTimeAnnotation = "kube-applier.io/last-action-time"
+	// ForceRunRequestedAnnotation records when a forced run was requested, in
+	// RFC3339 format with nanoseconds. It is set by replicas that are not the
+	// leader, so that the leader can queue the run, and removed once the run
+	// is queued.
+	ForceRunRequestedAnnotation = "kube-applier.io/force-run-requested"
+	// RollbackCommitAnnotation pins a Waybill to the commit that it was
+	// rolled back to through the kube-applier API. While it is set, polling
+	// runs are suspended and other runs apply the commit instead of the
+	// revision of the Waybill. It is removed when the pin is cleared, or
+	// when a newer commit is available for the Waybill.
+	RollbackCommitAnnotation = "kube-applier.io/rollback-commit"
+	// RollbackFromAnnotation records the commit that was applied when the
+	// Waybill was rolled back. Newer commits under the path of the Waybill
+	// release the pin.
+	RollbackFromAnnotation = "kube-applier.io/rollback-from"
+
+	// WaybillLabel is used to select the resources that belong to a Waybill,
+	// when there are multiple Waybills in the same namespace. Its value is
+	// the name of the Waybill.
+	WaybillLabel = "kube-applier.io/waybill"
+)
+
 // WaybillSpec defines the desired state of Waybill
 type WaybillSpec struct {
 	// AutoApply determines whether this Waybill will be automatically applied
@@ -12,10 +46,17 @@ type WaybillSpec struct {
 	// +kubebuilder:default=true
 	AutoApply *bool `json:"autoApply,omitempty"`
 
+	// DelegateServiceAccountRef references a ServiceAccount in the same
+	// namespace as the Waybill. If set, kube-applier requests a short-lived
+	// token for it through the TokenRequest API for each apply run and passes
+	// it to kubectl, instead of using DelegateServiceAccountSecretRef.
+	// +optional
+	DelegateServiceAccountRef string `json:"delegateServiceAccountRef,omitempty"`
+
 	// DelegateServiceAccountSecretRef references a Secret of type
 	// kubernetes.io/service-account-token in the same namespace as the Waybill
 	// that will be passed by kube-applier to kubectl when performing apply
-	// runs.
+	// runs. It is ignored if DelegateServiceAccountRef is set.
 	// +optional
 	// +kubebuilder:default=kube-applier-delegate-token
 	// +kubebuilder:validation:MinLength=1
@@ -35,6 +76,31 @@ type WaybillSpec struct {
 	// +optional
 	GitSSHSecretRef *ObjectReference `json:"gitSSHSecretRef,omitempty"`
 
+	// GitHTTPSSecretRef references a Secret with the credentials that are
+	// used by `kustomize` when cloning remote bases over HTTPS. The Secret
+	// contains either an item named `password` (a password or a token) and
+	// optionally an item named `username`, or the items `github_app_id`,
+	// `github_app_installation_id` and `github_app_private_key` of a GitHub
+	// App, in which case installation tokens are requested and refreshed
+	// automatically.
+	// +optional
+	GitHTTPSSecretRef *ObjectReference `json:"gitHTTPSSecretRef,omitempty"`
+
+	// Notifications configures targets that are notified when the outcome of
+	// the apply runs for this Waybill changes, for example when a run fails
+	// after a successful one.
+	// +optional
+	Notifications []WaybillNotification `json:"notifications,omitempty"`
+
+	// Priority adjusts the priority of the run requests for this Waybill in
+	// the run queue. Requests with a higher priority are applied first, but
+	// the run type (forced, git polling, retry after failure, scheduled)
+	// always takes precedence.
+	// +optional
+	// +kubebuilder:validation:Minimum=-50
+	// +kubebuilder:validation:Maximum=50
+	Priority int `json:"priority,omitempty"`
+
 	// Prune determines whether pruning is enabled for this Waybill.
 	// +optional
 	// +kubebuilder:default=true
@@ -61,6 +127,14 @@ type WaybillSpec struct {
 	// +kubebuilder:validation:Pattern=^(\/?[a-zA-Z0-9.\_\-]+(\/[a-zA-Z0-9.\_\-]+)*\/?)?$
 	RepositoryPath string `json:"repositoryPath"`
 
+	// Revision overrides the revision of the repository that is applied for
+	// this Waybill. It can be 'HEAD', for the HEAD of the branch, the full
+	// hash of a commit, the name of a tag, or a semantic version constraint,
+	// such as '>=1.4.0 <2', for the highest tag that satisfies it. If not
+	// specified, the revision that kube-applier is configured with is used.
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
 	// RunInterval determines how often this Waybill is applied in seconds.
 	// +optional
 	// +kubebuilder:default=3600
@@ -85,12 +159,72 @@ type WaybillSpec struct {
 	StrongboxKeyringSecretRef *ObjectReference `json:"strongboxKeyringSecretRef,omitempty"`
 }
 
+// WaybillNotification configures a target that is notified about changes in
+// the outcome of apply runs.
+type WaybillNotification struct {
+	// Template is a Go template used to render the payload sent to the
+	// target. If not specified, a default template for the type of the
+	// target is used.
+	// +optional
+	Template string `json:"template,omitempty"`
+
+	// Type is the type of the notification target. Slack targets expect a
+	// Slack incoming webhook URL, while webhook targets can be any HTTP
+	// endpoint that accepts POST requests.
+	// +kubebuilder:validation:Enum=slack;webhook
+	Type string `json:"type"`
+
+	// URLSecretRef references a Secret that contains an item named `url`
+	// with the URL of the notification target.
+	URLSecretRef ObjectReference `json:"urlSecretRef"`
+}
+
 // WaybillStatus defines the observed state of Waybill
 type WaybillStatus struct {
 	// LastRun contains the last apply run's information.
 	// +nullable
 	// +optional
 	LastRun *WaybillStatusRun `json:"lastRun,omitempty"`
+
+	// History summarises the most recent apply runs, oldest first.
+	// +optional
+	History []WaybillStatusRunSummary `json:"history,omitempty"`
+
+	// Rollback is set if the last apply run applied the commit that the
+	// Waybill is pinned to by a rollback.
+	// +nullable
+	// +optional
+	Rollback *WaybillStatusRollback `json:"rollback,omitempty"`
+}
+
+// WaybillStatusRunSummary summarises an apply run of a Waybill, as recorded
+// in its run history.
+type WaybillStatusRunSummary struct {
+	// Commit is the git commit hash on which this apply run operated.
+	Commit string `json:"commit"`
+
+	// DryRun denotes whether the apply run was performed in dry-run mode.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Finished is the time that the apply run finished applying this Waybill.
+	Finished metav1.Time `json:"finished"`
+
+	// Success denotes whether the apply run was successful or not.
+	Success bool `json:"success"`
+
+	// Type is a short description of the kind of apply run that was attempted.
+	Type string `json:"type"`
+}
+
+// WaybillStatusRollback describes the rollback that a Waybill is pinned to.
+type WaybillStatusRollback struct {
+	// Commit is the git commit hash that the Waybill was rolled back to.
+	Commit string `json:"commit"`
+
+	// From is the git commit hash that was applied when the Waybill was
+	// rolled back.
+	From string `json:"from"`
 }
 
 // WaybillStatusRun contains information about an apply run of a Waybill
@@ -117,6 +251,11 @@ type WaybillStatusRun struct {
 	// Success denotes whether the apply run was successful or not.
 	Success bool `json:"success"`
 
+	// TraceID is the ID of the OpenTelemetry trace of the apply run, if
+	// tracing is enabled.
+	// +optional
+	TraceID string `json:"traceID,omitempty"`
+
 	// Type is a short description of the kind of apply run that was attempted.
 	// +kubebuilder:default="unknown"
 	Type string `json:"type"`
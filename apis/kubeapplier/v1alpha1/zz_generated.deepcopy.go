@@ -9,6 +9,115 @@ import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterWaybill) DeepCopyInto(out *ClusterWaybill) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterWaybill.
+func (in *ClusterWaybill) DeepCopy() *ClusterWaybill {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterWaybill)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterWaybill) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterWaybillList) DeepCopyInto(out *ClusterWaybillList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterWaybill, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterWaybillList.
+func (in *ClusterWaybillList) DeepCopy() *ClusterWaybillList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterWaybillList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterWaybillList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterWaybillSpec) DeepCopyInto(out *ClusterWaybillSpec) {
+	*out = *in
+	if in.AutoApply != nil {
+		in, out := &in.AutoApply, &out.AutoApply
+		*out = new(bool)
+		**out = **in
+	}
+	if in.GitSSHSecretRef != nil {
+		in, out := &in.GitSSHSecretRef, &out.GitSSHSecretRef
+		*out = new(ObjectReference)
+		**out = **in
+	}
+	if in.GitHTTPSSecretRef != nil {
+		in, out := &in.GitHTTPSSecretRef, &out.GitHTTPSSecretRef
+		*out = new(ObjectReference)
+		**out = **in
+	}
+	if in.Notifications != nil {
+		in, out := &in.Notifications, &out.Notifications
+		*out = make([]WaybillNotification, len(*in))
+		copy(*out, *in)
+	}
+	if in.Prune != nil {
+		in, out := &in.Prune, &out.Prune
+		*out = new(bool)
+		**out = **in
+	}
+	if in.PruneBlacklist != nil {
+		in, out := &in.PruneBlacklist, &out.PruneBlacklist
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.StrongboxKeyringSecretRef != nil {
+		in, out := &in.StrongboxKeyringSecretRef, &out.StrongboxKeyringSecretRef
+		*out = new(ObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterWaybillSpec.
+func (in *ClusterWaybillSpec) DeepCopy() *ClusterWaybillSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterWaybillSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ObjectReference) DeepCopyInto(out *ObjectReference) {
 	*out = *in
@@ -83,6 +192,22 @@ func (in *WaybillList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WaybillNotification) DeepCopyInto(out *WaybillNotification) {
+	*out = *in
+	out.URLSecretRef = in.URLSecretRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WaybillNotification.
+func (in *WaybillNotification) DeepCopy() *WaybillNotification {
+	if in == nil {
+		return nil
+	}
+	out := new(WaybillNotification)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *WaybillSpec) DeepCopyInto(out *WaybillSpec) {
 	*out = *in
@@ -96,6 +221,16 @@ func (in *WaybillSpec) DeepCopyInto(out *WaybillSpec) {
 		*out = new(ObjectReference)
 		**out = **in
 	}
+	if in.GitHTTPSSecretRef != nil {
+		in, out := &in.GitHTTPSSecretRef, &out.GitHTTPSSecretRef
+		*out = new(ObjectReference)
+		**out = **in
+	}
+	if in.Notifications != nil {
+		in, out := &in.Notifications, &out.Notifications
+		*out = make([]WaybillNotification, len(*in))
+		copy(*out, *in)
+	}
 	if in.Prune != nil {
 		in, out := &in.Prune, &out.Prune
 		*out = new(bool)
@@ -131,6 +266,18 @@ func (in *WaybillStatus) DeepCopyInto(out *WaybillStatus) {
 		*out = new(WaybillStatusRun)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.History != nil {
+		in, out := &in.History, &out.History
+		*out = make([]WaybillStatusRunSummary, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Rollback != nil {
+		in, out := &in.Rollback, &out.Rollback
+		*out = new(WaybillStatusRollback)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WaybillStatus.
@@ -143,6 +290,21 @@ func (in *WaybillStatus) DeepCopy() *WaybillStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WaybillStatusRollback) DeepCopyInto(out *WaybillStatusRollback) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WaybillStatusRollback.
+func (in *WaybillStatusRollback) DeepCopy() *WaybillStatusRollback {
+	if in == nil {
+		return nil
+	}
+	out := new(WaybillStatusRollback)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *WaybillStatusRun) DeepCopyInto(out *WaybillStatusRun) {
 	*out = *in
@@ -159,3 +321,19 @@ func (in *WaybillStatusRun) DeepCopy() *WaybillStatusRun {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WaybillStatusRunSummary) DeepCopyInto(out *WaybillStatusRunSummary) {
+	*out = *in
+	in.Finished.DeepCopyInto(&out.Finished)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WaybillStatusRunSummary.
+func (in *WaybillStatusRunSummary) DeepCopy() *WaybillStatusRunSummary {
+	if in == nil {
+		return nil
+	}
+	out := new(WaybillStatusRunSummary)
+	in.DeepCopyInto(out)
+	return out
+}
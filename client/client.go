@@ -8,13 +8,18 @@ import (
 	"log"
 	"slices"
 	"strings"
+	"time"
 
+	authenticationv1 "k8s.io/api/authentication/v1"
 	authorizationv1 "k8s.io/api/authorization/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
@@ -22,8 +27,11 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
 	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/metrics"
 	// +kubebuilder:scaffold:imports
 	// For local dev
 	//_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
@@ -55,11 +63,31 @@ func init() {
 type Client struct {
 	cluster.Cluster
 	clientset kubernetes.Interface
+	delegates *delegateClientPool
+	discovery *discoveryCache
+	elected   <-chan struct{}
+	stopped   chan error
 	shutdown  func()
 }
 
+// Option configures the controller-runtime manager of a Client.
+type Option func(*manager.Options)
+
+// WithLeaderElection enables Lease-based leader election between the
+// replicas of kube-applier. The Lease with the provided name is created in
+// the provided namespace, or in the namespace that kube-applier runs in if it
+// is empty.
+func WithLeaderElection(namespace, name string) Option {
+	return func(options *manager.Options) {
+		options.LeaderElection = true
+		options.LeaderElectionID = name
+		options.LeaderElectionNamespace = namespace
+		options.LeaderElectionReleaseOnCancel = true
+	}
+}
+
 // New returns a new kubernetes client.
-func New(opts ...cluster.Option) (*Client, error) {
+func New(opts ...Option) (*Client, error) {
 	cfg, err := config.GetConfig()
 	if err != nil {
 		return nil, fmt.Errorf("Cannot get kubernetes config: %v", err)
@@ -69,27 +97,30 @@ func New(opts ...cluster.Option) (*Client, error) {
 
 // NewWithConfig returns a new kubernetes client initialised with the provided
 // configuration.
-func NewWithConfig(cfg *rest.Config, opts ...cluster.Option) (*Client, error) {
+func NewWithConfig(cfg *rest.Config, opts ...Option) (*Client, error) {
 	return newClient(cfg, opts...)
 }
 
-func newClient(cfg *rest.Config, opts ...cluster.Option) (*Client, error) {
-	c, err := cluster.New(cfg, func(options *cluster.Options) {
-		options.Scheme = scheme
-		options.NewCache = func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
-			// Only cache events for Waybills
+func newClient(cfg *rest.Config, opts ...Option) (*Client, error) {
+	options := manager.Options{
+		Scheme: scheme,
+		NewCache: func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+			// Only cache events for Waybills and ClusterWaybills
 			if opts.ByObject == nil {
 				opts.ByObject = make(map[client.Object]cache.ByObject)
 			}
 			opts.ByObject[&corev1.Event{}] = cache.ByObject{
-				Field: fields.SelectorFromSet(fields.Set{"involvedObject.kind": "Waybill"}),
+				Field: fields.SelectorFromSet(fields.Set{"involvedObject.apiVersion": kubeapplierv1alpha1.GroupVersion.String()}),
 			}
 			return cache.New(config, opts)
-		}
-		for _, opt := range opts {
-			opt(options)
-		}
-	})
+		},
+		// Metrics are served by the kube-applier webserver
+		Metrics: metricsserver.Options{BindAddress: "0"},
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	m, err := manager.New(cfg, options)
 	if err != nil {
 		return nil, err
 	}
@@ -99,12 +130,32 @@ func newClient(cfg *rest.Config, opts ...cluster.Option) (*Client, error) {
 		return nil, err
 	}
 
+	discovery := newDiscoveryCache(clientset.Discovery())
 	ctx, shutdown := context.WithCancel(context.Background())
-	go c.Start(ctx)
+	if err := discovery.invalidateOnCRDChanges(ctx, m.GetCache()); err != nil {
+		shutdown()
+		return nil, err
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- m.Start(ctx)
+	}()
+	go func() {
+		metrics.SetLeader(false)
+		select {
+		case <-m.Elected():
+			metrics.SetLeader(true)
+		case <-ctx.Done():
+		}
+	}()
 
 	return &Client{
-		Cluster:   c,
+		Cluster:   m,
 		clientset: clientset,
+		delegates: newDelegateClientPool(rest.AnonymousClientConfig(cfg), discovery),
+		discovery: discovery,
+		elected:   m.Elected(),
+		stopped:   stopped,
 		shutdown:  shutdown,
 	}, nil
 }
@@ -114,6 +165,39 @@ func (c *Client) Shutdown() {
 	c.shutdown()
 }
 
+// Elected returns a channel that is closed when this replica is elected as
+// the leader, or immediately if leader election is not enabled.
+func (c *Client) Elected() <-chan struct{} {
+	return c.elected
+}
+
+// IsLeader returns true if this replica is the leader, or if leader election
+// is not enabled.
+func (c *Client) IsLeader() bool {
+	select {
+	case <-c.elected:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stopped returns a channel that receives the error that the client stopped
+// with, for example when it loses leadership. In that case, kube-applier is
+// expected to exit, so that the replica elected next does not apply in
+// parallel with it.
+func (c *Client) Stopped() <-chan error {
+	return c.stopped
+}
+
+// DelegateClient returns a DelegateClient for the ServiceAccount specified by
+// the namespace and name, that authenticates with the given token. Clients are
+// pooled by ServiceAccount, so that runs of the same delegate reuse them even
+// though their tokens differ.
+func (c *Client) DelegateClient(namespace, serviceAccount, token string) (*DelegateClient, error) {
+	return c.delegates.get(types.NamespacedName{Namespace: namespace, Name: serviceAccount}, token)
+}
+
 // CloneConfig copies the client's config into a new rest.Config, it does not
 // copy user credentials
 func (c *Client) CloneConfig() *rest.Config {
@@ -122,6 +206,10 @@ func (c *Client) CloneConfig() *rest.Config {
 
 // EmitWaybillEvent creates an Event for the provided Waybill.
 func (c *Client) EmitWaybillEvent(waybill *kubeapplierv1alpha1.Waybill, eventType, reason, messageFmt string, args ...interface{}) {
+	if waybill.IsClusterWaybill() {
+		c.GetEventRecorderFor(Name).Eventf(waybill.ClusterWaybill(), eventType, reason, messageFmt, args...)
+		return
+	}
 	c.GetEventRecorderFor(Name).Eventf(waybill, eventType, reason, messageFmt, args...)
 }
 
@@ -129,6 +217,9 @@ func (c *Client) EmitWaybillEvent(waybill *kubeapplierv1alpha1.Waybill, eventTyp
 // corresponds to a user who has edit access to the specified Waybill.
 func (c *Client) HasAccess(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill, email, verb string) (bool, error) {
 	gvk := waybill.GroupVersionKind()
+	if waybill.IsClusterWaybill() {
+		gvk = kubeapplierv1alpha1.GroupVersion.WithKind("ClusterWaybill")
+	}
 	plural, err := c.pluralName(gvk)
 	if err != nil {
 		return false, err
@@ -155,92 +246,74 @@ func (c *Client) HasAccess(ctx context.Context, waybill *kubeapplierv1alpha1.Way
 	return response.Status.Allowed, nil
 }
 
-// ListWaybillEvents returns a list of Waybill events. The events are sorted by
-// the LastTimestamp field.
+// ListWaybillEvents returns a list of Waybill and ClusterWaybill events. The
+// events are sorted by the LastTimestamp field.
 func (c *Client) ListWaybillEvents(ctx context.Context) ([]corev1.Event, error) {
 	eventList := &corev1.EventList{}
 	if err := c.GetClient().List(ctx, eventList); err != nil {
 		return nil, err
 	}
+	return waybillEvents(eventList.Items), nil
+}
 
-	var events []corev1.Event
-	for _, e := range eventList.Items {
-		if e.InvolvedObject.Kind == "Waybill" && e.InvolvedObject.GroupVersionKind().Group == kubeapplierv1alpha1.GroupVersion.Group {
-			events = append(events, e)
-		}
-	}
-	slices.SortStableFunc(events, func(a, b corev1.Event) int {
-		if a.LastTimestamp.Before(&b.LastTimestamp) {
-			return -1
-		}
-		if b.LastTimestamp.Before(&a.LastTimestamp) {
-			return 1
-		}
-
-		return 0
-	})
-
-	return events, nil
+// ListNamespaceWaybillEvents returns a list of the Waybill events in the
+// provided namespace, sorted by the LastTimestamp field. Events for
+// ClusterWaybills are recorded in the "default" namespace.
+func (c *Client) ListNamespaceWaybillEvents(ctx context.Context, namespace string) ([]corev1.Event, error) {
+	return c.waybills().ListNamespaceWaybillEvents(ctx, namespace)
 }
 
-// ListWaybills returns a list of all the Waybill resources.
+// ListWaybills returns a list of all the Waybill resources, sorted by
+// namespace and name. ClusterWaybills are included in the list as Waybills
+// with an empty namespace, which means that they are sorted first.
 func (c *Client) ListWaybills(ctx context.Context) ([]kubeapplierv1alpha1.Waybill, error) {
-	waybills := &kubeapplierv1alpha1.WaybillList{}
-	if err := c.GetClient().List(ctx, waybills); err != nil {
-		return nil, err
-	}
-	// ensure that the list of Waybills is sorted alphabetically
-	sortedWaybills := make([]kubeapplierv1alpha1.Waybill, len(waybills.Items))
-	for i, wb := range waybills.Items {
-		sortedWaybills[i] = wb
-	}
-	slices.SortFunc(sortedWaybills, func(a, b kubeapplierv1alpha1.Waybill) int {
-		ns := strings.Compare(a.Namespace, b.Namespace)
-		if ns != 0 {
-			return ns
-		}
+	return c.waybills().ListWaybills(ctx)
+}
 
-		return strings.Compare(a.Name, b.Name)
-	})
+// ListClusterWaybills returns a list of all the ClusterWaybill resources as
+// Waybills, sorted by name. If the ClusterWaybill CRD is not installed in the
+// cluster, an empty list is returned.
+func (c *Client) ListClusterWaybills(ctx context.Context) ([]kubeapplierv1alpha1.Waybill, error) {
+	return c.waybills().ListClusterWaybills(ctx)
+}
 
-	unique := map[string]kubeapplierv1alpha1.Waybill{}
-	for _, wb := range sortedWaybills {
-		if v, ok := unique[wb.Namespace]; ok {
-			c.EmitWaybillEvent(&wb, corev1.EventTypeWarning, "MultipleWaybillsFound", "Waybill %s is already being used", v.Name)
-			continue
-		}
-		unique[wb.Namespace] = wb
-	}
-	ret := make([]kubeapplierv1alpha1.Waybill, len(unique))
-	i := 0
-	for _, wb := range unique {
-		ret[i] = wb
-		i++
-	}
-	slices.SortFunc(ret, func(a, b kubeapplierv1alpha1.Waybill) int {
-		return strings.Compare(a.Namespace, b.Namespace)
-	})
-	return ret, nil
+// ListNamespaceWaybills returns a list of the Waybill resources in the
+// provided namespace, sorted by name.
+func (c *Client) ListNamespaceWaybills(ctx context.Context, namespace string) ([]kubeapplierv1alpha1.Waybill, error) {
+	return c.waybills().ListNamespaceWaybills(ctx, namespace)
 }
 
 // GetWaybill returns the Waybill resource specified by the namespace
-// and name.
+// and name. If the namespace is empty, the ClusterWaybill with the provided
+// name is returned as a Waybill.
 func (c *Client) GetWaybill(ctx context.Context, namespace, name string) (*kubeapplierv1alpha1.Waybill, error) {
-	waybill := &kubeapplierv1alpha1.Waybill{}
-	if err := c.GetClient().Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, waybill); err != nil {
-		return nil, err
-	}
-	return waybill, nil
+	return c.waybills().GetWaybill(ctx, namespace, name)
 }
 
-// UpdateWaybill updates the Waybill resource provided.
+// UpdateWaybill updates the Waybill resource provided. Waybills that were
+// created from a ClusterWaybill update the ClusterWaybill instead.
 func (c *Client) UpdateWaybill(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) error {
-	return c.GetClient().Update(ctx, waybill, defaultUpdateOptions)
+	return c.waybills().UpdateWaybill(ctx, waybill)
+}
+
+// waybills returns a WaybillClient that uses the client of the manager, so
+// that Waybills, ClusterWaybills and Events are read from its cache.
+func (c *Client) waybills() *WaybillClient {
+	return &WaybillClient{client: c.GetClient()}
 }
 
 // UpdateWaybillStatus updates the status of the Waybill resource
-// provided.
+// provided. Waybills that were created from a ClusterWaybill update the
+// status of the ClusterWaybill instead.
 func (c *Client) UpdateWaybillStatus(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) error {
+	if waybill.IsClusterWaybill() {
+		clusterWaybill := waybill.ClusterWaybill()
+		if err := c.GetClient().SubResource("status").Update(ctx, clusterWaybill, &client.SubResourceUpdateOptions{UpdateOptions: *defaultUpdateOptions}); err != nil {
+			return err
+		}
+		clusterWaybill.ObjectMeta.DeepCopyInto(&waybill.ObjectMeta)
+		return nil
+	}
 	return c.GetClient().SubResource("status").Update(ctx, waybill, &client.SubResourceUpdateOptions{UpdateOptions: *defaultUpdateOptions})
 }
 
@@ -259,13 +332,98 @@ func (c *Client) GetSecret(ctx context.Context, namespace, name string) (*corev1
 	return secret, nil
 }
 
+// CreateServiceAccountToken requests a token for the ServiceAccount specified
+// by the namespace and name through the TokenRequest API. The token is bound
+// to the given audiences, or to the audiences of the API server if none are
+// specified, and expires after the given duration.
+func (c *Client) CreateServiceAccountToken(ctx context.Context, namespace, name string, audiences []string, expiration time.Duration) (string, error) {
+	expirationSeconds := int64(expiration.Seconds())
+	tr, err := c.clientset.CoreV1().ServiceAccounts(namespace).CreateToken(ctx, name, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         audiences,
+			ExpirationSeconds: &expirationSeconds,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	return tr.Status.Token, nil
+}
+
+// CurrentUser returns the name of the user that the client authenticates as.
+func (c *Client) CurrentUser(ctx context.Context) (string, error) {
+	return c.waybills().CurrentUser(ctx)
+}
+
+// ListLeases returns the Leases in the namespace that match the label
+// selector. Like Secrets, Leases are read from the API server directly rather
+// than being cached.
+func (c *Client) ListLeases(ctx context.Context, namespace, selector string) ([]coordinationv1.Lease, error) {
+	leases, err := c.clientset.CoordinationV1().Leases(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return leases.Items, nil
+}
+
+// RenewLease creates the provided Lease, or replaces the labels and spec of
+// the existing Lease with the same name.
+func (c *Client) RenewLease(ctx context.Context, lease *coordinationv1.Lease) error {
+	leases := c.clientset.CoordinationV1().Leases(lease.Namespace)
+	existing, err := leases.Get(ctx, lease.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{FieldManager: Name})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Labels = lease.Labels
+	existing.Spec = lease.Spec
+	_, err = leases.Update(ctx, existing, metav1.UpdateOptions{FieldManager: Name})
+	return err
+}
+
+// GetLease returns the Lease specified by the namespace and name.
+func (c *Client) GetLease(ctx context.Context, namespace, name string) (*coordinationv1.Lease, error) {
+	return c.clientset.CoordinationV1().Leases(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// CreateLease creates the provided Lease. It fails if a Lease with the same
+// name already exists.
+func (c *Client) CreateLease(ctx context.Context, lease *coordinationv1.Lease) error {
+	_, err := c.clientset.CoordinationV1().Leases(lease.Namespace).Create(ctx, lease, metav1.CreateOptions{FieldManager: Name})
+	return err
+}
+
+// UpdateLease updates the provided Lease. It fails with a conflict if the
+// Lease was modified since it was read.
+func (c *Client) UpdateLease(ctx context.Context, lease *coordinationv1.Lease) error {
+	_, err := c.clientset.CoordinationV1().Leases(lease.Namespace).Update(ctx, lease, metav1.UpdateOptions{FieldManager: Name})
+	return err
+}
+
+// DeleteLease deletes the Lease specified by the namespace and name, if it
+// exists.
+func (c *Client) DeleteLease(ctx context.Context, namespace, name string) error {
+	err := c.clientset.CoordinationV1().Leases(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
 // PrunableResourceGVKs returns the cluster and namespaced resources that the
 // client can prune as two slices of strings of the format
 // <group>/<version>/<kind>.
 func (c *Client) PrunableResourceGVKs(ctx context.Context, namespace string) ([]string, []string, error) {
+	return prunableResourceGVKs(ctx, c.clientset, c.discovery, namespace)
+}
+
+func prunableResourceGVKs(ctx context.Context, clientset kubernetes.Interface, discovery *discoveryCache, namespace string) ([]string, []string, error) {
 	var cluster, namespaced []string
 
-	_, resourceList, err := c.clientset.Discovery().ServerGroupsAndResources()
+	resourceList, err := discovery.ServerResources()
 	if err != nil {
 		return cluster, namespaced, err
 	}
@@ -275,7 +433,7 @@ func (c *Client) PrunableResourceGVKs(ctx context.Context, namespace string) ([]
 			Namespace: namespace,
 		},
 	}
-	reviewResp, err := c.clientset.AuthorizationV1().SelfSubjectRulesReviews().Create(ctx, srr, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	reviewResp, err := clientset.AuthorizationV1().SelfSubjectRulesReviews().Create(ctx, srr, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
 	if err != nil {
 		return cluster, namespaced, err
 	}
@@ -14,6 +14,7 @@ import (
 	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 )
 
@@ -116,15 +117,15 @@ var _ = Describe("Client", func() {
 		})
 	})
 	Context("When listing waybills", func() {
-		It("Should return only one Waybill per namespace and emit events for the others", func() {
+		It("Should return all Waybills, sorted by namespace and name", func() {
 			wbList := []kubeapplierv1alpha1.Waybill{
 				{
 					TypeMeta:   metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
-					ObjectMeta: metav1.ObjectMeta{Name: "alpha", Namespace: "ns-0"},
+					ObjectMeta: metav1.ObjectMeta{Name: "beta", Namespace: "ns-0"},
 				},
 				{
 					TypeMeta:   metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
-					ObjectMeta: metav1.ObjectMeta{Name: "beta", Namespace: "ns-0"},
+					ObjectMeta: metav1.ObjectMeta{Name: "alpha", Namespace: "ns-0"},
 				},
 				{
 					TypeMeta:   metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
@@ -141,33 +142,81 @@ var _ = Describe("Client", func() {
 			}
 
 			Eventually(
-				func() int {
+				func() []string {
 					waybills, err := testKubeClient.ListWaybills(context.TODO())
 					if err != nil {
-						return -1
+						return nil
 					}
-					return len(waybills)
+					var ret []string
+					for _, wb := range waybills {
+						ret = append(ret, fmt.Sprintf("%s/%s", wb.Namespace, wb.Name))
+					}
+					return ret
 				},
 				time.Second*15,
 				time.Second,
-			).Should(Equal(2))
+			).Should(Equal([]string{"ns-0/alpha", "ns-0/beta", "ns-1/foo"}))
+
+			waybills, err := testKubeClient.ListNamespaceWaybills(context.TODO(), "ns-0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(waybills).To(HaveLen(2))
+			Expect(waybills[0].Name).To(Equal("alpha"))
+			Expect(waybills[1].Name).To(Equal("beta"))
+		})
+	})
+	Context("When listing cluster waybills", func() {
+		It("Should return ClusterWaybills as Waybills without a namespace", func() {
+			cwb := &kubeapplierv1alpha1.ClusterWaybill{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "ClusterWaybill"},
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster-resources"},
+				Spec:       kubeapplierv1alpha1.ClusterWaybillSpec{RepositoryPath: "cluster"},
+			}
+			Expect(testKubeClient.GetClient().Create(context.TODO(), cwb)).To(BeNil())
+			defer func() {
+				Expect(testKubeClient.GetClient().Delete(context.TODO(), cwb)).To(BeNil())
+			}()
 
-			events := &corev1.EventList{}
 			Eventually(
-				func() int {
-					if err := testKubeClient.GetAPIReader().List(context.TODO(), events); err != nil {
-						return -1
+				func() []string {
+					waybills, err := testKubeClient.ListClusterWaybills(context.TODO())
+					if err != nil {
+						return nil
+					}
+					var ret []string
+					for _, wb := range waybills {
+						ret = append(ret, fmt.Sprintf("%s/%s", wb.Namespace, wb.Name))
 					}
-					return len(events.Items)
+					return ret
 				},
 				time.Second*15,
 				time.Second,
-			).Should(Equal(1))
-			for _, e := range events.Items {
-				Expect(e).To(matchEvent(wbList[1], corev1.EventTypeWarning, "MultipleWaybillsFound", fmt.Sprintf("^.*%s.*$", wbList[0].Name)))
-			}
+			).Should(Equal([]string{"/cluster-resources"}))
 
-			Expect(testKubeClient.GetClient().Delete(context.TODO(), &events.Items[0])).To(BeNil())
+			wb, err := testKubeClient.GetWaybill(context.TODO(), "", "cluster-resources")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(wb.IsClusterWaybill()).To(BeTrue())
+			Expect(wb.Spec.PruneClusterResources).To(BeTrue())
+			Expect(wb.Spec.RepositoryPath).To(Equal("cluster"))
+
+			wb.Status.LastRun = &kubeapplierv1alpha1.WaybillStatusRun{
+				Commit:   "foo",
+				Finished: metav1.Now(),
+				Started:  metav1.Now(),
+				Success:  true,
+				Type:     "test",
+			}
+			Expect(testKubeClient.UpdateWaybillStatus(context.TODO(), wb)).To(BeNil())
+			Eventually(
+				func() string {
+					updated := &kubeapplierv1alpha1.ClusterWaybill{}
+					if err := testKubeClient.GetClient().Get(context.TODO(), client.ObjectKey{Name: "cluster-resources"}, updated); err != nil || updated.Status.LastRun == nil {
+						return ""
+					}
+					return updated.Status.LastRun.Commit
+				},
+				time.Second*15,
+				time.Second,
+			).Should(Equal("foo"))
 		})
 	})
 	Context("When listing events", func() {
@@ -200,6 +249,13 @@ var _ = Describe("Client", func() {
 				time.Second,
 			).Should(Equal(2))
 
+			nsEvents, err := testKubeClient.ListNamespaceWaybillEvents(context.TODO(), "ns-0")
+			Expect(err).To(BeNil())
+			Expect(nsEvents).To(HaveLen(2))
+			nsEvents, err = testKubeClient.ListNamespaceWaybillEvents(context.TODO(), "ns-1")
+			Expect(err).To(BeNil())
+			Expect(nsEvents).To(BeEmpty())
+
 			events, err := testKubeClient.ListWaybillEvents(context.TODO())
 			Expect(err).To(BeNil())
 			for i, e := range events {
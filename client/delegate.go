@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/utilitywarehouse/kube-applier/metrics"
+)
+
+const (
+	// delegateClientIdleTimeout is how long a DelegateClient is kept in the
+	// pool after it was last used, so that the clients of ServiceAccounts
+	// that are no longer delegates are evicted.
+	delegateClientIdleTimeout = 2 * time.Hour
+)
+
+// DelegateClient is a lightweight kubernetes client that authenticates with
+// the token of a delegate ServiceAccount. Unlike Client, it does not start a
+// cache and it shares the discovery cache of the Client that created it.
+type DelegateClient struct {
+	clientset kubernetes.Interface
+	discovery *discoveryCache
+	lastUsed  time.Time
+	mu        sync.RWMutex
+	token     string
+}
+
+// PrunableResourceGVKs returns the cluster and namespaced resources that the
+// delegate can prune as two slices of strings of the format
+// <group>/<version>/<kind>.
+func (d *DelegateClient) PrunableResourceGVKs(ctx context.Context, namespace string) ([]string, []string, error) {
+	return prunableResourceGVKs(ctx, d.clientset, d.discovery, namespace)
+}
+
+func (d *DelegateClient) getToken() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.token
+}
+
+func (d *DelegateClient) setToken(token string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.token = token
+}
+
+// delegateTokenRoundTripper authenticates requests with the current token of
+// a DelegateClient, so that the token can be replaced without creating a new
+// clientset.
+type delegateTokenRoundTripper struct {
+	client *DelegateClient
+	rt     http.RoundTripper
+}
+
+func (rt *delegateTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = utilnet.CloneRequest(req)
+	req.Header.Set("Authorization", "Bearer "+rt.client.getToken())
+	return rt.rt.RoundTrip(req)
+}
+
+func (rt *delegateTokenRoundTripper) WrappedRoundTripper() http.RoundTripper { return rt.rt }
+
+// delegateClientPool holds DelegateClients keyed by the namespace and name of
+// their ServiceAccount. Tokens requested through the TokenRequest API are
+// different for every run, so the token of a pooled client is replaced with
+// the latest one instead of being part of the key.
+type delegateClientPool struct {
+	config    *rest.Config
+	discovery *discoveryCache
+	mu        sync.Mutex
+	clients   map[types.NamespacedName]*DelegateClient
+}
+
+func newDelegateClientPool(config *rest.Config, discovery *discoveryCache) *delegateClientPool {
+	return &delegateClientPool{
+		config:    config,
+		discovery: discovery,
+		clients:   make(map[types.NamespacedName]*DelegateClient),
+	}
+}
+
+// get returns the DelegateClient for the given ServiceAccount, authenticating
+// with the given token, creating it if it is not in the pool. Clients that
+// have been idle for longer than delegateClientIdleTimeout are evicted.
+func (p *delegateClientPool) get(serviceAccount types.NamespacedName, token string) (*DelegateClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for k, c := range p.clients {
+		if now.Sub(c.lastUsed) > delegateClientIdleTimeout {
+			delete(p.clients, k)
+		}
+	}
+	if c, ok := p.clients[serviceAccount]; ok {
+		metrics.RecordCacheRequest(metrics.CacheDelegateClient, true)
+		c.lastUsed = now
+		c.setToken(token)
+		return c, nil
+	}
+	metrics.RecordCacheRequest(metrics.CacheDelegateClient, false)
+	c := &DelegateClient{
+		discovery: p.discovery,
+		lastUsed:  now,
+		token:     token,
+	}
+	cfg := rest.CopyConfig(p.config)
+	cfg.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &delegateTokenRoundTripper{client: c, rt: rt}
+	})
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.clientset = clientset
+	p.clients[serviceAccount] = c
+	return c, nil
+}
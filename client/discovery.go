@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/metrics"
+)
+
+const (
+	// discoveryCacheTTL is the maximum age of the cached discovery
+	// information. The cache is invalidated when CustomResourceDefinitions
+	// change, but this ensures that other changes (eg. aggregated APIs) are
+	// eventually picked up as well.
+	discoveryCacheTTL = time.Hour
+)
+
+var crdGVK = schema.GroupVersionKind{
+	Group:   "apiextensions.k8s.io",
+	Version: "v1",
+	Kind:    "CustomResourceDefinition",
+}
+
+// discoveryCache caches the API resources served by the apiserver. Discovery
+// information is the same for all users, so it is shared between a Client and
+// the DelegateClients it creates, instead of performing full discovery for
+// every run.
+type discoveryCache struct {
+	discovery discovery.DiscoveryInterface
+	mu        sync.Mutex
+	resources []*metav1.APIResourceList
+	updated   time.Time
+}
+
+func newDiscoveryCache(d discovery.DiscoveryInterface) *discoveryCache {
+	return &discoveryCache{discovery: d}
+}
+
+// ServerResources returns the API resources supported by the server, using
+// the cached results if they are available.
+func (d *discoveryCache) ServerResources() ([]*metav1.APIResourceList, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.resources != nil && time.Since(d.updated) < discoveryCacheTTL {
+		metrics.RecordCacheRequest(metrics.CacheDiscovery, true)
+		return d.resources, nil
+	}
+	metrics.RecordCacheRequest(metrics.CacheDiscovery, false)
+	_, resources, err := d.discovery.ServerGroupsAndResources()
+	if err != nil {
+		return nil, err
+	}
+	d.resources = resources
+	d.updated = time.Now()
+	return resources, nil
+}
+
+// Invalidate drops the cached results, so that the next call to
+// ServerResources performs discovery against the apiserver.
+func (d *discoveryCache) Invalidate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.resources = nil
+}
+
+// invalidateOnCRDChanges registers an event handler that invalidates the
+// cache when CustomResourceDefinitions are created, updated or deleted. Only
+// the metadata of CustomResourceDefinitions is watched.
+func (d *discoveryCache) invalidateOnCRDChanges(ctx context.Context, c cache.Cache) error {
+	crd := &metav1.PartialObjectMetadata{}
+	crd.SetGroupVersionKind(crdGVK)
+	informer, err := c.GetInformer(ctx, crd, cache.BlockUntilSynced(false))
+	if err != nil {
+		return err
+	}
+	invalidate := func(reason string) {
+		log.Logger("client").Debug("Invalidating discovery cache", "reason", reason)
+		d.Invalidate()
+	}
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			invalidate("CustomResourceDefinition added")
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Ignore resyncs, but not status updates: resources of a new
+			// CustomResourceDefinition are only served once it becomes
+			// established.
+			o, okOld := oldObj.(*metav1.PartialObjectMetadata)
+			n, okNew := newObj.(*metav1.PartialObjectMetadata)
+			if okOld && okNew && o.ResourceVersion == n.ResourceVersion {
+				return
+			}
+			invalidate("CustomResourceDefinition updated")
+		},
+		DeleteFunc: func(obj interface{}) {
+			invalidate("CustomResourceDefinition deleted")
+		},
+	})
+	return err
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestDiscoveryCache(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	fd := clientset.Discovery().(*fakediscovery.FakeDiscovery)
+	fd.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{{Name: "pods", Kind: "Pod", Namespaced: true}}},
+	}
+	d := newDiscoveryCache(fd)
+
+	for i := 0; i < 3; i++ {
+		resources, err := d.ServerResources()
+		assert.NoError(t, err)
+		assert.Equal(t, fd.Resources, resources)
+	}
+	// Discovery gets both the groups and the resources
+	assert.Len(t, fd.Actions(), 2)
+
+	d.Invalidate()
+	_, err := d.ServerResources()
+	assert.NoError(t, err)
+	assert.Len(t, fd.Actions(), 4)
+
+	d.updated = time.Now().Add(-discoveryCacheTTL)
+	_, err = d.ServerResources()
+	assert.NoError(t, err)
+	assert.Len(t, fd.Actions(), 6)
+}
+
+func TestDelegateClientPool(t *testing.T) {
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"kind":"SelfSubjectRulesReview","apiVersion":"authorization.k8s.io/v1","status":{}}`)
+	}))
+	defer server.Close()
+	p := newDelegateClientPool(&rest.Config{Host: server.URL}, newDiscoveryCache(fake.NewSimpleClientset().Discovery()))
+	saA := types.NamespacedName{Namespace: "ns", Name: "a"}
+	saB := types.NamespacedName{Namespace: "ns", Name: "b"}
+
+	a, err := p.get(saA, "token-a")
+	assert.NoError(t, err)
+	b, err := p.get(saB, "token-b")
+	assert.NoError(t, err)
+	assert.NotSame(t, a, b)
+	assert.Same(t, p.discovery, a.discovery)
+
+	// Clients are reused for the same ServiceAccount, with the new token
+	again, err := p.get(saA, "token-a2")
+	assert.NoError(t, err)
+	assert.Same(t, a, again)
+	assert.Len(t, p.clients, 2)
+	_, err = again.clientset.AuthorizationV1().SelfSubjectRulesReviews().Create(context.Background(), &authorizationv1.SelfSubjectRulesReview{}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	_, err = b.clientset.AuthorizationV1().SelfSubjectRulesReviews().Create(context.Background(), &authorizationv1.SelfSubjectRulesReview{}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Bearer token-a2", "Bearer token-b"}, tokens)
+
+	// Idle clients are evicted
+	b.lastUsed = time.Now().Add(-delegateClientIdleTimeout - time.Second)
+	_, err = p.get(saA, "token-a3")
+	assert.NoError(t, err)
+	assert.Len(t, p.clients, 1)
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+// WaybillClient reads and updates Waybills, ClusterWaybills and their events.
+// It is used by Client, and on its own by short-lived clients, such as command
+// line tools, that should not start the caches and informers of a Client: it
+// talks to the apiserver directly, so it only needs access to the resources
+// that it reads.
+type WaybillClient struct {
+	client client.Client
+}
+
+// NewWaybillClient returns a WaybillClient initialised with the provided
+// configuration.
+func NewWaybillClient(cfg *rest.Config) (*WaybillClient, error) {
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	return &WaybillClient{client: c}, nil
+}
+
+// ListNamespaceWaybillEvents returns a list of the Waybill events in the
+// provided namespace, sorted by the LastTimestamp field. Events for
+// ClusterWaybills are recorded in the "default" namespace.
+func (c *WaybillClient) ListNamespaceWaybillEvents(ctx context.Context, namespace string) ([]corev1.Event, error) {
+	eventList := &corev1.EventList{}
+	if err := c.client.List(ctx, eventList, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	return waybillEvents(eventList.Items), nil
+}
+
+// waybillEvents returns the Waybill and ClusterWaybill events from the
+// provided list, sorted by the LastTimestamp field.
+func waybillEvents(items []corev1.Event) []corev1.Event {
+	var events []corev1.Event
+	for _, e := range items {
+		if (e.InvolvedObject.Kind == "Waybill" || e.InvolvedObject.Kind == "ClusterWaybill") && e.InvolvedObject.GroupVersionKind().Group == kubeapplierv1alpha1.GroupVersion.Group {
+			events = append(events, e)
+		}
+	}
+	slices.SortStableFunc(events, func(a, b corev1.Event) int {
+		if a.LastTimestamp.Before(&b.LastTimestamp) {
+			return -1
+		}
+		if b.LastTimestamp.Before(&a.LastTimestamp) {
+			return 1
+		}
+
+		return 0
+	})
+
+	return events
+}
+
+// ListWaybills returns a list of all the Waybill resources, sorted by
+// namespace and name. ClusterWaybills are included in the list as Waybills
+// with an empty namespace, which means that they are sorted first.
+func (c *WaybillClient) ListWaybills(ctx context.Context) ([]kubeapplierv1alpha1.Waybill, error) {
+	clusterWaybills, err := c.ListClusterWaybills(ctx)
+	if err != nil {
+		return nil, err
+	}
+	waybills := &kubeapplierv1alpha1.WaybillList{}
+	if err := c.client.List(ctx, waybills); err != nil {
+		return nil, err
+	}
+	sortWaybills(waybills.Items)
+	return append(clusterWaybills, waybills.Items...), nil
+}
+
+// ListClusterWaybills returns a list of all the ClusterWaybill resources as
+// Waybills, sorted by name. If the ClusterWaybill CRD is not installed in the
+// cluster, an empty list is returned.
+func (c *WaybillClient) ListClusterWaybills(ctx context.Context) ([]kubeapplierv1alpha1.Waybill, error) {
+	clusterWaybills := &kubeapplierv1alpha1.ClusterWaybillList{}
+	if err := c.client.List(ctx, clusterWaybills); err != nil {
+		if meta.IsNoMatchError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var waybills []kubeapplierv1alpha1.Waybill
+	for i := range clusterWaybills.Items {
+		waybills = append(waybills, *clusterWaybills.Items[i].Waybill())
+	}
+	sortWaybills(waybills)
+	return waybills, nil
+}
+
+// ListNamespaceWaybills returns a list of the Waybill resources in the
+// provided namespace, or in all namespaces if it is empty, sorted by namespace
+// and name.
+func (c *WaybillClient) ListNamespaceWaybills(ctx context.Context, namespace string) ([]kubeapplierv1alpha1.Waybill, error) {
+	waybills := &kubeapplierv1alpha1.WaybillList{}
+	if err := c.client.List(ctx, waybills, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	sortWaybills(waybills.Items)
+	return waybills.Items, nil
+}
+
+// sortWaybills ensures that the list of Waybills is sorted alphabetically by
+// namespace and name.
+func sortWaybills(waybills []kubeapplierv1alpha1.Waybill) {
+	slices.SortFunc(waybills, func(a, b kubeapplierv1alpha1.Waybill) int {
+		ns := strings.Compare(a.Namespace, b.Namespace)
+		if ns != 0 {
+			return ns
+		}
+
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+// GetWaybill returns the Waybill resource specified by the namespace
+// and name. If the namespace is empty, the ClusterWaybill with the provided
+// name is returned as a Waybill.
+func (c *WaybillClient) GetWaybill(ctx context.Context, namespace, name string) (*kubeapplierv1alpha1.Waybill, error) {
+	if namespace == "" {
+		clusterWaybill := &kubeapplierv1alpha1.ClusterWaybill{}
+		if err := c.client.Get(ctx, client.ObjectKey{Name: name}, clusterWaybill); err != nil {
+			return nil, err
+		}
+		return clusterWaybill.Waybill(), nil
+	}
+	waybill := &kubeapplierv1alpha1.Waybill{}
+	if err := c.client.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, waybill); err != nil {
+		return nil, err
+	}
+	return waybill, nil
+}
+
+// UpdateWaybill updates the Waybill resource provided. Waybills that were
+// created from a ClusterWaybill update the ClusterWaybill instead.
+func (c *WaybillClient) UpdateWaybill(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) error {
+	if waybill.IsClusterWaybill() {
+		clusterWaybill := waybill.ClusterWaybill()
+		if err := c.client.Update(ctx, clusterWaybill, defaultUpdateOptions); err != nil {
+			return err
+		}
+		clusterWaybill.ObjectMeta.DeepCopyInto(&waybill.ObjectMeta)
+		return nil
+	}
+	return c.client.Update(ctx, waybill, defaultUpdateOptions)
+}
+
+// CurrentUser returns the name of the user that the client authenticates as.
+func (c *WaybillClient) CurrentUser(ctx context.Context) (string, error) {
+	review := &authenticationv1.SelfSubjectReview{}
+	if err := c.client.Create(ctx, review); err != nil {
+		return "", err
+	}
+	return review.Status.UserInfo.Username, nil
+}
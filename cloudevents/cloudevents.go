@@ -0,0 +1,143 @@
+// Package cloudevents implements emitting CloudEvents for the lifecycle of
+// apply runs to an HTTP sink, using the binary content mode of the CloudEvents
+// HTTP protocol binding.
+package cloudevents
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/log"
+)
+
+const (
+	specVersion    = "1.0"
+	defaultSource  = "kube-applier"
+	defaultTimeout = 5 * time.Second
+)
+
+// Types of the events emitted by kube-applier.
+const (
+	TypeRunQueued    = "io.kube-applier.run.queued"
+	TypeRunStarted   = "io.kube-applier.run.started"
+	TypeRunSucceeded = "io.kube-applier.run.succeeded"
+	TypeRunFailed    = "io.kube-applier.run.failed"
+	TypePruneDeleted = "io.kube-applier.prune.deleted"
+)
+
+var rePruned = regexp.MustCompile(`^(\S+) pruned`)
+
+// Data is the payload of the events emitted by kube-applier.
+type Data struct {
+	Namespace       string   `json:"namespace"`
+	Name            string   `json:"name"`
+	RunType         string   `json:"runType,omitempty"`
+	Commit          string   `json:"commit,omitempty"`
+	DryRun          bool     `json:"dryRun,omitempty"`
+	DurationSeconds float64  `json:"durationSeconds,omitempty"`
+	ErrorMessage    string   `json:"errorMessage,omitempty"`
+	Resources       []string `json:"resources,omitempty"`
+}
+
+// NewData returns the Data describing the Waybill and the provided run type.
+// If the Waybill has a LastRun, its commit, outcome and duration are included.
+func NewData(waybill *kubeapplierv1alpha1.Waybill, runType string) Data {
+	data := Data{
+		Namespace: waybill.Namespace,
+		Name:      waybill.Name,
+		RunType:   runType,
+		DryRun:    waybill.Spec.DryRun,
+	}
+	if lr := waybill.Status.LastRun; lr != nil {
+		data.Commit = lr.Commit
+		data.DurationSeconds = lr.Finished.Sub(lr.Started.Time).Seconds()
+		data.ErrorMessage = lr.ErrorMessage
+	}
+	return data
+}
+
+// PrunedResources returns the resources that were pruned, as reported in the
+// output of kubectl apply.
+func PrunedResources(output string) []string {
+	var ret []string
+	for _, l := range strings.Split(output, "\n") {
+		if m := rePruned.FindStringSubmatch(strings.TrimSpace(l)); m != nil {
+			ret = append(ret, m[1])
+		}
+	}
+	return ret
+}
+
+// Emitter sends CloudEvents to the configured sink. A nil Emitter is valid and
+// does not send anything.
+type Emitter struct {
+	// Cluster is appended to the source of the events, to distinguish between
+	// events emitted by kube-applier in different clusters.
+	Cluster    string
+	HTTPClient *http.Client
+	SinkURL    string
+}
+
+// Emit sends an event to the sink in the background. Failures are logged.
+func (e *Emitter) Emit(eventType string, data Data) {
+	if e == nil || e.SinkURL == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		defer cancel()
+		if err := e.Send(ctx, eventType, data); err != nil {
+			log.Logger("cloudevents").Warn("Could not send event", "type", eventType, "waybill", fmt.Sprintf("%s/%s", data.Namespace, data.Name), "error", err)
+		}
+	}()
+}
+
+// Send sends an event to the sink and waits for the response.
+func (e *Emitter) Send(ctx context.Context, eventType string, data Data) error {
+	if e == nil || e.SinkURL == "" {
+		return nil
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.SinkURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	source := defaultSource
+	if e.Cluster != "" {
+		source = fmt.Sprintf("%s/%s", defaultSource, e.Cluster)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("ce-specversion", specVersion)
+	req.Header.Set("ce-id", uuid.NewString())
+	req.Header.Set("ce-source", source)
+	req.Header.Set("ce-type", eventType)
+	req.Header.Set("ce-subject", fmt.Sprintf("%s/%s", data.Namespace, data.Name))
+	req.Header.Set("ce-time", time.Now().UTC().Format(time.RFC3339Nano))
+	httpClient := e.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultTimeout}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package cloudevents
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+func TestNewData(t *testing.T) {
+	start := time.Date(2022, time.April, 26, 13, 36, 5, 0, time.UTC)
+	wb := &kubeapplierv1alpha1.Waybill{
+		ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"},
+		Spec:       kubeapplierv1alpha1.WaybillSpec{DryRun: true},
+	}
+	assert.Equal(t, Data{Namespace: "foo", Name: "main", RunType: "Forced run", DryRun: true}, NewData(wb, "Forced run"))
+
+	wb.Status.LastRun = &kubeapplierv1alpha1.WaybillStatusRun{
+		Commit:       "abc",
+		ErrorMessage: "exit status 1",
+		Started:      metav1.NewTime(start),
+		Finished:     metav1.NewTime(start.Add(1500 * time.Millisecond)),
+	}
+	assert.Equal(t, Data{
+		Namespace:       "foo",
+		Name:            "main",
+		RunType:         "Scheduled run",
+		Commit:          "abc",
+		DryRun:          true,
+		DurationSeconds: 1.5,
+		ErrorMessage:    "exit status 1",
+	}, NewData(wb, "Scheduled run"))
+}
+
+func TestPrunedResources(t *testing.T) {
+	output := `namespace/foo unchanged
+deployment.apps/a configured
+deployment.apps/b pruned
+configmap/c pruned (server dry run)
+`
+	assert.Equal(t, []string{"deployment.apps/b", "configmap/c"}, PrunedResources(output))
+	assert.Nil(t, PrunedResources("deployment.apps/a unchanged"))
+}
+
+func TestEmitterSend(t *testing.T) {
+	var (
+		header http.Header
+		data   Data
+	)
+	code := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&data))
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	e := &Emitter{Cluster: "prod", SinkURL: server.URL}
+	sent := Data{Namespace: "foo", Name: "main", RunType: "Scheduled run", Commit: "abc", DurationSeconds: 2}
+	require.NoError(t, e.Send(context.Background(), TypeRunSucceeded, sent))
+
+	assert.Equal(t, sent, data)
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+	assert.Equal(t, "1.0", header.Get("ce-specversion"))
+	assert.Equal(t, "kube-applier/prod", header.Get("ce-source"))
+	assert.Equal(t, "io.kube-applier.run.succeeded", header.Get("ce-type"))
+	assert.Equal(t, "foo/main", header.Get("ce-subject"))
+	assert.NotEmpty(t, header.Get("ce-id"))
+	_, err := time.Parse(time.RFC3339Nano, header.Get("ce-time"))
+	assert.NoError(t, err)
+
+	code = http.StatusServiceUnavailable
+	assert.Error(t, e.Send(context.Background(), TypeRunFailed, sent))
+
+	var nilEmitter *Emitter
+	assert.NoError(t, nilEmitter.Send(context.Background(), TypeRunFailed, sent))
+	assert.NoError(t, (&Emitter{}).Send(context.Background(), TypeRunFailed, sent))
+}
@@ -0,0 +1,597 @@
+// Command kubectl-waybill is a kubectl plugin for inspecting and operating the
+// Waybills that kube-applier applies, without going through its web UI.
+//
+// Once installed in the PATH, it is invoked as "kubectl waybill".
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/client"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/webserver"
+)
+
+// clusterScope is used in place of the namespace to refer to ClusterWaybills,
+// like it is on the status page.
+const clusterScope = "cluster"
+
+// command is a subcommand of the plugin. setup registers the flags of the
+// command and returns the function that runs it with the remaining arguments.
+type command struct {
+	usage   string
+	summary string
+	setup   func(fs *flag.FlagSet) runFunc
+}
+
+type runFunc func(ctx context.Context, p *plugin, args []string) error
+
+var commands = map[string]command{
+	"list": {
+		usage:   "list [flags]",
+		summary: "List Waybills and the outcome of their last run",
+		setup:   listCommand,
+	},
+	"status": {
+		usage:   "status [flags] <namespace> [<name>]",
+		summary: "Show the last run of a Waybill, including its output, and its events",
+		setup:   statusCommand,
+	},
+	"logs": {
+		usage:   "logs [flags] <namespace> [<name>]",
+		summary: "Show the run history of a Waybill",
+		setup:   logsCommand,
+	},
+	"force-run": {
+		usage:   "force-run [flags] <namespace> [<name>]",
+		summary: "Request a forced run of a Waybill",
+		setup:   forceRunCommand,
+	},
+	"pause": {
+		usage:   "pause [flags] <namespace> [<name>]",
+		summary: "Disable automatic runs of a Waybill",
+		setup:   autoApplyCommand("paused", false),
+	},
+	"resume": {
+		usage:   "resume [flags] <namespace> [<name>]",
+		summary: "Enable automatic runs of a Waybill",
+		setup:   autoApplyCommand("resumed", true),
+	},
+}
+
+// commandOrder is the order that the commands are listed in the usage.
+var commandOrder = []string{"list", "status", "logs", "force-run", "pause", "resume"}
+
+func main() {
+	os.Exit(runPlugin(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// runPlugin runs the subcommand in args and returns the exit code of the
+// plugin.
+func runPlugin(args []string, stdout, stderr io.Writer) int {
+	cmd, ok := commands[firstArg(args)]
+	if !ok {
+		printUsage(stderr)
+		if len(args) > 0 && args[0] != "help" && args[0] != "-h" && args[0] != "--help" {
+			fmt.Fprintf(stderr, "\nunknown command %q\n", args[0])
+		}
+		return 2
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "%s\n\nUsage: kubectl waybill %s\n\nFlags:\n", cmd.summary, cmd.usage)
+		fs.PrintDefaults()
+	}
+	kubeconfig := fs.String("kubeconfig", "", "Path to the kubeconfig file")
+	kubeContext := fs.String("context", "", "Name of the kubeconfig context to use")
+	run := cmd.setup(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	log.SetLevel("warn")
+	// controller-runtime and client-go log to stderr, which would be mixed
+	// with the output of the plugin
+	ctrl.SetLogger(logr.Discard())
+	klog.SetLogger(logr.Discard())
+
+	p := &plugin{
+		stdout:     stdout,
+		kubeconfig: *kubeconfig,
+		context:    *kubeContext,
+	}
+	if err := run(context.Background(), p, fs.Args()); err != nil {
+		var usageErr usageError
+		if errors.As(err, &usageErr) {
+			fmt.Fprintf(stderr, "%v\n\n", err)
+			fs.Usage()
+			return 2
+		}
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, "Inspect and operate the Waybills applied by kube-applier.\n\nUsage: kubectl waybill <command> [flags] [args]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range commandOrder {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, commands[name].summary)
+	}
+	tw.Flush()
+	fmt.Fprint(w, "\nWaybills are identified by their namespace, and a name if there are several\nWaybills in the namespace. ClusterWaybills use \"cluster\" as the namespace.\nRun \"kubectl waybill <command> -h\" for the flags of a command.\n")
+}
+
+// usageError is returned by commands that are called with invalid arguments.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// waybillClient is the subset of client.WaybillClient that the commands use.
+type waybillClient interface {
+	ListClusterWaybills(ctx context.Context) ([]kubeapplierv1alpha1.Waybill, error)
+	ListNamespaceWaybills(ctx context.Context, namespace string) ([]kubeapplierv1alpha1.Waybill, error)
+	ListNamespaceWaybillEvents(ctx context.Context, namespace string) ([]corev1.Event, error)
+	GetWaybill(ctx context.Context, namespace, name string) (*kubeapplierv1alpha1.Waybill, error)
+	UpdateWaybill(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) error
+	CurrentUser(ctx context.Context) (string, error)
+}
+
+// plugin holds the kubernetes client shared by the commands, which is only
+// created when it is first needed.
+type plugin struct {
+	stdout     io.Writer
+	kubeconfig string
+	context    string
+	kubeClient waybillClient
+}
+
+// client returns the kubernetes client of the plugin, configured like kubectl.
+func (p *plugin) client() (waybillClient, error) {
+	if p.kubeClient != nil {
+		return p.kubeClient, nil
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = p.kubeconfig
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: p.context}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get kubernetes config: %w", err)
+	}
+	kubeClient, err := client.NewWaybillClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.kubeClient = kubeClient
+	return kubeClient, nil
+}
+
+// waybill returns the Waybill identified by the arguments of a command: a
+// namespace, or "cluster" for ClusterWaybills, and an optional name.
+func (p *plugin) waybill(ctx context.Context, args []string) (*kubeapplierv1alpha1.Waybill, error) {
+	namespace, name, err := waybillArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	kubeClient, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	var waybills []kubeapplierv1alpha1.Waybill
+	if namespace == "" {
+		waybills, err = kubeClient.ListClusterWaybills(ctx)
+	} else {
+		waybills, err = kubeClient.ListNamespaceWaybills(ctx, namespace)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return webserver.FindWaybill(waybills, namespace, name)
+}
+
+// waybillArgs returns the namespace and name of the Waybill identified by the
+// arguments of a command. The namespace is empty for ClusterWaybills.
+func waybillArgs(args []string) (string, string, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return "", "", usageError("a namespace and an optional name are required")
+	}
+	namespace, name := args[0], ""
+	if len(args) == 2 {
+		name = args[1]
+	}
+	if namespace == clusterScope {
+		if name == "" {
+			return "", "", usageError("a name is required for ClusterWaybills")
+		}
+		namespace = ""
+	}
+	return namespace, name, nil
+}
+
+func listCommand(fs *flag.FlagSet) runFunc {
+	namespace := fs.String("n", "", "Only list the Waybills in this namespace, or ClusterWaybills if it is \"cluster\"")
+	output := fs.String("o", "", "Output format: empty, or wide for more columns")
+	outcome := fs.String("outcome", "", "Only list the Waybills with this outcome: auto-apply-disabled, dry-run, pending, failure, warning or success")
+	return func(ctx context.Context, p *plugin, args []string) error {
+		return list(ctx, p, args, *namespace, *output, *outcome)
+	}
+}
+
+func list(ctx context.Context, p *plugin, args []string, namespace, output, outcome string) error {
+	if len(args) > 0 {
+		return usageError("unexpected arguments")
+	}
+	if output != "" && output != "wide" {
+		return usageError(fmt.Sprintf("unsupported output format %q", output))
+	}
+	kubeClient, err := p.client()
+	if err != nil {
+		return err
+	}
+	var waybills []kubeapplierv1alpha1.Waybill
+	switch namespace {
+	case "":
+		waybills, err = listWaybills(ctx, kubeClient)
+	case clusterScope:
+		waybills, err = kubeClient.ListClusterWaybills(ctx)
+	default:
+		waybills, err = kubeClient.ListNamespaceWaybills(ctx, namespace)
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(p.stdout, 0, 0, 3, ' ', 0)
+	header := "NAMESPACE\tNAME\tOUTCOME\tCOMMIT\tLAST RUN"
+	if output == "wide" {
+		header += "\tTYPE\tAUTO APPLY\tDRY RUN\tROLLBACK\tLAST ACTION"
+	}
+	fmt.Fprintln(tw, header)
+	for _, wb := range waybills {
+		o := webserver.Outcome(wb)
+		if outcome != "" && o != outcome {
+			continue
+		}
+		commit, lastRun, runType := "<none>", "<none>", "<none>"
+		if wb.Status.LastRun != nil {
+			commit = wb.Status.LastRun.Commit
+			lastRun = age(wb.Status.LastRun.Finished)
+			runType = wb.Status.LastRun.Type
+		}
+		row := fmt.Sprintf("%s\t%s\t%s\t%s\t%s", scope(wb), wb.Name, o, commit, lastRun)
+		if output == "wide" {
+			row += fmt.Sprintf("\t%s\t%t\t%t\t%s\t%s",
+				runType,
+				ptr.Deref(wb.Spec.AutoApply, true),
+				wb.Spec.DryRun,
+				valueOrNone(wb.Annotations[kubeapplierv1alpha1.RollbackCommitAnnotation]),
+				valueOrNone(wb.Annotations[kubeapplierv1alpha1.LastActionAnnotation]),
+			)
+		}
+		fmt.Fprintln(tw, row)
+	}
+	return tw.Flush()
+}
+
+// listWaybills returns all the Waybills and ClusterWaybills, like
+// client.Client.ListWaybills. ClusterWaybills are left out if the user is not
+// allowed to list them, which is common for users that only have access to
+// their own namespaces.
+func listWaybills(ctx context.Context, kubeClient waybillClient) ([]kubeapplierv1alpha1.Waybill, error) {
+	clusterWaybills, err := kubeClient.ListClusterWaybills(ctx)
+	if err != nil && !apierrors.IsForbidden(err) {
+		return nil, err
+	}
+	waybills, err := kubeClient.ListNamespaceWaybills(ctx, metav1.NamespaceAll)
+	if err != nil {
+		return nil, err
+	}
+	return append(clusterWaybills, waybills...), nil
+}
+
+func statusCommand(fs *flag.FlagSet) runFunc {
+	return status
+}
+
+func status(ctx context.Context, p *plugin, args []string) error {
+	wb, err := p.waybill(ctx, args)
+	if err != nil {
+		return err
+	}
+	kubeClient, err := p.client()
+	if err != nil {
+		return err
+	}
+	// Events for ClusterWaybills are recorded in the default namespace
+	eventNamespace := wb.Namespace
+	if wb.IsClusterWaybill() {
+		eventNamespace = metav1.NamespaceDefault
+	}
+	allEvents, err := kubeClient.ListNamespaceWaybillEvents(ctx, eventNamespace)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(p.stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "Waybill:\t%s\n", title(*wb))
+	fmt.Fprintf(tw, "Outcome:\t%s\n", webserver.Outcome(*wb))
+	fmt.Fprintf(tw, "Auto apply:\t%t\n", ptr.Deref(wb.Spec.AutoApply, true))
+	fmt.Fprintf(tw, "Dry run:\t%t\n", wb.Spec.DryRun)
+	if commit := wb.Annotations[kubeapplierv1alpha1.RollbackCommitAnnotation]; commit != "" {
+		fmt.Fprintf(tw, "Rollback:\tpinned to %s, rolled back from %s\n", commit, valueOrNone(wb.Annotations[kubeapplierv1alpha1.RollbackFromAnnotation]))
+	}
+	if action := wb.Annotations[kubeapplierv1alpha1.LastActionAnnotation]; action != "" {
+		description := fmt.Sprintf("%s by %s at %s", action, wb.Annotations[kubeapplierv1alpha1.LastActionByAnnotation], wb.Annotations[kubeapplierv1alpha1.LastActionTimeAnnotation])
+		if reason := wb.Annotations[kubeapplierv1alpha1.LastActionReasonAnnotation]; reason != "" {
+			description = fmt.Sprintf("%s: %s", description, reason)
+		}
+		fmt.Fprintf(tw, "Last action:\t%s\n", description)
+	}
+	if lastRun := wb.Status.LastRun; lastRun == nil {
+		fmt.Fprintf(tw, "Last run:\t<none>\n")
+	} else {
+		fmt.Fprintf(tw, "Last run:\t\n")
+		fmt.Fprintf(tw, "  Type:\t%s\n", lastRun.Type)
+		fmt.Fprintf(tw, "  Commit:\t%s\n", lastRun.Commit)
+		fmt.Fprintf(tw, "  Started:\t%s\n", lastRun.Started.Format(time.RFC3339))
+		fmt.Fprintf(tw, "  Finished:\t%s (%s ago)\n", lastRun.Finished.Format(time.RFC3339), age(lastRun.Finished))
+		fmt.Fprintf(tw, "  Success:\t%t\n", lastRun.Success)
+		if lastRun.TraceID != "" {
+			fmt.Fprintf(tw, "  Trace ID:\t%s\n", lastRun.TraceID)
+		}
+		fmt.Fprintf(tw, "  Command:\t%s\n", lastRun.Command)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if lastRun := wb.Status.LastRun; lastRun != nil {
+		if lastRun.ErrorMessage != "" {
+			fmt.Fprintf(p.stdout, "  Error:\n%s", indent(lastRun.ErrorMessage, "    "))
+		}
+		fmt.Fprintf(p.stdout, "  Output:\n%s", indent(lastRun.Output, "    "))
+	}
+
+	var events []string
+	for _, e := range allEvents {
+		if e.InvolvedObject.Name == wb.Name && e.InvolvedObject.Namespace == wb.Namespace {
+			events = append(events, fmt.Sprintf("  %s\t%s\t%s\t%s", e.Type, e.Reason, age(e.LastTimestamp), strings.ReplaceAll(e.Message, "\n", " ")))
+		}
+	}
+	if len(events) == 0 {
+		fmt.Fprintln(p.stdout, "Events: <none>")
+		return nil
+	}
+	fmt.Fprintln(p.stdout, "Events:")
+	tw = tabwriter.NewWriter(p.stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "  TYPE\tREASON\tAGE\tMESSAGE")
+	for _, e := range events {
+		fmt.Fprintln(tw, e)
+	}
+	return tw.Flush()
+}
+
+func logsCommand(fs *flag.FlagSet) runFunc {
+	return logs
+}
+
+func logs(ctx context.Context, p *plugin, args []string) error {
+	wb, err := p.waybill(ctx, args)
+	if err != nil {
+		return err
+	}
+	if len(wb.Status.History) == 0 {
+		fmt.Fprintf(p.stdout, "No runs recorded for %s\n", title(*wb))
+		return nil
+	}
+	tw := tabwriter.NewWriter(p.stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "FINISHED\tTYPE\tCOMMIT\tDRY RUN\tRESULT")
+	for _, r := range wb.Status.History {
+		result := "success"
+		if !r.Success {
+			result = "failure"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%s\n", r.Finished.Format(time.RFC3339), r.Type, r.Commit, r.DryRun, result)
+	}
+	return tw.Flush()
+}
+
+func forceRunCommand(fs *flag.FlagSet) runFunc {
+	address := fs.String("url", "", "Address of the kube-applier web server to request the run from, instead of annotating the Waybill. Requests are rejected if the web server requires OIDC authentication")
+	return func(ctx context.Context, p *plugin, args []string) error {
+		return forceRun(ctx, p, args, *address)
+	}
+}
+
+func forceRun(ctx context.Context, p *plugin, args []string, address string) error {
+	if address != "" {
+		namespace, name, err := waybillArgs(args)
+		if err != nil {
+			return err
+		}
+		message, err := requestForceRun(ctx, address, namespace, name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(p.stdout, message)
+		return nil
+	}
+
+	wb, err := p.waybill(ctx, args)
+	if err != nil {
+		return err
+	}
+	kubeClient, err := p.client()
+	if err != nil {
+		return err
+	}
+	// The replica that applies the Waybill queues the run once it sees the
+	// request, like it does for requests made to other replicas
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := kubeClient.GetWaybill(ctx, wb.Namespace, wb.Name)
+		if err != nil {
+			return err
+		}
+		if latest.Annotations == nil {
+			latest.Annotations = map[string]string{}
+		}
+		latest.Annotations[kubeapplierv1alpha1.ForceRunRequestedAnnotation] = time.Now().UTC().Format(time.RFC3339Nano)
+		return kubeClient.UpdateWaybill(ctx, latest)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot request a run for %s: %w", title(*wb), err)
+	}
+	fmt.Fprintf(p.stdout, "Run requested for %s\n", title(*wb))
+	return nil
+}
+
+// requestForceRun requests a forced run of the Waybill from the kube-applier
+// web server at the provided address, and returns the message of the response.
+func requestForceRun(ctx context.Context, address, namespace, name string) (string, error) {
+	endpoint, err := url.JoinPath(address, "/api/v1/forceRun")
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"namespace": {namespace}, "name": {name}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var data struct {
+		Result  string `json:"result"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", fmt.Errorf("cannot decode response with status %s: %w", resp.Status, err)
+	}
+	if data.Result != "success" {
+		return "", fmt.Errorf("run request failed with status %s: %s", resp.Status, data.Message)
+	}
+	return data.Message, nil
+}
+
+// autoApplyCommand returns a command that sets the autoApply attribute of a
+// Waybill, recording the action in its annotations like the web server does.
+func autoApplyCommand(description string, autoApply bool) func(fs *flag.FlagSet) runFunc {
+	return func(fs *flag.FlagSet) runFunc {
+		reason := fs.String("reason", "", "Reason for the action, which is recorded on the Waybill")
+		return func(ctx context.Context, p *plugin, args []string) error {
+			return setAutoApply(ctx, p, args, description, autoApply, *reason)
+		}
+	}
+}
+
+func setAutoApply(ctx context.Context, p *plugin, args []string, description string, autoApply bool, reason string) error {
+	wb, err := p.waybill(ctx, args)
+	if err != nil {
+		return err
+	}
+	kubeClient, err := p.client()
+	if err != nil {
+		return err
+	}
+	user, err := kubeClient.CurrentUser(ctx)
+	if err != nil {
+		user = "unknown"
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := kubeClient.GetWaybill(ctx, wb.Namespace, wb.Name)
+		if err != nil {
+			return err
+		}
+		if latest.Annotations == nil {
+			latest.Annotations = map[string]string{}
+		}
+		latest.Spec.AutoApply = ptr.To(autoApply)
+		latest.Annotations[kubeapplierv1alpha1.LastActionAnnotation] = description
+		latest.Annotations[kubeapplierv1alpha1.LastActionByAnnotation] = user
+		latest.Annotations[kubeapplierv1alpha1.LastActionReasonAnnotation] = reason
+		latest.Annotations[kubeapplierv1alpha1.LastActionTimeAnnotation] = now
+		return kubeClient.UpdateWaybill(ctx, latest)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot update %s: %w", title(*wb), err)
+	}
+	fmt.Fprintf(p.stdout, "%s %s\n", title(*wb), description)
+	return nil
+}
+
+// scope returns the namespace of the Waybill, or "cluster" for
+// ClusterWaybills.
+func scope(wb kubeapplierv1alpha1.Waybill) string {
+	if wb.IsClusterWaybill() {
+		return clusterScope
+	}
+	return wb.Namespace
+}
+
+// title returns a description of the Waybill for messages.
+func title(wb kubeapplierv1alpha1.Waybill) string {
+	if wb.IsClusterWaybill() {
+		return fmt.Sprintf("ClusterWaybill %s", wb.Name)
+	}
+	return fmt.Sprintf("Waybill %s/%s", wb.Namespace, wb.Name)
+}
+
+// age returns the time elapsed since t, in the format used by kubectl.
+func age(t metav1.Time) string {
+	if t.IsZero() {
+		return "<unknown>"
+	}
+	return duration.HumanDuration(time.Since(t.Time))
+}
+
+func valueOrNone(v string) string {
+	if v == "" {
+		return "<none>"
+	}
+	return v
+}
+
+// indent prefixes each line of s, which is terminated with a newline.
+func indent(s, prefix string) string {
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return prefix + "<none>\n"
+	}
+	return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix) + "\n"
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+// testClient is an in-memory waybillClient. ClusterWaybills are stored as
+// Waybills without a namespace, like client.Client returns them.
+type testClient struct {
+	waybills  map[string]*kubeapplierv1alpha1.Waybill
+	user      string
+	conflicts int
+	updates   int
+	// forbidden makes listing ClusterWaybills fail, like it does for
+	// users that only have access to some namespaces
+	forbidden bool
+}
+
+func newTestClient(waybills ...kubeapplierv1alpha1.Waybill) *testClient {
+	c := &testClient{waybills: map[string]*kubeapplierv1alpha1.Waybill{}, user: "jane@example.com"}
+	for i := range waybills {
+		c.waybills[waybills[i].Namespace+"/"+waybills[i].Name] = waybills[i].DeepCopy()
+	}
+	return c
+}
+
+func (c *testClient) list(match func(wb *kubeapplierv1alpha1.Waybill) bool) []kubeapplierv1alpha1.Waybill {
+	var ret []kubeapplierv1alpha1.Waybill
+	for _, wb := range c.waybills {
+		if match(wb) {
+			ret = append(ret, *wb.DeepCopy())
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Namespace != ret[j].Namespace {
+			return ret[i].Namespace < ret[j].Namespace
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+func (c *testClient) ListClusterWaybills(ctx context.Context) ([]kubeapplierv1alpha1.Waybill, error) {
+	if c.forbidden {
+		return nil, apierrors.NewForbidden(schema.GroupResource{Group: "kube-applier.io", Resource: "clusterwaybills"}, "", errors.New("forbidden"))
+	}
+	return c.list(func(wb *kubeapplierv1alpha1.Waybill) bool { return wb.IsClusterWaybill() }), nil
+}
+
+func (c *testClient) ListNamespaceWaybills(ctx context.Context, namespace string) ([]kubeapplierv1alpha1.Waybill, error) {
+	return c.list(func(wb *kubeapplierv1alpha1.Waybill) bool {
+		return !wb.IsClusterWaybill() && (namespace == metav1.NamespaceAll || wb.Namespace == namespace)
+	}), nil
+}
+
+func (c *testClient) ListNamespaceWaybillEvents(ctx context.Context, namespace string) ([]corev1.Event, error) {
+	return nil, nil
+}
+
+func (c *testClient) GetWaybill(ctx context.Context, namespace, name string) (*kubeapplierv1alpha1.Waybill, error) {
+	wb, ok := c.waybills[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Group: "kube-applier.io", Resource: "waybills"}, name)
+	}
+	return wb.DeepCopy(), nil
+}
+
+func (c *testClient) UpdateWaybill(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) error {
+	c.updates++
+	if c.conflicts > 0 {
+		c.conflicts--
+		return apierrors.NewConflict(schema.GroupResource{Group: "kube-applier.io", Resource: "waybills"}, waybill.Name, errors.New("modified"))
+	}
+	c.waybills[waybill.Namespace+"/"+waybill.Name] = waybill.DeepCopy()
+	return nil
+}
+
+func (c *testClient) CurrentUser(ctx context.Context) (string, error) {
+	if c.user == "" {
+		return "", errors.New("forbidden")
+	}
+	return c.user, nil
+}
+
+var testWaybills = []kubeapplierv1alpha1.Waybill{
+	{
+		ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"},
+		Status: kubeapplierv1alpha1.WaybillStatus{
+			LastRun: &kubeapplierv1alpha1.WaybillStatusRun{Commit: "abc123", Success: true, Type: "Scheduled run"},
+		},
+	},
+	{
+		ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "bar"},
+		Status: kubeapplierv1alpha1.WaybillStatus{
+			LastRun: &kubeapplierv1alpha1.WaybillStatusRun{Commit: "def456", Success: false, Type: "Forced run"},
+		},
+	},
+	{
+		ObjectMeta: metav1.ObjectMeta{Name: "extra", Namespace: "bar"},
+		Spec:       kubeapplierv1alpha1.WaybillSpec{AutoApply: ptr.To(false)},
+	},
+	{
+		ObjectMeta: metav1.ObjectMeta{Name: "crds"},
+		Spec:       kubeapplierv1alpha1.WaybillSpec{DryRun: true},
+	},
+}
+
+func TestWaybillArgs(t *testing.T) {
+	testCases := []struct {
+		name      string
+		args      []string
+		namespace string
+		wbName    string
+		err       string
+	}{
+		{"namespace", []string{"foo"}, "foo", "", ""},
+		{"namespace and name", []string{"foo", "main"}, "foo", "main", ""},
+		{"cluster waybill", []string{"cluster", "crds"}, "", "crds", ""},
+		{"cluster waybill without a name", []string{"cluster"}, "", "", "a name is required for ClusterWaybills"},
+		{"no arguments", nil, "", "", "a namespace and an optional name are required"},
+		{"too many arguments", []string{"foo", "main", "other"}, "", "", "a namespace and an optional name are required"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			namespace, name, err := waybillArgs(tc.args)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				assert.ErrorAs(t, err, new(usageError))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.namespace, namespace)
+			assert.Equal(t, tc.wbName, name)
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	testCases := []struct {
+		name      string
+		namespace string
+		output    string
+		outcome   string
+		forbidden bool
+		header    []string
+		rows      [][]string
+		err       string
+	}{
+		{
+			name:   "all",
+			header: []string{"NAMESPACE", "NAME", "OUTCOME", "COMMIT", "LAST", "RUN"},
+			rows: [][]string{
+				{"cluster", "crds", "dry-run"},
+				{"bar", "extra", "auto-apply-disabled"},
+				{"bar", "main", "failure"},
+				{"foo", "main", "success"},
+			},
+		},
+		{
+			name:      "cluster waybills forbidden",
+			forbidden: true,
+			rows: [][]string{
+				{"bar", "extra", "auto-apply-disabled"},
+				{"bar", "main", "failure"},
+				{"foo", "main", "success"},
+			},
+		},
+		{
+			name:      "cluster waybills forbidden with namespace",
+			namespace: "cluster",
+			forbidden: true,
+			err:       `clusterwaybills.kube-applier.io is forbidden: forbidden`,
+		},
+		{
+			name:      "namespace",
+			namespace: "bar",
+			rows: [][]string{
+				{"bar", "extra", "auto-apply-disabled"},
+				{"bar", "main", "failure"},
+			},
+		},
+		{
+			name:      "cluster",
+			namespace: "cluster",
+			rows:      [][]string{{"cluster", "crds", "dry-run"}},
+		},
+		{
+			name:    "outcome",
+			outcome: "failure",
+			rows:    [][]string{{"bar", "main", "failure"}},
+		},
+		{
+			name:    "no matches",
+			outcome: "warning",
+		},
+		{
+			name:    "wide",
+			output:  "wide",
+			outcome: "success",
+			header:  []string{"NAMESPACE", "NAME", "OUTCOME", "COMMIT", "LAST", "RUN", "TYPE", "AUTO", "APPLY", "DRY", "RUN", "ROLLBACK", "LAST", "ACTION"},
+			rows:    [][]string{{"foo", "main", "success", "abc123"}},
+		},
+		{
+			name:   "unsupported output",
+			output: "json",
+			err:    `unsupported output format "json"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			kubeClient := newTestClient(testWaybills...)
+			kubeClient.forbidden = tc.forbidden
+			p := &plugin{stdout: stdout, kubeClient: kubeClient}
+			err := list(context.Background(), p, nil, tc.namespace, tc.output, tc.outcome)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+			require.Len(t, lines, len(tc.rows)+1)
+			if tc.header != nil {
+				assert.Equal(t, tc.header, strings.Fields(lines[0]))
+			}
+			for i, row := range tc.rows {
+				fields := strings.Fields(lines[i+1])
+				require.GreaterOrEqual(t, len(fields), len(row))
+				assert.Equal(t, row, fields[:len(row)])
+			}
+		})
+	}
+}
+
+func TestRequestForceRun(t *testing.T) {
+	testCases := []struct {
+		name    string
+		status  int
+		body    string
+		message string
+		err     string
+	}{
+		{
+			name:    "success",
+			status:  http.StatusOK,
+			body:    `{"result":"success","message":"Run queued"}`,
+			message: "Run queued",
+		},
+		{
+			name:   "error",
+			status: http.StatusForbidden,
+			body:   `{"result":"error","message":"user is not allowed to force a run"}`,
+			err:    "run request failed with status 403 Forbidden: user is not allowed to force a run",
+		},
+		{
+			name:   "not json",
+			status: http.StatusBadGateway,
+			body:   "<html>Bad Gateway</html>",
+			err:    "cannot decode response with status 502 Bad Gateway",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "/api/v1/forceRun", r.URL.Path)
+				assert.Equal(t, "foo", r.FormValue("namespace"))
+				assert.Equal(t, "main", r.FormValue("name"))
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer server.Close()
+
+			message, err := requestForceRun(context.Background(), server.URL, "foo", "main")
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.message, message)
+		})
+	}
+}
+
+func TestForceRun(t *testing.T) {
+	testCases := []struct {
+		name   string
+		args   []string
+		key    string
+		output string
+		err    string
+	}{
+		{"waybill", []string{"foo"}, "foo/main", "Run requested for Waybill foo/main\n", ""},
+		{"named waybill", []string{"bar", "extra"}, "bar/extra", "Run requested for Waybill bar/extra\n", ""},
+		{"cluster waybill", []string{"cluster", "crds"}, "/crds", "Run requested for ClusterWaybill crds\n", ""},
+		{"ambiguous namespace", []string{"bar"}, "", "", "multiple Waybills found in namespace 'bar', a name is required"},
+		{"missing waybill", []string{"baz"}, "", "", "cannot find Waybills in namespace 'baz'"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			kubeClient := newTestClient(testWaybills...)
+			// Conflicting updates are retried
+			kubeClient.conflicts = 1
+			p := &plugin{stdout: stdout, kubeClient: kubeClient}
+			before := time.Now()
+			err := forceRun(context.Background(), p, tc.args, "")
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, stdout.String())
+			assert.Equal(t, 2, kubeClient.updates)
+			requested, err := time.Parse(time.RFC3339Nano, kubeClient.waybills[tc.key].Annotations[kubeapplierv1alpha1.ForceRunRequestedAnnotation])
+			require.NoError(t, err)
+			assert.False(t, requested.Before(before))
+		})
+	}
+}
+
+func TestSetAutoApply(t *testing.T) {
+	testCases := []struct {
+		name        string
+		args        []string
+		description string
+		autoApply   bool
+		reason      string
+		user        string
+		key         string
+		output      string
+		by          string
+	}{
+		{
+			name:        "pause",
+			args:        []string{"foo"},
+			description: "paused",
+			reason:      "incident",
+			user:        "jane@example.com",
+			key:         "foo/main",
+			output:      "Waybill foo/main paused\n",
+			by:          "jane@example.com",
+		},
+		{
+			name:        "resume",
+			args:        []string{"bar", "extra"},
+			description: "resumed",
+			autoApply:   true,
+			user:        "jane@example.com",
+			key:         "bar/extra",
+			output:      "Waybill bar/extra resumed\n",
+			by:          "jane@example.com",
+		},
+		{
+			name:        "unknown user",
+			args:        []string{"cluster", "crds"},
+			description: "paused",
+			key:         "/crds",
+			output:      "ClusterWaybill crds paused\n",
+			by:          "unknown",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			kubeClient := newTestClient(testWaybills...)
+			kubeClient.user = tc.user
+			p := &plugin{stdout: stdout, kubeClient: kubeClient}
+			require.NoError(t, setAutoApply(context.Background(), p, tc.args, tc.description, tc.autoApply, tc.reason))
+			assert.Equal(t, tc.output, stdout.String())
+
+			wb := kubeClient.waybills[tc.key]
+			assert.Equal(t, ptr.To(tc.autoApply), wb.Spec.AutoApply)
+			assert.Equal(t, tc.description, wb.Annotations[kubeapplierv1alpha1.LastActionAnnotation])
+			assert.Equal(t, tc.by, wb.Annotations[kubeapplierv1alpha1.LastActionByAnnotation])
+			assert.Equal(t, tc.reason, wb.Annotations[kubeapplierv1alpha1.LastActionReasonAnnotation])
+			_, err := time.Parse(time.RFC3339, wb.Annotations[kubeapplierv1alpha1.LastActionTimeAnnotation])
+			assert.NoError(t, err)
+			// Forced runs are not requested when pausing or resuming
+			assert.NotContains(t, wb.Annotations, kubeapplierv1alpha1.ForceRunRequestedAnnotation)
+		})
+	}
+}
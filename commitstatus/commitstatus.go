@@ -0,0 +1,271 @@
+// Package commitstatus implements reporting the outcome of apply runs as commit
+// statuses to git hosting providers, such as GitHub and GitLab.
+package commitstatus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/client"
+)
+
+const (
+	defaultGitHubAPIURL  = "https://api.github.com"
+	defaultGitLabAPIURL  = "https://gitlab.com/api/v4"
+	defaultRetries       = 3
+	defaultRetryInterval = time.Second
+	defaultTimeout       = 10 * time.Second
+)
+
+// State is the state of a commit status.
+type State string
+
+const (
+	// StateSuccess is used when the apply run was successful.
+	StateSuccess State = "success"
+	// StateFailure is used when the apply run failed.
+	StateFailure State = "failure"
+)
+
+// Status is a commit status that is reported to a Provider.
+type Status struct {
+	Commit      string
+	Context     string
+	Description string
+	State       State
+	TargetURL   string
+}
+
+// Provider is implemented by git hosting providers that commit statuses can
+// be reported to.
+type Provider interface {
+	SetStatus(ctx context.Context, status Status) error
+}
+
+// TokenSource returns the token used to authenticate against a Provider.
+type TokenSource func(ctx context.Context) (string, error)
+
+// StaticToken returns a TokenSource that always returns the provided token.
+func StaticToken(token string) TokenSource {
+	return func(context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+// SecretToken returns a TokenSource that reads the token from the item named
+// `token` in the specified Secret. The Secret is read every time a token is
+// requested, so that it can be rotated without restarting kube-applier.
+func SecretToken(kubeClient *client.Client, namespace, name string) TokenSource {
+	return func(ctx context.Context) (string, error) {
+		secret, err := kubeClient.GetSecret(ctx, namespace, name)
+		if err != nil {
+			return "", err
+		}
+		token, ok := secret.Data["token"]
+		if !ok {
+			return "", fmt.Errorf(`secret "%s/%s" does not contain key 'token'`, namespace, name)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+}
+
+// GitHub reports commit statuses using the GitHub REST API.
+type GitHub struct {
+	// APIURL is the base URL of the API, defaults to https://api.github.com
+	APIURL     string
+	HTTPClient *http.Client
+	// Repository is the full name of the repository, eg. "owner/repo"
+	Repository string
+	Token      TokenSource
+}
+
+// SetStatus creates a commit status for the commit in the repository.
+func (g *GitHub) SetStatus(ctx context.Context, status Status) error {
+	token, err := g.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get token: %w", err)
+	}
+	apiURL := g.APIURL
+	if apiURL == "" {
+		apiURL = defaultGitHubAPIURL
+	}
+	body := map[string]string{
+		"context":     status.Context,
+		"description": status.Description,
+		"state":       string(status.State),
+		"target_url":  status.TargetURL,
+	}
+	return doRequest(ctx, g.HTTPClient, fmt.Sprintf("%s/repos/%s/statuses/%s", strings.TrimSuffix(apiURL, "/"), g.Repository, status.Commit), map[string]string{
+		"Accept":        "application/vnd.github+json",
+		"Authorization": "Bearer " + token,
+	}, body)
+}
+
+// GitLab reports commit statuses using the GitLab REST API.
+type GitLab struct {
+	// APIURL is the base URL of the API, defaults to https://gitlab.com/api/v4
+	APIURL     string
+	HTTPClient *http.Client
+	// Project is the ID or the full path of the project, eg. "group/project"
+	Project string
+	Token   TokenSource
+}
+
+// SetStatus creates a commit status for the commit in the project.
+func (g *GitLab) SetStatus(ctx context.Context, status Status) error {
+	token, err := g.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get token: %w", err)
+	}
+	apiURL := g.APIURL
+	if apiURL == "" {
+		apiURL = defaultGitLabAPIURL
+	}
+	state := string(status.State)
+	if status.State == StateFailure {
+		state = "failed"
+	}
+	body := map[string]string{
+		"description": status.Description,
+		"name":        status.Context,
+		"state":       state,
+		"target_url":  status.TargetURL,
+	}
+	return doRequest(ctx, g.HTTPClient, fmt.Sprintf("%s/projects/%s/statuses/%s", strings.TrimSuffix(apiURL, "/"), url.PathEscape(g.Project), status.Commit), map[string]string{
+		"PRIVATE-TOKEN": token,
+	}, body)
+}
+
+// responseError is returned when a Provider responds with an unexpected status
+// code.
+type responseError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("unexpected response status %d: %s", e.StatusCode, e.Body)
+}
+
+// isRetryable returns false for errors that are not expected to succeed if the
+// request is retried, such as client errors.
+func isRetryable(err error) bool {
+	var re *responseError
+	if errors.As(err, &re) {
+		return re.StatusCode == http.StatusTooManyRequests || re.StatusCode >= 500
+	}
+	return true
+}
+
+func doRequest(ctx context.Context, httpClient *http.Client, url string, headers map[string]string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultTimeout}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &responseError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	return nil
+}
+
+// Reporter reports the outcome of the last apply run of Waybills as commit
+// statuses to a Provider.
+type Reporter struct {
+	// Cluster is used in the context of the commit status, to distinguish
+	// between statuses reported by kube-applier in different clusters.
+	Cluster string
+	// ExternalURL is the URL where the kube-applier status page is exposed.
+	// If set, the commit status links to the page of the Waybill.
+	ExternalURL   string
+	Provider      Provider
+	Retries       int
+	RetryInterval time.Duration
+}
+
+// Report sets a commit status for the provided commit, based on the last apply
+// run of the Waybill. Failed requests are retried with an exponential backoff.
+func (r *Reporter) Report(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill, commit string) error {
+	if waybill.Status.LastRun == nil {
+		return nil
+	}
+	status := r.status(waybill, commit)
+	retries := r.Retries
+	if retries <= 0 {
+		retries = defaultRetries
+	}
+	interval := r.RetryInterval
+	if interval <= 0 {
+		interval = defaultRetryInterval
+	}
+	var err error
+	for i := 0; ; i++ {
+		err = r.Provider.SetStatus(ctx, status)
+		if err == nil || !isRetryable(err) || i >= retries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(interval << i):
+		}
+	}
+	return err
+}
+
+func (r *Reporter) status(waybill *kubeapplierv1alpha1.Waybill, commit string) Status {
+	contextParts := []string{"kube-applier"}
+	if r.Cluster != "" {
+		contextParts = append(contextParts, r.Cluster)
+	}
+	// Namespaces are lowercase, so ClusterWaybills cannot clash with Waybills
+	if waybill.IsClusterWaybill() {
+		contextParts = append(contextParts, "ClusterWaybill", waybill.Name)
+	} else {
+		contextParts = append(contextParts, waybill.Namespace, waybill.Name)
+	}
+	status := Status{
+		Commit:      commit,
+		Context:     strings.Join(contextParts, "/"),
+		Description: "Applied successfully",
+		State:       StateSuccess,
+	}
+	if !waybill.Status.LastRun.Success {
+		status.Description = "Apply failed"
+		status.State = StateFailure
+	}
+	if waybill.Spec.DryRun {
+		status.Description += " (dry-run)"
+	}
+	if r.ExternalURL != "" && waybill.IsClusterWaybill() {
+		status.TargetURL = fmt.Sprintf("%s/cluster/%s", strings.TrimSuffix(r.ExternalURL, "/"), url.PathEscape(waybill.Name))
+	} else if r.ExternalURL != "" {
+		status.TargetURL = fmt.Sprintf("%s/ns/%s/%s", strings.TrimSuffix(r.ExternalURL, "/"), url.PathEscape(waybill.Namespace), url.PathEscape(waybill.Name))
+	}
+	return status
+}
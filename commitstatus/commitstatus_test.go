@@ -0,0 +1,166 @@
+package commitstatus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+type testRequest struct {
+	Header http.Header
+	Path   string
+	Body   map[string]string
+}
+
+func testServer(t *testing.T, responses ...int) (*httptest.Server, *[]testRequest) {
+	t.Helper()
+	requests := &[]testRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		*requests = append(*requests, testRequest{Header: r.Header, Path: r.URL.EscapedPath(), Body: body})
+		code := http.StatusCreated
+		if len(*requests) <= len(responses) {
+			code = responses[len(*requests)-1]
+		}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func testWaybill(success, dryRun bool) *kubeapplierv1alpha1.Waybill {
+	return &kubeapplierv1alpha1.Waybill{
+		ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"},
+		Spec:       kubeapplierv1alpha1.WaybillSpec{DryRun: dryRun},
+		Status: kubeapplierv1alpha1.WaybillStatus{
+			LastRun: &kubeapplierv1alpha1.WaybillStatusRun{Commit: "abc", Success: success},
+		},
+	}
+}
+
+func TestReporter_GitHub(t *testing.T) {
+	server, requests := testServer(t)
+
+	r := &Reporter{
+		Cluster:     "prod",
+		ExternalURL: "https://kube-applier.example.com/",
+		Provider: &GitHub{
+			APIURL:     server.URL,
+			Repository: "org/repo",
+			Token:      StaticToken("secret"),
+		},
+	}
+	require.NoError(t, r.Report(context.Background(), testWaybill(true, false), "abcdef0123"))
+
+	require.Len(t, *requests, 1)
+	req := (*requests)[0]
+	assert.Equal(t, "/repos/org/repo/statuses/abcdef0123", req.Path)
+	assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+	assert.Equal(t, map[string]string{
+		"context":     "kube-applier/prod/foo/main",
+		"description": "Applied successfully",
+		"state":       "success",
+		"target_url":  "https://kube-applier.example.com/ns/foo/main",
+	}, req.Body)
+}
+
+func TestReporter_clusterWaybill(t *testing.T) {
+	server, requests := testServer(t)
+
+	r := &Reporter{
+		Cluster:     "prod",
+		ExternalURL: "https://kube-applier.example.com",
+		Provider: &GitHub{
+			APIURL:     server.URL,
+			Repository: "org/repo",
+			Token:      StaticToken("secret"),
+		},
+	}
+	waybill := testWaybill(true, false)
+	waybill.Namespace = ""
+	require.NoError(t, r.Report(context.Background(), waybill, "abcdef0123"))
+
+	require.Len(t, *requests, 1)
+	assert.Equal(t, map[string]string{
+		"context":     "kube-applier/prod/ClusterWaybill/main",
+		"description": "Applied successfully",
+		"state":       "success",
+		"target_url":  "https://kube-applier.example.com/cluster/main",
+	}, (*requests)[0].Body)
+}
+
+func TestReporter_GitLab(t *testing.T) {
+	server, requests := testServer(t)
+
+	r := &Reporter{
+		Provider: &GitLab{
+			APIURL:  server.URL,
+			Project: "group/project",
+			Token:   StaticToken("secret"),
+		},
+	}
+	require.NoError(t, r.Report(context.Background(), testWaybill(false, true), "abcdef0123"))
+
+	require.Len(t, *requests, 1)
+	req := (*requests)[0]
+	assert.Equal(t, "/projects/group%2Fproject/statuses/abcdef0123", req.Path)
+	assert.Equal(t, "secret", req.Header.Get("PRIVATE-TOKEN"))
+	assert.Equal(t, map[string]string{
+		"description": "Apply failed (dry-run)",
+		"name":        "kube-applier/foo/main",
+		"state":       "failed",
+		"target_url":  "",
+	}, req.Body)
+}
+
+func TestReporter_retries(t *testing.T) {
+	server, requests := testServer(t, http.StatusBadGateway, http.StatusTooManyRequests)
+
+	r := &Reporter{
+		Provider:      &GitHub{APIURL: server.URL, Repository: "org/repo", Token: StaticToken("secret")},
+		RetryInterval: time.Millisecond,
+	}
+	require.NoError(t, r.Report(context.Background(), testWaybill(true, false), "abc"))
+	assert.Len(t, *requests, 3)
+
+	server, requests = testServer(t, http.StatusUnprocessableEntity)
+	r.Provider = &GitHub{APIURL: server.URL, Repository: "org/repo", Token: StaticToken("secret")}
+	err := r.Report(context.Background(), testWaybill(true, false), "abc")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected response status 422")
+	assert.Len(t, *requests, 1)
+
+	server, requests = testServer(t, 500, 500, 500, 500, 500)
+	r.Provider = &GitHub{APIURL: server.URL, Repository: "org/repo", Token: StaticToken("secret")}
+	r.Retries = 2
+	require.Error(t, r.Report(context.Background(), testWaybill(true, false), "abc"))
+	assert.Len(t, *requests, 3)
+}
+
+func TestReporter_tokenError(t *testing.T) {
+	server, requests := testServer(t)
+
+	r := &Reporter{
+		Provider: &GitHub{
+			APIURL:     server.URL,
+			Repository: "org/repo",
+			Token:      func(context.Context) (string, error) { return "", errors.New("not found") },
+		},
+		RetryInterval: time.Millisecond,
+	}
+	err := r.Report(context.Background(), testWaybill(true, false), "abc")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "could not get token: not found")
+	assert.Empty(t, *requests)
+}
@@ -0,0 +1,282 @@
+package git
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHTTPSUsername is the username used with tokens, when one is not
+	// provided. GitHub accepts any username with a token, but installation
+	// tokens of GitHub Apps are documented with this one.
+	DefaultHTTPSUsername = "x-access-token"
+
+	defaultGitHubAPIURL = "https://api.github.com"
+	// gitHubAppJWTExpiration is how long the JWTs that authenticate as a
+	// GitHub App are valid for, the maximum allowed by GitHub is 10 minutes.
+	gitHubAppJWTExpiration = 9 * time.Minute
+	// gitHubAppTokenRefreshWindow is how long before their expiry that
+	// installation tokens are refreshed, so that they do not expire during a
+	// git operation.
+	gitHubAppTokenRefreshWindow = 10 * time.Minute
+	gitHubAppTimeout            = 10 * time.Second
+
+	// Environment variables read by the credential helper.
+	credentialsUsernameEnv = "KUBE_APPLIER_GIT_USERNAME"
+	credentialsPasswordEnv = "KUBE_APPLIER_GIT_PASSWORD"
+)
+
+// credentialHelper is a git credential helper that returns the username and
+// password from the environment, so that they are never written to disk or
+// included in the remote URL.
+var credentialHelper = fmt.Sprintf(`!f() { test "$1" = get && printf 'username=%%s\npassword=%%s\n' "$%s" "$%s"; }; f`, credentialsUsernameEnv, credentialsPasswordEnv)
+
+// Credentials provide the username and password that are used to
+// authenticate against HTTPS remotes.
+type Credentials interface {
+	Get(ctx context.Context) (username, password string, err error)
+}
+
+// CredentialsEnvironment returns the environment variables that configure git
+// to authenticate against HTTPS remotes with the provided credentials. The
+// credentials are only sent to the provided remotes, which are hosts that can
+// be followed by a path prefix, such as "github.com/org", or to any host if no
+// remotes are provided. They are never sent over plain HTTP. Any credential
+// helpers that are already configured are reset.
+func CredentialsEnvironment(ctx context.Context, credentials Credentials, remotes []string) ([]string, error) {
+	username, password, err := credentials.Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get git credentials: %w", err)
+	}
+	config := [][2]string{{"credential.helper", ""}}
+	if len(remotes) == 0 {
+		// An empty host matches any host
+		remotes = []string{""}
+	}
+	for _, remote := range remotes {
+		remote = strings.Trim(strings.TrimSpace(remote), "/")
+		config = append(config, [2]string{fmt.Sprintf("credential.https://%s.helper", remote), credentialHelper})
+		// git only matches the path of URLs against the configuration if
+		// useHttpPath is enabled
+		if strings.Contains(remote, "/") {
+			config = append(config, [2]string{fmt.Sprintf("credential.https://%s.useHttpPath", remote), "true"})
+		}
+	}
+	env := []string{
+		"GIT_TERMINAL_PROMPT=0",
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(config)),
+	}
+	for i, c := range config {
+		env = append(env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, c[0]), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, c[1]))
+	}
+	return append(env,
+		credentialsUsernameEnv+"="+username,
+		credentialsPasswordEnv+"="+password,
+	), nil
+}
+
+// HTTPSRemoteHost returns the host of the remote, if it is fetched over
+// HTTPS, or an empty string otherwise.
+func HTTPSRemoteHost(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.Scheme != "https" {
+		return ""
+	}
+	return u.Host
+}
+
+// StaticCredentials are a fixed username and password, or token.
+type StaticCredentials struct {
+	Username string
+	Password string
+}
+
+// Get returns the username and password.
+func (c *StaticCredentials) Get(context.Context) (string, string, error) {
+	username := c.Username
+	if username == "" {
+		username = DefaultHTTPSUsername
+	}
+	return username, c.Password, nil
+}
+
+// FileCredentials read the password, or token, from a file. The file is read
+// every time the credentials are requested, so that a mounted Secret can be
+// rotated without restarting kube-applier.
+type FileCredentials struct {
+	Username     string
+	PasswordPath string
+}
+
+// Get returns the username and the password read from the file.
+func (c *FileCredentials) Get(context.Context) (string, string, error) {
+	password, err := os.ReadFile(c.PasswordPath)
+	if err != nil {
+		return "", "", err
+	}
+	username := c.Username
+	if username == "" {
+		username = DefaultHTTPSUsername
+	}
+	return username, strings.TrimSpace(string(password)), nil
+}
+
+// GitHubAppCredentials exchange a JWT signed with the private key of a GitHub
+// App for an installation token. Tokens are cached and refreshed before they
+// expire.
+type GitHubAppCredentials struct {
+	// APIURL is the base URL of the API, defaults to https://api.github.com
+	APIURL         string
+	AppID          string
+	HTTPClient     *http.Client
+	InstallationID string
+	PrivateKey     *rsa.PrivateKey
+	expires        time.Time
+	lock           sync.Mutex
+	now            func() time.Time
+	token          string
+}
+
+// ParseGitHubAppPrivateKey parses the PEM encoded private key of a GitHub App.
+// GitHub provides keys in the PKCS #1 format, PKCS #8 is also supported.
+func ParseGitHubAppPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Get returns an installation token of the GitHub App, requesting a new one
+// if the cached token is about to expire.
+func (c *GitHubAppCredentials) Get(ctx context.Context) (string, string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if c.now != nil {
+		now = c.now()
+	}
+	if c.token != "" && now.Add(gitHubAppTokenRefreshWindow).Before(c.expires) {
+		return DefaultHTTPSUsername, c.token, nil
+	}
+	jwt, err := c.jwt(now)
+	if err != nil {
+		return "", "", err
+	}
+	token, expires, err := c.installationToken(ctx, jwt)
+	if err != nil {
+		return "", "", fmt.Errorf("could not get installation token for GitHub App %s: %w", c.AppID, err)
+	}
+	c.token, c.expires = token, expires
+	return DefaultHTTPSUsername, c.token, nil
+}
+
+// jwt returns a JWT that authenticates as the GitHub App, signed with RS256.
+func (c *GitHubAppCredentials) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		// Allow for clock drift, as recommended by GitHub
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(gitHubAppJWTExpiration).Unix(),
+		"iss": c.AppID,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.PrivateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("could not sign JWT: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// installationToken exchanges the JWT for an installation token.
+func (c *GitHubAppCredentials) installationToken(ctx context.Context, jwt string) (string, time.Time, error) {
+	apiURL := c.APIURL
+	if apiURL == "" {
+		apiURL = defaultGitHubAPIURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/app/installations/%s/access_tokens", strings.TrimSuffix(apiURL, "/"), c.InstallationID), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: gitHubAppTimeout}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", time.Time{}, fmt.Errorf("unexpected response status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var body struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", time.Time{}, fmt.Errorf("could not decode response: %w", err)
+	}
+	if body.Token == "" {
+		return "", time.Time{}, fmt.Errorf("response does not contain a token")
+	}
+	return body.Token, body.ExpiresAt, nil
+}
+
+// NewGitHubAppCredentials returns GitHubAppCredentials for the installation of
+// the GitHub App, validating the IDs and parsing the private key.
+func NewGitHubAppCredentials(apiURL, appID, installationID string, privateKey []byte) (*GitHubAppCredentials, error) {
+	if _, err := strconv.ParseInt(appID, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid GitHub App ID '%s'", appID)
+	}
+	if _, err := strconv.ParseInt(installationID, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid GitHub App installation ID '%s'", installationID)
+	}
+	key, err := ParseGitHubAppPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &GitHubAppCredentials{
+		APIURL:         apiURL,
+		AppID:          appID,
+		InstallationID: installationID,
+		PrivateKey:     key,
+	}, nil
+}
@@ -0,0 +1,166 @@
+package git
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsEnvironment(t *testing.T) {
+	fill := func(env []string, input string) (string, error) {
+		cmd := exec.Command(gitExecutablePath, "credential", "fill")
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdin = strings.NewReader(input)
+		out, err := cmd.Output()
+		return string(out), err
+	}
+
+	testCases := []struct {
+		name    string
+		remotes []string
+		input   string
+		sent    bool
+	}{
+		{"any host", nil, "protocol=https\nhost=github.com\n\n", true},
+		{"any host over http", nil, "protocol=http\nhost=github.com\n\n", false},
+		{"allowed host", []string{"example.com", "github.com"}, "protocol=https\nhost=github.com\n\n", true},
+		{"allowed host over http", []string{"github.com"}, "protocol=http\nhost=github.com\n\n", false},
+		{"other host", []string{"github.com"}, "protocol=https\nhost=attacker.example\n\n", false},
+		{"allowed path", []string{"github.com/org/"}, "protocol=https\nhost=github.com\npath=org/repo.git\n\n", true},
+		{"other path", []string{"github.com/org"}, "protocol=https\nhost=github.com\npath=other/repo.git\n\n", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			env, err := CredentialsEnvironment(context.Background(), &StaticCredentials{Password: "s3cr3t"}, tc.remotes)
+			require.NoError(t, err)
+			out, err := fill(env, tc.input)
+			if !tc.sent {
+				// git fails, since it cannot prompt for the credentials
+				assert.Error(t, err)
+				assert.NotContains(t, out, "s3cr3t")
+				return
+			}
+			require.NoError(t, err)
+			assert.Contains(t, out, "username=x-access-token\n")
+			assert.Contains(t, out, "password=s3cr3t\n")
+		})
+	}
+}
+
+func TestHTTPSRemoteHost(t *testing.T) {
+	assert.Equal(t, "github.com", HTTPSRemoteHost("https://github.com/org/repo.git"))
+	assert.Equal(t, "git.example.com:8443", HTTPSRemoteHost("https://git.example.com:8443/repo"))
+	assert.Equal(t, "", HTTPSRemoteHost("http://github.com/org/repo.git"))
+	assert.Equal(t, "", HTTPSRemoteHost("git@github.com:org/repo.git"))
+	assert.Equal(t, "", HTTPSRemoteHost("/src/repo"))
+}
+
+func TestFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("t0k3n\n"), 0600))
+	c := &FileCredentials{Username: "bot", PasswordPath: path}
+	username, password, err := c.Get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "bot", username)
+	assert.Equal(t, "t0k3n", password)
+
+	// The file is read again, so rotated tokens are picked up
+	require.NoError(t, os.WriteFile(path, []byte("r0t4t3d"), 0600))
+	_, password, err = c.Get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "r0t4t3d", password)
+}
+
+func TestParseGitHubAppPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	for _, block := range []*pem.Block{
+		{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		{Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		parsed, err := ParseGitHubAppPrivateKey(pem.EncodeToMemory(block))
+		require.NoError(t, err)
+		assert.True(t, key.Equal(parsed))
+	}
+	_, err = ParseGitHubAppPrivateKey([]byte("not a key"))
+	assert.Error(t, err)
+}
+
+func TestGitHubAppCredentials(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/app/installations/456/access_tokens", r.URL.Path)
+
+		// Verify the JWT
+		jwt := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		require.Len(t, jwt, 3)
+		digest := sha256.Sum256([]byte(jwt[0] + "." + jwt[1]))
+		signature, err := base64.RawURLEncoding.DecodeString(jwt[2])
+		require.NoError(t, err)
+		assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+		payload, err := base64.RawURLEncoding.DecodeString(jwt[1])
+		require.NoError(t, err)
+		var claims struct {
+			Iss string `json:"iss"`
+			Iat int64  `json:"iat"`
+			Exp int64  `json:"exp"`
+		}
+		require.NoError(t, json.Unmarshal(payload, &claims))
+		assert.Equal(t, "123", claims.Iss)
+		assert.Less(t, claims.Iat, now.Unix())
+		assert.LessOrEqual(t, claims.Exp, now.Add(10*time.Minute).Unix())
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":"ghs_%d","expires_at":"%s"}`, requests, now.Add(time.Hour).Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	c := &GitHubAppCredentials{
+		APIURL:         server.URL,
+		AppID:          "123",
+		InstallationID: "456",
+		PrivateKey:     key,
+		now:            func() time.Time { return now },
+	}
+	for i := 0; i < 2; i++ {
+		username, password, err := c.Get(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "x-access-token", username)
+		assert.Equal(t, "ghs_1", password)
+	}
+	assert.Equal(t, 1, requests)
+
+	// The token is refreshed before it expires
+	now = now.Add(55 * time.Minute)
+	_, password, err := c.Get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ghs_2", password)
+	assert.Equal(t, 2, requests)
+}
@@ -15,8 +15,12 @@ import (
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/utilitywarehouse/kube-applier/log"
 	"github.com/utilitywarehouse/kube-applier/metrics"
+	"github.com/utilitywarehouse/kube-applier/tracing"
 )
 
 var (
@@ -43,9 +47,21 @@ type RepositoryConfig struct {
 // SyncOptions encapsulates options about how a Repository should be fetched
 // from the remote.
 type SyncOptions struct {
+	// Credentials are used to authenticate against HTTPS remotes. They are
+	// requested before every operation that contacts the remote.
+	Credentials          Credentials
 	GitSSHKeyPath        string
 	GitSSHKnownHostsPath string
 	Interval             time.Duration
+	// LFS replaces the Git LFS pointers under the subpath of local clones
+	// with the files they point to, which are downloaded from the remote.
+	LFS bool
+	// Submodules initialises and updates the submodules under the subpath of
+	// local clones, recursively.
+	Submodules bool
+	// Verification configures the verification of commit signatures. The
+	// local revision is not advanced to commits that fail verification.
+	Verification VerificationOptions
 }
 
 // gitSSHCommand returns the environment variable to be used for configuring
@@ -62,6 +78,16 @@ func (so SyncOptions) gitSSHCommand() string {
 	return fmt.Sprintf(`GIT_SSH_COMMAND=ssh -q -F none -o IdentitiesOnly=yes -o IdentityFile=%s %s`, sshKeyPath, knownHostsOptions)
 }
 
+// remoteEnvironment returns the environment variables required by git
+// operations that contact the remote.
+func (r *Repository) remoteEnvironment(ctx context.Context) ([]string, error) {
+	host := HTTPSRemoteHost(r.repositoryConfig.Remote)
+	if r.syncOptions.Credentials == nil || host == "" {
+		return nil, nil
+	}
+	return CredentialsEnvironment(ctx, r.syncOptions.Credentials, []string{host})
+}
+
 // Repository defines a remote git repository that should be synced regularly
 // and is the source of truth for a cluster. Changes in this repository trigger
 // GitPolling type runs for namespaces. The implementation borrows heavily from
@@ -73,6 +99,8 @@ type Repository struct {
 	running          bool
 	stop, stopped    chan bool
 	syncOptions      SyncOptions
+	verification     Verification
+	verificationLock sync.RWMutex
 }
 
 // NewRepository initialises a Repository struct.
@@ -97,6 +125,12 @@ func NewRepository(path string, repositoryConfig RepositoryConfig, syncOptions S
 		log.Logger("repository").Info("Defaulting repository revision to 'HEAD'")
 		repositoryConfig.Revision = "HEAD"
 	}
+	if syncOptions.Verification.Enabled() && repositoryConfig.Revision != "HEAD" {
+		return nil, fmt.Errorf("signature verification is only supported when tracking the HEAD of a branch")
+	}
+	if syncOptions.Verification.AllCommits && repositoryConfig.Depth != 0 {
+		return nil, fmt.Errorf("verifying all commits requires a full clone, with a depth of zero")
+	}
 	if syncOptions.Interval == 0 {
 		log.Logger("repository").Info("Defaulting Interval to 30 seconds")
 		syncOptions.Interval = time.Second * 30
@@ -178,10 +212,19 @@ func (r *Repository) StopSync() {
 	r.running = false
 }
 
-func (r *Repository) runGitCommand(ctx context.Context, environment []string, cwd string, args ...string) (string, error) {
+func (r *Repository) runGitCommand(ctx context.Context, environment []string, cwd string, args ...string) (_ string, err error) {
 	cmdStr := gitExecutablePath + " " + strings.Join(args, " ")
 	log.Logger("repository").Debug("running command", "cwd", cwd, "cmd", cmdStr)
 
+	spanName := "git"
+	if len(args) > 0 {
+		spanName = "git " + args[0]
+	}
+	// Arguments are not recorded in the span, since they may include
+	// credentials as part of the remote URL.
+	ctx, span := tracing.Tracer().Start(ctx, spanName, trace.WithAttributes(attribute.String("git.cwd", cwd)))
+	defer func() { tracing.End(span, err) }()
+
 	cmd := exec.CommandContext(ctx, gitExecutablePath, args...)
 	if cwd != "" {
 		cmd.Dir = cwd
@@ -198,7 +241,7 @@ func (r *Repository) runGitCommand(ctx context.Context, environment []string, cw
 		cmd.Env = append(cmd.Env, environment...)
 	}
 	start := time.Now()
-	err := cmd.Run()
+	err = cmd.Run()
 	stdout := outbuf.String()
 	stderr := errbuf.String()
 	if ctx.Err() == context.DeadlineExceeded {
@@ -212,49 +255,29 @@ func (r *Repository) runGitCommand(ctx context.Context, environment []string, cw
 	return stdout, nil
 }
 
-// localHash returns the locally known hash for the configured Revision.
+// localHash returns the locally known hash of the HEAD of the branch.
 func (r *Repository) localHash(ctx context.Context) (string, error) {
-	output, err := r.runGitCommand(ctx, nil, r.path, "rev-parse", r.repositoryConfig.Revision)
+	output, err := r.runGitCommand(ctx, nil, r.path, "rev-parse", "HEAD")
 	if err != nil {
 		return "", err
 	}
 	return strings.Trim(string(output), "\n"), nil
 }
 
-// localHashForPath returns the hash of the configured revision for the
-// specified path.
-func (r *Repository) localHashForPath(ctx context.Context, path string) (string, error) {
-	output, err := r.runGitCommand(ctx, nil, r.path, "log", "--pretty=format:%h", "-n", "1", "--", path)
+// localHashForPath returns the hash of the commit for the specified path.
+func (r *Repository) localHashForPath(ctx context.Context, commit, path string) (string, error) {
+	output, err := r.runGitCommand(ctx, nil, r.path, "log", "--pretty=format:%h", "-n", "1", commit, "--", path)
 	if err != nil {
 		return "", err
 	}
 	return strings.Trim(string(output), "\n"), nil
 }
 
-// remoteHash returns the upstream hash for the ref that corresponds to the
-// configured Revision.
-func (r *Repository) remoteHash(ctx context.Context) (string, error) {
-	// Build a ref string, depending on whether the user asked to track HEAD or
-	// a tag.
-	ref := ""
-	if r.repositoryConfig.Revision == "HEAD" {
-		ref = "refs/heads/" + r.repositoryConfig.Branch
-	} else {
-		ref = "refs/tags/" + r.repositoryConfig.Revision
-	}
-
-	output, err := r.runGitCommand(ctx, nil, r.path, "ls-remote", "-q", "origin", ref)
-	if err != nil {
-		return "", err
-	}
-	parts := strings.Split(string(output), "\t")
-	return parts[0], nil
-}
-
 func (r *Repository) sync(ctx context.Context) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
+	var local string
 	gitRepoPath := filepath.Join(r.path, ".git")
 	_, err := os.Stat(gitRepoPath)
 	switch {
@@ -264,25 +287,54 @@ func (r *Repository) sync(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		return nil
+		if r.syncOptions.Verification.Enabled() {
+			if err := r.verify(ctx, "", "HEAD"); err != nil {
+				// Remove the clone, so that the revision is not used and the
+				// next attempt clones the repository again
+				if e := os.RemoveAll(r.path); e != nil {
+					log.Logger("repository").Error("could not remove unverified clone", "path", r.path, "error", e)
+				}
+				return err
+			}
+		}
+		if parseRevision(r.repositoryConfig.Revision).kind == revisionHead {
+			r.updateCommitTimestamps(ctx, "")
+			return nil
+		}
+		// Shallow clones do not include all the tags, or the pinned commit,
+		// which are fetched below
 	case err != nil:
 		return fmt.Errorf("error checking if repo exists %q: %v", gitRepoPath, err)
 	default:
-		// Not the first time. Figure out if the ref has changed.
-		// Since this operation is read only no lock required
-		local, err := r.localHash(ctx)
+		// Not the first time. Figure out if the branch or the tags have
+		// changed.
+		local, err = r.localHash(ctx)
 		if err != nil {
 			return err
 		}
-		remote, err := r.remoteHash(ctx)
+		refs, err := r.remoteRefs(ctx)
 		if err != nil {
 			return err
 		}
-		if local == remote {
+		remote := refs.revisionHash(parseRevision(r.repositoryConfig.Revision))
+		upToDate, err := r.upToDate(ctx, refs)
+		if err != nil {
+			return err
+		}
+		if upToDate {
 			log.Logger("repository").Info("no update required", "rev", r.repositoryConfig.Revision, "local", local, "remote", remote)
+			// The remote may have been reset to the local revision, after a
+			// later commit was rejected
+			if r.syncOptions.Verification.Enabled() && r.Verification().Commit != local {
+				if err := r.verify(ctx, "", local); err != nil {
+					return err
+				}
+			}
+			r.updateCommitTimestamps(ctx, remote)
 			return nil
 		}
 		log.Logger("repository").Info("update required", "rev", r.repositoryConfig.Revision, "local", local, "remote", remote)
+		defer r.updateCommitTimestamps(ctx, remote)
 	}
 
 	log.Logger("repository").Info("syncing git", "branch", r.repositoryConfig.Branch, "rev", r.repositoryConfig.Revision)
@@ -291,10 +343,25 @@ func (r *Repository) sync(ctx context.Context) error {
 		args = append(args, "--depth", strconv.Itoa(r.repositoryConfig.Depth))
 	}
 	args = append(args, "origin", r.repositoryConfig.Branch)
+	env, err := r.remoteEnvironment(ctx)
+	if err != nil {
+		return err
+	}
 	// Update from the remote.
-	if _, err := r.runGitCommand(ctx, nil, r.path, args...); err != nil {
+	if _, err := r.runGitCommand(ctx, env, r.path, args...); err != nil {
 		return err
 	}
+	if rev := parseRevision(r.repositoryConfig.Revision); rev.kind == revisionCommit {
+		if err := r.fetchCommit(ctx, rev.name); err != nil {
+			return err
+		}
+	}
+
+	if r.syncOptions.Verification.Enabled() && local != "" {
+		if err := r.verify(ctx, local, fmt.Sprintf("origin/%s", r.repositoryConfig.Branch)); err != nil {
+			return err
+		}
+	}
 
 	// Reset HEAD
 	if _, err = r.runGitCommand(ctx, nil, r.path, "reset", "--soft", fmt.Sprintf("origin/%s", r.repositoryConfig.Branch)); err != nil {
@@ -303,6 +370,44 @@ func (r *Repository) sync(ctx context.Context) error {
 	return nil
 }
 
+// updateCommitTimestamps updates the metrics for the commit timestamps of the
+// local and remote revisions. If the remote revision has not been fetched yet,
+// the remote timestamp is left unchanged. An empty remote hash uses the local
+// revision. Errors are only logged, since they should not affect the sync.
+func (r *Repository) updateCommitTimestamps(ctx context.Context, remote string) {
+	local, err := r.resolve(ctx, "")
+	if err != nil {
+		log.Logger("repository").Warn("could not resolve local revision", "rev", r.repositoryConfig.Revision, "error", err)
+		return
+	}
+	if remote == "" {
+		remote = local
+	}
+	if t, err := r.commitTimestamp(ctx, local); err != nil {
+		log.Logger("repository").Warn("could not get local commit timestamp", "ref", local, "error", err)
+	} else {
+		metrics.SetGitLocalCommitTimestamp(t)
+	}
+	if t, err := r.commitTimestamp(ctx, remote); err != nil {
+		log.Logger("repository").Debug("could not get remote commit timestamp", "ref", remote, "error", err)
+	} else {
+		metrics.SetGitRemoteCommitTimestamp(t)
+	}
+}
+
+// commitTimestamp returns the committer date of the provided ref.
+func (r *Repository) commitTimestamp(ctx context.Context, ref string) (time.Time, error) {
+	output, err := r.runGitCommand(ctx, nil, r.path, "log", "-1", "--format=%ct", ref)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse commit timestamp %q: %w", output, err)
+	}
+	return time.Unix(sec, 0), nil
+}
+
 func (r *Repository) gitCleanup(ctx context.Context) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
@@ -331,7 +436,11 @@ func (r *Repository) cloneRemote(ctx context.Context) error {
 	args = append(args, r.repositoryConfig.Remote, r.path)
 	log.Logger("repository").Info("cloning repo", "origin", r.repositoryConfig.Remote, "path", r.path)
 
-	_, err := r.runGitCommand(ctx, nil, "", args...)
+	env, err := r.remoteEnvironment(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = r.runGitCommand(ctx, env, "", args...)
 	if err != nil {
 		if strings.Contains(err.Error(), "already exists and is not an empty directory") {
 			// Maybe a previous run crashed?  Git won't use this dir.
@@ -340,7 +449,7 @@ func (r *Repository) cloneRemote(ctx context.Context) error {
 			if err != nil {
 				return err
 			}
-			_, err = r.runGitCommand(ctx, nil, "", args...)
+			_, err = r.runGitCommand(ctx, env, "", args...)
 			if err != nil {
 				return err
 			}
@@ -352,45 +461,167 @@ func (r *Repository) cloneRemote(ctx context.Context) error {
 }
 
 // CloneLocal creates a clone of the existing repository to a new location on
-// disk and only checkouts the specified subpath. On success, it returns the
-// hash of the new repository clone's HEAD.
-func (r *Repository) CloneLocal(ctx context.Context, environment []string, dst, subpath string) (string, error) {
+// disk and only checkouts the specified subpath at the provided revision, or
+// the configured Revision if it is empty. The clone shares the objects of the
+// repository, so the caller should remove it once it is no longer needed. On
+// success, it returns the hash of the commit of the subpath.
+func (r *Repository) CloneLocal(ctx context.Context, environment []string, dst, subpath, revision string) (string, error) {
+	if err := r.fetchPinnedCommit(ctx, revision); err != nil {
+		return "", err
+	}
+	hash, err := r.cloneLocal(ctx, environment, dst, subpath, revision)
+	if err != nil {
+		return "", err
+	}
+	// Submodules are cloned from their own remotes, so the lock is not held
+	if r.syncOptions.Submodules {
+		if err := r.updateSubmodules(ctx, environment, dst, subpath); err != nil {
+			return "", err
+		}
+	}
+	return hash, nil
+}
+
+func (r *Repository) cloneLocal(ctx context.Context, environment []string, dst, subpath, revision string) (string, error) {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
 
-	hash, err := r.localHashForPath(ctx, subpath)
+	commit, err := r.resolve(ctx, revision)
+	if err != nil {
+		return "", err
+	}
+	// The HEAD of the branch is verified when it is synced, while other
+	// revisions can point anywhere in the repository
+	if r.syncOptions.Verification.Enabled() && parseRevision(r.revisionOrDefault(revision)).kind != revisionHead {
+		if err := r.verifyRevision(ctx, commit); err != nil {
+			return "", err
+		}
+	}
+	hash, err := r.localHashForPath(ctx, commit, subpath)
 	if err != nil {
 		return "", err
 	}
 
-	// git clone --no-checkout src dst
-	if _, err := r.runGitCommand(ctx, nil, "", "clone", "--no-checkout", r.path, dst); err != nil {
+	// git init dst
+	if _, err := r.runGitCommand(ctx, nil, "", "init", "--quiet", dst); err != nil {
 		return "", err
 	}
+	// The clone borrows the objects of the repository through alternates,
+	// instead of copying them, so it only contains the files of the subpath.
+	// Unlike `git clone --shared`, this also works for shallow repositories.
+	// It is safe because objects are only removed by gc, which holds the
+	// write lock, and the clone is not used after the checkout below, other
+	// than to read the files.
+	objects := filepath.Join(r.path, ".git", "objects")
+	if err := os.WriteFile(filepath.Join(dst, ".git", "objects", "info", "alternates"), []byte(objects+"\n"), 0644); err != nil {
+		return "", err
+	}
+	if shallow, err := os.ReadFile(filepath.Join(r.path, ".git", "shallow")); err == nil {
+		if err := os.WriteFile(filepath.Join(dst, ".git", "shallow"), shallow, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	paths := []string{subpath}
+	if r.syncOptions.Submodules || r.syncOptions.LFS {
+		// Relative submodule URLs and the LFS endpoint are resolved against
+		// the remote
+		if _, err := r.runGitCommand(ctx, nil, dst, "config", "remote.origin.url", r.repositoryConfig.Remote); err != nil {
+			return "", err
+		}
+	}
+	if r.syncOptions.Submodules {
+		// The submodules are listed in .gitmodules, at the root of the
+		// repository
+		if _, err := r.runGitCommand(ctx, nil, r.path, "cat-file", "-e", commit+":.gitmodules"); err == nil {
+			paths = append(paths, ".gitmodules")
+		}
+	}
+	if r.syncOptions.LFS {
+		// git lfs install --local
+		if _, err := r.runGitCommand(ctx, nil, dst, "lfs", "install", "--local"); err != nil {
+			return "", err
+		}
+		env, err := r.remoteEnvironment(ctx)
+		if err != nil {
+			return "", err
+		}
+		environment = append(env, environment...)
+	}
 
-	// git checkout HEAD -- ./path
-	if _, err := r.runGitCommand(ctx, environment, dst, "checkout", r.repositoryConfig.Revision, "--", subpath); err != nil {
+	// git checkout <commit> -- ./path
+	if _, err := r.runGitCommand(ctx, environment, dst, append([]string{"checkout", commit, "--"}, paths...)...); err != nil {
 		return "", err
 	}
 	return hash, nil
 }
 
-// HashForPath returns the hash of the configured revision for the specified
-// path.
-func (r *Repository) HashForPath(ctx context.Context, path string) (string, error) {
+// updateSubmodules initialises and updates the submodules under the subpath of
+// a local clone, using the same SSH configuration and credentials as the
+// remote.
+func (r *Repository) updateSubmodules(ctx context.Context, environment []string, dst, subpath string) error {
+	env, err := r.remoteEnvironment(ctx)
+	if err != nil {
+		return err
+	}
+	// git submodule update --init --recursive -- ./path
+	if _, err := r.runGitCommand(ctx, append(env, environment...), dst, "submodule", "update", "--init", "--recursive", "--", subpath); err != nil {
+		return fmt.Errorf("could not update submodules: %w", err)
+	}
+	return nil
+}
+
+// HashForPath returns the hash of the provided revision, or the configured
+// Revision if it is empty, for the specified path.
+func (r *Repository) HashForPath(ctx context.Context, path, revision string) (string, error) {
+	if err := r.fetchPinnedCommit(ctx, revision); err != nil {
+		return "", err
+	}
 	r.lock.RLock()
 	defer r.lock.RUnlock()
-	return r.localHashForPath(ctx, path)
+	commit, err := r.resolve(ctx, revision)
+	if err != nil {
+		return "", err
+	}
+	return r.localHashForPath(ctx, commit, path)
 }
 
-// HasChangesForPath returns true if there are changes that have been committed
-// since the commit hash provided, under the specified path.
-func (r *Repository) HasChangesForPath(ctx context.Context, path, sinceHash string) (bool, error) {
+// FullHash returns the full hash of the commit referenced by the provided,
+// possibly abbreviated, hash.
+func (r *Repository) FullHash(ctx context.Context, hash string) (string, error) {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
+	output, err := r.runGitCommand(ctx, nil, r.path, "rev-parse", "--verify", hash+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(string(output), "\n"), nil
+}
+
+// CommitTimestamp returns the committer date of the commit referenced by the
+// provided hash.
+func (r *Repository) CommitTimestamp(ctx context.Context, hash string) (time.Time, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.commitTimestamp(ctx, hash)
+}
 
-	cmd := []string{"diff", "--quiet", sinceHash, r.repositoryConfig.Revision, "--", path}
-	_, err := r.runGitCommand(ctx, nil, r.path, cmd...)
+// HasChangesForPath returns true if there are changes under the specified path
+// between the commit hash provided and the provided revision, or the
+// configured Revision if it is empty.
+func (r *Repository) HasChangesForPath(ctx context.Context, path, sinceHash, revision string) (bool, error) {
+	if err := r.fetchPinnedCommit(ctx, revision); err != nil {
+		return false, err
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	commit, err := r.resolve(ctx, revision)
+	if err != nil {
+		return false, err
+	}
+	cmd := []string{"diff", "--quiet", sinceHash, commit, "--", path}
+	_, err = r.runGitCommand(ctx, nil, r.path, cmd...)
 	if err == nil {
 		return false, nil
 	}
@@ -0,0 +1,151 @@
+package git
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepository_CloneLocal(t *testing.T) {
+	ctx := context.Background()
+	remote := newTestRemote(t)
+	remote.commit("ns-a/deployment.yaml", "")
+	commit := remote.commit("ns-b/deployment.yaml", "")
+	repo := newTestRepository(t, remote, VerificationOptions{})
+	require.NoError(t, repo.sync(ctx))
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	hash, err := repo.CloneLocal(ctx, nil, dst, "ns-b", "")
+	require.NoError(t, err)
+	assert.Equal(t, commit[:len(hash)], hash)
+	assert.FileExists(t, filepath.Join(dst, "ns-b", "deployment.yaml"))
+	assert.NoDirExists(t, filepath.Join(dst, "ns-a"))
+
+	// The objects are shared with the repository, instead of being copied
+	alternates, err := os.ReadFile(filepath.Join(dst, ".git", "objects", "info", "alternates"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(repo.path, ".git", "objects")+"\n", string(alternates))
+	packs, err := filepath.Glob(filepath.Join(dst, ".git", "objects", "pack", "*.pack"))
+	require.NoError(t, err)
+	assert.Empty(t, packs)
+}
+
+// bareClone creates a bare clone of the remote next to it and returns its path.
+func bareClone(remote *testRemote) string {
+	path := remote.path + ".git"
+	remote.git("clone", "-q", "--bare", remote.path, path)
+	return path
+}
+
+func TestRepository_CloneLocalSubmodules(t *testing.T) {
+	// Submodules cannot be cloned from local paths by default
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "protocol.file.allow")
+	t.Setenv("GIT_CONFIG_VALUE_0", "always")
+	ctx := context.Background()
+	sub := newTestRemote(t)
+	sub.commit("deployment.yaml", "")
+	bareClone(sub)
+	remote := &testRemote{t: t, path: filepath.Join(filepath.Dir(sub.path), "super")}
+	remote.git("init", "-q", "-b", "master", remote.path)
+	remote.commit("ns-a/kustomization.yaml", "")
+	remote.git("submodule", "add", "-q", sub.path+".git", "ns-a/vendor")
+	remote.git("submodule", "add", "-q", sub.path+".git", "ns-b/vendor")
+	// Relative URLs are resolved against the remote of kube-applier
+	remote.git("config", "-f", ".gitmodules", "submodule.ns-a/vendor.url", "../remote.git")
+	remote.git("commit", "-q", "-m", "add submodules")
+	bare := bareClone(remote)
+
+	for _, submodules := range []bool{true, false} {
+		repo, err := NewRepository(filepath.Join(t.TempDir(), "src"), RepositoryConfig{Remote: bare}, SyncOptions{Submodules: submodules})
+		require.NoError(t, err)
+		require.NoError(t, repo.sync(ctx))
+		dst := filepath.Join(t.TempDir(), "dst")
+		_, err = repo.CloneLocal(ctx, nil, dst, "ns-a", "")
+		require.NoError(t, err)
+		if submodules {
+			assert.FileExists(t, filepath.Join(dst, "ns-a", "vendor", "deployment.yaml"))
+		} else {
+			assert.NoFileExists(t, filepath.Join(dst, "ns-a", "vendor", "deployment.yaml"))
+		}
+		assert.NoDirExists(t, filepath.Join(dst, "ns-b"))
+	}
+}
+
+func TestRepository_CloneLocalLFS(t *testing.T) {
+	if err := exec.Command(gitExecutablePath, "lfs", "version").Run(); err != nil {
+		t.Skip("git-lfs is not installed")
+	}
+	ctx := context.Background()
+	remote := newTestRemote(t)
+	remote.git("lfs", "install", "--local")
+	remote.git("lfs", "track", "ns-a/*.yaml")
+	remote.commit("ns-a/crds.yaml", "")
+	content, err := os.ReadFile(filepath.Join(remote.path, "ns-a", "crds.yaml"))
+	require.NoError(t, err)
+	bare := bareClone(remote)
+	remote.git("lfs", "push", "--all", bare)
+
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "src"), RepositoryConfig{Remote: bare}, SyncOptions{LFS: true})
+	require.NoError(t, err)
+	require.NoError(t, repo.sync(ctx))
+	dst := filepath.Join(t.TempDir(), "dst")
+	_, err = repo.CloneLocal(ctx, nil, dst, "ns-a", "")
+	require.NoError(t, err)
+	checkedOut, err := os.ReadFile(filepath.Join(dst, "ns-a", "crds.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, string(content), string(checkedOut))
+}
+
+// BenchmarkCloneLocal compares CloneLocal to a full local clone, which copies
+// or hardlinks all the objects of the repository, depending on whether the
+// destination is on the same filesystem.
+func BenchmarkCloneLocal(b *testing.B) {
+	ctx := context.Background()
+	remote := newTestRemote(b)
+	// 32 paths with 64 random 16KiB files each, 32MiB in total
+	content := make([]byte, 16<<10)
+	for i := 0; i < 32; i++ {
+		dir := filepath.Join(remote.path, fmt.Sprintf("ns-%d", i))
+		require.NoError(b, os.MkdirAll(dir, 0755))
+		for j := 0; j < 64; j++ {
+			_, err := rand.Read(content)
+			require.NoError(b, err)
+			require.NoError(b, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.yaml", j)), content, 0644))
+		}
+	}
+	remote.git("add", "-A")
+	remote.git("commit", "-q", "-m", "init")
+	repo, err := NewRepository(filepath.Join(b.TempDir(), "src"), RepositoryConfig{Remote: remote.path}, SyncOptions{})
+	require.NoError(b, err)
+	require.NoError(b, repo.sync(ctx))
+
+	b.Run("alternates", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dst := filepath.Join(b.TempDir(), "dst")
+			_, err := repo.CloneLocal(ctx, nil, dst, "ns-0", "")
+			require.NoError(b, err)
+		}
+	})
+	for name, args := range map[string][]string{
+		"clone":              {"clone", "--no-checkout"},
+		"clone-no-hardlinks": {"clone", "--no-checkout", "--no-hardlinks"},
+	} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dst := filepath.Join(b.TempDir(), "dst")
+				_, err := repo.runGitCommand(ctx, nil, "", append(args, repo.path, dst)...)
+				require.NoError(b, err)
+				_, err = repo.runGitCommand(ctx, nil, dst, "checkout", "HEAD", "--", "ns-0")
+				require.NoError(b, err)
+			}
+		})
+	}
+}
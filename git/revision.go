@@ -0,0 +1,276 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// revisionKind determines how a revision is resolved to a commit.
+type revisionKind int
+
+const (
+	// revisionHead follows the HEAD of the configured branch.
+	revisionHead revisionKind = iota
+	// revisionCommit pins an exact commit.
+	revisionCommit
+	// revisionTag follows a tag, or any other ref, by name.
+	revisionTag
+	// revisionConstraint follows the highest tag that matches a semantic
+	// version constraint.
+	revisionConstraint
+)
+
+var commitHashPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// revision is a parsed revision of the repository.
+type revision struct {
+	constraint *semver.Constraints
+	kind       revisionKind
+	name       string
+}
+
+// parseRevision determines the kind of the revision. Revisions can be:
+//   - HEAD, for the HEAD of the configured branch
+//   - the full hash of a commit
+//   - a semantic version constraint (eg. ">=1.4.0 <2"), for the highest tag
+//     that is a semantic version and satisfies the constraint
+//   - the name of a tag, including exact versions such as "v1.4.0"
+func parseRevision(rev string) revision {
+	if rev == "HEAD" {
+		return revision{kind: revisionHead, name: rev}
+	}
+	if commitHashPattern.MatchString(rev) {
+		return revision{kind: revisionCommit, name: rev}
+	}
+	if _, err := semver.NewVersion(rev); err != nil {
+		if c, err := semver.NewConstraint(rev); err == nil {
+			return revision{constraint: c, kind: revisionConstraint, name: rev}
+		}
+	}
+	return revision{kind: revisionTag, name: rev}
+}
+
+// tagVersion parses the name of a tag as a semantic version, with an optional
+// "v" prefix.
+func tagVersion(tag string) (*semver.Version, error) {
+	return semver.StrictNewVersion(strings.TrimPrefix(tag, "v"))
+}
+
+// latestTag returns the tag with the highest version that satisfies the
+// constraint. Tags that are not semantic versions are ignored.
+func latestTag(tags []string, constraint *semver.Constraints) (string, bool) {
+	var (
+		latest        string
+		latestVersion *semver.Version
+	)
+	for _, t := range tags {
+		v, err := tagVersion(t)
+		if err != nil || !constraint.Check(v) {
+			continue
+		}
+		if latestVersion == nil || v.GreaterThan(latestVersion) {
+			latest, latestVersion = t, v
+		}
+	}
+	return latest, latestVersion != nil
+}
+
+// remoteRefs are the refs of the remote that kube-applier syncs: the HEAD of
+// the branch and the tags.
+type remoteRefs struct {
+	// branch is the hash of the HEAD of the branch.
+	branch string
+	// tags maps the names of the tags to the hashes of the objects they
+	// point to, which are different from the commits for annotated tags.
+	tags map[string]string
+	// tagCommits maps the names of the tags to the commits they point to.
+	tagCommits map[string]string
+}
+
+// remoteRefs lists the HEAD of the branch and the tags of the remote.
+func (r *Repository) remoteRefs(ctx context.Context) (remoteRefs, error) {
+	env, err := r.remoteEnvironment(ctx)
+	if err != nil {
+		return remoteRefs{}, err
+	}
+	output, err := r.runGitCommand(ctx, env, r.path, "ls-remote", "-q", "origin", "refs/heads/"+r.repositoryConfig.Branch, "refs/tags/*")
+	if err != nil {
+		return remoteRefs{}, err
+	}
+	refs := remoteRefs{tags: map[string]string{}, tagCommits: map[string]string{}}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		hash, ref, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		if ref == "refs/heads/"+r.repositoryConfig.Branch {
+			refs.branch = hash
+			continue
+		}
+		tag, ok := strings.CutPrefix(ref, "refs/tags/")
+		if !ok {
+			continue
+		}
+		// Annotated tags are listed twice, the peeled entry points to the
+		// commit
+		if t, ok := strings.CutSuffix(tag, "^{}"); ok {
+			refs.tagCommits[t] = hash
+			continue
+		}
+		refs.tags[tag] = hash
+		if _, ok := refs.tagCommits[tag]; !ok {
+			refs.tagCommits[tag] = hash
+		}
+	}
+	if refs.branch == "" {
+		return remoteRefs{}, fmt.Errorf("branch %s not found on the remote", r.repositoryConfig.Branch)
+	}
+	return refs, nil
+}
+
+// revisionHash returns the commit that the revision resolves to on the
+// remote, or an empty string if it cannot be resolved.
+func (refs remoteRefs) revisionHash(rev revision) string {
+	switch rev.kind {
+	case revisionHead:
+		return refs.branch
+	case revisionCommit:
+		return rev.name
+	case revisionConstraint:
+		tags := make([]string, 0, len(refs.tagCommits))
+		for t := range refs.tagCommits {
+			tags = append(tags, t)
+		}
+		if t, ok := latestTag(tags, rev.constraint); ok {
+			return refs.tagCommits[t]
+		}
+		return ""
+	default:
+		return refs.tagCommits[rev.name]
+	}
+}
+
+// upToDate returns true if the local repository has the HEAD of the branch
+// and all the tags of the remote, as well as the commit of the configured
+// revision if it is pinned.
+func (r *Repository) upToDate(ctx context.Context, refs remoteRefs) (bool, error) {
+	local, err := r.localHash(ctx)
+	if err != nil {
+		return false, err
+	}
+	if local != refs.branch {
+		return false, nil
+	}
+	output, err := r.runGitCommand(ctx, nil, r.path, "for-each-ref", "--format=%(objectname) %(refname:strip=2)", "refs/tags")
+	if err != nil {
+		return false, err
+	}
+	localTags := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if hash, tag, ok := strings.Cut(line, " "); ok {
+			localTags[tag] = hash
+		}
+	}
+	for tag, hash := range refs.tags {
+		if localTags[tag] != hash {
+			return false, nil
+		}
+	}
+	if rev := parseRevision(r.repositoryConfig.Revision); rev.kind == revisionCommit {
+		return r.hasCommit(ctx, rev.name), nil
+	}
+	return true, nil
+}
+
+// hasCommit returns true if the commit exists in the local repository.
+func (r *Repository) hasCommit(ctx context.Context, hash string) bool {
+	_, err := r.runGitCommand(ctx, nil, r.path, "cat-file", "-e", hash+"^{commit}")
+	return err == nil
+}
+
+// fetchCommit fetches a pinned commit from the remote, if it does not exist
+// in the local repository, since it might not be reachable from the branch
+// or the tags, or beyond the depth of the clone.
+func (r *Repository) fetchCommit(ctx context.Context, hash string) error {
+	if r.hasCommit(ctx, hash) {
+		return nil
+	}
+	args := []string{"fetch", "-f"}
+	if r.repositoryConfig.Depth != 0 {
+		args = append(args, "--depth", strconv.Itoa(r.repositoryConfig.Depth))
+	}
+	env, err := r.remoteEnvironment(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := r.runGitCommand(ctx, env, r.path, append(args, "origin", hash)...); err != nil {
+		return fmt.Errorf("could not fetch commit %s: %w", hash, err)
+	}
+	return nil
+}
+
+// revisionOrDefault returns the configured Revision if rev is empty.
+func (r *Repository) revisionOrDefault(rev string) string {
+	if rev == "" {
+		return r.repositoryConfig.Revision
+	}
+	return rev
+}
+
+// resolve returns the commit that the revision resolves to in the local
+// repository. An empty revision resolves the configured Revision.
+func (r *Repository) resolve(ctx context.Context, rev string) (string, error) {
+	rev = r.revisionOrDefault(rev)
+	parsed := parseRevision(rev)
+	ref := parsed.name
+	if parsed.kind == revisionConstraint {
+		output, err := r.runGitCommand(ctx, nil, r.path, "for-each-ref", "--format=%(refname:strip=2)", "refs/tags")
+		if err != nil {
+			return "", err
+		}
+		tag, ok := latestTag(strings.Fields(output), parsed.constraint)
+		if !ok {
+			return "", fmt.Errorf("no tag matches the version constraint %q", rev)
+		}
+		ref = "refs/tags/" + tag
+	}
+	output, err := r.runGitCommand(ctx, nil, r.path, "rev-parse", "--verify", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("could not resolve revision %q: %w", rev, err)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// Resolve returns the commit that the revision resolves to. An empty
+// revision resolves the Revision of the RepositoryConfig.
+func (r *Repository) Resolve(ctx context.Context, rev string) (string, error) {
+	if err := r.fetchPinnedCommit(ctx, rev); err != nil {
+		return "", err
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.resolve(ctx, rev)
+}
+
+// fetchPinnedCommit fetches the commit of the revision, if it is pinned and
+// has not been fetched already.
+func (r *Repository) fetchPinnedCommit(ctx context.Context, rev string) error {
+	rev = r.revisionOrDefault(rev)
+	if parseRevision(rev).kind != revisionCommit {
+		return nil
+	}
+	r.lock.RLock()
+	found := r.hasCommit(ctx, rev)
+	r.lock.RUnlock()
+	if found {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.fetchCommit(ctx, rev)
+}
@@ -0,0 +1,173 @@
+package git
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRevision(t *testing.T) {
+	testCases := []struct {
+		rev  string
+		kind revisionKind
+	}{
+		{"HEAD", revisionHead},
+		{"0123456789abcdef0123456789abcdef01234567", revisionCommit},
+		{"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", revisionCommit},
+		{"0123456", revisionTag},
+		{"v1.4.0", revisionTag},
+		{"1.4.0", revisionTag},
+		{"release-2024", revisionTag},
+		{">=1.4.0 <2", revisionConstraint},
+		{"~1.4", revisionConstraint},
+		{"1.x", revisionConstraint},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.kind, parseRevision(tc.rev).kind, tc.rev)
+	}
+}
+
+func TestLatestTag(t *testing.T) {
+	tags := []string{"v1.0.0", "v1.4.0", "1.4.2", "v1.5.0-rc.1", "v2.0.0", "latest", "v1.10"}
+	testCases := []struct {
+		constraint string
+		tag        string
+		ok         bool
+	}{
+		{">=1.4.0 <2", "1.4.2", true},
+		{"~1.4", "1.4.2", true},
+		{"^1.0.0-0", "v1.5.0-rc.1", true},
+		{"*", "v2.0.0", true},
+		{">=3", "", false},
+	}
+	for _, tc := range testCases {
+		c, err := semver.NewConstraint(tc.constraint)
+		require.NoError(t, err)
+		tag, ok := latestTag(tags, c)
+		assert.Equal(t, tc.ok, ok, tc.constraint)
+		assert.Equal(t, tc.tag, tag, tc.constraint)
+	}
+}
+
+func TestRepository_revisions(t *testing.T) {
+	ctx := context.Background()
+	remote := newTestRemote(t)
+	v1 := remote.commit("ns-a/v1.yaml", "")
+	remote.git("tag", "v1.0.0")
+	v14 := remote.commit("ns-a/v1.4.yaml", "")
+	remote.git("tag", "-a", "-m", "v1.4.0", "v1.4.0")
+	v2 := remote.commit("ns-a/v2.yaml", "")
+	remote.git("tag", "v2.0.0")
+	head := remote.commit("ns-a/head.yaml", "")
+
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "src"), RepositoryConfig{Remote: remote.path, Revision: ">=1.4.0 <2", Depth: 1}, SyncOptions{})
+	require.NoError(t, err)
+	require.NoError(t, repo.sync(ctx))
+
+	for rev, expected := range map[string]string{
+		"":          v14,
+		"HEAD":      head,
+		"v1.0.0":    v1,
+		"v2.0.0":    v2,
+		"^1.0.0":    v14,
+		">=2":       v2,
+		v1:          v1,
+		"v1.4.0":    v14,
+		"~1.0.0":    v1,
+		"<=1.0.0":   v1,
+		">1.0.0 <2": v14,
+	} {
+		commit, err := repo.Resolve(ctx, rev)
+		require.NoError(t, err, rev)
+		assert.Equal(t, expected, commit, rev)
+	}
+	_, err = repo.Resolve(ctx, ">=3")
+	assert.Error(t, err)
+
+	// The clone only contains the files of the revision
+	dst := filepath.Join(t.TempDir(), "dst")
+	_, err = repo.CloneLocal(ctx, nil, dst, "ns-a", "v1.0.0")
+	require.NoError(t, err)
+	entries, err := os.ReadDir(filepath.Join(dst, "ns-a"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "v1.yaml", entries[0].Name())
+
+	// A new tag is picked up, even if the branch has not changed
+	remote.git("tag", "v1.5.0", head)
+	require.NoError(t, repo.sync(ctx))
+	commit, err := repo.Resolve(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, head, commit)
+
+	// Moving a tag is picked up as well
+	remote.git("tag", "-f", "v2.0.0", v1)
+	require.NoError(t, repo.sync(ctx))
+	commit, err = repo.Resolve(ctx, "v2.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, v1, commit)
+
+	changed, err := repo.HasChangesForPath(ctx, "ns-a", v14, "v1.4.0")
+	require.NoError(t, err)
+	assert.False(t, changed)
+	changed, err = repo.HasChangesForPath(ctx, "ns-a", v14, "")
+	require.NoError(t, err)
+	assert.True(t, changed)
+}
+
+func TestRepository_pinnedCommit(t *testing.T) {
+	ctx := context.Background()
+	remote := newTestRemote(t)
+	remote.commit("ns-a/deployment.yaml", "")
+	remote.git("config", "uploadpack.allowAnySHA1InWant", "true")
+	// The pinned commit is not reachable from the branch or any tag
+	remote.git("checkout", "-q", "-b", "other")
+	pinned := remote.commit("ns-a/pinned.yaml", "")
+	remote.git("checkout", "-q", "master")
+	head := remote.commit("ns-a/head.yaml", "")
+
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "src"), RepositoryConfig{Remote: remote.path, Revision: pinned}, SyncOptions{})
+	require.NoError(t, err)
+	require.NoError(t, repo.sync(ctx))
+	commit, err := repo.Resolve(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, pinned, commit)
+	hash, err := repo.HashForPath(ctx, "ns-a/pinned.yaml", "")
+	require.NoError(t, err)
+	assert.Equal(t, pinned[:len(hash)], hash)
+	commit, err = repo.Resolve(ctx, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, head, commit)
+
+	// Waybills can pin commits that have not been fetched yet
+	repo, err = NewRepository(filepath.Join(t.TempDir(), "src"), RepositoryConfig{Remote: remote.path}, SyncOptions{})
+	require.NoError(t, err)
+	require.NoError(t, repo.sync(ctx))
+	dst := filepath.Join(t.TempDir(), "dst")
+	hash, err = repo.CloneLocal(ctx, nil, dst, "ns-a", pinned)
+	require.NoError(t, err)
+	assert.Equal(t, pinned[:len(hash)], hash)
+	assert.FileExists(t, filepath.Join(dst, "ns-a", "pinned.yaml"))
+}
+
+func TestRepository_verifyRevision(t *testing.T) {
+	ctx := context.Background()
+	remote := newTestRemote(t)
+	remote.commit("ns-a/unsigned.yaml", "")
+	remote.git("tag", "v1.0.0")
+	remote.commit("ns-a/signed.yaml", "alice")
+	remote.git("tag", "v1.1.0")
+	remote.commit("ns-a/head.yaml", "alice")
+	repo := newTestRepository(t, remote, VerificationOptions{AllowedSignersPath: remote.allowedSigners()})
+	require.NoError(t, repo.sync(ctx))
+
+	_, err := repo.CloneLocal(ctx, nil, filepath.Join(t.TempDir(), "dst"), "ns-a", "v1.1.0")
+	assert.NoError(t, err)
+	_, err = repo.CloneLocal(ctx, nil, filepath.Join(t.TempDir(), "dst"), "ns-a", "v1.0.0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,290 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/metrics"
+)
+
+// VerificationOptions configures the verification of the signatures of the
+// commits that are synced from the remote. Verification is enabled if either
+// an allowed signers file or a GPG keyring is provided.
+type VerificationOptions struct {
+	// AllCommits verifies every commit since the last synced revision,
+	// instead of only the latest one. It requires a full clone.
+	AllCommits bool
+	// AllowedSignersPath is the path to a file that lists the SSH keys that
+	// commits can be signed with, in the format of ssh-keygen(1).
+	AllowedSignersPath string
+	// GPGKeyringPath is the path to a file with the armored public GPG keys
+	// that commits can be signed with.
+	GPGKeyringPath string
+}
+
+// Enabled returns true if signature verification is configured.
+func (vo VerificationOptions) Enabled() bool {
+	return vo.AllowedSignersPath != "" || vo.GPGKeyringPath != ""
+}
+
+// Verification is the outcome of verifying the signature of the latest
+// revision fetched from the remote.
+type Verification struct {
+	// ChangedPaths are the files that changed between the local revision and
+	// Commit, when Commit was rejected.
+	ChangedPaths []string
+	// Commit is the latest revision fetched from the remote.
+	Commit string
+	// Reason describes why Commit was rejected.
+	Reason string
+	// Signer is the signer of Commit, if it was verified.
+	Signer string
+	// Time is when the verification was performed.
+	Time time.Time
+	// UnverifiedCommit is the commit that failed verification. It differs from
+	// Commit when every commit is verified and one of its ancestors failed.
+	UnverifiedCommit string
+	// Verified denotes whether the signatures of Commit, and of its ancestors
+	// if every commit is verified, are valid and from an allowed signer.
+	Verified bool
+}
+
+// Blocked returns true if the latest revision on the remote was rejected and
+// the local revision is held back.
+func (v Verification) Blocked() bool {
+	return v.Commit != "" && !v.Verified
+}
+
+// Blocks returns true if the provided path, relative to the repository root,
+// has changes that are held back because the latest revision was rejected.
+func (v Verification) Blocks(path string) bool {
+	if !v.Blocked() {
+		return false
+	}
+	path = filepath.Clean(path)
+	if path == "." {
+		return len(v.ChangedPaths) > 0
+	}
+	for _, p := range v.ChangedPaths {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// signatureStatusReasons describes the signature statuses (%G? in
+// git-log(1)) of rejected commits.
+var signatureStatusReasons = map[string]string{
+	"B": "the signature is bad",
+	"E": "the signature cannot be checked, it is not from an allowed signer",
+	"G": "the signature is not from an allowed signer",
+	"N": "the commit is not signed",
+	"R": "the signature was made by a revoked key",
+	"U": "the signature is not from an allowed signer",
+	"X": "the signature has expired",
+	"Y": "the signature was made by an expired key",
+}
+
+// Verification returns the outcome of the latest signature verification. It
+// returns the zero value if verification is not enabled or the Repository is
+// nil.
+func (r *Repository) Verification() Verification {
+	if r == nil {
+		return Verification{}
+	}
+	r.verificationLock.RLock()
+	defer r.verificationLock.RUnlock()
+	return r.verification
+}
+
+// verify checks the signature of the target revision and, if every commit
+// is verified, of the commits since the local revision. The outcome is
+// recorded in the Repository and an error is returned if the target was
+// rejected. An empty local revision only verifies the target.
+func (r *Repository) verify(ctx context.Context, local, target string) error {
+	commit, err := r.runGitCommand(ctx, nil, r.path, "rev-parse", "--verify", target+"^{commit}")
+	if err != nil {
+		return err
+	}
+	commit = strings.TrimSpace(commit)
+	commits := []string{commit}
+	if local != "" && r.syncOptions.Verification.AllCommits {
+		out, err := r.runGitCommand(ctx, nil, r.path, "rev-list", "--reverse", local+".."+commit)
+		if err != nil {
+			return err
+		}
+		// The list is empty if the remote was reset to an ancestor of the
+		// local revision
+		if c := strings.Fields(out); len(c) > 0 {
+			commits = c
+		}
+	}
+	env, cleanup, err := r.verificationEnvironment(ctx)
+	if err != nil {
+		return fmt.Errorf("could not setup signature verification: %w", err)
+	}
+	defer cleanup()
+
+	v := Verification{Commit: commit, Time: time.Now(), Verified: true}
+	for _, c := range commits {
+		signer, reason, err := r.verifyCommit(ctx, env, c)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			v.Verified = false
+			v.Reason = reason
+			v.UnverifiedCommit = c
+			break
+		}
+		if c == commit {
+			v.Signer = signer
+		}
+	}
+	if !v.Verified && local != "" {
+		out, err := r.runGitCommand(ctx, nil, r.path, "diff", "--name-only", local, commit)
+		if err != nil {
+			log.Logger("repository").Warn("could not list the paths changed by the rejected commit", "commit", commit, "error", err)
+		} else {
+			v.ChangedPaths = strings.Fields(out)
+		}
+	}
+
+	r.verificationLock.Lock()
+	r.verification = v
+	r.verificationLock.Unlock()
+	metrics.RecordGitSignatureVerification(v.Verified)
+	if !v.Verified {
+		return fmt.Errorf("signature verification of commit %s failed: %s", v.UnverifiedCommit, v.Reason)
+	}
+	log.Logger("repository").Info("verified commit signature", "commit", commit, "signer", v.Signer)
+	return nil
+}
+
+// verifyRevision checks the signature of a commit that is applied instead of
+// the HEAD of the branch. The outcome is not recorded in the Repository, since
+// it does not hold back the local revision.
+func (r *Repository) verifyRevision(ctx context.Context, commit string) error {
+	env, cleanup, err := r.verificationEnvironment(ctx)
+	if err != nil {
+		return fmt.Errorf("could not setup signature verification: %w", err)
+	}
+	defer cleanup()
+	_, reason, err := r.verifyCommit(ctx, env, commit)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return fmt.Errorf("signature verification of commit %s failed: %s", commit, reason)
+	}
+	return nil
+}
+
+// verifyCommit returns the signer of the commit, or the reason why its
+// signature was rejected.
+func (r *Repository) verifyCommit(ctx context.Context, env []string, commit string) (string, string, error) {
+	out, err := r.runGitCommand(ctx, env, r.path, "log", "-1", "--format=%G?%x00%GT%x00%GS", commit)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(strings.TrimSpace(out), "\x00", 3)
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("unexpected signature status of commit %s: %q", commit, out)
+	}
+	status, trust, signer := parts[0], parts[1], parts[2]
+	// SSH keys in the allowed signers file and the GPG keys of the keyring
+	// are the only ones that are fully trusted
+	if status == "G" && (trust == "fully" || trust == "ultimate") {
+		return signer, "", nil
+	}
+	reason, ok := signatureStatusReasons[status]
+	if !ok {
+		reason = fmt.Sprintf("unknown signature status %q", status)
+	}
+	return "", reason, nil
+}
+
+// verificationEnvironment returns the environment variables that configure
+// git to verify signatures against the allowed signers. The GPG keys are
+// imported into a temporary home directory on every call, so that changes to
+// the keyring are picked up, which is removed by the returned function.
+func (r *Repository) verificationEnvironment(ctx context.Context) ([]string, func(), error) {
+	allowedSigners := r.syncOptions.Verification.AllowedSignersPath
+	if allowedSigners == "" {
+		allowedSigners = os.DevNull
+	}
+	env := []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=gpg.ssh.allowedSignersFile",
+		"GIT_CONFIG_VALUE_0=" + allowedSigners,
+	}
+	home, err := os.MkdirTemp("", "kube-applier-gnupg")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(home) }
+	env = append(env, "GNUPGHOME="+home)
+	if r.syncOptions.Verification.GPGKeyringPath == "" {
+		return env, cleanup, nil
+	}
+	if err := importGPGKeyring(ctx, home, r.syncOptions.Verification.GPGKeyringPath); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return env, cleanup, nil
+}
+
+// importGPGKeyring imports the public keys into the GPG home directory and
+// trusts them ultimately, so that their signatures are fully trusted by git.
+func importGPGKeyring(ctx context.Context, home, keyringPath string) error {
+	if _, err := runGPG(ctx, home, nil, "--import", keyringPath); err != nil {
+		return err
+	}
+	out, err := runGPG(ctx, home, nil, "--with-colons", "--list-keys")
+	if err != nil {
+		return err
+	}
+	ownerTrust := &bytes.Buffer{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	primary := false
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		switch {
+		case fields[0] == "pub":
+			primary = true
+		case fields[0] == "fpr" && primary && len(fields) > 9:
+			fmt.Fprintf(ownerTrust, "%s:6:\n", fields[9])
+			primary = false
+		}
+	}
+	if ownerTrust.Len() == 0 {
+		return fmt.Errorf("no keys found in %s", keyringPath)
+	}
+	_, err = runGPG(ctx, home, ownerTrust, "--import-ownertrust")
+	return err
+}
+
+func runGPG(ctx context.Context, home string, stdin *bytes.Buffer, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "gpg", append([]string{"--batch", "--no-tty", "--homedir", home}, args...)...)
+	cmd.WaitDelay = cmdWaitDelay
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Run(%s): %w: { stdout: %q, stderr: %q }", cmd.String(), err, stdout.String(), stderr.String())
+	}
+	return stdout.String(), nil
+}
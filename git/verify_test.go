@@ -0,0 +1,194 @@
+package git
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRemote is a repository that is used as the remote in tests, with
+// commits that are signed with SSH keys.
+type testRemote struct {
+	t    testing.TB
+	path string
+	keys map[string]string
+}
+
+func newTestRemote(t testing.TB) *testRemote {
+	dir := t.TempDir()
+	r := &testRemote{t: t, path: filepath.Join(dir, "remote"), keys: map[string]string{}}
+	r.git("init", "-q", "-b", "master", r.path)
+	for _, name := range []string{"alice", "mallory"} {
+		key := filepath.Join(dir, name)
+		out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", name, "-f", key).CombinedOutput()
+		require.NoError(t, err, string(out))
+		r.keys[name] = key
+	}
+	return r
+}
+
+func (r *testRemote) git(args ...string) string {
+	cmd := exec.Command(gitExecutablePath, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "commit.gpgsign=false"}, args...)...)
+	cmd.Dir = filepath.Dir(r.path)
+	if _, err := os.Stat(r.path); err == nil {
+		cmd.Dir = r.path
+	}
+	out, err := cmd.CombinedOutput()
+	require.NoError(r.t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes the file and commits it, signed with the key of the signer
+// unless it is empty.
+func (r *testRemote) commit(file, signer string) string {
+	require.NoError(r.t, os.MkdirAll(filepath.Join(r.path, filepath.Dir(file)), 0755))
+	require.NoError(r.t, os.WriteFile(filepath.Join(r.path, file), []byte(r.t.Name()+signer), 0644))
+	r.git("add", "-A")
+	args := []string{"commit", "-q", "-m", "update " + file}
+	if signer != "" {
+		args = append([]string{"-c", "gpg.format=ssh", "-c", "user.signingkey=" + r.keys[signer]}, append(args, "-S")...)
+	}
+	r.git(args...)
+	return r.git("rev-parse", "HEAD")
+}
+
+// allowedSigners writes an allowed signers file that only allows alice.
+func (r *testRemote) allowedSigners() string {
+	pub, err := os.ReadFile(r.keys["alice"] + ".pub")
+	require.NoError(r.t, err)
+	path := filepath.Join(filepath.Dir(r.path), "allowed_signers")
+	require.NoError(r.t, os.WriteFile(path, []byte("alice@example.com "+string(pub)), 0644))
+	return path
+}
+
+func newTestRepository(t *testing.T, remote *testRemote, verification VerificationOptions) *Repository {
+	repo, err := NewRepository(filepath.Join(t.TempDir(), "src"), RepositoryConfig{Remote: remote.path}, SyncOptions{Verification: verification})
+	require.NoError(t, err)
+	return repo
+}
+
+func TestNewRepository_verification(t *testing.T) {
+	verification := VerificationOptions{AllowedSignersPath: "/allowed_signers", AllCommits: true}
+	_, err := NewRepository("/src", RepositoryConfig{Remote: "foo", Depth: 1}, SyncOptions{Verification: verification})
+	assert.Error(t, err)
+	_, err = NewRepository("/src", RepositoryConfig{Remote: "foo", Revision: "v1.0.0"}, SyncOptions{Verification: verification})
+	assert.Error(t, err)
+	_, err = NewRepository("/src", RepositoryConfig{Remote: "foo"}, SyncOptions{Verification: verification})
+	assert.NoError(t, err)
+}
+
+func TestRepository_verify(t *testing.T) {
+	ctx := context.Background()
+	remote := newTestRemote(t)
+	verified := remote.commit("ns-a/deployment.yaml", "alice")
+	repo := newTestRepository(t, remote, VerificationOptions{AllowedSignersPath: remote.allowedSigners()})
+	require.NoError(t, repo.sync(ctx))
+	v := repo.Verification()
+	assert.True(t, v.Verified)
+	assert.Equal(t, verified, v.Commit)
+	assert.Equal(t, "alice@example.com", v.Signer)
+
+	// Unsigned commits and commits signed by other keys are not synced
+	for _, signer := range []string{"", "mallory"} {
+		rejected := remote.commit("ns-b/deployment.yaml", signer)
+		assert.Error(t, repo.sync(ctx))
+		local, err := repo.localHash(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, verified, local)
+		v = repo.Verification()
+		assert.True(t, v.Blocked())
+		assert.Equal(t, rejected, v.Commit)
+		assert.Equal(t, rejected, v.UnverifiedCommit)
+		assert.True(t, v.Blocks("ns-b"))
+		assert.False(t, v.Blocks("ns-a"))
+		assert.False(t, v.Blocks("ns"))
+	}
+
+	// Only the latest commit is verified by default
+	latest := remote.commit("ns-b/deployment.yaml", "alice")
+	require.NoError(t, repo.sync(ctx))
+	local, err := repo.localHash(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, latest, local)
+	assert.False(t, repo.Verification().Blocked())
+
+	// The remote is reset to the verified revision
+	rejected := remote.commit("ns-a/deployment.yaml", "")
+	assert.Error(t, repo.sync(ctx))
+	remote.git("reset", "-q", "--hard", latest)
+	require.NoError(t, repo.sync(ctx))
+	assert.False(t, repo.Verification().Blocked())
+	assert.NotEqual(t, rejected, repo.Verification().Commit)
+}
+
+func TestRepository_verifyAllCommits(t *testing.T) {
+	ctx := context.Background()
+	remote := newTestRemote(t)
+	verified := remote.commit("ns-a/deployment.yaml", "alice")
+	repo := newTestRepository(t, remote, VerificationOptions{AllowedSignersPath: remote.allowedSigners(), AllCommits: true})
+	require.NoError(t, repo.sync(ctx))
+
+	unsigned := remote.commit("ns-b/deployment.yaml", "")
+	latest := remote.commit("ns-c/deployment.yaml", "alice")
+	assert.Error(t, repo.sync(ctx))
+	local, err := repo.localHash(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, verified, local)
+	v := repo.Verification()
+	assert.Equal(t, latest, v.Commit)
+	assert.Equal(t, unsigned, v.UnverifiedCommit)
+	assert.True(t, v.Blocks("ns-b"))
+	assert.True(t, v.Blocks("ns-c"))
+}
+
+func TestRepository_verifyClone(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.commit("ns-a/deployment.yaml", "mallory")
+	repo := newTestRepository(t, remote, VerificationOptions{AllowedSignersPath: remote.allowedSigners()})
+	assert.Error(t, repo.sync(context.Background()))
+	// The clone is removed, so that it is not used
+	_, err := os.Stat(repo.path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRepository_verifyGPG(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	ctx := context.Background()
+	remote := newTestRemote(t)
+	// A short path is used, since the GPG agent socket is created in it
+	home, err := os.MkdirTemp("", "gnupg")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	_, err = runGPG(ctx, home, nil, "--passphrase", "", "--quick-gen-key", "Bob <bob@example.com>", "ed25519", "sign", "never")
+	require.NoError(t, err)
+	keyring, err := runGPG(ctx, home, nil, "--armor", "--export", "bob@example.com")
+	require.NoError(t, err)
+	keyringPath := filepath.Join(t.TempDir(), "keyring.asc")
+	require.NoError(t, os.WriteFile(keyringPath, []byte(keyring), 0644))
+
+	require.NoError(t, os.MkdirAll(remote.path, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(remote.path, "README"), nil, 0644))
+	remote.git("add", "-A")
+	cmd := exec.Command(gitExecutablePath, "-c", "user.name=Bob", "-c", "user.email=bob@example.com", "-c", "user.signingkey=bob@example.com", "commit", "-q", "-S", "-m", "init")
+	cmd.Dir = remote.path
+	cmd.Env = append(os.Environ(), "GNUPGHOME="+home)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	exec.Command("gpgconf", "--homedir", home, "--kill", "all").Run()
+
+	repo := newTestRepository(t, remote, VerificationOptions{GPGKeyringPath: keyringPath})
+	require.NoError(t, repo.sync(ctx))
+	assert.Equal(t, "Bob <bob@example.com>", repo.Verification().Signer)
+
+	remote.commit("ns-a/deployment.yaml", "alice")
+	assert.Error(t, repo.sync(ctx))
+	assert.True(t, repo.Verification().Blocked())
+}
@@ -8,14 +8,18 @@ import (
 	stdErrors "errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	kubeyaml "k8s.io/apimachinery/pkg/util/yaml"
@@ -23,6 +27,7 @@ import (
 
 	"github.com/utilitywarehouse/kube-applier/kustomizeutil"
 	"github.com/utilitywarehouse/kube-applier/metrics"
+	"github.com/utilitywarehouse/kube-applier/tracing"
 )
 
 var (
@@ -47,8 +52,17 @@ type ApplyOptions struct {
 	Environment    []string
 	Namespace      string
 	PruneWhitelist []string
-	ServerSide     bool
-	Token          string
+	// Labels are added to all the resources that are applied, so that they
+	// match the Selector.
+	Labels map[string]string
+	// Selector limits the resources that are applied and pruned to the ones
+	// matching the label selector.
+	Selector   string
+	ServerSide bool
+	Token      string
+	// Waybill is the name of the Waybill being applied, used for labelling
+	// metrics.
+	Waybill string
 }
 
 // Args returns the flags that should be passed to exec.Command
@@ -71,8 +85,15 @@ func (o *ApplyOptions) Args() []string {
 		args = append(args, []string{"--server-side", "--force-conflicts"}...)
 	}
 
+	if o.Selector != "" {
+		args = append(args, []string{"-l", o.Selector}...)
+	}
+
 	if len(o.PruneWhitelist) > 0 {
-		args = append(args, []string{"--prune", "--all"}...)
+		args = append(args, "--prune")
+		if o.Selector == "" {
+			args = append(args, "--all")
+		}
 		for _, w := range o.PruneWhitelist {
 			args = append(args, "--prune-allowlist="+w)
 		}
@@ -109,11 +130,30 @@ func NewClient(host, label, kubeCtlPath string, kubeCtlOpts []string) *Client {
 
 // Apply attempts to "kubectl apply" the files located at path. It returns the
 // full apply command and its output.
-func (c *Client) Apply(ctx context.Context, path string, options ApplyOptions) (string, string, error) {
+func (c *Client) Apply(ctx context.Context, path string, options ApplyOptions) (_ string, _ string, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "kubectl.Apply", trace.WithAttributes(
+		attribute.String("path", path),
+		attribute.String("namespace", options.Namespace),
+		attribute.String("dryRunStrategy", options.DryRunStrategy),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	if kustomizeutil.HasKustomizationFile(path) {
 		cmd, out, err := c.applyKustomize(ctx, path, options)
 		return sanitiseCmdStr(cmd), out, err
 	}
+	if len(options.Labels) > 0 {
+		// The manifests are labelled before they are applied
+		build, out, err := c.Build(ctx, path, options)
+		if err != nil {
+			return "", out, err
+		}
+		if len(build.Resources) == 0 && len(build.Secrets) == 0 {
+			return "", "", fmt.Errorf("No resources were found in %s", path)
+		}
+		cmd, out, err := c.applyBuild(ctx, build, options)
+		return sanitiseCmdStr(cmd), out, err
+	}
 	cmd, out, err := c.applyPath(ctx, path, options)
 	return sanitiseCmdStr(cmd), out, err
 }
@@ -132,7 +172,9 @@ func (c *Client) KustomizePath() string {
 
 // applyPath runs `kubectl apply -f <path>`
 func (c *Client) applyPath(ctx context.Context, path string, options ApplyOptions) (string, string, error) {
+	start := time.Now()
 	cmdStr, out, err := c.apply(ctx, path, []byte{}, options)
+	metrics.RecordRunPhase(options.Namespace, options.Waybill, metrics.PhaseKubectlApply, time.Since(start))
 	if err != nil {
 		// Filter potential secret leaks out of the output
 		return cmdStr, filterErrOutput(out), err
@@ -141,8 +183,69 @@ func (c *Client) applyPath(ctx context.Context, path string, options ApplyOption
 	return cmdStr, out, nil
 }
 
-// applyKustomize does a `kustomize build | kubectl apply -f -` on the path
-func (c *Client) applyKustomize(ctx context.Context, path string, options ApplyOptions) (string, string, error) {
+// BuildResult holds the manifests that would be applied for a path, with the
+// Secrets split from the other resources.
+type BuildResult struct {
+	// Command is the command used to build the manifests, if any.
+	Command   string
+	Resources []byte
+	Secrets   []byte
+}
+
+// Build builds the manifests located at path in the same way as Apply,
+// without contacting the apiserver: with `kustomize build` if the path
+// contains a kustomization file, otherwise by reading the manifest files under
+// it. The Secrets are split from the other resources, as they are applied
+// separately, and the Labels of the options are added to all of them. It also
+// returns the output of the build, which is filtered like
+// the output of Apply if there is an error.
+func (c *Client) Build(ctx context.Context, path string, options ApplyOptions) (BuildResult, string, error) {
+	if kustomizeutil.HasKustomizationFile(path) {
+		return c.kustomizeBuild(ctx, path, options)
+	}
+	manifests, err := readManifests(path)
+	if err != nil {
+		return BuildResult{}, "", err
+	}
+	resources, secrets, err := splitSecrets(manifests, options.Labels)
+	if err != nil {
+		return BuildResult{}, "error extracting secrets from manifests", err
+	}
+	return BuildResult{Resources: resources, Secrets: secrets}, "", nil
+}
+
+// readManifests reads the files under path with the extensions that
+// `kubectl apply -R -f <path>` considers, in lexical order, and joins them in
+// a single multi-document YAML.
+func readManifests(path string) ([]byte, error) {
+	var docs [][]byte
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch filepath.Ext(p) {
+		case ".json", ".yaml", ".yml":
+		default:
+			return nil
+		}
+		doc, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(docs, []byte("\n---\n")), nil
+}
+
+// kustomizeBuild runs `kustomize build` on the path and splits its output
+func (c *Client) kustomizeBuild(ctx context.Context, path string, options ApplyOptions) (BuildResult, string, error) {
 	var kustomizeStdout, kustomizeStderr bytes.Buffer
 
 	kustomizeCmd := exec.CommandContext(ctx, "kustomize", "build", path)
@@ -153,26 +256,46 @@ func (c *Client) applyKustomize(ctx context.Context, path string, options ApplyO
 	kustomizeCmd.Stdout = &kustomizeStdout
 	kustomizeCmd.Stderr = &kustomizeStderr
 
+	start := time.Now()
+	_, span := tracing.Tracer().Start(ctx, "kustomize build")
 	err := kustomizeCmd.Run()
+	tracing.End(span, err)
+	metrics.RecordRunPhase(options.Namespace, options.Waybill, metrics.PhaseKustomizeBuild, time.Since(start))
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
 			err = errors.Wrap(ctx.Err(), err.Error())
 		}
-		return kustomizeCmd.String(), kustomizeStderr.String(), err
+		return BuildResult{Command: kustomizeCmd.String()}, kustomizeStderr.String(), err
 	}
 
 	// Split the stdout into secrets and other resources
 	stdout, err := io.ReadAll(&kustomizeStdout)
 	if err != nil {
-		return kustomizeCmd.String(), "error reading kustomize output", err
+		return BuildResult{Command: kustomizeCmd.String()}, "error reading kustomize output", err
 	}
-	resources, secrets, err := splitSecrets(stdout)
+	resources, secrets, err := splitSecrets(stdout, options.Labels)
 	if err != nil {
-		return kustomizeCmd.String(), "error extracting secrets from kustomize output", err
+		return BuildResult{Command: kustomizeCmd.String()}, "error extracting secrets from kustomize output", err
 	}
 	if len(resources) == 0 && len(secrets) == 0 {
-		return kustomizeCmd.String(), "", fmt.Errorf("No resources were extracted from the kustomize output")
+		return BuildResult{Command: kustomizeCmd.String()}, "", fmt.Errorf("No resources were extracted from the kustomize output")
+	}
+	return BuildResult{Command: kustomizeCmd.String(), Resources: resources, Secrets: secrets}, "", nil
+}
+
+// applyKustomize does a `kustomize build | kubectl apply -f -` on the path
+func (c *Client) applyKustomize(ctx context.Context, path string, options ApplyOptions) (string, string, error) {
+	build, out, err := c.kustomizeBuild(ctx, path, options)
+	if err != nil {
+		return build.Command, out, err
 	}
+	return c.applyBuild(ctx, build, options)
+}
+
+// applyBuild applies the built manifests, with the resources and the Secrets
+// applied in separate invocations of `kubectl apply -f -`.
+func (c *Client) applyBuild(ctx context.Context, build BuildResult, options ApplyOptions) (string, string, error) {
+	resources, secrets := build.Resources, build.Secrets
 
 	// This is the command we are effectively applying. In actuality we're splitting it into two
 	// separate invocations of kubectl but we'll return this as the command
@@ -186,7 +309,10 @@ func (c *Client) applyKustomize(ctx context.Context, path string, options ApplyO
 	// Add opts that are specific to this client
 	displayArgs = append(c.KubeCtlOpts, displayArgs...)
 	kubectlCmd := exec.Command(c.KubeCtlPath, displayArgs...)
-	cmdStr := kustomizeCmd.String() + " | " + kubectlCmd.String()
+	cmdStr := kubectlCmd.String()
+	if build.Command != "" {
+		cmdStr = build.Command + " | " + cmdStr
+	}
 
 	var kubectlOut string
 
@@ -202,7 +328,9 @@ func (c *Client) applyKustomize(ctx context.Context, path string, options ApplyO
 		resourcesOptions := options
 		resourcesOptions.PruneWhitelist = resourcesPruneWhitelist
 
+		start := time.Now()
 		_, out, err := c.apply(ctx, "-", resources, resourcesOptions)
+		metrics.RecordRunPhase(options.Namespace, options.Waybill, metrics.PhaseKubectlApply, time.Since(start))
 		kubectlOut = kubectlOut + out
 		if err != nil {
 			return cmdStr, kubectlOut, err
@@ -221,7 +349,9 @@ func (c *Client) applyKustomize(ctx context.Context, path string, options ApplyO
 		secretsOptions := options
 		secretsOptions.PruneWhitelist = secretsPruneWhitelist
 
+		start := time.Now()
 		_, secretsOut, err := c.apply(ctx, "-", secrets, secretsOptions)
+		metrics.RecordRunPhase(options.Namespace, options.Waybill, metrics.PhaseKubectlApplySecrets, time.Since(start))
 		if err != nil {
 			// Don't include kubectl's output — on a failed apply kubectl
 			// echoes a "bigger context" window of the raw manifest JSON,
@@ -260,17 +390,19 @@ func (c *Client) apply(ctx context.Context, path string, stdin []byte, options A
 		}
 		kubectlCmd.Stdin = bytes.NewReader(stdin)
 	}
+	_, span := tracing.Tracer().Start(ctx, "kubectl apply", trace.WithAttributes(attribute.Int("stdin.bytes", len(stdin))))
 	out, err := kubectlCmd.CombinedOutput()
+	tracing.End(span, err)
 	if err != nil {
 		if e, ok := err.(*exec.ExitError); ok {
-			metrics.UpdateKubectlExitCodeCount(options.Namespace, e.ExitCode())
+			metrics.UpdateKubectlExitCodeCount(options.Namespace, options.Waybill, e.ExitCode())
 		}
 		if ctx.Err() == context.DeadlineExceeded {
 			err = errors.Wrap(ctx.Err(), err.Error())
 		}
 		return kubectlCmd.String(), string(out), err
 	}
-	metrics.UpdateKubectlExitCodeCount(options.Namespace, 0)
+	metrics.UpdateKubectlExitCodeCount(options.Namespace, options.Waybill, 0)
 
 	return kubectlCmd.String(), string(out), nil
 }
@@ -312,9 +444,20 @@ func filterErrOutput(out string) string {
 //	stringData:
 //	  token: my-plaintext-token-value
 func secretsErrMessage(secrets []byte) string {
+	names, err := SecretNames(secrets)
+	if err != nil || len(names) == 0 {
+		return omitErrOutputMessage
+	}
+	return fmt.Sprintf("Error applying Secret(s) [%s]; kubectl output has been omitted as it may contain sensitive data.\n", strings.Join(names, ", "))
+}
+
+// SecretNames returns the sorted names of the Secrets in the multi-document
+// YAML, prefixed by their namespace if they have one, so that they can be
+// referred to without revealing their data.
+func SecretNames(secrets []byte) ([]string, error) {
 	objs, err := splitYAML(secrets)
 	if err != nil {
-		return omitErrOutputMessage
+		return nil, err
 	}
 	var names []string
 	for _, obj := range objs {
@@ -327,17 +470,14 @@ func secretsErrMessage(secrets []byte) string {
 		}
 		names = append(names, name)
 	}
-	if len(names) == 0 {
-		return omitErrOutputMessage
-	}
 	sort.Strings(names)
-	return fmt.Sprintf("Error applying Secret(s) [%s]; kubectl output has been omitted as it may contain sensitive data.\n", strings.Join(names, ", "))
+	return names, nil
 }
 
 // splitSecrets will take a yaml file and separate the resources into Secrets
 // and other resources. This allows Secrets to be applied separately to other
-// resources.
-func splitSecrets(yamlData []byte) (resources, secrets []byte, err error) {
+// resources. The provided labels are added to all the resources.
+func splitSecrets(yamlData []byte, labels map[string]string) (resources, secrets []byte, err error) {
 	objs, err := splitYAML(yamlData)
 	if err != nil {
 		return resources, secrets, err
@@ -346,6 +486,9 @@ func splitSecrets(yamlData []byte) (resources, secrets []byte, err error) {
 	secretsDocs := [][]byte{}
 	resourcesDocs := [][]byte{}
 	for _, obj := range objs {
+		if err := addLabels(obj, labels); err != nil {
+			return resources, secrets, err
+		}
 		y, err := yaml.Marshal(obj)
 		if err != nil {
 			return resources, secrets, err
@@ -363,6 +506,27 @@ func splitSecrets(yamlData []byte) (resources, secrets []byte, err error) {
 	return resources, secrets, nil
 }
 
+// addLabels adds the labels to the object, or to the items of a list.
+func addLabels(obj *unstructured.Unstructured, labels map[string]string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	if obj.IsList() {
+		return obj.EachListItem(func(item runtime.Object) error {
+			return addLabels(item.(*unstructured.Unstructured), labels)
+		})
+	}
+	l := obj.GetLabels()
+	if l == nil {
+		l = map[string]string{}
+	}
+	for k, v := range labels {
+		l[k] = v
+	}
+	obj.SetLabels(l)
+	return nil
+}
+
 // splitYAML splits a YAML file into unstructured objects. Returns list of all unstructured objects
 // found in the yaml. If an error occurs, returns objects that have been parsed so far too.
 //
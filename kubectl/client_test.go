@@ -1,9 +1,15 @@
 package kubectl
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/go-test/deep"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 func TestFilterErrOutput(t *testing.T) {
@@ -180,6 +186,18 @@ func TestApplyOptionsArgs(t *testing.T) {
 		options ApplyOptions
 		want    []string
 	}{
+		{
+			options: ApplyOptions{
+				DryRunStrategy: "none",
+				PruneWhitelist: []string{
+					"rbac.authorization.k8s.io/v1/ClusterRole",
+				},
+			},
+			want: []string{"--dry-run=none",
+				"--prune", "--all",
+				"--prune-allowlist=rbac.authorization.k8s.io/v1/ClusterRole",
+			},
+		},
 		{
 			options: ApplyOptions{
 				Namespace:      "example",
@@ -233,6 +251,20 @@ func TestApplyOptionsArgs(t *testing.T) {
 				"--prune-allowlist=rbac.authorization.k8s.io/v1beta1/RoleBinding",
 			},
 		},
+		{
+			options: ApplyOptions{
+				Namespace: "example",
+				PruneWhitelist: []string{
+					"core/v1/ConfigMap",
+				},
+				Selector: "kube-applier.io/waybill=main",
+			},
+			want: []string{"-n", "example",
+				"-l", "kube-applier.io/waybill=main",
+				"--prune",
+				"--prune-allowlist=core/v1/ConfigMap",
+			},
+		},
 		{
 			options: ApplyOptions{
 				Namespace:      "example",
@@ -471,7 +503,7 @@ type: Opaque
 	}
 
 	for _, tc := range testCases {
-		resources, secrets, err := splitSecrets(tc.yamlData)
+		resources, secrets, err := splitSecrets(tc.yamlData, nil)
 		if err != nil {
 			t.Error(err)
 			continue
@@ -486,3 +518,129 @@ type: Opaque
 		}
 	}
 }
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"configmap.yaml":     "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n",
+		"nested/secret.yml":  "apiVersion: v1\nkind: Secret\nmetadata:\n  name: b\n  namespace: ns\n",
+		"nested/config.json": `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "c"}}`,
+		"README.md":          "not a manifest",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build, _, err := NewClient("", "", "", nil).Build(context.Background(), dir, ApplyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources, err := splitYAML(build.Resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range resources {
+		names = append(names, r.GetName())
+	}
+	if diff := deep.Equal(names, []string{"a", "c"}); diff != nil {
+		t.Error(diff)
+	}
+	secrets, err := SecretNames(build.Secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(secrets, []string{"ns/b"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestBuildLabels(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"configmap.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n  labels:\n    app: a\n",
+		"list.yaml":      "apiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: b\n",
+		"secret.yaml":    "apiVersion: v1\nkind: Secret\nmetadata:\n  name: c\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	labels := map[string]string{"kube-applier.io/waybill": "main"}
+	build, _, err := NewClient("", "", "", nil).Build(context.Background(), dir, ApplyOptions{Labels: labels})
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := splitYAML(append(append(build.Resources, []byte("---\n")...), build.Secrets...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]string
+	for _, obj := range objs {
+		if obj.IsList() {
+			if err := obj.EachListItem(func(item runtime.Object) error {
+				got = append(got, item.(*unstructured.Unstructured).GetLabels())
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		got = append(got, obj.GetLabels())
+	}
+	expected := []map[string]string{
+		{"app": "a", "kube-applier.io/waybill": "main"},
+		{"kube-applier.io/waybill": "main"},
+		{"kube-applier.io/waybill": "main"},
+	}
+	if diff := deep.Equal(got, expected); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestApplyLabels(t *testing.T) {
+	dir := t.TempDir()
+	// kubectl is replaced with a script that prints its arguments and the
+	// manifests that it is passed
+	kubectlPath := filepath.Join(dir, "kubectl")
+	if err := os.WriteFile(kubectlPath, []byte("#!/bin/sh\necho \"$@\"\ncat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifests := filepath.Join(dir, "manifests")
+	if err := os.Mkdir(manifests, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(manifests, "configmap.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, out, err := NewClient("", "", kubectlPath, nil).Apply(context.Background(), manifests, ApplyOptions{
+		Labels:         map[string]string{"kube-applier.io/waybill": "main"},
+		Namespace:      "ns",
+		PruneWhitelist: []string{"core/v1/ConfigMap"},
+		Selector:       "kube-applier.io/waybill=main",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cmd, "apply -f - -n ns -l kube-applier.io/waybill=main --prune") {
+		t.Errorf("unexpected command: %s", cmd)
+	}
+	if !strings.Contains(out, "kube-applier.io/waybill: main") {
+		t.Errorf("resources were not labelled: %s", out)
+	}
+
+	_, _, err = NewClient("", "", kubectlPath, nil).Apply(context.Background(), t.TempDir(), ApplyOptions{
+		Labels: map[string]string{"kube-applier.io/waybill": "main"},
+	})
+	if err == nil {
+		t.Error("expected an error for a path without resources")
+	}
+}
@@ -10,46 +10,131 @@ import (
 	"strings"
 	"time"
 
+	"k8s.io/apimachinery/pkg/labels"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 
 	"github.com/go-logr/logr"
 	"github.com/utilitywarehouse/kube-applier/client"
 	"github.com/utilitywarehouse/kube-applier/clock"
+	"github.com/utilitywarehouse/kube-applier/cloudevents"
+	"github.com/utilitywarehouse/kube-applier/commitstatus"
 	"github.com/utilitywarehouse/kube-applier/git"
 	"github.com/utilitywarehouse/kube-applier/kubectl"
 	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/notify"
 	"github.com/utilitywarehouse/kube-applier/run"
+	"github.com/utilitywarehouse/kube-applier/shard"
+	"github.com/utilitywarehouse/kube-applier/tracing"
 	"github.com/utilitywarehouse/kube-applier/webserver"
 	"github.com/utilitywarehouse/kube-applier/webserver/oidc"
 )
 
 var (
-	fDiffURLFormat       = flag.String("diff-url-format", getStringEnv("DIFF_URL_FORMAT", ""), "Used to generate commit links in the status page")
-	fDryRun              = flag.Bool("dry-run", getBoolEnv("DRY_RUN", false), "Whether kube-applier operates in dry-run mode globally")
-	fGitPollWait         = flag.Duration("git-poll-wait", getDurationEnv("GIT_POLL_WAIT", time.Second*5), "How long kube-applier waits before checking for changes in the repository")
-	fGitKnownHostsPath   = flag.String("git-ssh-known-hosts-path", getStringEnv("GIT_KNOWN_HOSTS_PATH", ""), "Path to the known hosts file used for fetching the repository")
-	fGitSSHKeyPath       = flag.String("git-ssh-key-path", getStringEnv("GIT_SSH_KEY_PATH", ""), "Path to the SSH key file used for fetching the repository. This will also be used for any Kustomize bases fetched via ssh, unless overridden by Waybill.Spec.GitSSHSecretRef config")
-	fListenPort          = flag.Int("listen-port", getIntEnv("LISTEN_PORT", 8080), "Port that the http server is listening on")
-	fLogLevel            = flag.String("log-level", getStringEnv("LOG_LEVEL", "warn"), "Logging level: trace, debug, info, warn, error, off")
-	fOidcCallbackURL     = flag.String("oidc-callback-url", getStringEnv("OIDC_CALLBACK_URL", ""), "OIDC callback url should be the root URL where kube-applier is exposed")
-	fOidcClientID        = flag.String("oidc-client-id", getStringEnv("OIDC_CLIENT_ID", ""), "Client ID of the OIDC application")
-	fOidcClientSecret    = flag.String("oidc-client-secret", getStringEnv("OIDC_CLIENT_SECRET", ""), "Client secret of the OIDC application")
-	fOidcIssuer          = flag.String("oidc-issuer", getStringEnv("OIDC_ISSUER", ""), "OIDC issuer URL of the authentication server")
-	fPruneBlacklist      = flag.String("prune-blacklist", getStringEnv("PRUNE_BLACKLIST", ""), "Comma-separated list of resources to add to the global prune blacklist, in the <group>/<version>/<kind> format")
-	fRepoBranch          = flag.String("repo-branch", getStringEnv("REPO_BRANCH", "master"), "Branch of the git repository to use")
-	fRepoDepth           = flag.Int("repo-depth", getIntEnv("REPO_DEPTH", 1), "Depth of the git repository to fetch. Use zero to ignore")
-	fRepoDest            = flag.String("repo-dest", getStringEnv("REPO_DEST", "/src"), "Path under which the the git repository is fetched")
-	fRepoPath            = flag.String("repo-path", getStringEnv("REPO_PATH", ""), "Path relative to the repository root that kube-applier operates in")
-	fRepoRemote          = flag.String("repo-remote", getStringEnv("REPO_REMOTE", ""), "Remote URL of the git repository that kube-applier uses as a source")
-	fRepoRevision        = flag.String("repo-revision", getStringEnv("REPO_REVISION", "HEAD"), "Revision of the git repository to use")
-	fRepoSyncInterval    = flag.Duration("repo-sync-interval", getDurationEnv("REPO_SYNC_INTERVAL", time.Second*30), "How often kube-applier will try to sync the local repository clone to the remote")
-	fRepoTimeout         = flag.Duration("repo-timeout", getDurationEnv("REPO_TIMEOUT", time.Minute*3), "How long kube-applier will wait for the initial repository sync to complete")
-	fStatusTimeout       = flag.Duration("status-timeout", getDurationEnv("STATUS_TIMEOUT", time.Second*30), "Timeout for retrieving the status UI information from Kubernetes")
-	fWaybillPollInterval = flag.Duration("waybill-poll-interval", getDurationEnv("WAYBILL_POLL_INTERVAL", time.Minute), "How often kube-applier updates the Waybills it tracks from the cluster")
-	fWorkerCount         = flag.Int("worker-count", getIntEnv("WORKER_COUNT", 2), "Number of apply worker goroutines that kube-applier uses")
+	fClusterName             = flag.String("cluster-name", getStringEnv("CLUSTER_NAME", ""), "Name of the cluster that kube-applier runs in, used to distinguish between multiple kube-applier deployments")
+	fClusterWaybillNamespace = flag.String("cluster-waybill-namespace", getStringEnv("CLUSTER_WAYBILL_NAMESPACE", "kube-applier"), "Namespace of the Secrets referenced by ClusterWaybills, such as the delegate ServiceAccount token, when a namespace is not specified")
+	fCommitStatusAPIURL      = flag.String("commit-status-api-url", getStringEnv("COMMIT_STATUS_API_URL", ""), "Base URL of the API of the commit status provider, defaults to the public GitHub or GitLab API")
+	fCommitStatusProvider    = flag.String("commit-status-provider", getStringEnv("COMMIT_STATUS_PROVIDER", ""), "Git hosting provider that commit statuses are reported to: github, gitlab. Reporting is disabled if empty")
+	fCommitStatusRepository  = flag.String("commit-status-repository", getStringEnv("COMMIT_STATUS_REPOSITORY", ""), "Repository (eg. owner/repo) or project path that commit statuses are reported to")
+	fCommitStatusTokenSecret = flag.String("commit-status-token-secret", getStringEnv("COMMIT_STATUS_TOKEN_SECRET", ""), "Secret (in the <namespace>/<name> format) that contains the token used to report commit statuses under the 'token' key")
+	fDelegateTokenAudiences  = flag.String("delegate-token-audiences", getStringEnv("DELEGATE_TOKEN_AUDIENCES", ""), "Comma-separated list of audiences of the tokens requested for delegate ServiceAccounts, defaults to the audiences of the API server")
+	fDelegateTokenExpiration = flag.Duration("delegate-token-expiration", getDurationEnv("DELEGATE_TOKEN_EXPIRATION", time.Minute*15), "Expiration of the tokens requested for delegate ServiceAccounts. Tokens never expire before the run timeout of the Waybill and the minimum is 10m")
+	fDiffURLFormat           = flag.String("diff-url-format", getStringEnv("DIFF_URL_FORMAT", ""), "Used to generate commit links in the status page")
+	fDryRun                  = flag.Bool("dry-run", getBoolEnv("DRY_RUN", false), "Whether kube-applier operates in dry-run mode globally")
+	fEventsSinkURL           = flag.String("events-sink-url", getStringEnv("EVENTS_SINK_URL", ""), "URL of an HTTP sink that CloudEvents for the lifecycle of apply runs are sent to")
+	fExternalURL             = flag.String("external-url", getStringEnv("EXTERNAL_URL", ""), "URL where the kube-applier status page is exposed, used for linking to it")
+	fGitGitHubAPIURL         = flag.String("git-github-api-url", getStringEnv("GIT_GITHUB_API_URL", ""), "Base URL of the GitHub API used for requesting installation tokens of the GitHub App, defaults to the public GitHub API")
+	fGitGitHubAppID          = flag.String("git-github-app-id", getStringEnv("GIT_GITHUB_APP_ID", ""), "ID of the GitHub App used for fetching the repository over HTTPS")
+	fGitGitHubAppInstallID   = flag.String("git-github-app-installation-id", getStringEnv("GIT_GITHUB_APP_INSTALLATION_ID", ""), "ID of the installation of the GitHub App used for fetching the repository over HTTPS")
+	fGitGitHubAppKeyPath     = flag.String("git-github-app-private-key-path", getStringEnv("GIT_GITHUB_APP_PRIVATE_KEY_PATH", ""), "Path to the private key of the GitHub App used for fetching the repository over HTTPS")
+	fGitHTTPSPasswordPath    = flag.String("git-https-password-path", getStringEnv("GIT_HTTPS_PASSWORD_PATH", ""), "Path to the file that contains the password or token used for fetching the repository over HTTPS. This will also be used for Kustomize bases fetched via HTTPS from git-https-remote-base-hosts, unless overridden by Waybill.Spec.GitHTTPSSecretRef config")
+	fGitHTTPSRemoteBaseHosts = flag.String("git-https-remote-base-hosts", getStringEnv("GIT_HTTPS_REMOTE_BASE_HOSTS", ""), "Comma-separated list of hosts, optionally followed by a path prefix (eg. github.com/org), of the Kustomize bases that the default HTTPS credentials are used for. Bases on other hosts are fetched anonymously, unless the Waybill sets Waybill.Spec.GitHTTPSSecretRef")
+	fGitHTTPSUsername        = flag.String("git-https-username", getStringEnv("GIT_HTTPS_USERNAME", ""), "Username used with git-https-password-path, defaults to x-access-token")
+	fGitLFS                  = flag.Bool("git-lfs", getBoolEnv("GIT_LFS", false), "Whether Git LFS files under the path of each Waybill are downloaded, instead of applying their pointers. Requires git-lfs")
+	fGitPollWait             = flag.Duration("git-poll-wait", getDurationEnv("GIT_POLL_WAIT", time.Second*5), "How long kube-applier waits before checking for changes in the repository")
+	fGitKnownHostsPath       = flag.String("git-ssh-known-hosts-path", getStringEnv("GIT_KNOWN_HOSTS_PATH", ""), "Path to the known hosts file used for fetching the repository")
+	fGitSSHKeyPath           = flag.String("git-ssh-key-path", getStringEnv("GIT_SSH_KEY_PATH", ""), "Path to the SSH key file used for fetching the repository. This will also be used for any Kustomize bases fetched via ssh, unless overridden by Waybill.Spec.GitSSHSecretRef config")
+	fGitSubmodules           = flag.Bool("git-submodules", getBoolEnv("GIT_SUBMODULES", false), "Whether submodules under the path of each Waybill are initialised and updated recursively before applying")
+	fGitVerifyAllCommits     = flag.Bool("git-verify-all-commits", getBoolEnv("GIT_VERIFY_ALL_COMMITS", false), "Whether the signature of every commit since the last synced revision is verified, instead of only the latest one. Requires repo-depth to be zero")
+	fGitVerifyAllowedSigners = flag.String("git-verify-allowed-signers-path", getStringEnv("GIT_VERIFY_ALLOWED_SIGNERS_PATH", ""), "Path to the allowed signers file, in the format of ssh-keygen, with the SSH keys that commits must be signed with")
+	fGitVerifyGPGKeyring     = flag.String("git-verify-gpg-keyring-path", getStringEnv("GIT_VERIFY_GPG_KEYRING_PATH", ""), "Path to the file with the armored public GPG keys that commits must be signed with")
+	fLeaderElection          = flag.Bool("leader-election", getBoolEnv("LEADER_ELECTION", false), "Whether replicas elect a leader through a Lease, so that only the leader schedules and applies Waybills")
+	fLeaderElectionID        = flag.String("leader-election-id", getStringEnv("LEADER_ELECTION_ID", "kube-applier"), "Name of the Lease used for leader election")
+	fLeaderElectionNamespace = flag.String("leader-election-namespace", getStringEnv("LEADER_ELECTION_NAMESPACE", ""), "Namespace of the Lease used for leader election, defaults to the namespace that kube-applier runs in")
+	fListenPort              = flag.Int("listen-port", getIntEnv("LISTEN_PORT", 8080), "Port that the http server is listening on")
+	fLogLevel                = flag.String("log-level", getStringEnv("LOG_LEVEL", "warn"), "Logging level: trace, debug, info, warn, error, off")
+	fNotifySlackURL          = flag.String("notify-slack-webhook-url", getStringEnv("NOTIFY_SLACK_WEBHOOK_URL", ""), "Slack incoming webhook URL that is notified about changes in the outcome of apply runs for all Waybills")
+	fNotifyWebhookURL        = flag.String("notify-webhook-url", getStringEnv("NOTIFY_WEBHOOK_URL", ""), "HTTP endpoint that is notified about changes in the outcome of apply runs for all Waybills")
+	fNotifyWebhookTmpl       = flag.String("notify-webhook-template", getStringEnv("NOTIFY_WEBHOOK_TEMPLATE", ""), "Go template used to render the payload sent to the notify-webhook-url, defaults to a JSON representation of the notification")
+	fOnce                    = flag.Bool("once", getBoolEnv("ONCE", false), "Whether kube-applier syncs the repository, applies the selected Waybills once and exits, with a non-zero status if any run fails, instead of running continuously")
+	fOnceNamespaces          = flag.String("once-namespaces", getStringEnv("ONCE_NAMESPACES", ""), "Comma-separated list of namespaces whose Waybills are applied with -once, in order. Use 'cluster' for ClusterWaybills. All namespaces are selected if empty")
+	fOnceSelector            = flag.String("once-selector", getStringEnv("ONCE_SELECTOR", ""), "Label selector for the Waybills applied with -once")
+	fOidcCallbackURL         = flag.String("oidc-callback-url", getStringEnv("OIDC_CALLBACK_URL", ""), "OIDC callback url should be the root URL where kube-applier is exposed")
+	fOidcClientID            = flag.String("oidc-client-id", getStringEnv("OIDC_CLIENT_ID", ""), "Client ID of the OIDC application")
+	fOidcClientSecret        = flag.String("oidc-client-secret", getStringEnv("OIDC_CLIENT_SECRET", ""), "Client secret of the OIDC application")
+	fOidcIssuer              = flag.String("oidc-issuer", getStringEnv("OIDC_ISSUER", ""), "OIDC issuer URL of the authentication server")
+	fPruneBlacklist          = flag.String("prune-blacklist", getStringEnv("PRUNE_BLACKLIST", ""), "Comma-separated list of resources to add to the global prune blacklist, in the <group>/<version>/<kind> format")
+	fRepoBranch              = flag.String("repo-branch", getStringEnv("REPO_BRANCH", "master"), "Branch of the git repository to use")
+	fRepoDepth               = flag.Int("repo-depth", getIntEnv("REPO_DEPTH", 1), "Depth of the git repository to fetch. Use zero to ignore")
+	fRepoDest                = flag.String("repo-dest", getStringEnv("REPO_DEST", "/src"), "Path under which the the git repository is fetched")
+	fRepoPath                = flag.String("repo-path", getStringEnv("REPO_PATH", ""), "Path relative to the repository root that kube-applier operates in")
+	fRepoRemote              = flag.String("repo-remote", getStringEnv("REPO_REMOTE", ""), "Remote URL of the git repository that kube-applier uses as a source")
+	fRepoRevision            = flag.String("repo-revision", getStringEnv("REPO_REVISION", "HEAD"), "Revision of the git repository to apply: HEAD, a commit hash, a tag or a semantic version constraint for tags")
+	fRepoSyncInterval        = flag.Duration("repo-sync-interval", getDurationEnv("REPO_SYNC_INTERVAL", time.Second*30), "How often kube-applier will try to sync the local repository clone to the remote")
+	fRepoTimeout             = flag.Duration("repo-timeout", getDurationEnv("REPO_TIMEOUT", time.Minute*3), "How long kube-applier will wait for the initial repository sync to complete")
+	fScheduledRunJitter      = flag.Float64("scheduled-run-jitter", getFloat64Env("SCHEDULED_RUN_JITTER", 0), "Fraction of their run interval that the scheduled runs of overdue Waybills are spread over on startup, instead of being queued at once. Use zero to queue them at once")
+	fScheduledRunRateLimit   = flag.Int("scheduled-run-rate-limit", getIntEnv("SCHEDULED_RUN_RATE_LIMIT", 0), "Maximum number of scheduled runs queued per minute, git polling and forced runs are not limited. Use zero for no limit")
+	fShardGroup              = flag.String("shard-group", getStringEnv("SHARD_GROUP", ""), "Name of the group of replicas that Waybills are sharded between by consistent hashing. Sharding is disabled if empty")
+	fShardNamespace          = flag.String("shard-namespace", getStringEnv("SHARD_NAMESPACE", ""), "Namespace of the Leases of the shard group members, defaults to the namespace that kube-applier runs in")
+	fShardSelector           = flag.String("shard-selector", getStringEnv("SHARD_SELECTOR", ""), "Label selector that limits the Waybills applied by this replica")
+	fStatusTimeout           = flag.Duration("status-timeout", getDurationEnv("STATUS_TIMEOUT", time.Second*30), "Timeout for retrieving the status UI information from Kubernetes")
+	fTracingOTLPEndpoint     = flag.String("tracing-otlp-endpoint", getStringEnv("TRACING_OTLP_ENDPOINT", ""), "OTLP/HTTP endpoint (eg. http://otel-collector:4318) that OpenTelemetry traces are exported to. Tracing is disabled if empty")
+	fWaybillPollInterval     = flag.Duration("waybill-poll-interval", getDurationEnv("WAYBILL_POLL_INTERVAL", time.Minute), "How often kube-applier updates the Waybills it tracks from the cluster")
+	fWorkerCount             = flag.Int("worker-count", getIntEnv("WORKER_COUNT", 2), "Number of apply worker goroutines that kube-applier uses")
 )
 
+// applyOnce applies the Waybills selected by -once-namespaces and
+// -once-selector in order, prints a table with the outcome of each run and
+// returns the exit code.
+func applyOnce(runner *run.Runner, kubeClient *client.Client) int {
+	selector, err := labels.Parse(*fOnceSelector)
+	if err != nil {
+		log.Logger("kube-applier").Error("invalid once selector", "selector", *fOnceSelector, "error", err)
+		return 1
+	}
+	var namespaces []string
+	if *fOnceNamespaces != "" {
+		for _, ns := range strings.Split(*fOnceNamespaces, ",") {
+			namespaces = append(namespaces, strings.TrimSpace(ns))
+		}
+	}
+	ctx := signals.SetupSignalHandler()
+	waybills, err := kubeClient.ListWaybills(ctx)
+	if err != nil {
+		log.Logger("kube-applier").Error("could not list Waybills", "error", err)
+		return 1
+	}
+	selected := run.SelectWaybills(waybills, namespaces, selector)
+	if len(selected) == 0 {
+		log.Logger("kube-applier").Error("no Waybills selected", "namespaces", *fOnceNamespaces, "selector", *fOnceSelector)
+		return 1
+	}
+	results := runner.ApplyOnce(ctx, selected)
+	if err := run.PrintOnceResults(os.Stdout, results); err != nil {
+		log.Logger("kube-applier").Error("could not print results", "error", err)
+		return 1
+	}
+	for _, r := range results {
+		if !r.Success {
+			return 1
+		}
+	}
+	if len(results) < len(selected) {
+		return 1
+	}
+	return 0
+}
+
 func getStringEnv(name, defaultValue string) string {
 	if v, ok := os.LookupEnv(name); ok {
 		return v
@@ -81,6 +166,18 @@ func getIntEnv(name string, defaultValue int) int {
 	return defaultValue
 }
 
+func getFloat64Env(name string, defaultValue float64) float64 {
+	if v, ok := os.LookupEnv(name); ok {
+		vv, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			fmt.Printf("%s must be a number, got %v\n", name, v)
+			os.Exit(1)
+		}
+		return vv
+	}
+	return defaultValue
+}
+
 func getDurationEnv(name string, defaultValue time.Duration) time.Duration {
 	if v, ok := os.LookupEnv(name); ok {
 		vv, err := time.ParseDuration(v)
@@ -94,6 +191,12 @@ func getDurationEnv(name string, defaultValue time.Duration) time.Duration {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "render", "validate":
+			os.Exit(renderCommand(os.Args[1], os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
 	flag.Parse()
 
 	log.SetLevel(*fLogLevel)
@@ -109,12 +212,22 @@ func main() {
 		}),
 	))
 
+	// One-shot runs do not take part in leader election or sharding, so they
+	// would apply Waybills that another replica owns
+	if *fOnce && (*fLeaderElection || *fShardGroup != "" || *fShardSelector != "") {
+		log.Logger("kube-applier").Error("once cannot be used with leader-election or sharding")
+		os.Exit(1)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), *fTracingOTLPEndpoint, *fClusterName)
+	if err != nil {
+		log.Logger("kube-applier").Error("could not setup tracing", "error", err)
+		os.Exit(1)
+	}
+
 	clk := &clock.Clock{}
 
-	var (
-		oidcAuthenticator *oidc.Authenticator
-		err               error
-	)
+	var oidcAuthenticator *oidc.Authenticator
 	if strings.Join([]string{*fOidcIssuer, *fOidcClientID, *fOidcClientSecret, *fOidcCallbackURL}, "") != "" {
 		oidcAuthenticator, err = oidc.NewAuthenticator(
 			*fOidcIssuer,
@@ -129,6 +242,23 @@ func main() {
 		log.Logger("kube-applier").Info("OIDC authentication configured", "issuer", *fOidcIssuer, "clientID", *fOidcClientID)
 	}
 
+	var gitCredentials git.Credentials
+	switch {
+	case *fGitGitHubAppID != "":
+		key, err := os.ReadFile(*fGitGitHubAppKeyPath)
+		if err != nil {
+			log.Logger("kube-applier").Error("could not read GitHub App private key", "error", err)
+			os.Exit(1)
+		}
+		gitCredentials, err = git.NewGitHubAppCredentials(*fGitGitHubAPIURL, *fGitGitHubAppID, *fGitGitHubAppInstallID, key)
+		if err != nil {
+			log.Logger("kube-applier").Error("could not setup GitHub App credentials", "error", err)
+			os.Exit(1)
+		}
+	case *fGitHTTPSPasswordPath != "":
+		gitCredentials = &git.FileCredentials{Username: *fGitHTTPSUsername, PasswordPath: *fGitHTTPSPasswordPath}
+	}
+
 	repo, err := git.NewRepository(
 		*fRepoDest,
 		git.RepositoryConfig{
@@ -138,9 +268,17 @@ func main() {
 			Depth:    *fRepoDepth,
 		},
 		git.SyncOptions{
+			Credentials:          gitCredentials,
 			GitSSHKeyPath:        *fGitSSHKeyPath,
 			GitSSHKnownHostsPath: *fGitKnownHostsPath,
 			Interval:             *fRepoSyncInterval,
+			LFS:                  *fGitLFS,
+			Submodules:           *fGitSubmodules,
+			Verification: git.VerificationOptions{
+				AllCommits:         *fGitVerifyAllCommits,
+				AllowedSignersPath: *fGitVerifyAllowedSigners,
+				GPGKeyringPath:     *fGitVerifyGPGKeyring,
+			},
 		},
 	)
 	if err != nil {
@@ -154,13 +292,47 @@ func main() {
 	}
 	cancel()
 
-	kubeClient, err := client.New()
+	var clientOptions []client.Option
+	if *fLeaderElection {
+		clientOptions = append(clientOptions, client.WithLeaderElection(*fLeaderElectionNamespace, *fLeaderElectionID))
+	}
+	kubeClient, err := client.New(clientOptions...)
 	if err != nil {
 		log.Logger("kube-applier").Error("error creating kubernetes API client", "error", err)
 		os.Exit(1)
 	}
 	defer kubeClient.Shutdown()
 
+	var sharder *shard.Sharder
+	if *fShardGroup != "" || *fShardSelector != "" {
+		if *fLeaderElection {
+			log.Logger("kube-applier").Error("leader-election cannot be used with sharding")
+			os.Exit(1)
+		}
+		selector, err := labels.Parse(*fShardSelector)
+		if err != nil {
+			log.Logger("kube-applier").Error("invalid shard selector", "selector", *fShardSelector, "error", err)
+			os.Exit(1)
+		}
+		identity, err := os.Hostname()
+		if err != nil {
+			log.Logger("kube-applier").Error("could not get hostname", "error", err)
+			os.Exit(1)
+		}
+		sharder = &shard.Sharder{
+			Clock:      clk,
+			Group:      *fShardGroup,
+			Identity:   identity,
+			KubeClient: kubeClient,
+			Namespace:  *fShardNamespace,
+			Selector:   selector,
+		}
+		if err := sharder.Start(); err != nil {
+			log.Logger("kube-applier").Error("could not join shard group", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	kubeCtlClient := kubectl.NewClient("", "", "", []string{})
 
 	// Kubernetes copies annotations from StatefulSets, Deployments and
@@ -174,31 +346,103 @@ func main() {
 		pruneBlacklistSlice = append(pruneBlacklistSlice, strings.Split(*fPruneBlacklist, ",")...)
 	}
 
+	var gitCredentialsRemotes []string
+	if *fGitHTTPSRemoteBaseHosts != "" {
+		gitCredentialsRemotes = strings.Split(*fGitHTTPSRemoteBaseHosts, ",")
+	}
+
+	var delegateTokenAudiences []string
+	if *fDelegateTokenAudiences != "" {
+		delegateTokenAudiences = strings.Split(*fDelegateTokenAudiences, ",")
+	}
+
+	var notifyTargets []notify.Target
+	if *fNotifySlackURL != "" {
+		notifyTargets = append(notifyTargets, notify.Target{Type: notify.TypeSlack, URL: *fNotifySlackURL})
+	}
+	if *fNotifyWebhookURL != "" {
+		notifyTargets = append(notifyTargets, notify.Target{Type: notify.TypeWebhook, URL: *fNotifyWebhookURL, Template: *fNotifyWebhookTmpl})
+	}
+
+	var commitStatusReporter *commitstatus.Reporter
+	if *fCommitStatusProvider != "" {
+		tokenSecret := strings.SplitN(*fCommitStatusTokenSecret, "/", 2)
+		if len(tokenSecret) != 2 || tokenSecret[0] == "" || tokenSecret[1] == "" {
+			log.Logger("kube-applier").Error("commit-status-token-secret must be in the <namespace>/<name> format", "value", *fCommitStatusTokenSecret)
+			os.Exit(1)
+		}
+		token := commitstatus.SecretToken(kubeClient, tokenSecret[0], tokenSecret[1])
+		var provider commitstatus.Provider
+		switch *fCommitStatusProvider {
+		case "github":
+			provider = &commitstatus.GitHub{APIURL: *fCommitStatusAPIURL, Repository: *fCommitStatusRepository, Token: token}
+		case "gitlab":
+			provider = &commitstatus.GitLab{APIURL: *fCommitStatusAPIURL, Project: *fCommitStatusRepository, Token: token}
+		default:
+			log.Logger("kube-applier").Error("unsupported commit status provider", "provider", *fCommitStatusProvider)
+			os.Exit(1)
+		}
+		commitStatusReporter = &commitstatus.Reporter{
+			Cluster:     *fClusterName,
+			ExternalURL: *fExternalURL,
+			Provider:    provider,
+		}
+	}
+
+	eventsEmitter := &cloudevents.Emitter{
+		Cluster: *fClusterName,
+		SinkURL: *fEventsSinkURL,
+	}
+
 	runner := &run.Runner{
-		Clock:                clk,
-		DefaultGitSSHKeyPath: *fGitSSHKeyPath,
-		DryRun:               *fDryRun,
-		KubeClient:           kubeClient,
-		KubeCtlClient:        kubeCtlClient,
-		PruneBlacklist:       pruneBlacklistSlice,
-		Repository:           repo,
-		RepoPath:             *fRepoPath,
-		Strongbox:            &run.Strongboxer{},
-		WorkerCount:          *fWorkerCount,
+		Clock:                        clk,
+		ClusterWaybillNamespace:      *fClusterWaybillNamespace,
+		CommitStatus:                 commitStatusReporter,
+		DefaultGitCredentials:        gitCredentials,
+		DefaultGitCredentialsRemotes: gitCredentialsRemotes,
+		DefaultGitSSHKeyPath:         *fGitSSHKeyPath,
+		DelegateTokenAudiences:       delegateTokenAudiences,
+		DelegateTokenExpiration:      *fDelegateTokenExpiration,
+		DryRun:                       *fDryRun,
+		Events:                       eventsEmitter,
+		KubeClient:                   kubeClient,
+		KubeCtlClient:                kubeCtlClient,
+		Notifier:                     &notify.Notifier{Targets: notifyTargets},
+		PruneBlacklist:               pruneBlacklistSlice,
+		Repository:                   repo,
+		RepoPath:                     *fRepoPath,
+		Sharder:                      sharder,
+		Strongbox:                    &run.Strongboxer{},
+		WorkerCount:                  *fWorkerCount,
+	}
+
+	if *fOnce {
+		code := applyOnce(runner, kubeClient)
+		repo.StopSync()
+		kubeClient.Shutdown()
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Logger("kube-applier").Error("Cannot shutdown tracing", "error", err)
+		}
+		os.Exit(code)
 	}
 
 	runQueue := runner.Start()
 
+	// The Scheduler is only started once this replica is elected as the
+	// leader, so runs are not queued on the other replicas
 	scheduler := &run.Scheduler{
-		Clock:               clk,
-		GitPollWait:         *fGitPollWait,
-		KubeClient:          kubeClient,
-		Repository:          repo,
-		RepoPath:            *fRepoPath,
-		RunQueue:            runQueue,
-		WaybillPollInterval: *fWaybillPollInterval,
+		Clock:                 clk,
+		Events:                eventsEmitter,
+		GitPollWait:           *fGitPollWait,
+		KubeClient:            kubeClient,
+		Repository:            repo,
+		RepoPath:              *fRepoPath,
+		RunQueue:              runQueue,
+		ScheduledRunJitter:    *fScheduledRunJitter,
+		ScheduledRunRateLimit: *fScheduledRunRateLimit,
+		Sharder:               sharder,
+		WaybillPollInterval:   *fWaybillPollInterval,
 	}
-	scheduler.Start()
 
 	webserver := &webserver.WebServer{
 		Authenticator: oidcAuthenticator,
@@ -206,7 +450,10 @@ func main() {
 		DiffURLFormat: *fDiffURLFormat,
 		KubeClient:    kubeClient,
 		ListenPort:    *fListenPort,
+		RepoPath:      *fRepoPath,
+		Repository:    repo,
 		RunQueue:      runQueue,
+		Sharder:       sharder,
 		StatusTimeout: *fStatusTimeout,
 	}
 	if err := webserver.Start(); err != nil {
@@ -215,12 +462,31 @@ func main() {
 	}
 
 	ctx = signals.SetupSignalHandler()
-	<-ctx.Done()
-	log.Logger("kube-applier").Info("Interrupted, shutting down...")
+	elected := kubeClient.Elected()
+	for running := true; running; {
+		select {
+		case <-elected:
+			log.Logger("kube-applier").Info("Elected as the leader, starting scheduler")
+			scheduler.Start()
+			elected = nil
+		case err := <-kubeClient.Stopped():
+			// Exit immediately, without waiting for ongoing runs, as
+			// another replica might already be applying Waybills
+			log.Logger("kube-applier").Error("Kubernetes client stopped, exiting", "error", err)
+			os.Exit(1)
+		case <-ctx.Done():
+			log.Logger("kube-applier").Info("Interrupted, shutting down...")
+			running = false
+		}
+	}
 	if err := webserver.Shutdown(); err != nil {
 		log.Logger("kube-applier").Error("Cannot shutdown webserver", "error", err)
 	}
 	repo.StopSync()
 	scheduler.Stop()
 	runner.Stop()
+	sharder.Stop()
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Logger("kube-applier").Error("Cannot shutdown tracing", "error", err)
+	}
 }
@@ -1,24 +1,37 @@
 // Package metrics contains global structures for capturing kube-applier
 // metrics. The following metrics are implemented:
 //
+//   - kube_applier_cache_request_count{"cache", "result"}
+//   - kube_applier_commit_apply_latency_seconds{"namespace", "waybill"}
 //   - kube_applier_git_last_sync_timestamp
+//   - kube_applier_git_local_commit_timestamp_seconds
+//   - kube_applier_git_remote_commit_timestamp_seconds
+//   - kube_applier_git_signature_verification_count{"verified"}
+//   - kube_applier_git_signature_verified
 //   - kube_applier_git_sync_count{"success"}
-//   - kube_applier_kubectl_exit_code_count{"namespace", "exit_code"}
-//   - kube_applier_namespace_apply_count{"namespace"}
-//   - kube_applier_run_latency_seconds{"namespace", "success"}
-//   - kube_applier_result_summary{"namespace", "type", "name", "action"}
-//   - kube_applier_last_run_timestamp_seconds{"namespace"}
-//   - kube_applier_run_queue{"namespace", "type"}
-//   - kube_applier_run_queue_failures{"namespace", "type"}
-//   - kube_applier_waybill_spec_auto_apply{"namespace"}
-//   - kube_applier_waybill_spec_dry_run{"namespace"}
-//   - kube_applier_waybill_spec_run_interval{"namespace"}
+//   - kube_applier_kubectl_exit_code_count{"namespace", "waybill", "exit_code"}
+//   - kube_applier_leader
+//   - kube_applier_namespace_apply_count{"namespace", "waybill"}
+//   - kube_applier_run_latency_seconds{"namespace", "waybill", "success"}
+//   - kube_applier_run_phase_duration_seconds{"namespace", "waybill", "phase"}
+//   - kube_applier_result_summary{"namespace", "waybill", "type", "name", "action"}
+//   - kube_applier_last_run_timestamp_seconds{"namespace", "waybill"}
+//   - kube_applier_run_queue{"namespace", "waybill", "type"}
+//   - kube_applier_run_queue_coalesced{"namespace", "waybill", "type"}
+//   - kube_applier_run_queue_depth
+//   - kube_applier_run_queue_oldest_request_age_seconds
+//   - kube_applier_shard_members
+//   - kube_applier_waybill_blocked{"namespace", "waybill"}
+//   - kube_applier_waybill_spec_auto_apply{"namespace", "waybill"}
+//   - kube_applier_waybill_spec_dry_run{"namespace", "waybill"}
+//   - kube_applier_waybill_spec_run_interval{"namespace", "waybill"}
 package metrics
 
 import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -33,23 +46,67 @@ const (
 	metricsNamespace = "kube_applier"
 )
 
+// Phases of an apply run, used as the value of the phase label of the
+// run_phase_duration_seconds metric.
+const (
+	PhaseQueueWait           = "queue_wait"
+	PhaseDelegateClientSetup = "delegate_client_setup"
+	PhasePrunableDiscovery   = "prunable_discovery"
+	PhaseRepositoryClone     = "repository_clone"
+	PhaseStrongboxSetup      = "strongbox_setup"
+	PhaseKustomizeBuild      = "kustomize_build"
+	PhaseKubectlApply        = "kubectl_apply"
+	PhaseKubectlApplySecrets = "kubectl_apply_secrets"
+	PhaseStatusUpdate        = "status_update"
+)
+
+// Caches used by kube-applier, used as the value of the cache label of the
+// cache_request_count metric.
+const (
+	CacheDelegateClient = "delegate_client"
+	CacheDiscovery      = "discovery"
+)
+
 var (
 	// Used to parse kubectl output
 	kubectlOutputPattern = regexp.MustCompile(`([\w.\-]+)\/([\w.\-:]+) ([\w-]+).*`)
 
+	// cacheRequestCount is a Counter vector of cache lookups and whether they
+	// were served from the cache
+	cacheRequestCount *prometheus.CounterVec
+	// commitApplyLatency is a Histogram vector that keeps track of the time
+	// between a commit and its successful apply
+	commitApplyLatency *prometheus.HistogramVec
 	// gitLastSyncTimestamp is a Gauge that captures the timestamp of the last
 	// successful git sync
 	gitLastSyncTimestamp prometheus.Gauge
+	// gitLocalCommitTimestamp is a Gauge that captures the commit timestamp
+	// of the locally synced revision
+	gitLocalCommitTimestamp prometheus.Gauge
+	// gitRemoteCommitTimestamp is a Gauge that captures the commit timestamp
+	// of the revision on the remote
+	gitRemoteCommitTimestamp prometheus.Gauge
+	// gitSignatureVerificationCount is a Counter vector of commit signature
+	// verifications and whether they were successful
+	gitSignatureVerificationCount *prometheus.CounterVec
+	// gitSignatureVerified is a Gauge that captures whether the latest
+	// revision on the remote passed signature verification
+	gitSignatureVerified prometheus.Gauge
 	// gitSyncCount is a Counter vector of git sync operations
 	gitSyncCount *prometheus.CounterVec
 	// gitSyncLatency is a Histogram vector that keeps track of git repo sync durations
 	gitSyncLatency *prometheus.HistogramVec
 	// kubectlExitCodeCount is a Counter vector of run exit codes
 	kubectlExitCodeCount *prometheus.CounterVec
+	// leader is a Gauge that captures whether this replica is the leader
+	leader prometheus.Gauge
 	// namespaceApplyCount is a Counter vector of runs success status
 	namespaceApplyCount *prometheus.CounterVec
 	// runLatency is a Histogram vector that keeps track of run durations
 	runLatency *prometheus.HistogramVec
+	// runPhaseLatency is a Histogram vector that keeps track of the duration
+	// of each phase of a run
+	runPhaseLatency *prometheus.HistogramVec
 	// resultSummary is a Gauge vector that captures information about objects
 	// applied during runs
 	resultSummary *prometheus.GaugeVec
@@ -60,8 +117,20 @@ var (
 	lastRunTimestamp *prometheus.GaugeVec
 	// runQueue is a Gauge vector of active run requests
 	runQueue *prometheus.GaugeVec
-	// runQueueFailures is a Counter vector of failed queue attempts
-	runQueueFailures *prometheus.CounterVec
+	// runQueueCoalesced is a Counter vector of run requests that were
+	// coalesced with a request that was already queued
+	runQueueCoalesced *prometheus.CounterVec
+	// runQueueStats provides the depth and age of the run queue to the
+	// run_queue_depth and run_queue_oldest_request_age_seconds metrics
+	runQueueStats      RunQueueStats
+	runQueueStatsMutex sync.Mutex
+	// shardMembers is a Gauge that captures the number of replicas in the
+	// shard group
+	shardMembers prometheus.Gauge
+	// waybillBlocked is a Gauge vector that captures whether a Waybill has
+	// changes that are held back by a commit that failed signature
+	// verification
+	waybillBlocked *prometheus.GaugeVec
 	// waybillSpecAutoApply is a Gauge vector that captures a Waybill's
 	// autoApply attribute
 	waybillSpecAutoApply *prometheus.GaugeVec
@@ -74,11 +143,61 @@ var (
 )
 
 func init() {
+	cacheRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_request_count",
+		Help:      "Number of cache lookups, partitioned by cache and result (hit or miss)",
+	},
+		[]string{
+			// Name of the cache
+			"cache",
+			// Whether the lookup was a hit or a miss
+			"result",
+		},
+	)
+	commitApplyLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "commit_apply_latency_seconds",
+		Help:      "Time between the commit date of the applied revision and its successful apply",
+		Buckets:   []float64{30, 60, 120, 300, 600, 1800, 3600, 7200, 21600, 86400},
+	},
+		[]string{
+			// Namespace of the Waybill applied
+			"namespace",
+			// Name of the Waybill
+			"waybill",
+		},
+	)
 	gitLastSyncTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: metricsNamespace,
 		Name:      "git_last_sync_timestamp",
 		Help:      "Timestamp of the last successful git sync",
 	})
+	gitLocalCommitTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "git_local_commit_timestamp_seconds",
+		Help:      "Commit timestamp of the locally synced revision",
+	})
+	gitRemoteCommitTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "git_remote_commit_timestamp_seconds",
+		Help:      "Commit timestamp of the revision on the remote",
+	})
+	gitSignatureVerificationCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "git_signature_verification_count",
+		Help:      "Count of commit signature verifications of the revisions fetched from the remote",
+	},
+		[]string{
+			// Whether the signatures were verified or not
+			"verified",
+		},
+	)
+	gitSignatureVerified = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "git_signature_verified",
+		Help:      "Whether the latest revision on the remote passed signature verification",
+	})
 	gitSyncCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: metricsNamespace,
 		Name:      "git_sync_count",
@@ -108,10 +227,17 @@ func init() {
 		[]string{
 			// Namespace of the Waybill applied
 			"namespace",
+			// Name of the Waybill
+			"waybill",
 			// Exit code
 			"exit_code",
 		},
 	)
+	leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "Whether this replica is the leader and applies Waybills",
+	})
 	namespaceApplyCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: metricsNamespace,
 		Name:      "namespace_apply_count",
@@ -120,6 +246,8 @@ func init() {
 		[]string{
 			// Namespace of the Waybill applied
 			"namespace",
+			// Name of the Waybill
+			"waybill",
 			// Whether the apply was successful or not
 			"success",
 		},
@@ -133,12 +261,29 @@ func init() {
 		[]string{
 			// Namespace of the Waybill applied
 			"namespace",
+			// Name of the Waybill
+			"waybill",
 			// Whether the apply was successful or not
 			"success",
 			// Whether the apply was a dry run
 			"dryrun",
 		},
 	)
+	runPhaseLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_phase_duration_seconds",
+		Help:      "Duration of each phase of apply runs",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+	},
+		[]string{
+			// Namespace of the Waybill applied
+			"namespace",
+			// Name of the Waybill
+			"waybill",
+			// The phase of the run
+			"phase",
+		},
+	)
 	resultSummary = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: metricsNamespace,
 		Name:      "result_summary",
@@ -147,6 +292,8 @@ func init() {
 		[]string{
 			// The object namespace
 			"namespace",
+			// Name of the Waybill that applied the object
+			"waybill",
 			// The object type
 			"type",
 			// The object name
@@ -163,6 +310,8 @@ func init() {
 		[]string{
 			// Namespace of the Waybill applied
 			"namespace",
+			// Name of the Waybill
+			"waybill",
 		},
 	)
 	lastRunTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
@@ -173,6 +322,8 @@ func init() {
 		[]string{
 			// Namespace of the Waybill applied
 			"namespace",
+			// Name of the Waybill
+			"waybill",
 		},
 	)
 	runQueue = promauto.NewGaugeVec(prometheus.GaugeOpts{
@@ -183,22 +334,71 @@ func init() {
 		[]string{
 			// Namespace of the Waybill applied
 			"namespace",
+			// Name of the Waybill
+			"waybill",
 			// Type of the run requested
 			"type",
 		},
 	)
-	runQueueFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	runQueueCoalesced = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: metricsNamespace,
-		Name:      "run_queue_failures",
-		Help:      "Number of run requests queue failures",
+		Name:      "run_queue_coalesced",
+		Help:      "Number of run requests coalesced with a request that was already queued",
 	},
 		[]string{
 			// Namespace of the Waybill applied
 			"namespace",
+			// Name of the Waybill
+			"waybill",
 			// Type of the run requested
 			"type",
 		},
 	)
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_queue_depth",
+		Help:      "Number of Waybills with a pending run request",
+	}, func() float64 {
+		runQueueStatsMutex.Lock()
+		defer runQueueStatsMutex.Unlock()
+		if runQueueStats == nil {
+			return 0
+		}
+		return float64(runQueueStats.Len())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_queue_oldest_request_age_seconds",
+		Help:      "How long the oldest pending run request has been queued for",
+	}, func() float64 {
+		runQueueStatsMutex.Lock()
+		defer runQueueStatsMutex.Unlock()
+		if runQueueStats == nil {
+			return 0
+		}
+		oldest := runQueueStats.Oldest()
+		if oldest.IsZero() {
+			return 0
+		}
+		return time.Since(oldest).Seconds()
+	})
+	shardMembers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "shard_members",
+		Help:      "Number of replicas that Waybills are sharded between",
+	})
+	waybillBlocked = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "waybill_blocked",
+		Help:      "Whether the Waybill has changes that are held back by a commit that failed signature verification",
+	},
+		[]string{
+			// Namespace of the Waybill
+			"namespace",
+			// Name of the Waybill
+			"waybill",
+		},
+	)
 	waybillSpecAutoApply = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: metricsNamespace,
 		Subsystem: "waybill_spec",
@@ -208,6 +408,8 @@ func init() {
 		[]string{
 			// Namespace of the Waybill
 			"namespace",
+			// Name of the Waybill
+			"waybill",
 		},
 	)
 	waybillSpecDryRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
@@ -219,6 +421,8 @@ func init() {
 		[]string{
 			// Namespace of the Waybill
 			"namespace",
+			// Name of the Waybill
+			"waybill",
 		},
 	)
 	waybillSpecRunInterval = promauto.NewGaugeVec(prometheus.GaugeOpts{
@@ -230,18 +434,37 @@ func init() {
 		[]string{
 			// Namespace of the Waybill
 			"namespace",
+			// Name of the Waybill
+			"waybill",
 		},
 	)
 }
 
-// AddRunRequestQueueFailure increments the counter of failed queue attempts
-func AddRunRequestQueueFailure(t string, waybill *kubeapplierv1alpha1.Waybill) {
-	runQueueFailures.With(prometheus.Labels{
+// AddRunRequestCoalesced increments the counter of run requests coalesced with
+// a request that was already queued
+func AddRunRequestCoalesced(t string, waybill *kubeapplierv1alpha1.Waybill) {
+	runQueueCoalesced.With(prometheus.Labels{
 		"namespace": waybill.Namespace,
+		"waybill":   waybill.Name,
 		"type":      t,
 	}).Inc()
 }
 
+// RunQueueStats is implemented by the run queue to report its depth and the
+// time that its oldest pending request was queued.
+type RunQueueStats interface {
+	Len() int
+	Oldest() time.Time
+}
+
+// SetRunQueue sets the run queue reported by the run_queue_depth and
+// run_queue_oldest_request_age_seconds metrics
+func SetRunQueue(q RunQueueStats) {
+	runQueueStatsMutex.Lock()
+	defer runQueueStatsMutex.Unlock()
+	runQueueStats = q
+}
+
 // ReconcileFromWaybillList ensures that the last_run_success, last_run_timestamp
 // and waybill_spec metrics correctly represent the state in the cluster
 func ReconcileFromWaybillList(waybills []kubeapplierv1alpha1.Waybill) {
@@ -260,31 +483,35 @@ func ReconcileFromWaybillList(waybills []kubeapplierv1alpha1.Waybill) {
 		}
 		waybillSpecAutoApply.With(prometheus.Labels{
 			"namespace": wb.Namespace,
+			"waybill":   wb.Name,
 		}).Set(autoApply)
 		waybillSpecDryRun.With(prometheus.Labels{
 			"namespace": wb.Namespace,
+			"waybill":   wb.Name,
 		}).Set(dryRun)
 		waybillSpecRunInterval.With(prometheus.Labels{
 			"namespace": wb.Namespace,
+			"waybill":   wb.Name,
 		}).Set(float64(wb.Spec.RunInterval))
 		if wb.Status.LastRun == nil {
 			continue
 		}
-		setLastRunSuccess(wb.Namespace, wb.Status.LastRun.Success)
+		setLastRunSuccess(wb.Namespace, wb.Name, wb.Status.LastRun.Success)
 		lastRunTimestamp.With(prometheus.Labels{
 			"namespace": wb.Namespace,
+			"waybill":   wb.Name,
 		}).Set(float64(wb.Status.LastRun.Finished.Unix()))
 		// Initialise the following vectors, if they don't exist. By simply
 		// fetching an instance of a Counter from the CounterVec, it is being
 		// initialised, if it doesn't exist. This ensures that counters start
 		// with a zero value if they have not been updated before.
 		for _, b := range []string{"true", "false"} {
-			namespaceApplyCount.With(prometheus.Labels{"namespace": wb.Namespace, "success": b})
-			runLatency.With(prometheus.Labels{"namespace": wb.Namespace, "success": b, "dryrun": "true"})
-			runLatency.With(prometheus.Labels{"namespace": wb.Namespace, "success": b, "dryrun": "false"})
+			namespaceApplyCount.With(prometheus.Labels{"namespace": wb.Namespace, "waybill": wb.Name, "success": b})
+			runLatency.With(prometheus.Labels{"namespace": wb.Namespace, "waybill": wb.Name, "success": b, "dryrun": "true"})
+			runLatency.With(prometheus.Labels{"namespace": wb.Namespace, "waybill": wb.Name, "success": b, "dryrun": "false"})
 		}
-		kubectlExitCodeCount.With(prometheus.Labels{"namespace": wb.Namespace, "exit_code": "0"})
-		kubectlExitCodeCount.With(prometheus.Labels{"namespace": wb.Namespace, "exit_code": "1"})
+		kubectlExitCodeCount.With(prometheus.Labels{"namespace": wb.Namespace, "waybill": wb.Name, "exit_code": "0"})
+		kubectlExitCodeCount.With(prometheus.Labels{"namespace": wb.Namespace, "waybill": wb.Name, "exit_code": "1"})
 	}
 }
 
@@ -302,6 +529,92 @@ func RecordGitSync(success bool, start time.Time) {
 	}).Inc()
 }
 
+// RecordGitSignatureVerification records the outcome of verifying the
+// signatures of a revision fetched from the remote
+func RecordGitSignatureVerification(verified bool) {
+	if verified {
+		gitSignatureVerified.Set(1)
+	} else {
+		gitSignatureVerified.Set(0)
+	}
+	gitSignatureVerificationCount.With(prometheus.Labels{
+		"verified": strconv.FormatBool(verified),
+	}).Inc()
+}
+
+// ReconcileBlockedWaybills ensures that the waybill_blocked metric represents
+// the provided Waybills and whether they are blocked
+func ReconcileBlockedWaybills(waybills map[*kubeapplierv1alpha1.Waybill]bool) {
+	waybillBlocked.Reset()
+	for wb, blocked := range waybills {
+		var v float64
+		if blocked {
+			v = 1
+		}
+		waybillBlocked.With(prometheus.Labels{
+			"namespace": wb.Namespace,
+			"waybill":   wb.Name,
+		}).Set(v)
+	}
+}
+
+// RecordCacheRequest records a lookup in one of the caches used by
+// kube-applier and whether it was served from the cache
+func RecordCacheRequest(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequestCount.With(prometheus.Labels{
+		"cache":  cache,
+		"result": result,
+	}).Inc()
+}
+
+// RecordCommitApplyLatency observes the time between the commit date of a
+// revision and the time it was successfully applied
+func RecordCommitApplyLatency(waybill *kubeapplierv1alpha1.Waybill, committed, applied time.Time) {
+	commitApplyLatency.With(prometheus.Labels{
+		"namespace": waybill.Namespace,
+		"waybill":   waybill.Name,
+	}).Observe(applied.Sub(committed).Seconds())
+}
+
+// RecordRunPhase observes the duration of a phase of an apply run
+func RecordRunPhase(namespace, waybill, phase string, duration time.Duration) {
+	runPhaseLatency.With(prometheus.Labels{
+		"namespace": namespace,
+		"waybill":   waybill,
+		"phase":     phase,
+	}).Observe(duration.Seconds())
+}
+
+// SetLeader sets whether this replica is the leader
+func SetLeader(isLeader bool) {
+	if isLeader {
+		leader.Set(1)
+	} else {
+		leader.Set(0)
+	}
+}
+
+// SetShardMembers sets the number of replicas in the shard group
+func SetShardMembers(n int) {
+	shardMembers.Set(float64(n))
+}
+
+// SetGitLocalCommitTimestamp sets the commit timestamp of the locally synced
+// revision
+func SetGitLocalCommitTimestamp(t time.Time) {
+	gitLocalCommitTimestamp.Set(float64(t.Unix()))
+}
+
+// SetGitRemoteCommitTimestamp sets the commit timestamp of the revision on the
+// remote
+func SetGitRemoteCommitTimestamp(t time.Time) {
+	gitRemoteCommitTimestamp.Set(float64(t.Unix()))
+}
+
 // UpdateFromLastRun takes information from a Waybill's LastRun status and
 // updates all the relevant metrics
 func UpdateFromLastRun(waybill *kubeapplierv1alpha1.Waybill) {
@@ -309,23 +622,27 @@ func UpdateFromLastRun(waybill *kubeapplierv1alpha1.Waybill) {
 	dryRun := strconv.FormatBool(waybill.Spec.DryRun)
 	namespaceApplyCount.With(prometheus.Labels{
 		"namespace": waybill.Namespace,
+		"waybill":   waybill.Name,
 		"success":   success,
 	}).Inc()
 	runLatency.With(prometheus.Labels{
 		"namespace": waybill.Namespace,
+		"waybill":   waybill.Name,
 		"success":   success,
 		"dryrun":    dryRun,
 	}).Observe(waybill.Status.LastRun.Finished.Sub(waybill.Status.LastRun.Started.Time).Seconds())
 	lastRunTimestamp.With(prometheus.Labels{
 		"namespace": waybill.Namespace,
+		"waybill":   waybill.Name,
 	}).Set(float64(waybill.Status.LastRun.Finished.Unix()))
-	setLastRunSuccess(waybill.Namespace, waybill.Status.LastRun.Success)
+	setLastRunSuccess(waybill.Namespace, waybill.Name, waybill.Status.LastRun.Success)
 }
 
 // UpdateKubectlExitCodeCount increments for each exit code returned by kubectl
-func UpdateKubectlExitCodeCount(namespace string, code int) {
+func UpdateKubectlExitCodeCount(namespace, waybill string, code int) {
 	kubectlExitCodeCount.With(prometheus.Labels{
 		"namespace": namespace,
+		"waybill":   waybill,
 		"exit_code": strconv.Itoa(code),
 	}).Inc()
 }
@@ -343,6 +660,7 @@ func UpdateResultSummary(waybills []kubeapplierv1alpha1.Waybill) {
 		for _, r := range res {
 			resultSummary.With(prometheus.Labels{
 				"namespace": wb.Namespace,
+				"waybill":   wb.Name,
 				"type":      r.Type,
 				"name":      r.Name,
 				"action":    r.Action,
@@ -355,33 +673,40 @@ func UpdateResultSummary(waybills []kubeapplierv1alpha1.Waybill) {
 func UpdateRunRequest(t string, waybill *kubeapplierv1alpha1.Waybill, diff float64) {
 	runQueue.With(prometheus.Labels{
 		"namespace": waybill.Namespace,
+		"waybill":   waybill.Name,
 		"type":      t,
 	}).Add(diff)
 }
 
 // Reset deletes all metrics. This is exported for use in integration tests.
 func Reset() {
+	cacheRequestCount.Reset()
+	commitApplyLatency.Reset()
+	gitSignatureVerificationCount.Reset()
 	gitSyncCount.Reset()
 	kubectlExitCodeCount.Reset()
 	namespaceApplyCount.Reset()
 	runLatency.Reset()
+	runPhaseLatency.Reset()
 	resultSummary.Reset()
 	lastRunSuccess.Reset()
 	lastRunTimestamp.Reset()
 	runQueue.Reset()
-	runQueueFailures.Reset()
+	runQueueCoalesced.Reset()
+	waybillBlocked.Reset()
 	waybillSpecAutoApply.Reset()
 	waybillSpecDryRun.Reset()
 	waybillSpecRunInterval.Reset()
 }
 
-func setLastRunSuccess(namespace string, success bool) {
+func setLastRunSuccess(namespace, waybill string, success bool) {
 	lrs := float64(0)
 	if success {
 		lrs = 1
 	}
 	lastRunSuccess.With(prometheus.Labels{
 		"namespace": namespace,
+		"waybill":   waybill,
 	}).Set(lrs)
 }
 
@@ -3,8 +3,15 @@ package metrics
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
 	"github.com/utilitywarehouse/kube-applier/log"
 )
 
@@ -129,3 +136,101 @@ deployment.apps/deploymentName serverside-applied
 		t.Error(diff)
 	}
 }
+
+func TestRecordRunPhase(t *testing.T) {
+	Reset()
+	RecordRunPhase("foo", "main", PhaseRepositoryClone, 2*time.Second)
+	RecordRunPhase("foo", "main", PhaseRepositoryClone, 0)
+	RecordRunPhase("foo", "main", PhaseKustomizeBuild, 0)
+
+	m := &dto.Metric{}
+	if err := runPhaseLatency.WithLabelValues("foo", "main", PhaseRepositoryClone).(prometheus.Histogram).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("unexpected sample count: got %d, want 2", got)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got < 2 {
+		t.Errorf("unexpected sample sum: got %f, want >= 2", got)
+	}
+	if got := testutil.CollectAndCount(runPhaseLatency); got != 2 {
+		t.Errorf("unexpected number of series: got %d, want 2", got)
+	}
+}
+
+func TestRecordCacheRequest(t *testing.T) {
+	Reset()
+	RecordCacheRequest(CacheDiscovery, true)
+	RecordCacheRequest(CacheDiscovery, true)
+	RecordCacheRequest(CacheDiscovery, false)
+	RecordCacheRequest(CacheDelegateClient, false)
+
+	if got := testutil.ToFloat64(cacheRequestCount.WithLabelValues(CacheDiscovery, "hit")); got != 2 {
+		t.Errorf("unexpected discovery hits: got %f, want 2", got)
+	}
+	if got := testutil.ToFloat64(cacheRequestCount.WithLabelValues(CacheDiscovery, "miss")); got != 1 {
+		t.Errorf("unexpected discovery misses: got %f, want 1", got)
+	}
+	if got := testutil.CollectAndCount(cacheRequestCount); got != 3 {
+		t.Errorf("unexpected number of series: got %d, want 3", got)
+	}
+}
+
+func TestRecordCommitApplyLatency(t *testing.T) {
+	Reset()
+	wb := &kubeapplierv1alpha1.Waybill{ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"}}
+	applied := time.Date(2022, time.April, 26, 13, 36, 5, 0, time.UTC)
+	RecordCommitApplyLatency(wb, applied.Add(-90*time.Second), applied)
+
+	m := &dto.Metric{}
+	if err := commitApplyLatency.WithLabelValues("foo", "main").(prometheus.Histogram).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("unexpected sample count: got %d, want 1", got)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got != 90 {
+		t.Errorf("unexpected sample sum: got %f, want 90", got)
+	}
+}
+
+func TestSetLeader(t *testing.T) {
+	SetLeader(true)
+	if got := testutil.ToFloat64(leader); got != 1 {
+		t.Errorf("unexpected leader value: got %f, want 1", got)
+	}
+	SetLeader(false)
+	if got := testutil.ToFloat64(leader); got != 0 {
+		t.Errorf("unexpected leader value: got %f, want 0", got)
+	}
+}
+
+func TestRecordGitSignatureVerification(t *testing.T) {
+	Reset()
+	RecordGitSignatureVerification(true)
+	RecordGitSignatureVerification(false)
+
+	if got := testutil.ToFloat64(gitSignatureVerified); got != 0 {
+		t.Errorf("unexpected verified value: got %f, want 0", got)
+	}
+	if got := testutil.ToFloat64(gitSignatureVerificationCount.WithLabelValues("false")); got != 1 {
+		t.Errorf("unexpected failed verifications: got %f, want 1", got)
+	}
+}
+
+func TestReconcileBlockedWaybills(t *testing.T) {
+	Reset()
+	ReconcileBlockedWaybills(map[*kubeapplierv1alpha1.Waybill]bool{
+		{ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"}}: true,
+		{ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "bar"}}: false,
+	})
+	if got := testutil.ToFloat64(waybillBlocked.WithLabelValues("foo", "main")); got != 1 {
+		t.Errorf("unexpected blocked value: got %f, want 1", got)
+	}
+	ReconcileBlockedWaybills(map[*kubeapplierv1alpha1.Waybill]bool{
+		{ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "bar"}}: false,
+	})
+	if got := testutil.CollectAndCount(waybillBlocked); got != 1 {
+		t.Errorf("unexpected number of series: got %d, want 1", got)
+	}
+}
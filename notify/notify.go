@@ -0,0 +1,216 @@
+// Package notify implements sending notifications to Slack incoming webhooks
+// and generic HTTP endpoints when the outcome of apply runs changes.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+const (
+	// TypeSlack is the type of targets that are Slack incoming webhooks.
+	TypeSlack = "slack"
+	// TypeWebhook is the type of targets that are generic HTTP endpoints.
+	TypeWebhook = "webhook"
+
+	defaultTimeout = 10 * time.Second
+
+	defaultSlackTemplate   = `{"text": {{ json .Summary }}}`
+	defaultWebhookTemplate = `{{ json . }}`
+)
+
+var (
+	warningReg = regexp.MustCompile(`^Warning:.*`)
+
+	templateFuncs = template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+)
+
+// Reason describes the kind of change in the outcome of apply runs that
+// triggered a notification.
+type Reason string
+
+const (
+	// ReasonFailure is used when an apply run fails after a successful one,
+	// or when the first known run of a Waybill fails.
+	ReasonFailure Reason = "failure"
+	// ReasonRecovery is used when an apply run succeeds after a failed one.
+	ReasonRecovery Reason = "recovery"
+	// ReasonWarnings is used when a successful apply run produces warnings
+	// that were not present in the previous run.
+	ReasonWarnings Reason = "warnings"
+)
+
+// Event contains the information about a change in the outcome of apply runs
+// for a Waybill. It is passed to the notification templates.
+type Event struct {
+	Namespace string                                `json:"namespace"`
+	Name      string                                `json:"name"`
+	Reason    Reason                                `json:"reason"`
+	Summary   string                                `json:"summary"`
+	Run       *kubeapplierv1alpha1.WaybillStatusRun `json:"run"`
+	Warnings  []string                              `json:"warnings,omitempty"`
+}
+
+// NewEvent compares the current apply run of a Waybill to the previous one and
+// returns an Event if the outcome has changed in a way that should be notified
+// about. The second return value is false if no notification is needed.
+func NewEvent(waybill *kubeapplierv1alpha1.Waybill, previous, current *kubeapplierv1alpha1.WaybillStatusRun) (Event, bool) {
+	if current == nil {
+		return Event{}, false
+	}
+	event := Event{
+		Namespace: waybill.Namespace,
+		Name:      waybill.Name,
+		Run:       current,
+	}
+	wbId := fmt.Sprintf("%s/%s", waybill.Namespace, waybill.Name)
+	switch {
+	case !current.Success && (previous == nil || previous.Success):
+		event.Reason = ReasonFailure
+		event.Summary = fmt.Sprintf("Apply run for Waybill %s failed", wbId)
+		if current.Commit != "" {
+			event.Summary = fmt.Sprintf("%s on commit %s", event.Summary, current.Commit)
+		}
+		if current.ErrorMessage != "" {
+			event.Summary = fmt.Sprintf("%s: %s", event.Summary, current.ErrorMessage)
+		}
+	case current.Success && previous != nil && !previous.Success:
+		event.Reason = ReasonRecovery
+		event.Summary = fmt.Sprintf("Apply run for Waybill %s succeeded after previously failing", wbId)
+		if current.Commit != "" {
+			event.Summary = fmt.Sprintf("%s, on commit %s", event.Summary, current.Commit)
+		}
+	case current.Success:
+		var previousOutput string
+		if previous != nil {
+			previousOutput = previous.Output
+		}
+		event.Warnings = newWarnings(previousOutput, current.Output)
+		if len(event.Warnings) == 0 {
+			return Event{}, false
+		}
+		event.Reason = ReasonWarnings
+		event.Summary = fmt.Sprintf("Apply run for Waybill %s produced new warnings:\n%s", wbId, strings.Join(event.Warnings, "\n"))
+	default:
+		return Event{}, false
+	}
+	return event, true
+}
+
+// newWarnings returns the warning lines found in the current output that are
+// not present in the previous output.
+func newWarnings(previous, current string) []string {
+	seen := map[string]bool{}
+	for _, l := range strings.Split(previous, "\n") {
+		seen[strings.TrimSpace(l)] = true
+	}
+	var ret []string
+	for _, l := range strings.Split(current, "\n") {
+		l = strings.TrimSpace(l)
+		if warningReg.MatchString(l) && !seen[l] {
+			ret = append(ret, l)
+			seen[l] = true
+		}
+	}
+	return ret
+}
+
+// Target is a destination for notifications.
+type Target struct {
+	// Template is a text/template that is rendered with an Event to produce
+	// the payload sent to the target. If empty, a default template based on
+	// the Type is used.
+	Template string
+	// Type is one of TypeSlack or TypeWebhook.
+	Type string
+	// URL is the address that the payload is POSTed to.
+	URL string
+}
+
+func (t Target) render(event Event) ([]byte, error) {
+	text := t.Template
+	if text == "" {
+		switch t.Type {
+		case TypeSlack:
+			text = defaultSlackTemplate
+		case TypeWebhook:
+			text = defaultWebhookTemplate
+		default:
+			return nil, fmt.Errorf("unknown notification target type '%s'", t.Type)
+		}
+	}
+	tmpl, err := template.New(t.Type).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse notification template: %w", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, event); err != nil {
+		return nil, fmt.Errorf("could not execute notification template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Notifier sends notifications to the configured global Targets, as well as
+// any additional Targets provided for each Event.
+type Notifier struct {
+	HTTPClient *http.Client
+	Targets    []Target
+}
+
+// Notify sends the Event to the global Targets of the Notifier and to the
+// additional Targets provided. It attempts to deliver to all of them and
+// returns an error describing any failures.
+func (n *Notifier) Notify(ctx context.Context, event Event, targets []Target) error {
+	if n == nil {
+		return nil
+	}
+	var errs []error
+	for _, t := range append(append([]Target{}, n.Targets...), targets...) {
+		if err := n.send(ctx, t, event); err != nil {
+			errs = append(errs, fmt.Errorf("%s notification failed: %w", t.Type, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) send(ctx context.Context, target Target, event Event) error {
+	payload, err := target.render(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	httpClient := n.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultTimeout}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
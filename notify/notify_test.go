@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+var testWaybill = &kubeapplierv1alpha1.Waybill{
+	ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"},
+}
+
+func TestNewEvent(t *testing.T) {
+	success := &kubeapplierv1alpha1.WaybillStatusRun{Commit: "abc", Success: true, Output: "deployment.apps/foo unchanged\n"}
+	failure := &kubeapplierv1alpha1.WaybillStatusRun{Commit: "def", ErrorMessage: "exit status 1"}
+	warnings := &kubeapplierv1alpha1.WaybillStatusRun{
+		Commit:  "abc",
+		Success: true,
+		Output:  "deployment.apps/foo unchanged\nWarning: batch/v1beta1 CronJob is deprecated\n",
+	}
+
+	testCases := []struct {
+		name     string
+		previous *kubeapplierv1alpha1.WaybillStatusRun
+		current  *kubeapplierv1alpha1.WaybillStatusRun
+		ok       bool
+		reason   Reason
+		summary  string
+	}{
+		{"no current run", success, nil, false, "", ""},
+		{"first run succeeds", nil, success, false, "", ""},
+		{"first run fails", nil, failure, true, ReasonFailure, "Apply run for Waybill foo/main failed on commit def: exit status 1"},
+		{"success to success", success, success, false, "", ""},
+		{"success to failure", success, failure, true, ReasonFailure, "Apply run for Waybill foo/main failed on commit def: exit status 1"},
+		{"failure to failure", failure, failure, false, "", ""},
+		{"failure to success", failure, success, true, ReasonRecovery, "Apply run for Waybill foo/main succeeded after previously failing, on commit abc"},
+		{"new warnings", success, warnings, true, ReasonWarnings, "Apply run for Waybill foo/main produced new warnings:\nWarning: batch/v1beta1 CronJob is deprecated"},
+		{"same warnings", warnings, warnings, false, "", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			event, ok := NewEvent(testWaybill, tc.previous, tc.current)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.reason, event.Reason)
+			assert.Equal(t, tc.summary, event.Summary)
+		})
+	}
+}
+
+func TestNotifierNotify(t *testing.T) {
+	received := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		received[r.URL.Path] = string(body)
+	}))
+	defer server.Close()
+
+	event, ok := NewEvent(testWaybill, nil, &kubeapplierv1alpha1.WaybillStatusRun{Commit: "def", ErrorMessage: `exit "status" 1`})
+	require.True(t, ok)
+
+	n := &Notifier{
+		Targets: []Target{{Type: TypeSlack, URL: server.URL + "/slack"}},
+	}
+	err := n.Notify(context.Background(), event, []Target{
+		{Type: TypeWebhook, URL: server.URL + "/webhook"},
+		{Type: TypeWebhook, URL: server.URL + "/custom", Template: `{{ .Reason }} {{ .Namespace }}/{{ .Name }} {{ .Run.Commit }}`},
+	})
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{"text": "Apply run for Waybill foo/main failed on commit def: exit \"status\" 1"}`, received["/slack"])
+	var webhookEvent Event
+	require.NoError(t, json.Unmarshal([]byte(received["/webhook"]), &webhookEvent))
+	assert.Equal(t, event, webhookEvent)
+	assert.Equal(t, "failure foo/main def", received["/custom"])
+}
+
+func TestNotifierNotify_errors(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/fail" {
+			http.Error(w, "invalid_payload", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	event, ok := NewEvent(testWaybill, nil, &kubeapplierv1alpha1.WaybillStatusRun{})
+	require.True(t, ok)
+
+	n := &Notifier{}
+	err := n.Notify(context.Background(), event, []Target{
+		{Type: TypeWebhook, URL: server.URL + "/fail"},
+		{Type: "invalid", URL: server.URL + "/invalid"},
+		{Type: TypeWebhook, URL: server.URL + "/bad-template", Template: `{{ .Invalid`},
+		{Type: TypeSlack, URL: server.URL + "/ok"},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected response status 400: invalid_payload")
+	assert.Contains(t, err.Error(), "unknown notification target type 'invalid'")
+	assert.Contains(t, err.Error(), "could not parse notification template")
+	assert.Equal(t, 2, calls)
+
+	var nilNotifier *Notifier
+	assert.NoError(t, nilNotifier.Notify(context.Background(), event, []Target{{Type: TypeSlack, URL: server.URL}}))
+}
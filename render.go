@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/kubectl"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/run"
+)
+
+// renderOutput is the result of rendering a Waybill, as printed with
+// -output=json.
+type renderOutput struct {
+	run.RenderResult
+	Manifests string `json:"manifests,omitempty"`
+}
+
+// renderCommand implements the render and validate subcommands, which
+// reproduce the steps of an apply run offline for the Waybills in the provided
+// files. render prints the manifests that would be applied, while validate
+// only reports errors. It returns the exit code of the command.
+func renderCommand(name string, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: kube-applier %s [flags] <waybill.yaml>...\n\nFlags:\n", name)
+		fs.PrintDefaults()
+	}
+	var (
+		fClusterWaybillNamespace = fs.String("cluster-waybill-namespace", getStringEnv("CLUSTER_WAYBILL_NAMESPACE", "kube-applier"), "Namespace of the Secrets referenced by ClusterWaybills, when a namespace is not specified")
+		fGitSSHKeyPath           = fs.String("git-ssh-key-path", getStringEnv("GIT_SSH_KEY_PATH", ""), "Path to the SSH key file used for fetching kustomize bases via ssh, unless overridden by Waybill.Spec.GitSSHSecretRef config")
+		fIncludeSecrets          = fs.Bool("include-secrets", false, "Whether the rendered Secrets are printed along with the other resources, instead of only their names")
+		fLogLevel                = fs.String("log-level", getStringEnv("LOG_LEVEL", "warn"), "Logging level: trace, debug, info, warn, error, off")
+		fNamespace               = fs.String("namespace", "", "Namespace of the Waybills, if it is not set in their metadata")
+		fOutput                  = fs.String("output", "yaml", "Output format: yaml, or json for a structured result with errors")
+		fRepo                    = fs.String("repo", ".", "Path to the checkout of the git repository")
+		fRepoPath                = fs.String("repo-path", getStringEnv("REPO_PATH", ""), "Path relative to the repository root that kube-applier operates in")
+		fRevision                = fs.String("revision", "", "Revision of the repository to render, overriding the revision of the Waybills. Defaults to the HEAD of the checkout")
+		fSecrets                 = fs.String("secrets", "", "Comma-separated list of files with the Secrets referenced by the Waybills, such as strongbox keyrings and SSH keys, which are otherwise fetched from the cluster")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *fOutput != "yaml" && *fOutput != "json" {
+		fmt.Fprintf(stderr, "unsupported output format %q\n", *fOutput)
+		return 2
+	}
+	log.SetLevel(*fLogLevel)
+
+	repoDir, err := filepath.Abs(*fRepo)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid repository path: %v\n", err)
+		return 2
+	}
+	// The checkout is used as the local repository that kube-applier clones
+	// Waybills from, without being synced
+	repo, err := git.NewRepository(repoDir, git.RepositoryConfig{Remote: repoDir}, git.SyncOptions{})
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid repository: %v\n", err)
+		return 2
+	}
+	var secrets []corev1.Secret
+	for _, path := range strings.Split(*fSecrets, ",") {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(stderr, "cannot read secrets: %v\n", err)
+			return 2
+		}
+		s, err := run.ParseSecrets(data)
+		if err != nil {
+			fmt.Fprintf(stderr, "cannot parse secrets in %s: %v\n", path, err)
+			return 2
+		}
+		secrets = append(secrets, s...)
+	}
+	options := run.RenderOptions{
+		ClusterWaybillNamespace: *fClusterWaybillNamespace,
+		DefaultGitSSHKeyPath:    *fGitSSHKeyPath,
+		KubeCtlClient:           kubectl.NewClient("", "", "", nil),
+		RepoPath:                *fRepoPath,
+		Repository:              repo,
+		Revision:                *fRevision,
+		Secrets:                 secrets,
+		Strongbox:               &run.Strongboxer{},
+	}
+
+	failed := false
+	var results []renderOutput
+	for _, path := range fs.Args() {
+		var result run.RenderResult
+		data, err := os.ReadFile(path)
+		if err == nil {
+			waybill, perr := run.ParseWaybill(data)
+			if perr == nil {
+				if waybill.Namespace == "" && !waybill.IsClusterWaybill() {
+					waybill.Namespace = *fNamespace
+				}
+				result = run.Render(context.Background(), waybill, options)
+			}
+			err = perr
+		}
+		if err != nil {
+			result = run.RenderResult{Errors: []run.RenderError{{Step: "waybill", Message: fmt.Sprintf("%s: %v", path, err)}}}
+		}
+		out := renderOutput{RenderResult: result}
+		if name == "render" {
+			out.Manifests = string(result.Resources)
+			if *fIncludeSecrets && len(result.Secrets) > 0 {
+				out.Manifests = joinManifests(out.Manifests, string(result.Secrets))
+			}
+		}
+		results = append(results, out)
+		failed = failed || len(result.Errors) > 0
+	}
+
+	if *fOutput == "json" {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fmt.Fprintf(stderr, "cannot encode result: %v\n", err)
+			return 1
+		}
+	} else {
+		printRenderResults(results, stdout, stderr)
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// printRenderResults prints the rendered manifests to stdout, and a summary of
+// each Waybill, including any errors, to stderr.
+func printRenderResults(results []renderOutput, stdout, stderr io.Writer) {
+	manifests := ""
+	for _, r := range results {
+		manifests = joinManifests(manifests, r.Manifests)
+		if len(r.Errors) == 0 {
+			fmt.Fprintf(stderr, "%s: ok (path %s, commit %s)\n", r.Waybill, r.Path, r.Commit)
+			if len(r.SecretNames) > 0 {
+				fmt.Fprintf(stderr, "%s: Secrets %s\n", r.Waybill, strings.Join(r.SecretNames, ", "))
+			}
+			continue
+		}
+		for _, e := range r.Errors {
+			prefix := r.Waybill
+			if prefix == "" {
+				prefix = "error"
+			}
+			fmt.Fprintf(stderr, "%s: %s\n", prefix, e.Error())
+			if e.Output != "" {
+				fmt.Fprintf(stderr, "%s\n", strings.TrimRight(e.Output, "\n"))
+			}
+		}
+	}
+	if manifests != "" {
+		fmt.Fprint(stdout, manifests)
+	}
+}
+
+// joinManifests joins two multi-document YAMLs.
+func joinManifests(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return strings.TrimRight(a, "\n") + "\n---\n" + b
+}
@@ -0,0 +1,64 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/utilitywarehouse/kube-applier/git"
+)
+
+// gitHubAppCache holds the credentials of the GitHub Apps referenced by
+// Waybills, so that installation tokens are reused between runs until they
+// need to be refreshed. Credentials are keyed by Secret and replaced when the
+// Secret is updated.
+type gitHubAppCache struct {
+	mutex   sync.Mutex
+	entries map[string]gitHubAppCacheEntry
+}
+
+type gitHubAppCacheEntry struct {
+	resourceVersion string
+	credentials     *git.GitHubAppCredentials
+}
+
+// credentials returns the git credentials contained in the Secret.
+func (c *gitHubAppCache) credentials(secret *corev1.Secret) (git.Credentials, error) {
+	if _, ok := secret.Data["github_app_id"]; !ok {
+		password, ok := secret.Data["password"]
+		if !ok {
+			return nil, fmt.Errorf(`secret "%s/%s" must contain either 'password' or 'github_app_id'`, secret.Namespace, secret.Name)
+		}
+		return &git.StaticCredentials{
+			Username: strings.TrimSpace(string(secret.Data["username"])),
+			Password: strings.TrimSpace(string(password)),
+		}, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := fmt.Sprintf("%s/%s", secret.Namespace, secret.Name)
+	if e, ok := c.entries[key]; ok && e.resourceVersion == secret.ResourceVersion {
+		return e.credentials, nil
+	}
+	for _, k := range []string{"github_app_installation_id", "github_app_private_key"} {
+		if _, ok := secret.Data[k]; !ok {
+			return nil, fmt.Errorf(`secret "%s/%s" does not contain key '%s'`, secret.Namespace, secret.Name, k)
+		}
+	}
+	credentials, err := git.NewGitHubAppCredentials(
+		strings.TrimSpace(string(secret.Data["github_api_url"])),
+		strings.TrimSpace(string(secret.Data["github_app_id"])),
+		strings.TrimSpace(string(secret.Data["github_app_installation_id"])),
+		secret.Data["github_app_private_key"],
+	)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid GitHub App in secret "%s/%s": %w`, secret.Namespace, secret.Name, err)
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]gitHubAppCacheEntry)
+	}
+	c.entries[key] = gitHubAppCacheEntry{resourceVersion: secret.ResourceVersion, credentials: credentials}
+	return credentials, nil
+}
@@ -0,0 +1,83 @@
+package run
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/git"
+)
+
+func TestGitHubAppCache(t *testing.T) {
+	cache := &gitHubAppCache{}
+
+	// Static credentials
+	c, err := cache.credentials(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "git", Namespace: "foo"},
+		Data:       map[string][]byte{"password": []byte("t0k3n\n")},
+	})
+	require.NoError(t, err)
+	username, password, err := c.Get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "x-access-token", username)
+	assert.Equal(t, "t0k3n", password)
+
+	_, err = cache.credentials(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "git", Namespace: "foo"},
+		Data:       map[string][]byte{"username": []byte("bot")},
+	})
+	assert.Error(t, err)
+
+	// GitHub App credentials are reused until the Secret changes
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "foo", ResourceVersion: "1"},
+		Data: map[string][]byte{
+			"github_app_id":              []byte("123"),
+			"github_app_installation_id": []byte("456"),
+			"github_app_private_key":     pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		},
+	}
+	first, err := cache.credentials(secret)
+	require.NoError(t, err)
+	second, err := cache.credentials(secret)
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+	secret.ResourceVersion = "2"
+	third, err := cache.credentials(secret)
+	require.NoError(t, err)
+	assert.NotSame(t, first, third)
+
+	delete(secret.Data, "github_app_private_key")
+	secret.ResourceVersion = "3"
+	_, err = cache.credentials(secret)
+	assert.Error(t, err)
+}
+
+func TestSetupGitHTTPSDefaultCredentials(t *testing.T) {
+	waybill := &kubeapplierv1alpha1.Waybill{ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"}}
+
+	// The default credentials are not sent to remote bases, unless their
+	// hosts are allowed
+	r := &Runner{DefaultGitCredentials: &git.StaticCredentials{Password: "t0k3n"}}
+	env, err := r.setupGitHTTPS(context.Background(), waybill)
+	require.NoError(t, err)
+	assert.Empty(t, env)
+
+	r.DefaultGitCredentialsRemotes = []string{"github.com/org"}
+	env, err = r.setupGitHTTPS(context.Background(), waybill)
+	require.NoError(t, err)
+	assert.Contains(t, env, "GIT_CONFIG_KEY_1=credential.https://github.com/org.helper")
+	assert.Contains(t, env, "GIT_CONFIG_KEY_2=credential.https://github.com/org.useHttpPath")
+	assert.NotContains(t, env, "GIT_CONFIG_KEY_1=credential.helper")
+}
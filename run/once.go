@@ -0,0 +1,121 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/log"
+)
+
+// OnceResult is the outcome of applying a Waybill with ApplyOnce.
+type OnceResult struct {
+	Waybill  string
+	Commit   string
+	Duration time.Duration
+	Error    string
+	Success  bool
+}
+
+// SelectWaybills returns the Waybills in the provided namespaces, or all of
+// them if none are provided, that match the selector, in the order that they
+// should be applied in: ClusterWaybills first, since they usually provide the
+// namespaces and CRDs that Waybills depend on, followed by Waybills with a
+// higher priority, then in the order of the namespaces provided.
+func SelectWaybills(waybills []kubeapplierv1alpha1.Waybill, namespaces []string, selector labels.Selector) []*kubeapplierv1alpha1.Waybill {
+	var selected []*kubeapplierv1alpha1.Waybill
+	for i := range waybills {
+		wb := &waybills[i]
+		if len(namespaces) > 0 && !slices.Contains(namespaces, scopeOf(wb)) {
+			continue
+		}
+		if selector != nil && !selector.Matches(labels.Set(wb.Labels)) {
+			continue
+		}
+		selected = append(selected, wb)
+	}
+	rank := func(wb *kubeapplierv1alpha1.Waybill) int {
+		if i := slices.Index(namespaces, scopeOf(wb)); i >= 0 {
+			return i
+		}
+		return len(namespaces)
+	}
+	slices.SortStableFunc(selected, func(a, b *kubeapplierv1alpha1.Waybill) int {
+		if a.IsClusterWaybill() != b.IsClusterWaybill() {
+			if a.IsClusterWaybill() {
+				return -1
+			}
+			return 1
+		}
+		if a.Spec.Priority != b.Spec.Priority {
+			return b.Spec.Priority - a.Spec.Priority
+		}
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra - rb
+		}
+		return strings.Compare(waybillKey(a), waybillKey(b))
+	})
+	return selected
+}
+
+// scopeOf returns the namespace of the Waybill, or "cluster" for
+// ClusterWaybills, which is how they are selected by namespace.
+func scopeOf(waybill *kubeapplierv1alpha1.Waybill) string {
+	if waybill.IsClusterWaybill() {
+		return "cluster"
+	}
+	return waybill.Namespace
+}
+
+// ApplyOnce applies the Waybills one at a time, in the provided order, outside
+// of the run queue and returns the outcome of each run. The runs are forced
+// runs, so Waybills are applied even if autoApply is disabled, and the status
+// of the Waybills is updated as usual. A failed run does not stop the
+// remaining Waybills from being applied.
+func (r *Runner) ApplyOnce(ctx context.Context, waybills []*kubeapplierv1alpha1.Waybill) []OnceResult {
+	var results []OnceResult
+	for _, waybill := range waybills {
+		request := Request{Type: ForcedRun, Waybill: waybill.DeepCopy(), Queued: time.Now()}
+		result := OnceResult{Waybill: waybillKey(waybill)}
+		start := time.Now()
+		if err := r.processRequest(ctx, request); err != nil {
+			r.captureRequestFailure(ctx, request, err)
+			result.Error = err.Error()
+		} else if lastRun := request.Waybill.Status.LastRun; lastRun != nil {
+			result.Commit = lastRun.Commit
+			result.Error = lastRun.ErrorMessage
+			result.Success = lastRun.Success
+		}
+		result.Duration = time.Since(start)
+		log.Logger("runner").Info("Applied Waybill once", "waybill", result.Waybill, "success", result.Success)
+		results = append(results, result)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return results
+}
+
+// PrintOnceResults writes a table with the outcome of each run to w.
+func PrintOnceResults(w io.Writer, results []OnceResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "WAYBILL\tCOMMIT\tDURATION\tRESULT")
+	for _, r := range results {
+		outcome := "success"
+		if !r.Success {
+			outcome = "failure"
+			if r.Error != "" {
+				outcome = fmt.Sprintf("failure: %s", strings.ReplaceAll(r.Error, "\n", " "))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Waybill, r.Commit, r.Duration.Round(time.Millisecond), outcome)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,73 @@
+package run
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+func TestSelectWaybills(t *testing.T) {
+	waybill := func(namespace, name string, priority int, l map[string]string) kubeapplierv1alpha1.Waybill {
+		return kubeapplierv1alpha1.Waybill{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: l},
+			Spec:       kubeapplierv1alpha1.WaybillSpec{Priority: priority},
+		}
+	}
+	clusterWaybill := (&kubeapplierv1alpha1.ClusterWaybill{
+		ObjectMeta: metav1.ObjectMeta{Name: "crds"},
+	}).Waybill()
+	waybills := []kubeapplierv1alpha1.Waybill{
+		*clusterWaybill,
+		waybill("ns-a", "main", 0, nil),
+		waybill("ns-b", "main", 0, map[string]string{"bootstrap": "true"}),
+		waybill("ns-c", "main", 10, map[string]string{"bootstrap": "true"}),
+		waybill("ns-c", "extra", 0, nil),
+	}
+	keys := func(wbs []*kubeapplierv1alpha1.Waybill) []string {
+		var ret []string
+		for _, wb := range wbs {
+			ret = append(ret, waybillKey(wb))
+		}
+		return ret
+	}
+
+	testCases := []struct {
+		name       string
+		namespaces []string
+		selector   string
+		expected   []string
+	}{
+		{"all", nil, "", []string{"/crds", "ns-c/main", "ns-a/main", "ns-b/main", "ns-c/extra"}},
+		{"namespaces in order", []string{"ns-c", "ns-a"}, "", []string{"ns-c/main", "ns-c/extra", "ns-a/main"}},
+		{"cluster", []string{"ns-b", "cluster"}, "", []string{"/crds", "ns-b/main"}},
+		{"selector", nil, "bootstrap=true", []string{"ns-c/main", "ns-b/main"}},
+		{"namespaces and selector", []string{"ns-b"}, "bootstrap=true", []string{"ns-b/main"}},
+		{"none", []string{"ns-d"}, "", nil},
+	}
+	for _, tc := range testCases {
+		selector, err := labels.Parse(tc.selector)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, keys(SelectWaybills(waybills, tc.namespaces, selector)), tc.name)
+	}
+}
+
+func TestPrintOnceResults(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.NoError(t, PrintOnceResults(out, []OnceResult{
+		{Waybill: "ns-a/main", Commit: "0123456", Duration: 1500 * time.Millisecond, Success: true},
+		{Waybill: "ns-b/main", Commit: "0123456", Duration: time.Second, Error: "exit status 1\nmore"},
+		{Waybill: "ns-c/main", Duration: time.Second},
+	}))
+	assert.Equal(t, `WAYBILL    COMMIT   DURATION  RESULT
+ns-a/main  0123456  1.5s      success
+ns-b/main  0123456  1s        failure: exit status 1 more
+ns-c/main           1s        failure
+`, out.String())
+}
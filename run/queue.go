@@ -0,0 +1,268 @@
+package run
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/metrics"
+)
+
+const (
+	// queueTypePriorityWeight is the effective priority that a run type has
+	// over the type with the next lower priority. It is larger than the
+	// range of Waybill priorities, so that the run type always takes
+	// precedence for requests that were queued at the same time.
+	queueTypePriorityWeight = 100
+	// queueAgingInterval is how long a request needs to wait to gain one
+	// point of effective priority. This prevents starvation: a request
+	// overtakes newer requests of the type with the next higher priority
+	// after waiting for 10 minutes.
+	queueAgingInterval = 6 * time.Second
+)
+
+// AddResult describes what Queue.Add did with a run request.
+type AddResult int
+
+const (
+	// RequestAdded means that the request was added to the Queue.
+	RequestAdded AddResult = iota
+	// RequestCoalesced means that the request was merged into the request
+	// that was already pending for the Waybill.
+	RequestCoalesced
+	// RequestDropped means that the request was ignored, because the Queue
+	// is shut down.
+	RequestDropped
+)
+
+// Queue is a priority work queue of run requests, keyed by Waybill. A Waybill
+// is queued at most once: requests for a Waybill that is already queued are
+// coalesced with the pending request, keeping the type with the highest
+// priority. A Waybill is also never handed to more than one worker at a time,
+// requests made while it is being applied are queued again once the run is
+// done. Unlike a channel, the Queue is unbounded and never drops requests.
+//
+// Requests are handed to workers in order of their effective priority, which
+// is determined by the run type, the priority in the Waybill spec and the
+// time the request has been waiting for. Requests with the same effective
+// priority are handed out in the order they were queued.
+type Queue struct {
+	cond       *sync.Cond
+	now        func() time.Time
+	pending    map[string]*Request
+	keys       []string
+	processing map[string]bool
+	shutdown   bool
+}
+
+// QueuedRequest describes a pending run request and its position in the
+// Queue.
+type QueuedRequest struct {
+	Position  int       `json:"position"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Priority  int       `json:"priority"`
+	Queued    time.Time `json:"queued"`
+	// Running is true if the Waybill is currently being applied, in which
+	// case the request is handed out once the current run is done.
+	Running bool `json:"running"`
+}
+
+// NewQueue returns an empty Queue.
+func NewQueue() *Queue {
+	return &Queue{
+		cond:       sync.NewCond(&sync.Mutex{}),
+		now:        time.Now,
+		pending:    make(map[string]*Request),
+		processing: make(map[string]bool),
+	}
+}
+
+// effectivePriority returns the priority of the request at the given time.
+func effectivePriority(request *Request, now time.Time) int {
+	return request.Type.priority()*queueTypePriorityWeight +
+		request.Waybill.Spec.Priority +
+		int(now.Sub(request.Queued)/queueAgingInterval)
+}
+
+// before returns true if request a should be handed out before request b.
+func before(a, b *Request, now time.Time) bool {
+	pa, pb := effectivePriority(a, now), effectivePriority(b, now)
+	if pa != pb {
+		return pa > pb
+	}
+	return a.Queued.Before(b.Queued)
+}
+
+// queueKey returns the key of the Waybill in the Queue. ClusterWaybills have
+// an empty namespace, so their keys cannot clash with those of Waybills.
+func queueKey(waybill *kubeapplierv1alpha1.Waybill) string {
+	return fmt.Sprintf("%s/%s", waybill.Namespace, waybill.Name)
+}
+
+// Add adds a run request to the Queue. If a request for the same Waybill is
+// already pending, the two are coalesced: the pending request keeps its place
+// in the Queue, is updated with the Waybill of the new request and its type
+// is replaced if the new one has a higher priority. Requests are dropped once
+// the Queue is shut down.
+func (q *Queue) Add(request Request) AddResult {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	key := queueKey(request.Waybill)
+	if q.shutdown {
+		log.Logger("runner").Warn("Run queue is shut down, ignoring request", "waybill", key, "type", request.Type)
+		return RequestDropped
+	}
+	if p, ok := q.pending[key]; ok {
+		metrics.AddRunRequestCoalesced(request.Type.String(), request.Waybill)
+		if request.Type.priority() > p.Type.priority() {
+			metrics.UpdateRunRequest(p.Type.String(), p.Waybill, -1)
+			metrics.UpdateRunRequest(request.Type.String(), request.Waybill, 1)
+			p.Type = request.Type
+		}
+		p.Waybill = request.Waybill
+		return RequestCoalesced
+	}
+	q.pending[key] = &request
+	metrics.UpdateRunRequest(request.Type.String(), request.Waybill, 1)
+	// Requests for Waybills that are being applied are only made available
+	// to workers once the current run is done
+	if !q.processing[key] {
+		q.keys = append(q.keys, key)
+		q.cond.Signal()
+	}
+	return RequestAdded
+}
+
+// AddAfter adds a run request to the Queue once the delay has passed, for
+// retrying requests that cannot be processed yet.
+func (q *Queue) AddAfter(request Request, delay time.Duration) {
+	time.AfterFunc(delay, func() { q.Add(request) })
+}
+
+// Get blocks until a request is available and returns it. The request must be
+// marked as done by calling Done once it has been processed. After the Queue
+// is shut down, Get keeps returning the remaining requests and returns false
+// once there are none left.
+func (q *Queue) Get() (Request, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for len(q.keys) == 0 && !q.shutdown {
+		q.cond.Wait()
+	}
+	if len(q.keys) == 0 {
+		return Request{}, false
+	}
+	now := q.now()
+	next := 0
+	for i := 1; i < len(q.keys); i++ {
+		if before(q.pending[q.keys[i]], q.pending[q.keys[next]], now) {
+			next = i
+		}
+	}
+	key := q.keys[next]
+	q.keys = append(q.keys[:next], q.keys[next+1:]...)
+	request := q.pending[key]
+	delete(q.pending, key)
+	q.processing[key] = true
+	metrics.UpdateRunRequest(request.Type.String(), request.Waybill, -1)
+	return *request, true
+}
+
+// Done marks a request returned by Get as processed, allowing further
+// requests for its Waybill to be handed to workers.
+func (q *Queue) Done(request Request) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	key := queueKey(request.Waybill)
+	delete(q.processing, key)
+	if _, ok := q.pending[key]; ok {
+		q.keys = append(q.keys, key)
+		q.cond.Signal()
+	}
+}
+
+// Len returns the number of pending requests.
+func (q *Queue) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return len(q.pending)
+}
+
+// Pending returns the pending requests, in the order that they would be handed
+// out to workers at the time of the call.
+func (q *Queue) Pending() []QueuedRequest {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	now := q.now()
+	requests := make([]*Request, 0, len(q.pending))
+	for _, r := range q.pending {
+		requests = append(requests, r)
+	}
+	// Requests for Waybills that are being applied are handed out after
+	// the others, since they need to wait for the current run
+	sort.Slice(requests, func(i, j int) bool {
+		ri, rj := q.processing[queueKey(requests[i].Waybill)], q.processing[queueKey(requests[j].Waybill)]
+		if ri != rj {
+			return !ri
+		}
+		return before(requests[i], requests[j], now)
+	})
+	ret := make([]QueuedRequest, len(requests))
+	for i, r := range requests {
+		ret[i] = QueuedRequest{
+			Position:  i + 1,
+			Namespace: r.Waybill.Namespace,
+			Name:      r.Waybill.Name,
+			Type:      r.Type.String(),
+			Priority:  effectivePriority(r, now),
+			Queued:    r.Queued,
+			Running:   q.processing[queueKey(r.Waybill)],
+		}
+	}
+	return ret
+}
+
+// Oldest returns the time that the oldest pending request was queued, or the
+// zero time if there are no pending requests.
+func (q *Queue) Oldest() time.Time {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	var oldest time.Time
+	for _, r := range q.pending {
+		if oldest.IsZero() || r.Queued.Before(oldest) {
+			oldest = r.Queued
+		}
+	}
+	return oldest
+}
+
+// ShutDown stops the Queue from accepting new requests and unblocks the
+// callers of Get once the pending requests have been processed.
+func (q *Queue) ShutDown() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.shutdown = true
+	q.cond.Broadcast()
+}
+
+// priority returns the priority of the run type, used to decide which type to
+// keep when requests are coalesced. Forced runs are explicitly requested by
+// users and polling runs apply new commits, so they take precedence over
+// retries and scheduled runs.
+func (t Type) priority() int {
+	switch t {
+	case ForcedRun:
+		return 3
+	case PollingRun:
+		return 2
+	case FailedRun:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,153 @@
+package run
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+func testQueueWaybill(namespace, name string) *kubeapplierv1alpha1.Waybill {
+	return &kubeapplierv1alpha1.Waybill{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+	}
+}
+
+func TestQueue_coalesce(t *testing.T) {
+	q := NewQueue()
+	queued := time.Now()
+	a := testQueueWaybill("ns-a", "main")
+	aUpdated := testQueueWaybill("ns-a", "main")
+	b := testQueueWaybill("ns-b", "main")
+
+	assert.Equal(t, RequestAdded, q.Add(Request{Type: ScheduledRun, Waybill: a, Queued: queued}))
+	assert.Equal(t, RequestAdded, q.Add(Request{Type: ScheduledRun, Waybill: b, Queued: queued}))
+	assert.Equal(t, RequestCoalesced, q.Add(Request{Type: PollingRun, Waybill: aUpdated, Queued: queued.Add(time.Second)}))
+	assert.Equal(t, RequestCoalesced, q.Add(Request{Type: FailedRun, Waybill: aUpdated, Queued: queued.Add(time.Second)}))
+	// A ClusterWaybill with the same name is a different key
+	assert.Equal(t, RequestAdded, q.Add(Request{Type: ScheduledRun, Waybill: testQueueWaybill("", "main"), Queued: queued}))
+	assert.Equal(t, 3, q.Len())
+	assert.Equal(t, queued, q.Oldest())
+
+	// The coalesced request keeps its place in the queue and the time it was
+	// queued, but has the highest priority type and the latest Waybill
+	r, ok := q.Get()
+	assert.True(t, ok)
+	assert.Equal(t, Request{Type: PollingRun, Waybill: aUpdated, Queued: queued}, r)
+	q.Done(r)
+
+	r, ok = q.Get()
+	assert.True(t, ok)
+	assert.Same(t, b, r.Waybill)
+	q.Done(r)
+}
+
+func TestQueue_processing(t *testing.T) {
+	q := NewQueue()
+	a := testQueueWaybill("ns-a", "main")
+	b := testQueueWaybill("ns-b", "main")
+
+	q.Add(Request{Type: ScheduledRun, Waybill: a})
+	r, ok := q.Get()
+	assert.True(t, ok)
+	assert.Same(t, a, r.Waybill)
+
+	// A request for a Waybill that is being processed is not handed out
+	// until the run is done
+	q.Add(Request{Type: ForcedRun, Waybill: a})
+	q.Add(Request{Type: ScheduledRun, Waybill: b})
+	assert.Equal(t, 2, q.Len())
+	r2, ok := q.Get()
+	assert.True(t, ok)
+	assert.Same(t, b, r2.Waybill)
+
+	got := make(chan Request)
+	go func() {
+		r, _ := q.Get()
+		got <- r
+	}()
+	select {
+	case <-got:
+		t.Fatal("request handed out while its Waybill was being processed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.Done(r)
+	r3 := <-got
+	assert.Equal(t, ForcedRun, r3.Type)
+	assert.Same(t, a, r3.Waybill)
+}
+
+func TestQueue_shutDown(t *testing.T) {
+	q := NewQueue()
+	q.Add(Request{Type: ScheduledRun, Waybill: testQueueWaybill("ns-a", "main")})
+	q.ShutDown()
+	assert.Equal(t, RequestDropped, q.Add(Request{Type: ScheduledRun, Waybill: testQueueWaybill("ns-b", "main")}))
+
+	// Pending requests are drained after the queue is shut down
+	r, ok := q.Get()
+	assert.True(t, ok)
+	assert.Equal(t, "ns-a", r.Waybill.Namespace)
+	q.Done(r)
+	_, ok = q.Get()
+	assert.False(t, ok)
+}
+
+func TestQueue_priority(t *testing.T) {
+	now := time.Now()
+	q := NewQueue()
+	q.now = func() time.Time { return now }
+
+	scheduled := testQueueWaybill("scheduled", "main")
+	old := testQueueWaybill("old", "main")
+	important := testQueueWaybill("important", "main")
+	important.Spec.Priority = 10
+	forced := testQueueWaybill("forced", "main")
+	polling := testQueueWaybill("polling", "main")
+	failed := testQueueWaybill("failed", "main")
+
+	q.Add(Request{Type: ScheduledRun, Waybill: scheduled, Queued: now})
+	// Waited long enough to overtake a fresh retry after failure, but not a
+	// polling run
+	q.Add(Request{Type: ScheduledRun, Waybill: old, Queued: now.Add(-11 * time.Minute)})
+	q.Add(Request{Type: ScheduledRun, Waybill: important, Queued: now})
+	q.Add(Request{Type: PollingRun, Waybill: polling, Queued: now})
+	q.Add(Request{Type: ForcedRun, Waybill: forced, Queued: now})
+	q.Add(Request{Type: FailedRun, Waybill: failed, Queued: now})
+
+	expected := []*kubeapplierv1alpha1.Waybill{forced, polling, old, failed, important, scheduled}
+	pending := q.Pending()
+	if assert.Len(t, pending, len(expected)) {
+		for i, wb := range expected {
+			assert.Equal(t, i+1, pending[i].Position)
+			assert.Equal(t, wb.Namespace, pending[i].Namespace)
+		}
+	}
+	for _, wb := range expected {
+		r, ok := q.Get()
+		assert.True(t, ok)
+		assert.Same(t, wb, r.Waybill)
+		q.Done(r)
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	q := NewQueue()
+	wb := testQueueWaybill("ns-a", "main")
+	assert.True(t, Enqueue(q, ScheduledRun, wb))
+	// Coalesced requests are not queued again
+	assert.False(t, Enqueue(q, ForcedRun, wb))
+	assert.Equal(t, 1, q.Len())
+
+	paused := testQueueWaybill("ns-b", "main")
+	paused.Spec.AutoApply = ptr.To(false)
+	assert.False(t, Enqueue(q, ScheduledRun, paused))
+	assert.True(t, Enqueue(q, ForcedRun, paused))
+
+	q.ShutDown()
+	assert.False(t, Enqueue(q, ForcedRun, testQueueWaybill("ns-c", "main")))
+	assert.Equal(t, 2, q.Len())
+}
@@ -0,0 +1,251 @@
+package run
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/kubectl"
+)
+
+// The steps of an apply run that are reproduced by Render, used to identify
+// where an error happened.
+const (
+	RenderStepSecrets   = "secrets"
+	RenderStepClone     = "clone"
+	RenderStepStrongbox = "strongbox"
+	RenderStepBuild     = "build"
+)
+
+// RenderOptions configure Render.
+type RenderOptions struct {
+	// ClusterWaybillNamespace is the namespace of the Secrets referenced by
+	// ClusterWaybills, when a namespace is not specified.
+	ClusterWaybillNamespace string
+	// DefaultGitSSHKeyPath is the SSH key used for fetching remote bases,
+	// unless the Waybill references its own keys.
+	DefaultGitSSHKeyPath string
+	KubeCtlClient        *kubectl.Client
+	// RepoPath is the path relative to the repository root that kube-applier
+	// operates in.
+	RepoPath   string
+	Repository *git.Repository
+	// Revision overrides the revision of the Waybill, if not empty.
+	Revision string
+	// Secrets stand in for the Secrets in the cluster that the Waybill
+	// references.
+	Secrets   []corev1.Secret
+	Strongbox StrongboxInterface
+}
+
+// RenderError is an error encountered in one of the steps of Render.
+type RenderError struct {
+	Step    string `json:"step"`
+	Message string `json:"message"`
+	Output  string `json:"output,omitempty"`
+}
+
+// Error implements the error interface.
+func (e RenderError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Step, e.Message)
+}
+
+// RenderResult holds the manifests rendered for a Waybill. The data of the
+// Secrets is only included in Secrets, which is not serialised.
+type RenderResult struct {
+	Waybill     string        `json:"waybill"`
+	Path        string        `json:"path"`
+	Commit      string        `json:"commit,omitempty"`
+	Command     string        `json:"command,omitempty"`
+	Resources   []byte        `json:"-"`
+	Secrets     []byte        `json:"-"`
+	SecretNames []string      `json:"secrets,omitempty"`
+	Errors      []RenderError `json:"errors,omitempty"`
+}
+
+// Render reproduces the steps of an apply run for the Waybill offline, without
+// the cluster, and returns the manifests that would be applied: the Secrets it
+// references are set up from the provided ones, the repository is cloned,
+// kustomize bases are rewritten to use the SSH keys of the Waybill and the
+// manifests are built, with the Secrets split from the other resources. An
+// error in any of these steps is recorded in the result.
+func Render(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill, options RenderOptions) RenderResult {
+	result := RenderResult{
+		Waybill: waybillKey(waybill),
+		Path:    WaybillPath(options.RepoPath, waybill),
+	}
+	fail := func(step string, output string, err error) RenderResult {
+		result.Errors = append(result.Errors, RenderError{Step: step, Message: err.Error(), Output: output})
+		return result
+	}
+
+	tmpHomeDir, err := os.MkdirTemp("", fmt.Sprintf("render_%s_%s_home_", waybill.Namespace, waybill.Name))
+	if err != nil {
+		return fail(RenderStepSecrets, "", err)
+	}
+	defer os.RemoveAll(tmpHomeDir)
+	tmpRepoDir, err := os.MkdirTemp("", fmt.Sprintf("render_%s_%s_repo_", waybill.Namespace, waybill.Name))
+	if err != nil {
+		return fail(RenderStepClone, "", err)
+	}
+	defer os.RemoveAll(tmpRepoDir)
+
+	secretNamespace := waybill.Namespace
+	if waybill.IsClusterWaybill() {
+		secretNamespace = options.ClusterWaybillNamespace
+	}
+	gitSSHCommand, err := renderGitSSH(waybill, options, secretNamespace, tmpHomeDir)
+	if err != nil {
+		return fail(RenderStepSecrets, "", err)
+	}
+	if ref := waybill.Spec.StrongboxKeyringSecretRef; ref != nil {
+		secret, err := renderSecret(options.Secrets, secretNamespace, ref.Namespace, ref.Name)
+		if err == nil {
+			err = writeStrongboxKeyring(secret, tmpHomeDir)
+		}
+		if err != nil {
+			return fail(RenderStepSecrets, "", err)
+		}
+	}
+	environment := []string{
+		gitSSHCommand,
+		fmt.Sprintf("HOME=%s", tmpHomeDir),
+		fmt.Sprintf("STRONGBOX_HOME=%s", tmpHomeDir),
+	}
+
+	revision := options.Revision
+	if revision == "" {
+		revision = waybillRevision(waybill)
+	}
+	hash, err := options.Repository.CloneLocal(ctx, []string{fmt.Sprintf("STRONGBOX_HOME=%s", tmpHomeDir)}, tmpRepoDir, result.Path, revision)
+	if err != nil {
+		return fail(RenderStepClone, "", err)
+	}
+	result.Commit = hash
+	if waybill.Spec.GitSSHSecretRef != nil {
+		if err := updateRepoBaseAddresses(tmpRepoDir); err != nil {
+			return fail(RenderStepClone, "", err)
+		}
+	}
+
+	if err := options.Strongbox.SetupGitConfigForStrongbox(ctx, waybill, environment); err != nil {
+		return fail(RenderStepStrongbox, "", err)
+	}
+
+	build, output, err := options.KubeCtlClient.Build(ctx, WaybillPath(filepath.Join(tmpRepoDir, options.RepoPath), waybill), kubectl.ApplyOptions{
+		Environment: environment,
+		Namespace:   waybill.Namespace,
+		Waybill:     waybill.Name,
+	})
+	result.Command = build.Command
+	if err != nil {
+		return fail(RenderStepBuild, output, err)
+	}
+	names, err := kubectl.SecretNames(build.Secrets)
+	if err != nil {
+		return fail(RenderStepBuild, "", err)
+	}
+	result.Resources = build.Resources
+	result.Secrets = build.Secrets
+	result.SecretNames = names
+	return result
+}
+
+// renderGitSSH sets up the SSH keys of the Waybill for fetching remote bases,
+// like setupGitSSH, from the provided Secrets.
+func renderGitSSH(waybill *kubeapplierv1alpha1.Waybill, options RenderOptions, secretNamespace, tmpHomeDir string) (string, error) {
+	sshDir := filepath.Join(tmpHomeDir, ".ssh")
+	if err := os.Mkdir(sshDir, 0700); err != nil {
+		return "", err
+	}
+	ref := waybill.Spec.GitSSHSecretRef
+	if ref == nil {
+		return defaultGitSSHCommand(options.DefaultGitSSHKeyPath), nil
+	}
+	secret, err := renderSecret(options.Secrets, secretNamespace, ref.Namespace, ref.Name)
+	if err != nil {
+		return "", err
+	}
+	return writeGitSSHConfig(secret, sshDir)
+}
+
+// renderSecret returns the provided Secret that a reference of a Waybill
+// resolves to, checking that the Waybill is allowed to use it.
+func renderSecret(secrets []corev1.Secret, secretNamespace, namespace, name string) (*corev1.Secret, error) {
+	if namespace == "" {
+		namespace = secretNamespace
+	}
+	for i := range secrets {
+		if secrets[i].Namespace == namespace && secrets[i].Name == name {
+			if err := checkSecretIsAllowed(secretNamespace, &secrets[i]); err != nil {
+				return nil, err
+			}
+			return &secrets[i], nil
+		}
+	}
+	return nil, fmt.Errorf(`secret "%s/%s" referenced by the Waybill was not provided`, namespace, name)
+}
+
+// ParseWaybill decodes a Waybill or a ClusterWaybill from YAML or JSON.
+// ClusterWaybills are converted to Waybills, like they are when applied.
+func ParseWaybill(data []byte) (*kubeapplierv1alpha1.Waybill, error) {
+	typeMeta := metav1.TypeMeta{}
+	if err := yaml.Unmarshal(data, &typeMeta); err != nil {
+		return nil, err
+	}
+	switch typeMeta.Kind {
+	case "Waybill":
+		waybill := &kubeapplierv1alpha1.Waybill{}
+		if err := yaml.UnmarshalStrict(data, waybill); err != nil {
+			return nil, err
+		}
+		return waybill, nil
+	case "ClusterWaybill":
+		clusterWaybill := &kubeapplierv1alpha1.ClusterWaybill{}
+		if err := yaml.UnmarshalStrict(data, clusterWaybill); err != nil {
+			return nil, err
+		}
+		return clusterWaybill.Waybill(), nil
+	default:
+		return nil, fmt.Errorf("expected a Waybill or a ClusterWaybill, got kind %q", typeMeta.Kind)
+	}
+}
+
+// ParseSecrets decodes the Secrets in a multi-document YAML or JSON, ignoring
+// any other resources.
+func ParseSecrets(data []byte) ([]corev1.Secret, error) {
+	var secrets []corev1.Secret
+	d := kubeyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for {
+		secret := corev1.Secret{}
+		if err := d.Decode(&secret); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if secret.Kind != "Secret" {
+			continue
+		}
+		// stringData is only converted to data by the apiserver
+		for k, v := range secret.StringData {
+			if secret.Data == nil {
+				secret.Data = map[string][]byte{}
+			}
+			secret.Data[k] = []byte(v)
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
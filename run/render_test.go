@@ -0,0 +1,157 @@
+package run
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/kubectl"
+)
+
+func TestParseWaybill(t *testing.T) {
+	waybill, err := ParseWaybill([]byte(`apiVersion: kube-applier.io/v1alpha1
+kind: Waybill
+metadata:
+  name: main
+  namespace: ns-a
+spec:
+  repositoryPath: apps/ns-a
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "ns-a", waybill.Namespace)
+	assert.Equal(t, "apps/ns-a", waybill.Spec.RepositoryPath)
+
+	waybill, err = ParseWaybill([]byte(`apiVersion: kube-applier.io/v1alpha1
+kind: ClusterWaybill
+metadata:
+  name: cluster
+spec:
+  repositoryPath: cluster
+`))
+	require.NoError(t, err)
+	assert.True(t, waybill.IsClusterWaybill())
+	assert.Equal(t, "cluster", waybill.Spec.RepositoryPath)
+
+	_, err = ParseWaybill([]byte(`apiVersion: v1
+kind: ConfigMap
+`))
+	assert.Error(t, err)
+	// Typos in the spec are reported, instead of being ignored
+	_, err = ParseWaybill([]byte(`apiVersion: kube-applier.io/v1alpha1
+kind: Waybill
+spec:
+  repositoryPth: apps/ns-a
+`))
+	assert.Error(t, err)
+}
+
+func TestParseSecrets(t *testing.T) {
+	secrets, err := ParseSecrets([]byte(`apiVersion: v1
+kind: Secret
+metadata:
+  name: keyring
+  namespace: ns-a
+stringData:
+  .strongbox_keyring: keys
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: ssh
+  namespace: ns-a
+data:
+  key_a: a2V5
+`))
+	require.NoError(t, err)
+	require.Len(t, secrets, 2)
+	assert.Equal(t, "keys", string(secrets[0].Data[".strongbox_keyring"]))
+	assert.Equal(t, "key", string(secrets[1].Data["key_a"]))
+}
+
+func TestRender(t *testing.T) {
+	ctx := context.Background()
+	repoPath := t.TempDir()
+	runGit(t, repoPath, "init")
+	runGit(t, repoPath, "config", "user.name", "kube-applier-tests")
+	runGit(t, repoPath, "config", "user.email", "kube-applier-tests@example.invalid")
+	require.NoError(t, os.MkdirAll(filepath.Join(repoPath, "root", "ns-a"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "root", "ns-a", "configmap.yaml"), []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "root", "ns-a", "secret.yaml"), []byte(`apiVersion: v1
+kind: Secret
+metadata:
+  name: secret
+stringData:
+  password: hunter2
+`), 0o644))
+	runGit(t, repoPath, "add", ".")
+	runGit(t, repoPath, "commit", "-m", "initial")
+	head := runGit(t, repoPath, "rev-parse", "--short", "HEAD")
+	repo, err := git.NewRepository(repoPath, git.RepositoryConfig{Remote: repoPath}, git.SyncOptions{})
+	require.NoError(t, err)
+
+	options := RenderOptions{
+		KubeCtlClient: kubectl.NewClient("", "", "", nil),
+		RepoPath:      "root",
+		Repository:    repo,
+		Secrets: []corev1.Secret{{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "ssh",
+				Namespace:   "shared",
+				Annotations: map[string]string{secretAllowedNamespacesAnnotation: "ns-a"},
+			},
+			Data: map[string][]byte{"key_a": []byte("key")},
+		}},
+		Strongbox: &Strongboxer{},
+	}
+	waybill := &kubeapplierv1alpha1.Waybill{
+		ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "ns-a"},
+		Spec: kubeapplierv1alpha1.WaybillSpec{
+			GitSSHSecretRef: &kubeapplierv1alpha1.ObjectReference{Name: "ssh", Namespace: "shared"},
+		},
+	}
+	result := Render(ctx, waybill, options)
+	require.Empty(t, result.Errors)
+	assert.Equal(t, "ns-a/main", result.Waybill)
+	assert.Equal(t, filepath.Join("root", "ns-a"), result.Path)
+	assert.Equal(t, head, result.Commit)
+	assert.Contains(t, string(result.Resources), "name: config")
+	assert.NotContains(t, string(result.Resources), "hunter2")
+	assert.Contains(t, string(result.Secrets), "hunter2")
+	assert.Equal(t, []string{"secret"}, result.SecretNames)
+
+	// Secrets that are not provided, or that the Waybill is not allowed to
+	// use, are reported
+	waybill.Namespace = "ns-b"
+	waybill.Spec.RepositoryPath = "ns-a"
+	result = Render(ctx, waybill, options)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, RenderStepSecrets, result.Errors[0].Step)
+	waybill.Spec.GitSSHSecretRef.Name = "missing"
+	result = Render(ctx, waybill, options)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, RenderStepSecrets, result.Errors[0].Step)
+
+	// The path of the Waybill does not exist
+	waybill.Spec.GitSSHSecretRef = nil
+	waybill.Spec.RepositoryPath = "ns-b"
+	result = Render(ctx, waybill, options)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, RenderStepClone, result.Errors[0].Step)
+}
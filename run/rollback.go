@@ -0,0 +1,71 @@
+package run
+
+import (
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+// maxRunHistory is the number of apply runs that are recorded in the history
+// of a Waybill.
+const maxRunHistory = 10
+
+// appendRunHistory returns the history with a summary of the run appended to
+// it, keeping only the most recent maxRunHistory runs.
+func appendRunHistory(history []kubeapplierv1alpha1.WaybillStatusRunSummary, run *kubeapplierv1alpha1.WaybillStatusRun, dryRun bool) []kubeapplierv1alpha1.WaybillStatusRunSummary {
+	if run == nil {
+		return history
+	}
+	history = append(history, kubeapplierv1alpha1.WaybillStatusRunSummary{
+		Commit:   run.Commit,
+		DryRun:   dryRun,
+		Finished: run.Finished,
+		Success:  run.Success,
+		Type:     run.Type,
+	})
+	if len(history) > maxRunHistory {
+		history = history[len(history)-maxRunHistory:]
+	}
+	return history
+}
+
+// waybillRevision returns the revision that is applied for the Waybill: the
+// commit that it is pinned to by a rollback, if any, or its spec.revision.
+func waybillRevision(waybill *kubeapplierv1alpha1.Waybill) string {
+	if commit := waybill.Annotations[kubeapplierv1alpha1.RollbackCommitAnnotation]; commit != "" {
+		return commit
+	}
+	return waybill.Spec.Revision
+}
+
+// rollbackStatus returns the rollback that the Waybill is pinned to, or nil if
+// it is not pinned.
+func rollbackStatus(waybill *kubeapplierv1alpha1.Waybill) *kubeapplierv1alpha1.WaybillStatusRollback {
+	commit := waybill.Annotations[kubeapplierv1alpha1.RollbackCommitAnnotation]
+	if commit == "" {
+		return nil
+	}
+	return &kubeapplierv1alpha1.WaybillStatusRollback{
+		Commit: commit,
+		From:   waybill.Annotations[kubeapplierv1alpha1.RollbackFromAnnotation],
+	}
+}
+
+// RollbackCommit returns the commit of the most recent successful run in the
+// history of the Waybill that the Waybill can be rolled back to. The commit of
+// the last run and the commit that the Waybill was last rolled back from are
+// skipped, as well as dry runs, since nothing was applied.
+func RollbackCommit(waybill *kubeapplierv1alpha1.Waybill) (string, bool) {
+	skip := map[string]bool{"": true}
+	if waybill.Status.LastRun != nil {
+		skip[waybill.Status.LastRun.Commit] = true
+	}
+	if from := waybill.Annotations[kubeapplierv1alpha1.RollbackFromAnnotation]; from != "" {
+		skip[from] = true
+	}
+	for i := len(waybill.Status.History) - 1; i >= 0; i-- {
+		h := waybill.Status.History[i]
+		if h.Success && !h.DryRun && !skip[h.Commit] {
+			return h.Commit, true
+		}
+	}
+	return "", false
+}
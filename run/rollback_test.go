@@ -0,0 +1,88 @@
+package run
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+func TestAppendRunHistory(t *testing.T) {
+	var history []kubeapplierv1alpha1.WaybillStatusRunSummary
+	assert.Nil(t, appendRunHistory(history, nil, false))
+	for i := 0; i < maxRunHistory+2; i++ {
+		history = appendRunHistory(history, &kubeapplierv1alpha1.WaybillStatusRun{
+			Commit:   fmt.Sprintf("%07d", i),
+			Finished: metav1.Now(),
+			Success:  i%2 == 0,
+			Type:     ScheduledRun.String(),
+		}, i == 1)
+	}
+	assert.Len(t, history, maxRunHistory)
+	assert.Equal(t, "0000002", history[0].Commit)
+	assert.Equal(t, fmt.Sprintf("%07d", maxRunHistory+1), history[maxRunHistory-1].Commit)
+	assert.True(t, history[0].Success)
+	assert.False(t, history[1].Success)
+}
+
+func TestRollbackCommit(t *testing.T) {
+	history := []kubeapplierv1alpha1.WaybillStatusRunSummary{
+		{Commit: "0000001", Success: true},
+		{Commit: "0000002", Success: true},
+		{Commit: "0000003", Success: true, DryRun: true},
+		{Commit: "0000004", Success: false},
+		{Commit: "", Success: true},
+		{Commit: "0000005", Success: true},
+	}
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		lastCommit  string
+		history     []kubeapplierv1alpha1.WaybillStatusRunSummary
+		commit      string
+		ok          bool
+	}{
+		{"no history", nil, "0000005", nil, "", false},
+		{"skips the last commit, failed runs and dry runs", nil, "0000005", history, "0000002", true},
+		{"last run failed", nil, "0000004", history, "0000005", true},
+		{
+			"skips the commit rolled back from",
+			map[string]string{kubeapplierv1alpha1.RollbackFromAnnotation: "0000005"},
+			"0000002",
+			history,
+			"0000001",
+			true,
+		},
+	}
+	for _, tc := range testCases {
+		wb := &kubeapplierv1alpha1.Waybill{
+			ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations},
+			Status: kubeapplierv1alpha1.WaybillStatus{
+				History: tc.history,
+				LastRun: &kubeapplierv1alpha1.WaybillStatusRun{Commit: tc.lastCommit},
+			},
+		}
+		commit, ok := RollbackCommit(wb)
+		assert.Equal(t, tc.ok, ok, tc.name)
+		assert.Equal(t, tc.commit, commit, tc.name)
+	}
+}
+
+func TestWaybillRevision(t *testing.T) {
+	wb := &kubeapplierv1alpha1.Waybill{Spec: kubeapplierv1alpha1.WaybillSpec{Revision: "v1.0.0"}}
+	assert.Equal(t, "v1.0.0", waybillRevision(wb))
+	assert.Nil(t, rollbackStatus(wb))
+
+	wb.Annotations = map[string]string{
+		kubeapplierv1alpha1.RollbackCommitAnnotation: "0123456789abcdef0123456789abcdef01234567",
+		kubeapplierv1alpha1.RollbackFromAnnotation:   "fedcba9",
+	}
+	assert.Equal(t, "0123456789abcdef0123456789abcdef01234567", waybillRevision(wb))
+	assert.Equal(t, &kubeapplierv1alpha1.WaybillStatusRollback{
+		Commit: "0123456789abcdef0123456789abcdef01234567",
+		From:   "fedcba9",
+	}, rollbackStatus(wb))
+}
@@ -18,6 +18,8 @@ import (
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/utils/ptr"
@@ -25,17 +27,29 @@ import (
 	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
 	"github.com/utilitywarehouse/kube-applier/client"
 	"github.com/utilitywarehouse/kube-applier/clock"
+	"github.com/utilitywarehouse/kube-applier/cloudevents"
+	"github.com/utilitywarehouse/kube-applier/commitstatus"
 	"github.com/utilitywarehouse/kube-applier/git"
 	"github.com/utilitywarehouse/kube-applier/kubectl"
 	"github.com/utilitywarehouse/kube-applier/kustomizeutil"
 	"github.com/utilitywarehouse/kube-applier/log"
 	"github.com/utilitywarehouse/kube-applier/metrics"
+	"github.com/utilitywarehouse/kube-applier/notify"
+	"github.com/utilitywarehouse/kube-applier/shard"
+	"github.com/utilitywarehouse/kube-applier/tracing"
 )
 
 const (
 	defaultRunnerWorkerCount = 2
-	defaultWorkerQueueSize   = 512
-	enqueueTimeout           = 5 * time.Second
+	// defaultReportConcurrency is the number of reports about finished runs
+	// that are sent at the same time.
+	defaultReportConcurrency = 4
+	notifyTimeout            = 30 * time.Second
+	commitStatusTimeout      = 30 * time.Second
+
+	// minDelegateTokenExpiration is the minimum expiration accepted by the
+	// TokenRequest API.
+	minDelegateTokenExpiration = 10 * time.Minute
 
 	hostFragment = `Host %s_github_com
     HostName github.com
@@ -54,30 +68,39 @@ const (
 )
 
 var (
+	// claimRetryInterval is how long a run request waits before it is
+	// queued again, when its Waybill is claimed by another replica of the
+	// shard group. Claims are released as soon as the run of the other
+	// replica finishes, or expire with the Lease of its Waybill.
+	claimRetryInterval = 10 * time.Second
+
 	reKeyName     = regexp.MustCompile(`#\skube-applier:\skey_(\w+)`)
 	reRepoAddress = regexp.MustCompile(`(?P<prefix>^\s*-\s*(?:ssh:\/\/))(?P<user>\w.+?@)?(?P<domain>github\.com)(?P<repoDetails>[\/:].*$)`)
 )
 
-// Checks whether the provided Secret can be used by the Waybill and returns an
-// error if it is not allowed.
-func checkSecretIsAllowed(waybill *kubeapplierv1alpha1.Waybill, secret *corev1.Secret) error {
-	if secret.Namespace == waybill.Namespace {
+// Checks whether the provided Secret can be used by a Waybill in the provided
+// namespace and returns an error if it is not allowed. For ClusterWaybills,
+// the namespace is the one configured for ClusterWaybills.
+func checkSecretIsAllowed(namespace string, secret *corev1.Secret) error {
+	if secret.Namespace == namespace {
 		return nil
 	}
 	allowedNamespaces := strings.Split(secret.Annotations[secretAllowedNamespacesAnnotation], ",")
 	for _, v := range allowedNamespaces {
-		if match, _ := path.Match(strings.TrimSpace(v), waybill.Namespace); match {
+		if match, _ := path.Match(strings.TrimSpace(v), namespace); match {
 			return nil
 		}
 	}
 
-	return fmt.Errorf(`secret "%s/%s" cannot be used in namespace "%s", the namespace must be listed in the '%s' annotation`, secret.Namespace, secret.Name, waybill.Namespace, secretAllowedNamespacesAnnotation)
+	return fmt.Errorf(`secret "%s/%s" cannot be used in namespace "%s", the namespace must be listed in the '%s' annotation`, secret.Namespace, secret.Name, namespace, secretAllowedNamespacesAnnotation)
 }
 
 // Request defines an apply run request
 type Request struct {
 	Type    Type
 	Waybill *kubeapplierv1alpha1.Waybill
+	// Queued is the time the request was added to the queue.
+	Queued time.Time
 }
 
 // ApplyOptions contains global configuration for Apply
@@ -85,6 +108,12 @@ type ApplyOptions struct {
 	ClusterResources     []string
 	NamespacedResources  []string
 	EnvironmentVariables []string
+	// Labels are added to the resources that are applied, so that they
+	// match the Selector.
+	Labels map[string]string
+	// Selector limits the resources that are pruned, when the namespace is
+	// shared with other Waybills.
+	Selector string
 }
 
 func (o *ApplyOptions) pruneWhitelist(waybill *kubeapplierv1alpha1.Waybill, pruneBlacklist []string) []string {
@@ -128,22 +157,40 @@ func uniqueStrings(in []string) []string {
 // Runner manages the full process of an apply run, including getting the
 // appropriate files, running apply commands on them, and handling the results.
 type Runner struct {
-	Clock                clock.ClockInterface
-	DefaultGitSSHKeyPath string
-	DryRun               bool
-	KubeClient           *client.Client
-	KubeCtlClient        *kubectl.Client
-	PruneBlacklist       []string
-	RepoPath             string
-	Repository           *git.Repository
-	Strongbox            StrongboxInterface
-	WorkerCount          int
-	workerGroup          *sync.WaitGroup
-	workerQueue          chan Request
-}
-
-// Start runs a continuous loop that starts a new run when a request comes into the queue channel.
-func (r *Runner) Start() chan<- Request {
+	Clock                   clock.ClockInterface
+	ClusterWaybillNamespace string
+	CommitStatus            *commitstatus.Reporter
+	// DefaultGitCredentials are used for cloning remote bases over HTTPS
+	// from DefaultGitCredentialsRemotes, for Waybills that do not reference
+	// credentials of their own.
+	DefaultGitCredentials git.Credentials
+	// DefaultGitCredentialsRemotes are the hosts, optionally followed by a
+	// path prefix, that DefaultGitCredentials are sent to. Remote bases are
+	// fetched anonymously from any other host.
+	DefaultGitCredentialsRemotes []string
+	DefaultGitSSHKeyPath         string
+	DelegateTokenAudiences       []string
+	DelegateTokenExpiration      time.Duration
+	DryRun                       bool
+	Events                       *cloudevents.Emitter
+	KubeClient                   *client.Client
+	KubeCtlClient                *kubectl.Client
+	Notifier                     *notify.Notifier
+	PruneBlacklist               []string
+	RepoPath                     string
+	Repository                   *git.Repository
+	Sharder                      *shard.Sharder
+	Strongbox                    StrongboxInterface
+	WorkerCount                  int
+	gitHubApps                   gitHubAppCache
+	reportGroup                  *sync.WaitGroup
+	reportSlots                  chan struct{}
+	workerGroup                  *sync.WaitGroup
+	workerQueue                  *Queue
+}
+
+// Start runs a continuous loop that starts a new run when a request comes into the queue.
+func (r *Runner) Start() *Queue {
 	if r.workerGroup != nil {
 		log.Logger("runner").Info("Runner is already started, will not do anything")
 		return nil
@@ -151,7 +198,10 @@ func (r *Runner) Start() chan<- Request {
 	if r.WorkerCount <= 0 {
 		r.WorkerCount = defaultRunnerWorkerCount
 	}
-	r.workerQueue = make(chan Request, defaultWorkerQueueSize)
+	r.workerQueue = NewQueue()
+	metrics.SetRunQueue(r.workerQueue)
+	r.reportGroup = &sync.WaitGroup{}
+	r.reportSlots = make(chan struct{}, defaultReportConcurrency)
 	r.workerGroup = &sync.WaitGroup{}
 	r.workerGroup.Add(r.WorkerCount)
 	for i := 0; i < r.WorkerCount; i++ {
@@ -162,35 +212,90 @@ func (r *Runner) Start() chan<- Request {
 
 func (r *Runner) applyWorker() {
 	defer r.workerGroup.Done()
-	for request := range r.workerQueue {
-		if err := r.processRequest(request); err != nil {
-			r.captureRequestFailure(request, err)
+	for {
+		request, ok := r.workerQueue.Get()
+		if !ok {
+			return
+		}
+		// The Waybill might have been reassigned to another replica since
+		// the request was queued
+		if !r.Sharder.Owns(request.Waybill) {
+			log.Logger("runner").Info("Waybill is owned by another replica, skipping run", "waybill", queueKey(request.Waybill))
+			r.workerQueue.Done(request)
+			continue
+		}
+		release, ok := r.claim(request)
+		if !ok {
+			r.workerQueue.Done(request)
+			continue
+		}
+		ctx, span := tracing.Tracer().Start(context.Background(), "Runner.processRequest", trace.WithAttributes(
+			attribute.String("namespace", request.Waybill.Namespace),
+			attribute.String("name", request.Waybill.Name),
+			attribute.String("type", request.Type.String()),
+		))
+		err := r.processRequest(ctx, request)
+		release()
+		if err != nil {
+			r.captureRequestFailure(ctx, request, err)
 		}
+		tracing.End(span, err)
+		r.workerQueue.Done(request)
 	}
 }
 
-func (r *Runner) processRequest(request Request) error {
+// claim claims the Waybill of the request for this replica. While the members
+// of the shard group change, the previous owner might still be applying the
+// Waybill, in which case the request is queued again after
+// claimRetryInterval, instead of being dropped.
+func (r *Runner) claim(request Request) (func(), bool) {
+	release, err := r.Sharder.Claim(request.Waybill)
+	if err != nil {
+		log.Logger("runner").Info("Waybill is being applied by another replica, retrying run later", "waybill", queueKey(request.Waybill), "retryIn", claimRetryInterval, "error", err)
+		r.workerQueue.AddAfter(request, claimRetryInterval)
+		return nil, false
+	}
+	return release, true
+}
+
+func (r *Runner) processRequest(ctx context.Context, request Request) error {
 	wbId := fmt.Sprintf("%s/%s", request.Waybill.Namespace, request.Waybill.Name)
 	log.Logger("runner").Info("Started apply run", "waybill", wbId)
-	metrics.UpdateRunRequest(request.Type.String(), request.Waybill, -1)
+	if !request.Queued.IsZero() {
+		r.recordRunPhase(request.Waybill, metrics.PhaseQueueWait, request.Queued)
+	}
+	r.Events.Emit(cloudevents.TypeRunStarted, cloudevents.Data{
+		Namespace: request.Waybill.Namespace,
+		Name:      request.Waybill.Name,
+		RunType:   request.Type.String(),
+		DryRun:    request.Waybill.Spec.DryRun,
+	})
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request.Waybill.Spec.RunTimeout)*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(request.Waybill.Spec.RunTimeout)*time.Second)
 	defer cancel()
 
-	delegateToken, err := r.getDelegateToken(ctx, request.Waybill)
+	previousRun := request.Waybill.Status.LastRun
+
+	phaseStart := r.Clock.Now()
+	spanCtx, span := tracing.Tracer().Start(ctx, "getDelegateToken")
+	delegateServiceAccount, delegateToken, err := r.getDelegateToken(spanCtx, request.Waybill)
+	tracing.End(span, err)
 	if err != nil {
 		return fmt.Errorf("failed fetching delegate token: %w", err)
 	}
-	// Create a client for the delegate service account so only resources
+	// Use a client for the delegate service account so only resources
 	// that the delegate can prune are returned by PrunableResourceGVKs
-	delegateCfg := r.KubeClient.CloneConfig()
-	delegateCfg.BearerToken = delegateToken
-	delegateKubeClient, err := client.NewWithConfig(delegateCfg)
+	delegateKubeClient, err := r.KubeClient.DelegateClient(r.secretNamespace(request.Waybill), delegateServiceAccount, delegateToken)
 	if err != nil {
 		return fmt.Errorf("could not create delegate kubernetes client: %w", err)
 	}
-	defer delegateKubeClient.Shutdown()
-	clusterResources, namespacedResources, err := delegateKubeClient.PrunableResourceGVKs(ctx, request.Waybill.Namespace)
+	r.recordRunPhase(request.Waybill, metrics.PhaseDelegateClientSetup, phaseStart)
+
+	phaseStart = r.Clock.Now()
+	spanCtx, span = tracing.Tracer().Start(ctx, "PrunableResourceGVKs")
+	clusterResources, namespacedResources, err := delegateKubeClient.PrunableResourceGVKs(spanCtx, request.Waybill.Namespace)
+	tracing.End(span, err)
+	r.recordRunPhase(request.Waybill, metrics.PhasePrunableDiscovery, phaseStart)
 	if err != nil {
 		return fmt.Errorf("could not compute list of prunable resources: %w", err)
 	}
@@ -198,21 +303,55 @@ func (r *Runner) processRequest(request Request) error {
 		ClusterResources:    clusterResources,
 		NamespacedResources: namespacedResources,
 	}
+	// ClusterWaybills only prune cluster resources.
+	if request.Waybill.IsClusterWaybill() {
+		applyOptions.NamespacedResources = nil
+	}
+	// If the namespace is shared with other Waybills, the resources are
+	// labelled as belonging to this Waybill and only the labelled resources
+	// are pruned, so that Waybills do not prune each other's resources. The
+	// same applies to multiple ClusterWaybills.
+	var namespaceWaybills []kubeapplierv1alpha1.Waybill
+	if request.Waybill.IsClusterWaybill() {
+		namespaceWaybills, err = r.KubeClient.ListClusterWaybills(ctx)
+	} else {
+		namespaceWaybills, err = r.KubeClient.ListNamespaceWaybills(ctx, request.Waybill.Namespace)
+	}
+	if err != nil {
+		return fmt.Errorf("could not list Waybills in namespace: %w", err)
+	}
+	if len(namespaceWaybills) > 1 {
+		applyOptions.Labels = map[string]string{kubeapplierv1alpha1.WaybillLabel: request.Waybill.Name}
+		applyOptions.Selector = fmt.Sprintf("%s=%s", kubeapplierv1alpha1.WaybillLabel, request.Waybill.Name)
+	}
 
 	tmpHomeDir, tmpRepoDir, cleanupTemp, err := r.setupTempDirs(request.Waybill)
 	if err != nil {
 		return fmt.Errorf("could not setup temporary directories: %w", err)
 	}
 	defer cleanupTemp()
-	gitSSHCommand, err := r.setupGitSSH(ctx, request.Waybill, tmpHomeDir)
+	phaseStart = r.Clock.Now()
+	spanCtx, span = tracing.Tracer().Start(ctx, "setupGitSSH")
+	gitSSHCommand, err := r.setupGitSSH(spanCtx, request.Waybill, tmpHomeDir)
+	tracing.End(span, err)
 	if err != nil {
 		return fmt.Errorf("failed setting up repository clone: %w", err)
 	}
 	applyOptions.EnvironmentVariables = append(applyOptions.EnvironmentVariables, gitSSHCommand)
+	spanCtx, span = tracing.Tracer().Start(ctx, "setupGitHTTPS")
+	gitHTTPSEnvironment, err := r.setupGitHTTPS(spanCtx, request.Waybill)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed setting up git HTTPS credentials: %w", err)
+	}
+	applyOptions.EnvironmentVariables = append(applyOptions.EnvironmentVariables, gitHTTPSEnvironment...)
 	// Set HOME to tmpHomeDir, this means that SSH should not pick up any
 	// local SSH keys and use them for cloning
 	applyOptions.EnvironmentVariables = append(applyOptions.EnvironmentVariables, fmt.Sprintf("HOME=%s", tmpHomeDir))
-	tmpRepoPath, hash, err := r.setupRepositoryClone(ctx, request.Waybill, tmpHomeDir, tmpRepoDir)
+	spanCtx, span = tracing.Tracer().Start(ctx, "setupRepositoryClone")
+	tmpRepoPath, hash, err := r.setupRepositoryClone(spanCtx, request.Waybill, tmpHomeDir, tmpRepoDir)
+	tracing.End(span, err)
+	r.recordRunPhase(request.Waybill, metrics.PhaseRepositoryClone, phaseStart)
 	if err != nil {
 		return fmt.Errorf("failed setting up repository clone: %w", err)
 	}
@@ -221,15 +360,23 @@ func (r *Runner) processRequest(request Request) error {
 	// That way we should also be able to decrypt files cloned from remote
 	// bases on kustomize build.
 	applyOptions.EnvironmentVariables = append(applyOptions.EnvironmentVariables, fmt.Sprintf("STRONGBOX_HOME=%s", tmpHomeDir))
-	if err := r.Strongbox.SetupGitConfigForStrongbox(ctx, request.Waybill, applyOptions.EnvironmentVariables); err != nil {
+	phaseStart = r.Clock.Now()
+	err = r.Strongbox.SetupGitConfigForStrongbox(ctx, request.Waybill, applyOptions.EnvironmentVariables)
+	r.recordRunPhase(request.Waybill, metrics.PhaseStrongboxSetup, phaseStart)
+	if err != nil {
 		return fmt.Errorf("failed setting up strongbox git config: %w", err)
 	}
 	r.apply(ctx, tmpRepoPath, delegateToken, request.Waybill, applyOptions)
 
 	request.Waybill.Status.LastRun.Commit = hash
+	request.Waybill.Status.LastRun.TraceID = tracing.TraceID(ctx)
 	request.Waybill.Status.LastRun.Type = request.Type.String()
+	request.Waybill.Status.Rollback = rollbackStatus(request.Waybill)
 
-	if err := r.updateWaybillStatus(ctx, request.Waybill); err != nil {
+	phaseStart = r.Clock.Now()
+	err = r.updateWaybillStatus(ctx, request.Waybill)
+	r.recordRunPhase(request.Waybill, metrics.PhaseStatusUpdate, phaseStart)
+	if err != nil {
 		log.Logger("runner").Warn("Could not update Waybill status", "waybill", wbId, "error", err)
 		r.KubeClient.EmitWaybillEvent(request.Waybill, corev1.EventTypeWarning, "WaybillUpdateStatusFailed", "%s", err.Error())
 	}
@@ -250,6 +397,11 @@ func (r *Runner) processRequest(request Request) error {
 	}
 
 	metrics.UpdateFromLastRun(request.Waybill)
+	r.recordCommitApplyLatency(ctx, request.Waybill, previousRun)
+	r.emitRunFinished(request.Waybill, request.Type)
+	finished := request.Waybill.DeepCopy()
+	r.dispatchReport(func() { r.notify(finished, previousRun) })
+	r.dispatchReport(func() { r.reportCommitStatus(finished) })
 
 	log.Logger("runner").Info("Finished apply run", "waybill", wbId)
 	return nil
@@ -257,12 +409,16 @@ func (r *Runner) processRequest(request Request) error {
 
 // updateWaybillStatus updates the status on the provided Waybill. It will
 // retrieve the latest version of the Waybill before updating, which will
-// tolerate modifications to the Waybill that may happen during the run.
+// tolerate modifications to the Waybill that may happen during the run. The
+// last run is appended to the run history of the latest version, since the
+// provided Waybill might not include the runs that finished after it was
+// queued.
 func (r *Runner) updateWaybillStatus(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) error {
 	wb, err := r.KubeClient.GetWaybill(ctx, waybill.Namespace, waybill.Name)
 	if err != nil {
 		return err
 	}
+	waybill.Status.History = appendRunHistory(wb.Status.History, waybill.Status.LastRun, r.DryRun || waybill.Spec.DryRun)
 	wb.Status = waybill.Status
 	return r.KubeClient.UpdateWaybillStatus(ctx, wb)
 }
@@ -270,19 +426,19 @@ func (r *Runner) updateWaybillStatus(ctx context.Context, waybill *kubeapplierv1
 // captureRequestFailure is used to capture a request failure that occured
 // before attempting to apply. The reason is logged and emitted as a kubernetes
 // event.
-func (r *Runner) captureRequestFailure(req Request, err error) {
+func (r *Runner) captureRequestFailure(ctx context.Context, req Request, err error) {
 	wbId := fmt.Sprintf("%s/%s", req.Waybill.Namespace, req.Waybill.Name)
 	log.Logger("runner").Error("Run request failed", "waybill", wbId, "error", err)
 	r.KubeClient.EmitWaybillEvent(req.Waybill, corev1.EventTypeWarning, "WaybillRunRequestFailed", "%s", err.Error())
-	r.updateWaybillStatusRequestFailure(req, err.Error())
+	r.updateWaybillStatusRequestFailure(ctx, req, err.Error())
 }
 
 // updateWaybillStatusRequestFailure will update the waybill status with a
 // failure. All values produced by `kubectl apply` will be empty and Success
 // should be false to mark a failure. The UI shall rely on emitted events to
 // provide more information regarding the error led to this failure.
-func (r *Runner) updateWaybillStatusRequestFailure(req Request, errorMessage string) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.Waybill.Spec.RunTimeout)*time.Second)
+func (r *Runner) updateWaybillStatusRequestFailure(ctx context.Context, req Request, errorMessage string) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(req.Waybill.Spec.RunTimeout)*time.Second)
 	defer cancel()
 	wbId := fmt.Sprintf("%s/%s", req.Waybill.Namespace, req.Waybill.Name)
 	wb, err := r.KubeClient.GetWaybill(ctx, req.Waybill.Namespace, req.Waybill.Name)
@@ -296,9 +452,10 @@ func (r *Runner) updateWaybillStatusRequestFailure(req Request, errorMessage str
 	// not clobber a known-good commit hash with "". The empty commit
 	// would cause the scheduler's git polling loop to feed "" to
 	// git diff, which git rejects with "fatal: bad revision ''".
+	previousRun := wb.Status.LastRun
 	prevCommit := ""
-	if wb.Status.LastRun != nil {
-		prevCommit = wb.Status.LastRun.Commit
+	if previousRun != nil {
+		prevCommit = previousRun.Commit
 	}
 	t := r.Clock.Now()
 	wb.Status.LastRun = &kubeapplierv1alpha1.WaybillStatusRun{
@@ -309,11 +466,159 @@ func (r *Runner) updateWaybillStatusRequestFailure(req Request, errorMessage str
 		Finished:     metav1.NewTime(t),
 		Started:      metav1.NewTime(t),
 		Success:      false,
+		TraceID:      tracing.TraceID(ctx),
 		Type:         req.Type.String(),
 	}
+	wb.Status.History = appendRunHistory(wb.Status.History, wb.Status.LastRun, r.DryRun || req.Waybill.Spec.DryRun)
+	wb.Status.Rollback = rollbackStatus(req.Waybill)
 	if err := r.KubeClient.UpdateWaybillStatus(ctx, wb); err != nil {
 		log.Logger("runner").Error("Failed to update waybill with request failure", "waybill", wbId, "error", err)
 	}
+	r.emitRunFinished(wb, req.Type)
+	r.dispatchReport(func() { r.notify(wb, previousRun) })
+}
+
+// recordRunPhase observes the duration of a phase of the run of the Waybill,
+// measured with the clock of the Runner from the provided start time.
+func (r *Runner) recordRunPhase(waybill *kubeapplierv1alpha1.Waybill, phase string, start time.Time) {
+	metrics.RecordRunPhase(waybill.Namespace, waybill.Name, phase, r.Clock.Since(start))
+}
+
+// recordCommitApplyLatency records the time between the commit date of the
+// applied revision and the end of the run, if the Waybill was successfully
+// applied. Dry runs are ignored since nothing is actually applied.
+func (r *Runner) recordCommitApplyLatency(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill, previousRun *kubeapplierv1alpha1.WaybillStatusRun) {
+	if !newCommitApplied(waybill.Status.LastRun, previousRun) || r.DryRun || waybill.Spec.DryRun {
+		return
+	}
+	lastRun := waybill.Status.LastRun
+	committed, err := r.Repository.CommitTimestamp(ctx, lastRun.Commit)
+	if err != nil {
+		log.Logger("runner").Warn("Could not get commit timestamp", "waybill", fmt.Sprintf("%s/%s", waybill.Namespace, waybill.Name), "commit", lastRun.Commit, "error", err)
+		return
+	}
+	metrics.RecordCommitApplyLatency(waybill, committed, lastRun.Finished.Time)
+}
+
+// newCommitApplied returns true if the last run successfully applied a commit
+// that was not already applied by the previous run. Runs that re-apply the
+// same commit would otherwise inflate the commit apply latency.
+func newCommitApplied(lastRun, previousRun *kubeapplierv1alpha1.WaybillStatusRun) bool {
+	if lastRun == nil || !lastRun.Success || lastRun.Commit == "" {
+		return false
+	}
+	return previousRun == nil || !previousRun.Success || previousRun.Commit != lastRun.Commit
+}
+
+// emitRunFinished emits events describing the outcome of the last run of the
+// Waybill, as well as any resources that were pruned during the run.
+func (r *Runner) emitRunFinished(waybill *kubeapplierv1alpha1.Waybill, t Type) {
+	if waybill.Status.LastRun == nil {
+		return
+	}
+	data := cloudevents.NewData(waybill, t.String())
+	if waybill.Status.LastRun.Success {
+		r.Events.Emit(cloudevents.TypeRunSucceeded, data)
+	} else {
+		r.Events.Emit(cloudevents.TypeRunFailed, data)
+	}
+	if pruned := cloudevents.PrunedResources(waybill.Status.LastRun.Output); len(pruned) > 0 {
+		data.Resources = pruned
+		r.Events.Emit(cloudevents.TypePruneDeleted, data)
+	}
+}
+
+// dispatchReport runs the provided report about a finished run in the
+// background, so that slow external services do not hold up the apply
+// workers. At most defaultReportConcurrency reports are sent at the same time
+// and Stop waits for the pending ones. Reports are sent right away if the
+// Runner has not been started.
+func (r *Runner) dispatchReport(report func()) {
+	if r.reportGroup == nil {
+		report()
+		return
+	}
+	r.reportGroup.Add(1)
+	go func() {
+		defer r.reportGroup.Done()
+		r.reportSlots <- struct{}{}
+		defer func() { <-r.reportSlots }()
+		report()
+	}()
+}
+
+// notify sends notifications about the last run of the Waybill, if its
+// outcome has changed compared to the previous run. Failures are logged and
+// emitted as kubernetes events but otherwise do not affect the run.
+func (r *Runner) notify(waybill *kubeapplierv1alpha1.Waybill, previousRun *kubeapplierv1alpha1.WaybillStatusRun) {
+	if r.Notifier == nil {
+		return
+	}
+	event, ok := notify.NewEvent(waybill, previousRun, waybill.Status.LastRun)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	wbId := fmt.Sprintf("%s/%s", waybill.Namespace, waybill.Name)
+	targets, err := r.notificationTargets(ctx, waybill)
+	if err != nil {
+		log.Logger("runner").Warn("Could not setup notification targets", "waybill", wbId, "error", err)
+		r.KubeClient.EmitWaybillEvent(waybill, corev1.EventTypeWarning, "WaybillNotificationFailed", "%s", err.Error())
+	}
+	if err := r.Notifier.Notify(ctx, event, targets); err != nil {
+		log.Logger("runner").Warn("Could not send notifications", "waybill", wbId, "error", err)
+		r.KubeClient.EmitWaybillEvent(waybill, corev1.EventTypeWarning, "WaybillNotificationFailed", "%s", err.Error())
+	}
+}
+
+// reportCommitStatus reports the outcome of the last run of the Waybill as a
+// status on the commit that was applied. Failures are logged and emitted as
+// kubernetes events but otherwise do not affect the run.
+func (r *Runner) reportCommitStatus(waybill *kubeapplierv1alpha1.Waybill) {
+	if r.CommitStatus == nil || waybill.Status.LastRun == nil || waybill.Status.LastRun.Commit == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commitStatusTimeout)
+	defer cancel()
+	wbId := fmt.Sprintf("%s/%s", waybill.Namespace, waybill.Name)
+	commit, err := r.Repository.FullHash(ctx, waybill.Status.LastRun.Commit)
+	if err == nil {
+		err = r.CommitStatus.Report(ctx, waybill, commit)
+	}
+	if err != nil {
+		log.Logger("runner").Warn("Could not report commit status", "waybill", wbId, "commit", waybill.Status.LastRun.Commit, "error", err)
+		r.KubeClient.EmitWaybillEvent(waybill, corev1.EventTypeWarning, "WaybillCommitStatusFailed", "%s", err.Error())
+	}
+}
+
+// notificationTargets returns the notification targets configured for the
+// Waybill, reading their URLs from the referenced Secrets.
+func (r *Runner) notificationTargets(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) ([]notify.Target, error) {
+	var targets []notify.Target
+	for _, n := range waybill.Spec.Notifications {
+		secretNamespace := n.URLSecretRef.Namespace
+		if secretNamespace == "" {
+			secretNamespace = r.secretNamespace(waybill)
+		}
+		secret, err := r.KubeClient.GetSecret(ctx, secretNamespace, n.URLSecretRef.Name)
+		if err != nil {
+			return targets, err
+		}
+		if err := checkSecretIsAllowed(r.secretNamespace(waybill), secret); err != nil {
+			return targets, err
+		}
+		url, ok := secret.Data["url"]
+		if !ok {
+			return targets, fmt.Errorf(`secret "%s/%s" does not contain key 'url'`, secret.Namespace, secret.Name)
+		}
+		targets = append(targets, notify.Target{
+			Template: n.Template,
+			Type:     n.Type,
+			URL:      strings.TrimSpace(string(url)),
+		})
+	}
+	return targets, nil
 }
 
 // Stop gracefully shuts down the Runner.
@@ -321,24 +626,62 @@ func (r *Runner) Stop() {
 	if r.workerGroup == nil {
 		return
 	}
-	close(r.workerQueue)
+	r.workerQueue.ShutDown()
 	r.workerGroup.Wait()
 	r.workerGroup = nil
+	r.reportGroup.Wait()
+	r.reportGroup = nil
 }
 
-func (r *Runner) getDelegateToken(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) (string, error) {
-	secret, err := r.KubeClient.GetSecret(ctx, waybill.Namespace, waybill.Spec.DelegateServiceAccountSecretRef)
+// secretNamespace returns the namespace that the Secrets referenced by the
+// Waybill are looked up in, when they do not specify one. This is the
+// namespace of the Waybill, or the configured namespace for ClusterWaybills.
+func (r *Runner) secretNamespace(waybill *kubeapplierv1alpha1.Waybill) string {
+	if waybill.IsClusterWaybill() {
+		return r.ClusterWaybillNamespace
+	}
+	return waybill.Namespace
+}
+
+// getDelegateToken returns the name of the delegate ServiceAccount of the
+// Waybill and the token passed to kubectl when applying it. If the Waybill
+// references a delegate ServiceAccount, a short-lived token is requested for
+// it, otherwise the token is read from the legacy service account token Secret.
+func (r *Runner) getDelegateToken(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) (string, string, error) {
+	if waybill.Spec.DelegateServiceAccountRef != "" {
+		token, err := r.KubeClient.CreateServiceAccountToken(ctx, r.secretNamespace(waybill), waybill.Spec.DelegateServiceAccountRef, r.DelegateTokenAudiences, r.delegateTokenExpiration(waybill))
+		return waybill.Spec.DelegateServiceAccountRef, token, err
+	}
+	secret, err := r.KubeClient.GetSecret(ctx, r.secretNamespace(waybill), waybill.Spec.DelegateServiceAccountSecretRef)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	if secret.Type != corev1.SecretTypeServiceAccountToken {
-		return "", fmt.Errorf(`secret "%s/%s" is not of type %s`, secret.Namespace, secret.Name, corev1.SecretTypeServiceAccountToken)
+		return "", "", fmt.Errorf(`secret "%s/%s" is not of type %s`, secret.Namespace, secret.Name, corev1.SecretTypeServiceAccountToken)
+	}
+	serviceAccount := secret.Annotations[corev1.ServiceAccountNameKey]
+	if serviceAccount == "" {
+		return "", "", fmt.Errorf(`secret "%s/%s" does not have annotation '%s'`, secret.Namespace, secret.Name, corev1.ServiceAccountNameKey)
 	}
 	delegateToken, ok := secret.Data["token"]
 	if !ok {
-		return "", fmt.Errorf(`secret "%s/%s" does not contain key 'token'`, secret.Namespace, secret.Name)
+		return "", "", fmt.Errorf(`secret "%s/%s" does not contain key 'token'`, secret.Namespace, secret.Name)
+	}
+	return serviceAccount, string(delegateToken), nil
+}
+
+// delegateTokenExpiration returns the expiration of the tokens requested for
+// the delegate ServiceAccount of the Waybill. Tokens need to outlive the run,
+// so the expiration is never shorter than the run timeout of the Waybill.
+func (r *Runner) delegateTokenExpiration(waybill *kubeapplierv1alpha1.Waybill) time.Duration {
+	expiration := r.DelegateTokenExpiration
+	if runTimeout := time.Duration(waybill.Spec.RunTimeout) * time.Second; runTimeout > expiration {
+		expiration = runTimeout
+	}
+	if expiration < minDelegateTokenExpiration {
+		expiration = minDelegateTokenExpiration
 	}
-	return string(delegateToken), nil
+	return expiration
 }
 
 func (r *Runner) setupTempDirs(waybill *kubeapplierv1alpha1.Waybill) (string, string, func(), error) {
@@ -355,22 +698,18 @@ func (r *Runner) setupTempDirs(waybill *kubeapplierv1alpha1.Waybill) (string, st
 }
 
 func (r *Runner) setupRepositoryClone(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill, tmpHomeDir, tmpRepoDir string) (string, string, error) {
-	if err := r.Strongbox.SetupStrongboxKeyring(ctx, r.KubeClient, waybill, tmpHomeDir); err != nil {
+	if err := r.Strongbox.SetupStrongboxKeyring(ctx, r.KubeClient, waybill, r.secretNamespace(waybill), tmpHomeDir); err != nil {
 		return "", "", err
 	}
-	repositoryPath := waybill.Spec.RepositoryPath
-	if repositoryPath == "" {
-		repositoryPath = waybill.Namespace
-	}
-	subpath := filepath.Join(r.RepoPath, repositoryPath)
+	subpath := WaybillPath(r.RepoPath, waybill)
 	// Point Strongbox home to the temporary home to be able to decrypt files based on Waybill configuration
-	hash, err := r.Repository.CloneLocal(ctx, []string{fmt.Sprintf("STRONGBOX_HOME=%s", tmpHomeDir)}, tmpRepoDir, subpath)
+	hash, err := r.Repository.CloneLocal(ctx, []string{fmt.Sprintf("STRONGBOX_HOME=%s", tmpHomeDir)}, tmpRepoDir, subpath, waybillRevision(waybill))
 	if err != nil {
 		return "", "", err
 	}
 	// Rewrite repo addresses for those that want to use SSH keys to clone
 	if waybill.Spec.GitSSHSecretRef != nil {
-		if err := r.updateRepoBaseAddresses(tmpRepoDir); err != nil {
+		if err := updateRepoBaseAddresses(tmpRepoDir); err != nil {
 			return "", "", err
 		}
 	}
@@ -383,7 +722,7 @@ func (r *Runner) setupRepositoryClone(ctx context.Context, waybill *kubeapplierv
 // the next line by injecting the `foobar` part into domain, resulting in
 // `foobar_github_com`. We must not use `.` - as it breaks Host matching in
 // .ssh/config
-func (r *Runner) updateRepoBaseAddresses(tmpRepoDir string) error {
+func updateRepoBaseAddresses(tmpRepoDir string) error {
 	kFiles := []string{}
 	if err := filepath.WalkDir(tmpRepoDir, func(path string, info fs.DirEntry, err error) error {
 		if err != nil {
@@ -450,28 +789,42 @@ func (r *Runner) setupGitSSH(ctx context.Context, waybill *kubeapplierv1alpha1.W
 	if waybill.Spec.GitSSHSecretRef == nil {
 		// If there is no SSH secret defined, fall back to using the one
 		// provided to kube-applier as a flag to clone the root repo.
-		if r.DefaultGitSSHKeyPath != "" {
-			log.Logger("runner").Debug("No GitSSHSecretRef set, falling back to root repo ssh config path", "path", r.DefaultGitSSHKeyPath)
-			return fmt.Sprintf("GIT_SSH_COMMAND=ssh -q -F none -o IdentitiesOnly=yes -o User=git -o IdentityFile=%s -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no", r.DefaultGitSSHKeyPath), nil
-		}
-		// Else override the git ssh command (pointing the key to /dev/null) to surface the error if bases over ssh have been configured.
-		log.Logger("runner").Debug("No Git SSH key found, pointing identity file to /dev/null")
-		return `GIT_SSH_COMMAND=ssh -q -F none -o IdentitiesOnly=yes -o IdentityFile=/dev/null -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no`, nil
+		return defaultGitSSHCommand(r.DefaultGitSSHKeyPath), nil
 	}
 	gsNamespace := waybill.Spec.GitSSHSecretRef.Namespace
 	if gsNamespace == "" {
-		gsNamespace = waybill.Namespace
+		gsNamespace = r.secretNamespace(waybill)
 	}
 	secret, err := r.KubeClient.GetSecret(ctx, gsNamespace, waybill.Spec.GitSSHSecretRef.Name)
 	if err != nil {
 		return "", err
 	}
-	if err := checkSecretIsAllowed(waybill, secret); err != nil {
+	if err := checkSecretIsAllowed(r.secretNamespace(waybill), secret); err != nil {
 		return "", err
 	}
+	return writeGitSSHConfig(secret, sshDir)
+}
+
+// defaultGitSSHCommand returns a value for GIT_SSH_COMMAND that uses the SSH
+// key provided to kube-applier, for Waybills that do not reference their own
+// SSH keys.
+func defaultGitSSHCommand(keyPath string) string {
+	if keyPath != "" {
+		log.Logger("runner").Debug("No GitSSHSecretRef set, falling back to root repo ssh config path", "path", keyPath)
+		return fmt.Sprintf("GIT_SSH_COMMAND=ssh -q -F none -o IdentitiesOnly=yes -o User=git -o IdentityFile=%s -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no", keyPath)
+	}
+	// Else override the git ssh command (pointing the key to /dev/null) to surface the error if bases over ssh have been configured.
+	log.Logger("runner").Debug("No Git SSH key found, pointing identity file to /dev/null")
+	return `GIT_SSH_COMMAND=ssh -q -F none -o IdentitiesOnly=yes -o IdentityFile=/dev/null -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no`
+}
+
+// writeGitSSHConfig writes an SSH config for the keys in the Secret, and the
+// known hosts if present, to sshDir and returns a value for GIT_SSH_COMMAND
+// that uses them.
+func writeGitSSHConfig(secret *corev1.Secret, sshDir string) (string, error) {
 	knownHostsFragment := `-o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no`
 	configFilename := filepath.Join(sshDir, "config")
-	body, err := r.constructSSHConfig(secret, sshDir, configFilename)
+	body, err := constructSSHConfig(secret, sshDir, configFilename)
 	if err != nil {
 		return "", err
 	}
@@ -489,7 +842,38 @@ func (r *Runner) setupGitSSH(ctx context.Context, waybill *kubeapplierv1alpha1.W
 	return fmt.Sprintf(`GIT_SSH_COMMAND=ssh -q -F %s %s`, configFilename, knownHostsFragment), nil
 }
 
-func (r *Runner) constructSSHConfig(secret *corev1.Secret, sshDir, configFilename string) ([]byte, error) {
+// setupGitHTTPS returns the environment variables that configure git (and
+// therefore kustomize) to authenticate with the HTTPS credentials of the
+// Waybill, or with the default credentials of kube-applier, when cloning
+// remote bases. The default credentials are only sent to the remotes that
+// they are configured for, since the remote bases are chosen by the owners of
+// the Waybills.
+func (r *Runner) setupGitHTTPS(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) ([]string, error) {
+	if waybill.Spec.GitHTTPSSecretRef == nil {
+		if r.DefaultGitCredentials == nil || len(r.DefaultGitCredentialsRemotes) == 0 {
+			return nil, nil
+		}
+		return git.CredentialsEnvironment(ctx, r.DefaultGitCredentials, r.DefaultGitCredentialsRemotes)
+	}
+	ghNamespace := waybill.Spec.GitHTTPSSecretRef.Namespace
+	if ghNamespace == "" {
+		ghNamespace = r.secretNamespace(waybill)
+	}
+	secret, err := r.KubeClient.GetSecret(ctx, ghNamespace, waybill.Spec.GitHTTPSSecretRef.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSecretIsAllowed(r.secretNamespace(waybill), secret); err != nil {
+		return nil, err
+	}
+	credentials, err := r.gitHubApps.credentials(secret)
+	if err != nil {
+		return nil, err
+	}
+	return git.CredentialsEnvironment(ctx, credentials, nil)
+}
+
+func constructSSHConfig(secret *corev1.Secret, sshDir, configFilename string) ([]byte, error) {
 	var tk int
 	var kfn string
 	hostFragments := []string{}
@@ -524,14 +908,20 @@ func (r *Runner) constructSSHConfig(secret *corev1.Secret, sshDir, configFilenam
 	return []byte(strings.Join(hostFragments, "\n")), nil
 }
 
-// Apply takes a list of files and attempts an apply command on each.
-func (r *Runner) apply(ctx context.Context, rootPath, token string, waybill *kubeapplierv1alpha1.Waybill, options *ApplyOptions) {
-	start := r.Clock.Now()
+// WaybillPath returns the path of the Waybill's configuration under root,
+// which defaults to its namespace if the Waybill does not specify one.
+func WaybillPath(root string, waybill *kubeapplierv1alpha1.Waybill) string {
 	repositoryPath := waybill.Spec.RepositoryPath
 	if repositoryPath == "" {
 		repositoryPath = waybill.Namespace
 	}
-	path := filepath.Join(rootPath, repositoryPath)
+	return filepath.Join(root, repositoryPath)
+}
+
+// Apply takes a list of files and attempts an apply command on each.
+func (r *Runner) apply(ctx context.Context, rootPath, token string, waybill *kubeapplierv1alpha1.Waybill, options *ApplyOptions) {
+	start := r.Clock.Now()
+	path := WaybillPath(rootPath, waybill)
 	log.Logger("runner").Info("Applying files", "path", path)
 
 	dryRunStrategy := "none"
@@ -547,8 +937,11 @@ func (r *Runner) apply(ctx context.Context, rootPath, token string, waybill *kub
 			DryRunStrategy: dryRunStrategy,
 			Environment:    options.EnvironmentVariables,
 			PruneWhitelist: options.pruneWhitelist(waybill, r.PruneBlacklist),
+			Labels:         options.Labels,
+			Selector:       options.Selector,
 			ServerSide:     waybill.Spec.ServerSideApply,
 			Token:          token,
+			Waybill:        waybill.Name,
 		},
 	)
 	finish := r.Clock.Now()
@@ -567,20 +960,22 @@ func (r *Runner) apply(ctx context.Context, rootPath, token string, waybill *kub
 	}
 }
 
-// Enqueue attempts to add a run request to the queue, timing out after 5
-// seconds.
-func Enqueue(queue chan<- Request, t Type, waybill *kubeapplierv1alpha1.Waybill) {
+// Enqueue adds a run request to the queue, coalescing it with any request
+// that is already queued for the Waybill. It returns true if the request was
+// added to the queue as a new request, and false if it was ignored or
+// coalesced with a pending request.
+func Enqueue(queue *Queue, t Type, waybill *kubeapplierv1alpha1.Waybill) bool {
 	wbId := fmt.Sprintf("%s/%s", waybill.Namespace, waybill.Name)
 	if t != ForcedRun && !ptr.Deref(waybill.Spec.AutoApply, true) {
 		log.Logger("runner").Debug("Run ignored, waybill autoApply is disabled", "waybill", wbId, "type", t)
-		return
+		return false
 	}
-	select {
-	case queue <- Request{Type: t, Waybill: waybill}:
+	switch queue.Add(Request{Type: t, Waybill: waybill, Queued: time.Now()}) {
+	case RequestAdded:
 		log.Logger("runner").Debug("Run queued", "waybill", wbId, "type", t)
-		metrics.UpdateRunRequest(t.String(), waybill, 1)
-	case <-time.After(enqueueTimeout):
-		log.Logger("runner").Error("Timed out trying to queue a run, run queue is full", "waybill", wbId, "type", t)
-		metrics.AddRunRequestQueueFailure(t.String(), waybill)
+		return true
+	case RequestCoalesced:
+		log.Logger("runner").Debug("Run coalesced with queued request", "waybill", wbId, "type", t)
 	}
+	return false
 }
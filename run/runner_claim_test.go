@@ -0,0 +1,124 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/utilitywarehouse/kube-applier/clock"
+	"github.com/utilitywarehouse/kube-applier/shard"
+)
+
+// testLeaseClient is an in-memory shard.LeaseClient that implements the
+// optimistic concurrency of the apiserver for updates.
+type testLeaseClient struct {
+	mutex  sync.Mutex
+	leases map[string]coordinationv1.Lease
+}
+
+func (c *testLeaseClient) ListLeases(ctx context.Context, namespace, selector string) ([]coordinationv1.Lease, error) {
+	return nil, nil
+}
+
+func (c *testLeaseClient) GetLease(ctx context.Context, namespace, name string) (*coordinationv1.Lease, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	l, ok := c.leases[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(coordinationv1.Resource("leases"), name)
+	}
+	return l.DeepCopy(), nil
+}
+
+func (c *testLeaseClient) CreateLease(ctx context.Context, lease *coordinationv1.Lease) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := lease.Namespace + "/" + lease.Name
+	if _, ok := c.leases[key]; ok {
+		return apierrors.NewAlreadyExists(coordinationv1.Resource("leases"), lease.Name)
+	}
+	l := *lease.DeepCopy()
+	l.ResourceVersion = "1"
+	c.leases[key] = l
+	return nil
+}
+
+func (c *testLeaseClient) UpdateLease(ctx context.Context, lease *coordinationv1.Lease) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := lease.Namespace + "/" + lease.Name
+	existing, ok := c.leases[key]
+	if !ok {
+		return apierrors.NewNotFound(coordinationv1.Resource("leases"), lease.Name)
+	}
+	if existing.ResourceVersion != lease.ResourceVersion {
+		return apierrors.NewConflict(coordinationv1.Resource("leases"), lease.Name, fmt.Errorf("resource version changed"))
+	}
+	rv, _ := strconv.Atoi(existing.ResourceVersion)
+	l := *lease.DeepCopy()
+	l.ResourceVersion = strconv.Itoa(rv + 1)
+	c.leases[key] = l
+	return nil
+}
+
+func (c *testLeaseClient) RenewLease(ctx context.Context, lease *coordinationv1.Lease) error {
+	return nil
+}
+
+func (c *testLeaseClient) DeleteLease(ctx context.Context, namespace, name string) error {
+	return nil
+}
+
+func TestRunnerClaim(t *testing.T) {
+	defer func(interval time.Duration) { claimRetryInterval = interval }(claimRetryInterval)
+	claimRetryInterval = 10 * time.Millisecond
+
+	leaseClient := &testLeaseClient{leases: map[string]coordinationv1.Lease{}}
+	newSharder := func(identity string) *shard.Sharder {
+		return &shard.Sharder{
+			Clock:         &clock.Clock{},
+			Group:         "kube-applier",
+			Identity:      identity,
+			KubeClient:    leaseClient,
+			LeaseDuration: 30 * time.Second,
+			Namespace:     "kube-applier",
+		}
+	}
+	queue := NewQueue()
+	runner := &Runner{Sharder: newSharder("b"), workerQueue: queue}
+	wb := testQueueWaybill("foo", "main")
+	queued := time.Now()
+
+	// The previous owner is still applying the Waybill
+	releasePrevious, err := newSharder("a").Claim(wb)
+	require.NoError(t, err)
+
+	queue.Add(Request{Type: PollingRun, Waybill: wb, Queued: queued})
+	request, ok := queue.Get()
+	require.True(t, ok)
+	_, ok = runner.claim(request)
+	assert.False(t, ok)
+	queue.Done(request)
+
+	// The request is not dropped, but queued again after a while
+	assert.Equal(t, 0, queue.Len())
+	assert.Eventually(t, func() bool { return queue.Len() == 1 }, time.Second, claimRetryInterval)
+
+	// Once the previous owner releases the Waybill, the run goes ahead
+	releasePrevious()
+	request, ok = queue.Get()
+	require.True(t, ok)
+	assert.Equal(t, Request{Type: PollingRun, Waybill: wb, Queued: queued}, request)
+	release, ok := runner.claim(request)
+	assert.True(t, ok)
+	release()
+	queue.Done(request)
+}
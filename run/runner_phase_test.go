@@ -0,0 +1,47 @@
+package run
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/kube-applier/metrics"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time                  { return c.now }
+func (c *testClock) Since(t time.Time) time.Duration { return c.now.Sub(t) }
+func (c *testClock) Sleep(d time.Duration)           { c.now = c.now.Add(d) }
+
+func TestRunnerRecordRunPhase(t *testing.T) {
+	metrics.Reset()
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	runner := &Runner{Clock: clock}
+	wb := testQueueWaybill("foo", "main")
+
+	start := runner.Clock.Now()
+	clock.Sleep(3 * time.Second)
+	runner.recordRunPhase(wb, metrics.PhaseRepositoryClone, start)
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	var sum float64
+	var count uint64
+	for _, f := range families {
+		if f.GetName() != "kube_applier_run_phase_duration_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			sum += m.GetHistogram().GetSampleSum()
+			count += m.GetHistogram().GetSampleCount()
+		}
+	}
+	assert.Equal(t, uint64(1), count)
+	assert.Equal(t, float64(3), sum)
+}
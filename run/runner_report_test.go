@@ -0,0 +1,58 @@
+package run
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunnerDispatchReport(t *testing.T) {
+	runner := &Runner{WorkerCount: 1}
+	runner.Start()
+
+	unblock := make(chan struct{})
+	var running, maxRunning, finished int32
+	for i := 0; i < 2*defaultReportConcurrency; i++ {
+		// Reports must not hold up the worker that dispatches them
+		dispatched := make(chan struct{})
+		go func() {
+			runner.dispatchReport(func() {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				<-unblock
+				atomic.AddInt32(&running, -1)
+				atomic.AddInt32(&finished, 1)
+			})
+			close(dispatched)
+		}()
+		select {
+		case <-dispatched:
+		case <-time.After(time.Second):
+			t.Fatal("dispatchReport blocked while reports were pending")
+		}
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&running) == defaultReportConcurrency }, time.Second, 10*time.Millisecond)
+
+	// Stop waits for the pending reports
+	stopped := make(chan struct{})
+	go func() {
+		runner.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while reports were pending")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(unblock)
+	<-stopped
+	assert.Equal(t, int32(2*defaultReportConcurrency), atomic.LoadInt32(&finished))
+	assert.Equal(t, int32(defaultReportConcurrency), atomic.LoadInt32(&maxRunning))
+}
@@ -108,7 +108,7 @@ resources:
 				[]byte(tt.input), 0644)
 			assert.NoError(t, err)
 
-			err = (&Runner{}).updateRepoBaseAddresses(tmpDir)
+			err = updateRepoBaseAddresses(tmpDir)
 			assert.NoError(t, err)
 
 			got, err := os.ReadFile(filepath.Join(tmpDir, "kustomization.yaml"))
@@ -136,7 +136,7 @@ func TestConstructSSHConfig(t *testing.T) {
 		}
 		configFile := filepath.Join(sshDir, "config")
 		keyFile := filepath.Join(sshDir, "key_deploy")
-		body, err := (&Runner{}).constructSSHConfig(secret, sshDir, configFile)
+		body, err := constructSSHConfig(secret, sshDir, configFile)
 		assert.NoError(t, err)
 
 		// Verify key file was written with trailing newline
@@ -167,7 +167,7 @@ func TestConstructSSHConfig(t *testing.T) {
 			},
 		}
 		configFile := filepath.Join(sshDir, "config")
-		body, err := (&Runner{}).constructSSHConfig(secret, sshDir, configFile)
+		body, err := constructSSHConfig(secret, sshDir, configFile)
 		assert.NoError(t, err)
 
 		// Both key files should exist
@@ -198,7 +198,7 @@ func TestConstructSSHConfig(t *testing.T) {
 				"known_hosts": []byte("some-host-key"),
 			},
 		}
-		_, err := (&Runner{}).constructSSHConfig(secret, sshDir, "")
+		_, err := constructSSHConfig(secret, sshDir, "")
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(),
 			`secret "test-ns/git-ssh" does not contain any keys`)
@@ -216,7 +216,7 @@ func TestConstructSSHConfig(t *testing.T) {
 			},
 		}
 		configFile := filepath.Join(sshDir, "config")
-		_, err := (&Runner{}).constructSSHConfig(secret, sshDir, configFile)
+		_, err := constructSSHConfig(secret, sshDir, configFile)
 		assert.NoError(t, err)
 
 		keyData, err := os.ReadFile(filepath.Join(sshDir, "key_deploy"))
@@ -118,7 +118,7 @@ func TestCheckSecretIsAllowed(t *testing.T) {
 				},
 			}
 
-			err := checkSecretIsAllowed(waybill, secret)
+			err := checkSecretIsAllowed(waybill.Namespace, secret)
 			if tc.wantErr == "" {
 				assert.NoError(t, err)
 				return
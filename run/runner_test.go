@@ -106,10 +106,31 @@ func TestApplyOptions_pruneWhitelist(t *testing.T) {
 	}
 }
 
+func TestRunner_delegateTokenExpiration(t *testing.T) {
+	testCases := []struct {
+		expiration time.Duration
+		runTimeout int
+		expected   time.Duration
+	}{
+		{0, 0, 10 * time.Minute},
+		{5 * time.Minute, 0, 10 * time.Minute},
+		{time.Hour, 900, time.Hour},
+		{15 * time.Minute, 3600, time.Hour},
+	}
+
+	for _, tc := range testCases {
+		runner := &Runner{DelegateTokenExpiration: tc.expiration}
+		waybill := &kubeapplierv1alpha1.Waybill{
+			Spec: kubeapplierv1alpha1.WaybillSpec{RunTimeout: tc.runTimeout},
+		}
+		assert.Equal(t, tc.expected, runner.delegateTokenExpiration(waybill))
+	}
+}
+
 var _ = Describe("Runner", func() {
 	var (
 		runner        Runner
-		runQueue      chan<- Request
+		runQueue      *Queue
 		applyOptions  *ApplyOptions
 		kustomizePath string
 	)
@@ -254,7 +275,7 @@ deployment.apps/test-deployment created (server dry run)
 				if repositoryPath == "" {
 					repositoryPath = expected[i].Namespace
 				}
-				headCommitHash, err := runner.Repository.HashForPath(context.TODO(), filepath.Join(runner.RepoPath, repositoryPath))
+				headCommitHash, err := runner.Repository.HashForPath(context.TODO(), filepath.Join(runner.RepoPath, repositoryPath), "")
 				Expect(err).To(BeNil())
 				expected[i].Status.LastRun.Commit = headCommitHash
 			}
@@ -272,19 +293,19 @@ deployment.apps/test-deployment created (server dry run)
 			}
 
 			testMetrics([]string{
-				`kube_applier_kubectl_exit_code_count{exit_code="0",namespace="app-a"} 1`,
-				`kube_applier_kubectl_exit_code_count{exit_code="1",namespace="app-b"} 1`,
-				`kube_applier_kubectl_exit_code_count{exit_code="0",namespace="app-c"} 1`,
-				`kube_applier_last_run_timestamp_seconds{namespace="app-a"}`,
-				`kube_applier_last_run_timestamp_seconds{namespace="app-b"}`,
-				`kube_applier_last_run_timestamp_seconds{namespace="app-c"}`,
-				`kube_applier_namespace_apply_count{namespace="app-a",success="true"} 1`,
-				`kube_applier_namespace_apply_count{namespace="app-b",success="false"} 1`,
-				`kube_applier_namespace_apply_count{namespace="app-c",success="true"} 1`,
+				`kube_applier_kubectl_exit_code_count{exit_code="0",namespace="app-a",waybill="app-a"} 1`,
+				`kube_applier_kubectl_exit_code_count{exit_code="1",namespace="app-b",waybill="app-b"} 1`,
+				`kube_applier_kubectl_exit_code_count{exit_code="0",namespace="app-c",waybill="app-c"} 1`,
+				`kube_applier_last_run_timestamp_seconds{namespace="app-a",waybill="app-a"}`,
+				`kube_applier_last_run_timestamp_seconds{namespace="app-b",waybill="app-b"}`,
+				`kube_applier_last_run_timestamp_seconds{namespace="app-c",waybill="app-c"}`,
+				`kube_applier_namespace_apply_count{namespace="app-a",success="true",waybill="app-a"} 1`,
+				`kube_applier_namespace_apply_count{namespace="app-b",success="false",waybill="app-b"} 1`,
+				`kube_applier_namespace_apply_count{namespace="app-c",success="true",waybill="app-c"} 1`,
 				`kube_applier_run_latency_seconds`,
-				`kube_applier_run_queue{namespace="app-a",type="Git polling run"} 0`,
-				`kube_applier_run_queue{namespace="app-b",type="Git polling run"} 0`,
-				`kube_applier_run_queue{namespace="app-c",type="Git polling run"} 0`,
+				`kube_applier_run_queue{namespace="app-a",type="Git polling run",waybill="app-a"} 0`,
+				`kube_applier_run_queue{namespace="app-b",type="Git polling run",waybill="app-b"} 0`,
+				`kube_applier_run_queue{namespace="app-c",type="Git polling run",waybill="app-c"} 0`,
 			})
 		})
 	})
@@ -309,7 +330,7 @@ deployment.apps/test-deployment created (server dry run)
 			if repositoryPath == "" {
 				repositoryPath = waybill.Namespace
 			}
-			headCommitHash, err := runner.Repository.HashForPath(context.TODO(), filepath.Join(runner.RepoPath, repositoryPath))
+			headCommitHash, err := runner.Repository.HashForPath(context.TODO(), filepath.Join(runner.RepoPath, repositoryPath), "")
 			Expect(err).To(BeNil())
 			expected := waybill
 			expected.Status = kubeapplierv1alpha1.WaybillStatus{
@@ -335,12 +356,12 @@ Error applying Secret(s) [-invalid]; kubectl output has been omitted as it may c
 			Expect(waybill).Should(matchWaybill(expected, kubeCtlPath, kustomizePath, runner.RepoPath, applyOptions.pruneWhitelist(&waybill, runner.PruneBlacklist)))
 
 			testMetrics([]string{
-				`kube_applier_kubectl_exit_code_count{exit_code="0",namespace="app-a-kustomize"} 1`,
-				`kube_applier_kubectl_exit_code_count{exit_code="1",namespace="app-a-kustomize"} 1`,
-				`kube_applier_last_run_timestamp_seconds{namespace="app-a-kustomize"}`,
-				`kube_applier_namespace_apply_count{namespace="app-a-kustomize",success="false"} 1`,
+				`kube_applier_kubectl_exit_code_count{exit_code="0",namespace="app-a-kustomize",waybill="app-a"} 1`,
+				`kube_applier_kubectl_exit_code_count{exit_code="1",namespace="app-a-kustomize",waybill="app-a"} 1`,
+				`kube_applier_last_run_timestamp_seconds{namespace="app-a-kustomize",waybill="app-a"}`,
+				`kube_applier_namespace_apply_count{namespace="app-a-kustomize",success="false",waybill="app-a"} 1`,
 				`kube_applier_run_latency_seconds`,
-				`kube_applier_run_queue{namespace="app-a-kustomize",type="Git polling run"} 0`,
+				`kube_applier_run_queue{namespace="app-a-kustomize",type="Git polling run",waybill="app-a"} 0`,
 			})
 		})
 	})
@@ -381,7 +402,7 @@ Error applying Secret(s) [-invalid]; kubectl output has been omitted as it may c
 				},
 				Type: corev1.SecretTypeOpaque,
 			})).To(BeNil())
-			headCommitHash, err := runner.Repository.HashForPath(context.TODO(), filepath.Join(runner.RepoPath, "app-d"))
+			headCommitHash, err := runner.Repository.HashForPath(context.TODO(), filepath.Join(runner.RepoPath, "app-d"), "")
 			Expect(err).To(BeNil())
 			Expect(headCommitHash).ToNot(BeEmpty())
 
@@ -426,10 +447,10 @@ Error applying Secret(s) [-invalid]; kubectl output has been omitted as it may c
 			}
 
 			testMetrics([]string{
-				`kube_applier_last_run_timestamp_seconds{namespace="app-d"}`,
-				`kube_applier_namespace_apply_count{namespace="app-d",success="true"} 1`,
+				`kube_applier_last_run_timestamp_seconds{namespace="app-d",waybill="app-d"}`,
+				`kube_applier_namespace_apply_count{namespace="app-d",success="true",waybill="app-d"} 1`,
 				`kube_applier_run_latency_seconds`,
-				`kube_applier_run_queue{namespace="app-d",type="Git polling run"} 0`,
+				`kube_applier_run_queue{namespace="app-d",type="Git polling run",waybill="app-d"} 0`,
 			})
 		})
 	})
@@ -469,7 +490,7 @@ AGE-SECRET-KEY-1GNC98E3WNPAXE49FATT434CFC2THV5Q0SLW45T3VNYUVZ4F8TY6SREQR9Q`,
 				},
 				Type: corev1.SecretTypeOpaque,
 			})).To(BeNil())
-			headCommitHash, err := runner.Repository.HashForPath(context.TODO(), filepath.Join(runner.RepoPath, "strongbox-age"))
+			headCommitHash, err := runner.Repository.HashForPath(context.TODO(), filepath.Join(runner.RepoPath, "strongbox-age"), "")
 			Expect(err).To(BeNil())
 			Expect(headCommitHash).ToNot(BeEmpty())
 
@@ -514,10 +535,10 @@ AGE-SECRET-KEY-1GNC98E3WNPAXE49FATT434CFC2THV5Q0SLW45T3VNYUVZ4F8TY6SREQR9Q`,
 			}
 
 			testMetrics([]string{
-				`kube_applier_last_run_timestamp_seconds{namespace="strongbox-age"}`,
-				`kube_applier_namespace_apply_count{namespace="strongbox-age",success="true"} 1`,
+				`kube_applier_last_run_timestamp_seconds{namespace="strongbox-age",waybill="strongbox-age"}`,
+				`kube_applier_namespace_apply_count{namespace="strongbox-age",success="true",waybill="strongbox-age"} 1`,
 				`kube_applier_run_latency_seconds`,
-				`kube_applier_run_queue{namespace="strongbox-age",type="Git polling run"} 0`,
+				`kube_applier_run_queue{namespace="strongbox-age",type="Git polling run",waybill="strongbox-age"} 0`,
 			})
 		})
 	})
@@ -586,7 +607,7 @@ AGE-SECRET-KEY-1GNC98E3WNPAXE49FATT434CFC2THV5Q0SLW45T3VNYUVZ4F8TY6SREQR9Q`,
 				Data: map[string][]byte{},
 			})).To(BeNil())
 
-			headCommitHash, err := runner.Repository.HashForPath(context.TODO(), filepath.Join(runner.RepoPath, "app-e"))
+			headCommitHash, err := runner.Repository.HashForPath(context.TODO(), filepath.Join(runner.RepoPath, "app-e"), "")
 			Expect(err).To(BeNil())
 			Expect(headCommitHash).ToNot(BeEmpty())
 
@@ -644,36 +665,44 @@ deployment.apps/test-deployment created
 			}
 
 			testMetrics([]string{
-				`kube_applier_kubectl_exit_code_count{exit_code="0",namespace="app-e"} 1`,
-				`kube_applier_namespace_apply_count{namespace="app-e",success="true"} 1`,
+				`kube_applier_kubectl_exit_code_count{exit_code="0",namespace="app-e",waybill="app-e"} 1`,
+				`kube_applier_namespace_apply_count{namespace="app-e",success="true",waybill="app-e"} 1`,
 				`kube_applier_run_latency_seconds`,
-				`kube_applier_run_queue{namespace="app-e-notfound",type="Git polling run"} 0`,
-				`kube_applier_run_queue{namespace="app-e-wrongtype",type="Git polling run"} 0`,
-				`kube_applier_run_queue{namespace="app-e",type="Git polling run"} 0`,
+				`kube_applier_run_queue{namespace="app-e-notfound",type="Git polling run",waybill="app-e"} 0`,
+				`kube_applier_run_queue{namespace="app-e-wrongtype",type="Git polling run",waybill="app-e"} 0`,
+				`kube_applier_run_queue{namespace="app-e",type="Git polling run",waybill="app-e"} 0`,
 			})
 		})
 	})
 
-	Context("When it fails to enqueue a run request", func() {
-		It("Should increase the respective metrics counter", func() {
-			smallRunQueue := make(chan Request, 1)
-			Enqueue(smallRunQueue, PollingRun, &kubeapplierv1alpha1.Waybill{
+	Context("When a run request is enqueued for a Waybill that is already queued", func() {
+		It("Should coalesce the requests and increase the respective metrics counter", func() {
+			queue := NewQueue()
+			Enqueue(queue, PollingRun, &kubeapplierv1alpha1.Waybill{
 				TypeMeta:   metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
 				ObjectMeta: metav1.ObjectMeta{Name: "appD", Namespace: "queued-ok"},
 			})
-			Enqueue(smallRunQueue, PollingRun, &kubeapplierv1alpha1.Waybill{
+			Enqueue(queue, PollingRun, &kubeapplierv1alpha1.Waybill{
 				TypeMeta:   metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
-				ObjectMeta: metav1.ObjectMeta{Name: "appD", Namespace: "failed-to-queue"},
+				ObjectMeta: metav1.ObjectMeta{Name: "appD", Namespace: "coalesced"},
 			})
+			Enqueue(queue, PollingRun, &kubeapplierv1alpha1.Waybill{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
+				ObjectMeta: metav1.ObjectMeta{Name: "appD", Namespace: "coalesced"},
+			})
+			Expect(queue.Len()).To(Equal(2))
 			testMetrics([]string{
-				`kube_applier_run_queue_failures{namespace="failed-to-queue",type="Git polling run"} 1`,
+				`kube_applier_run_queue_coalesced{namespace="coalesced",type="Git polling run",waybill="appD"} 1`,
+				`kube_applier_run_queue{namespace="coalesced",type="Git polling run",waybill="appD"} 1`,
 			})
-			Enqueue(smallRunQueue, PollingRun, &kubeapplierv1alpha1.Waybill{
+			Enqueue(queue, ScheduledRun, &kubeapplierv1alpha1.Waybill{
 				TypeMeta:   metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
-				ObjectMeta: metav1.ObjectMeta{Name: "appD", Namespace: "failed-to-queue"},
+				ObjectMeta: metav1.ObjectMeta{Name: "appD", Namespace: "coalesced"},
 			})
+			Expect(queue.Len()).To(Equal(2))
 			testMetrics([]string{
-				`kube_applier_run_queue_failures{namespace="failed-to-queue",type="Git polling run"} 2`,
+				`kube_applier_run_queue_coalesced{namespace="coalesced",type="Scheduled run",waybill="appD"} 1`,
+				`kube_applier_run_queue{namespace="coalesced",type="Git polling run",waybill="appD"} 1`,
 			})
 		})
 	})
@@ -893,20 +922,27 @@ var _ = Describe("Run Queue", func() {
 				},
 			}
 
-			fakeRunQueue := make(chan Request, 4)
+			fakeRunQueue := NewQueue()
 			Enqueue(fakeRunQueue, ScheduledRun, &waybill)
 			Enqueue(fakeRunQueue, PollingRun, &waybill)
 			Enqueue(fakeRunQueue, ForcedRun, &waybill)
 
-			close(fakeRunQueue)
+			fakeRunQueue.ShutDown()
 
 			res := []Request{}
-			for req := range fakeRunQueue {
+			for {
+				req, ok := fakeRunQueue.Get()
+				if !ok {
+					break
+				}
 				res = append(res, req)
+				fakeRunQueue.Done(req)
 			}
-			Expect(res).To(Equal([]Request{
-				{Type: ForcedRun, Waybill: &waybill},
-			}))
+			Expect(res).To(ConsistOf(MatchAllFields(Fields{
+				"Type":    Equal(ForcedRun),
+				"Waybill": Equal(&waybill),
+				"Queued":  Not(BeZero()),
+			})))
 		})
 	})
 })
@@ -980,6 +1016,7 @@ func matchWaybill(expected kubeapplierv1alpha1.Waybill, kubectlPath, kustomizePa
 			"Output":  outputMatcher,
 			"Started": Equal(expected.Status.LastRun.Started),
 			"Success": Equal(expected.Status.LastRun.Success),
+			"TraceID": Equal(expected.Status.LastRun.TraceID),
 			"Type":    Equal(expected.Status.LastRun.Type),
 		}))
 	}
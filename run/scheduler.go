@@ -3,17 +3,25 @@ package run
 import (
 	"context"
 	"fmt"
-	"path/filepath"
+	"hash/fnv"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/retry"
+
 	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
 	"github.com/utilitywarehouse/kube-applier/client"
 	"github.com/utilitywarehouse/kube-applier/clock"
+	"github.com/utilitywarehouse/kube-applier/cloudevents"
 	"github.com/utilitywarehouse/kube-applier/git"
 	"github.com/utilitywarehouse/kube-applier/log"
 	"github.com/utilitywarehouse/kube-applier/metrics"
+	"github.com/utilitywarehouse/kube-applier/shard"
 )
 
 // Type defines what kind of apply run is performed.
@@ -48,17 +56,31 @@ const (
 
 // Scheduler handles queueing apply runs.
 type Scheduler struct {
-	Clock               clock.ClockInterface
-	GitPollWait         time.Duration
-	KubeClient          *client.Client
-	Repository          *git.Repository
-	RepoPath            string
-	RunQueue            chan<- Request
+	Clock       clock.ClockInterface
+	Events      *cloudevents.Emitter
+	GitPollWait time.Duration
+	KubeClient  *client.Client
+	Repository  *git.Repository
+	RepoPath    string
+	RunQueue    *Queue
+	// ScheduledRunJitter is the fraction of their run interval that the
+	// scheduled runs of overdue Waybills are spread over when the Scheduler
+	// starts, instead of all being queued at once.
+	ScheduledRunJitter float64
+	// ScheduledRunRateLimit is the maximum number of scheduled runs that are
+	// queued per minute. Zero means no limit.
+	ScheduledRunRateLimit int
+	// Sharder limits the Waybills that are scheduled to those owned by this
+	// replica. If it is nil, all Waybills are scheduled.
+	Sharder             *shard.Sharder
 	WaybillPollInterval time.Duration
 	waybills            map[string]*kubeapplierv1alpha1.Waybill
 	waybillSchedulers   map[string]func()
 	waybillsMutex       sync.Mutex
+	blockedCommits      map[string]string
 	gitLastQueuedHash   string
+	scheduledRunLimiter *rate.Limiter
+	started             time.Time
 	stop                chan bool
 	waitGroup           *sync.WaitGroup
 }
@@ -73,6 +95,10 @@ func (s *Scheduler) Start() {
 	}
 	s.stop = make(chan bool)
 	s.waitGroup = &sync.WaitGroup{}
+	s.started = s.Clock.Now()
+	if s.ScheduledRunRateLimit > 0 {
+		s.scheduledRunLimiter = rate.NewLimiter(rate.Limit(float64(s.ScheduledRunRateLimit)/60), 1)
+	}
 	s.waybills = make(map[string]*kubeapplierv1alpha1.Waybill)
 	s.waybillSchedulers = make(map[string]func())
 
@@ -104,43 +130,104 @@ func (s *Scheduler) updateWaybills() {
 	ctx, cancel := context.WithTimeout(context.Background(), s.WaybillPollInterval-time.Second)
 	defer cancel()
 
-	waybills, err := s.KubeClient.ListWaybills(ctx)
+	all, err := s.KubeClient.ListWaybills(ctx)
 	if err != nil {
 		log.Logger("scheduler").Error("Could not list Waybills", "error", err)
 		return
 	}
+	// Waybills owned by other replicas are dropped, which stops their loops
+	// when they are reassigned
+	waybills := make([]kubeapplierv1alpha1.Waybill, 0, len(all))
+	for i := range all {
+		if s.Sharder.Owns(&all[i]) {
+			waybills = append(waybills, all[i])
+		}
+	}
 	metrics.ReconcileFromWaybillList(waybills)
 	metrics.UpdateResultSummary(waybills)
 	s.waybillsMutex.Lock()
+	current := map[string]bool{}
+	var forced []*kubeapplierv1alpha1.Waybill
 	for i := range waybills {
 		wb := &waybills[i]
-		if v, ok := s.waybills[wb.Namespace]; ok {
+		key := waybillKey(wb)
+		current[key] = true
+		if v, ok := s.waybills[key]; ok {
 			if !reflect.DeepEqual(v, wb) {
-				s.waybillSchedulers[wb.Namespace]()
-				s.waybillSchedulers[wb.Namespace] = s.newWaybillLoop(wb)
-				s.waybills[wb.Namespace] = wb
-				log.Logger("scheduler").Debug("Waybill changed, updating schedulers", "waybill", fmt.Sprintf("%s/%s", wb.Namespace, wb.Name))
+				s.waybillSchedulers[key]()
+				s.waybillSchedulers[key] = s.newWaybillLoop(wb)
+				s.waybills[key] = wb
+				log.Logger("scheduler").Debug("Waybill changed, updating schedulers", "waybill", key)
+				if forceRunPending(wb) {
+					forced = append(forced, wb)
+				}
 			}
 		} else {
-			s.waybillSchedulers[wb.Namespace] = s.newWaybillLoop(wb)
-			s.waybills[wb.Namespace] = wb
-		}
-	}
-	for ns := range s.waybills {
-		found := false
-		for _, wb := range waybills {
-			if ns == wb.Namespace {
-				found = true
-				break
+			s.waybillSchedulers[key] = s.newWaybillLoop(wb)
+			s.waybills[key] = wb
+			if forceRunPending(wb) {
+				forced = append(forced, wb)
 			}
 		}
-		if !found {
-			s.waybillSchedulers[ns]()
-			delete(s.waybillSchedulers, ns)
-			delete(s.waybills, ns)
+	}
+	for key := range s.waybills {
+		if !current[key] {
+			s.waybillSchedulers[key]()
+			delete(s.waybillSchedulers, key)
+			delete(s.waybills, key)
 		}
 	}
 	s.waybillsMutex.Unlock()
+	for _, wb := range forced {
+		log.Logger("scheduler").Info("Forced run requested by another replica", "waybill", waybillKey(wb))
+		s.enqueue(ForcedRun, wb)
+		s.acknowledgeForceRun(ctx, wb)
+	}
+}
+
+// forceRunPending returns true if a forced run was requested for the Waybill,
+// through the ForceRunRequestedAnnotation, after its last run started.
+// Since the requests are compared against the status of the Waybill, they are
+// not lost when the leader changes before they are picked up. The start time
+// of runs is stored with second precision, so requests made in the same second
+// as the last run started are considered pending.
+func forceRunPending(waybill *kubeapplierv1alpha1.Waybill) bool {
+	v, ok := waybill.Annotations[kubeapplierv1alpha1.ForceRunRequestedAnnotation]
+	if !ok {
+		return false
+	}
+	requested, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		log.Logger("scheduler").Warn("Invalid forced run request", "waybill", waybillKey(waybill), "value", v, "error", err)
+		return false
+	}
+	return waybill.Status.LastRun == nil || !requested.Before(waybill.Status.LastRun.Started.Truncate(time.Second))
+}
+
+// acknowledgeForceRun removes the ForceRunRequestedAnnotation from the Waybill
+// once its run is queued, unless a newer request was recorded in the meantime.
+func (s *Scheduler) acknowledgeForceRun(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) {
+	requested := waybill.Annotations[kubeapplierv1alpha1.ForceRunRequestedAnnotation]
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		wb, err := s.KubeClient.GetWaybill(ctx, waybill.Namespace, waybill.Name)
+		if err != nil {
+			return err
+		}
+		if wb.Annotations[kubeapplierv1alpha1.ForceRunRequestedAnnotation] != requested {
+			return nil
+		}
+		delete(wb.Annotations, kubeapplierv1alpha1.ForceRunRequestedAnnotation)
+		return s.KubeClient.UpdateWaybill(ctx, wb)
+	})
+	if err != nil {
+		log.Logger("scheduler").Warn("Could not acknowledge forced run request", "waybill", waybillKey(waybill), "error", err)
+	}
+}
+
+// waybillKey returns the key used to identify a Waybill in the Scheduler, in
+// the form of namespace/name.
+func waybillKey(waybill *kubeapplierv1alpha1.Waybill) string {
+	return fmt.Sprintf("%s/%s", waybill.Namespace, waybill.Name)
 }
 
 func (s *Scheduler) updateWaybillsLoop() {
@@ -152,6 +239,8 @@ func (s *Scheduler) updateWaybillsLoop() {
 		select {
 		case <-ticker.C:
 			s.updateWaybills()
+		case <-s.Sharder.Changed():
+			s.updateWaybills()
 		case <-s.stop:
 			return
 		}
@@ -164,8 +253,9 @@ func (s *Scheduler) gitPollingLoop() {
 		select {
 		case <-time.After(s.GitPollWait):
 			for _, wb := range s.waybillsWithGitChanges() {
-				Enqueue(s.RunQueue, PollingRun, wb)
+				s.enqueue(PollingRun, wb)
 			}
+			s.updateBlockedWaybills()
 		case <-s.stop:
 			return
 		}
@@ -189,11 +279,41 @@ func (s *Scheduler) waybillsWithGitChanges() []*kubeapplierv1alpha1.Waybill {
 	ctx, cancel := context.WithTimeout(context.Background(), gitPollTimeout)
 	defer cancel()
 
-	hash, err := s.Repository.HashForPath(ctx, s.RepoPath)
-	if err != nil {
-		log.Logger("scheduler").Warn("Git polling could not get HEAD hash", "error", err)
-		return nil
+	s.waybillsMutex.Lock()
+	waybills := make([]*kubeapplierv1alpha1.Waybill, 0, len(s.waybills))
+	for _, wb := range s.waybills {
+		waybills = append(waybills, wb)
+	}
+	s.waybillsMutex.Unlock()
+
+	// Waybills can override the revision, so the hash of each revision in use
+	// is tracked, with the configured revision denoted by an empty string
+	revisions := map[string]string{"": ""}
+	for _, wb := range waybills {
+		revisions[wb.Spec.Revision] = ""
+	}
+	names := make([]string, 0, len(revisions))
+	for rev := range revisions {
+		names = append(names, rev)
+	}
+	sort.Strings(names)
+	var key []string
+	for _, rev := range names {
+		hash, err := s.Repository.HashForPath(ctx, s.RepoPath, rev)
+		if err != nil {
+			log.Logger("scheduler").Warn("Git polling could not get revision hash", "revision", rev, "error", err)
+			if rev == "" {
+				return nil
+			}
+		}
+		revisions[rev] = hash
+		if rev == "" {
+			key = append(key, hash)
+		} else {
+			key = append(key, fmt.Sprintf("%s=%s", rev, hash))
+		}
 	}
+	hash := strings.Join(key, " ")
 
 	s.waybillsMutex.Lock()
 	if hash == s.gitLastQueuedHash {
@@ -203,19 +323,26 @@ func (s *Scheduler) waybillsWithGitChanges() []*kubeapplierv1alpha1.Waybill {
 	// Reserve this hash before doing any slow checks so a concurrent call does
 	// not process the same commit again.
 	s.gitLastQueuedHash = hash
-	waybills := make([]*kubeapplierv1alpha1.Waybill, 0, len(s.waybills))
-	for _, wb := range s.waybills {
-		waybills = append(waybills, wb)
-	}
 	s.waybillsMutex.Unlock()
 
 	log.Logger("scheduler").Debug("New HEAD hash detected, checking for Waybills that need to be applied", "hash", hash)
 
 	var result []*kubeapplierv1alpha1.Waybill
 	for i := range waybills {
+		// Polling runs are suspended while the Waybill is pinned by a
+		// rollback, until a newer commit is available for it
+		if waybills[i].Annotations[kubeapplierv1alpha1.RollbackCommitAnnotation] != "" {
+			if wb := s.releaseRollback(ctx, waybills[i]); wb != nil {
+				result = append(result, wb)
+			}
+			continue
+		}
+		revisionHash := revisions[waybills[i].Spec.Revision]
 		// If LastRun is nil, we don't trigger the Polling run at all
 		// and instead rely on the Scheduled run to kickstart things.
-		if waybills[i].Status.LastRun == nil || waybills[i].Status.LastRun.Commit == hash {
+		// Waybills with a revision that cannot be resolved are left to the
+		// Scheduled run, which reports the error.
+		if waybills[i].Status.LastRun == nil || revisionHash == "" || waybills[i].Status.LastRun.Commit == revisionHash {
 			continue
 		}
 		sinceHash := waybills[i].Status.LastRun.Commit
@@ -229,12 +356,9 @@ func (s *Scheduler) waybillsWithGitChanges() []*kubeapplierv1alpha1.Waybill {
 			result = append(result, waybills[i])
 			continue
 		}
-		path := waybills[i].Spec.RepositoryPath
-		if path == "" {
-			path = waybills[i].Namespace
-		}
+		path := WaybillPath(s.RepoPath, waybills[i])
 		wbId := fmt.Sprintf("%s/%s", waybills[i].Namespace, waybills[i].Name)
-		changed, err := s.Repository.HasChangesForPath(ctx, filepath.Join(s.RepoPath, path), sinceHash)
+		changed, err := s.Repository.HasChangesForPath(ctx, path, sinceHash, waybills[i].Spec.Revision)
 		if err != nil {
 			log.Logger("scheduler").Warn("Could not check path for changes, forcing polling run", "waybill", wbId, "path", path, "since", sinceHash, "error", err)
 			result = append(result, waybills[i])
@@ -247,6 +371,105 @@ func (s *Scheduler) waybillsWithGitChanges() []*kubeapplierv1alpha1.Waybill {
 	return result
 }
 
+// releaseRollback removes the pin of a Waybill that was rolled back, if there
+// are changes under its path since the commit that it was rolled back from,
+// and returns the updated Waybill so that the changes are applied. It returns
+// nil if the Waybill remains pinned.
+func (s *Scheduler) releaseRollback(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) *kubeapplierv1alpha1.Waybill {
+	wbId := waybillKey(waybill)
+	commit := waybill.Annotations[kubeapplierv1alpha1.RollbackCommitAnnotation]
+	from := waybill.Annotations[kubeapplierv1alpha1.RollbackFromAnnotation]
+	if from == "" {
+		return nil
+	}
+	path := WaybillPath(s.RepoPath, waybill)
+	changed, err := s.Repository.HasChangesForPath(ctx, path, from, waybill.Spec.Revision)
+	if err != nil {
+		log.Logger("scheduler").Warn("Could not check path of rolled back Waybill for changes", "waybill", wbId, "path", path, "since", from, "error", err)
+		return nil
+	}
+	if !changed {
+		return nil
+	}
+	var (
+		updated  *kubeapplierv1alpha1.Waybill
+		released bool
+	)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		wb, err := s.KubeClient.GetWaybill(ctx, waybill.Namespace, waybill.Name)
+		if err != nil {
+			return err
+		}
+		updated, released = wb, false
+		// The pin might have been cleared already
+		if wb.Annotations[kubeapplierv1alpha1.RollbackCommitAnnotation] == "" {
+			return nil
+		}
+		delete(wb.Annotations, kubeapplierv1alpha1.RollbackCommitAnnotation)
+		delete(wb.Annotations, kubeapplierv1alpha1.RollbackFromAnnotation)
+		released = true
+		return s.KubeClient.UpdateWaybill(ctx, wb)
+	})
+	if err != nil {
+		log.Logger("scheduler").Warn("Could not release rollback of Waybill", "waybill", wbId, "error", err)
+		return nil
+	}
+	if released {
+		log.Logger("scheduler").Info("Newer commit available, releasing rollback", "waybill", wbId, "commit", commit)
+		s.KubeClient.EmitWaybillEvent(updated, corev1.EventTypeNormal, "WaybillRollbackReleased", "Rollback to commit %s released, changes were committed since commit %s", commit, from)
+	}
+	return updated
+}
+
+// updateBlockedWaybills marks the Waybills with changes that are held back,
+// because the latest revision on the remote failed signature verification.
+// An event is emitted for each Waybill once per rejected revision.
+func (s *Scheduler) updateBlockedWaybills() {
+	verification := s.Repository.Verification()
+	s.waybillsMutex.Lock()
+	if s.blockedCommits == nil {
+		s.blockedCommits = make(map[string]string)
+	}
+	blocked := make(map[*kubeapplierv1alpha1.Waybill]bool, len(s.waybills))
+	var newlyBlocked []*kubeapplierv1alpha1.Waybill
+	for key, wb := range s.waybills {
+		blocked[wb] = verification.Blocks(WaybillPath(s.RepoPath, wb))
+		if !blocked[wb] {
+			delete(s.blockedCommits, key)
+			continue
+		}
+		if s.blockedCommits[key] != verification.Commit {
+			s.blockedCommits[key] = verification.Commit
+			newlyBlocked = append(newlyBlocked, wb)
+		}
+	}
+	for key := range s.blockedCommits {
+		if _, ok := s.waybills[key]; !ok {
+			delete(s.blockedCommits, key)
+		}
+	}
+	s.waybillsMutex.Unlock()
+	metrics.ReconcileBlockedWaybills(blocked)
+	for _, wb := range newlyBlocked {
+		log.Logger("scheduler").Warn("Waybill is blocked by a commit that failed signature verification", "waybill", waybillKey(wb), "commit", verification.UnverifiedCommit, "reason", verification.Reason)
+		s.KubeClient.EmitWaybillEvent(wb, corev1.EventTypeWarning, "WaybillBlocked", "Changes in commit %s are not applied, signature verification of commit %s failed: %s", verification.Commit, verification.UnverifiedCommit, verification.Reason)
+	}
+}
+
+// enqueue adds a run request for the Waybill to the RunQueue and emits an
+// event if it was added as a new request, rather than dropped or coalesced
+// with a request that is already queued.
+func (s *Scheduler) enqueue(t Type, waybill *kubeapplierv1alpha1.Waybill) {
+	if Enqueue(s.RunQueue, t, waybill) {
+		s.Events.Emit(cloudevents.TypeRunQueued, cloudevents.Data{
+			Namespace: waybill.Namespace,
+			Name:      waybill.Name,
+			RunType:   t.String(),
+			DryRun:    waybill.Spec.DryRun,
+		})
+	}
+}
+
 func (s *Scheduler) newWaybillLoop(waybill *kubeapplierv1alpha1.Waybill) func() {
 	stop := make(chan bool)
 	stopped := make(chan bool)
@@ -256,14 +479,20 @@ func (s *Scheduler) newWaybillLoop(waybill *kubeapplierv1alpha1.Waybill) func()
 		// Immediately trigger if there is no previous run recorded, otherwise
 		// wait for the proper amount of time in order to maintain the period.
 		// If it's been too long, it will still trigger immediately since the
-		// wait duration is going to be negative.
+		// wait duration is going to be negative, unless it is spread by
+		// ScheduledRunJitter.
 		if waybill.Status.LastRun == nil {
-			Enqueue(s.RunQueue, ScheduledRun, waybill)
+			if !s.waitScheduledRunLimit(stop) {
+				return
+			}
+			s.enqueue(ScheduledRun, waybill)
 		} else {
-			runAt := waybill.Status.LastRun.Started.Add(time.Duration(waybill.Spec.RunInterval) * time.Second)
 			select {
-			case <-time.After(runAt.Sub(s.Clock.Now())):
-				Enqueue(s.RunQueue, ScheduledRun, waybill)
+			case <-time.After(s.nextScheduledRun(waybill).Sub(s.Clock.Now())):
+				if !s.waitScheduledRunLimit(stop) {
+					return
+				}
+				s.enqueue(ScheduledRun, waybill)
 			case <-stop:
 				return
 			}
@@ -273,7 +502,10 @@ func (s *Scheduler) newWaybillLoop(waybill *kubeapplierv1alpha1.Waybill) func()
 		for {
 			select {
 			case <-ticker.C:
-				Enqueue(s.RunQueue, ScheduledRun, waybill)
+				if !s.waitScheduledRunLimit(stop) {
+					return
+				}
+				s.enqueue(ScheduledRun, waybill)
 			case <-stop:
 				return
 			}
@@ -284,3 +516,47 @@ func (s *Scheduler) newWaybillLoop(waybill *kubeapplierv1alpha1.Waybill) func()
 		<-stopped
 	}
 }
+
+// nextScheduledRun returns the time of the next scheduled run of a Waybill
+// with a previous run, which maintains the period since that run. Waybills
+// that become overdue while kube-applier is not running would all be queued
+// as soon as the Scheduler starts, so their runs are spread over the first
+// ScheduledRunJitter fraction of their run interval instead. The offset of
+// each Waybill is derived from its namespace and name, so it does not change
+// when the loop of the Waybill is restarted.
+func (s *Scheduler) nextScheduledRun(waybill *kubeapplierv1alpha1.Waybill) time.Time {
+	interval := time.Duration(waybill.Spec.RunInterval) * time.Second
+	runAt := waybill.Status.LastRun.Started.Add(interval)
+	window := time.Duration(float64(interval) * s.ScheduledRunJitter)
+	if window <= 0 {
+		return runAt
+	}
+	if jitterAt := s.started.Add(jitterOffset(waybillKey(waybill), window)); runAt.Before(jitterAt) {
+		return jitterAt
+	}
+	return runAt
+}
+
+// jitterOffset returns an offset within the window, derived from a hash of
+// the key.
+func jitterOffset(key string, window time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return time.Duration(h.Sum64() % uint64(window))
+}
+
+// waitScheduledRunLimit blocks until a scheduled run is allowed by
+// ScheduledRunRateLimit. It returns false if stop is closed first.
+func (s *Scheduler) waitScheduledRunLimit(stop <-chan bool) bool {
+	if s.scheduledRunLimiter == nil {
+		return true
+	}
+	r := s.scheduledRunLimiter.Reserve()
+	select {
+	case <-time.After(r.Delay()):
+		return true
+	case <-stop:
+		r.Cancel()
+		return false
+	}
+}
@@ -0,0 +1,41 @@
+package run
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+func TestForceRunPending(t *testing.T) {
+	lastRun := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	waybill := func(requested string, lastRun *time.Time) *kubeapplierv1alpha1.Waybill {
+		wb := &kubeapplierv1alpha1.Waybill{
+			ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"},
+		}
+		if requested != "" {
+			wb.Annotations = map[string]string{kubeapplierv1alpha1.ForceRunRequestedAnnotation: requested}
+		}
+		if lastRun != nil {
+			wb.Status.LastRun = &kubeapplierv1alpha1.WaybillStatusRun{Started: metav1.NewTime(*lastRun)}
+		}
+		return wb
+	}
+
+	assert.False(t, forceRunPending(waybill("", &lastRun)))
+	assert.False(t, forceRunPending(waybill("invalid", nil)))
+	assert.True(t, forceRunPending(waybill("2024-03-01T11:00:00Z", nil)))
+	assert.True(t, forceRunPending(waybill("2024-03-01T12:00:01Z", &lastRun)))
+	// The request was picked up by a run that started afterwards
+	assert.False(t, forceRunPending(waybill("2024-03-01T11:59:59Z", &lastRun)))
+	assert.False(t, forceRunPending(waybill("2024-03-01T11:59:59.999999999Z", &lastRun)))
+	// Requests in the same second as the last run are not dropped, since the
+	// start time of runs is stored with second precision
+	assert.True(t, forceRunPending(waybill("2024-03-01T12:00:00Z", &lastRun)))
+	assert.True(t, forceRunPending(waybill("2024-03-01T12:00:00.5Z", &lastRun)))
+	started := lastRun.Add(700 * time.Millisecond)
+	assert.True(t, forceRunPending(waybill("2024-03-01T12:00:00.9Z", &started)))
+}
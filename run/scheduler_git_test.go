@@ -27,15 +27,15 @@ func TestWaybillsWithGitChanges(t *testing.T) {
 	ctx := context.Background()
 	testRepo, repoPath, hashes := createTestGitRepository(t)
 
-	headHash, err := testRepo.HashForPath(ctx, repoPath)
+	headHash, err := testRepo.HashForPath(ctx, repoPath, "")
 	require.NoError(t, err)
 	require.Equal(t, hashes.head, headHash)
 
-	appAHash, err := testRepo.HashForPath(ctx, filepath.Join(repoPath, "app-a"))
+	appAHash, err := testRepo.HashForPath(ctx, filepath.Join(repoPath, "app-a"), "")
 	require.NoError(t, err)
 	require.Equal(t, hashes.appA, appAHash)
 
-	appAKHash, err := testRepo.HashForPath(ctx, filepath.Join(repoPath, "app-a-kustomize"))
+	appAKHash, err := testRepo.HashForPath(ctx, filepath.Join(repoPath, "app-a-kustomize"), "")
 	require.NoError(t, err)
 	require.Equal(t, hashes.appAK, appAKHash)
 
@@ -149,6 +149,55 @@ func TestWaybillsWithGitChanges(t *testing.T) {
 		assert.Equal(t, "scheduler-polling-app-a-kustomize", result[0].Namespace)
 	})
 
+	t.Run("compares Waybill with its own revision", func(t *testing.T) {
+		initial := runGit(t, repoPath, "rev-parse", hashes.initial)
+		s := makeScheduler(map[string]*kubeapplierv1alpha1.Waybill{
+			"pinned": {
+				ObjectMeta: metav1.ObjectMeta{Namespace: "pinned"},
+				Spec: kubeapplierv1alpha1.WaybillSpec{
+					RepositoryPath: "app-a-kustomize",
+					Revision:       initial,
+				},
+				Status: kubeapplierv1alpha1.WaybillStatus{
+					LastRun: &kubeapplierv1alpha1.WaybillStatusRun{
+						Commit:   staleHash,
+						Started:  now,
+						Finished: now,
+					},
+				},
+			},
+		}, headHash)
+		result := s.waybillsWithGitChanges()
+		assert.Empty(t, result)
+		assert.Equal(t, headHash+" "+initial+"="+staleHash, s.gitLastQueuedHash)
+	})
+
+	t.Run("skips Waybill pinned by a rollback", func(t *testing.T) {
+		s := makeScheduler(map[string]*kubeapplierv1alpha1.Waybill{
+			"rolled-back": {
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "rolled-back",
+					Annotations: map[string]string{
+						kubeapplierv1alpha1.RollbackCommitAnnotation: runGit(t, repoPath, "rev-parse", staleHash),
+						kubeapplierv1alpha1.RollbackFromAnnotation:   appAKHash,
+					},
+				},
+				Spec: kubeapplierv1alpha1.WaybillSpec{
+					RepositoryPath: "app-a-kustomize",
+				},
+				Status: kubeapplierv1alpha1.WaybillStatus{
+					LastRun: &kubeapplierv1alpha1.WaybillStatusRun{
+						Commit:   staleHash,
+						Started:  now,
+						Finished: now,
+					},
+				},
+			},
+		}, "")
+		result := s.waybillsWithGitChanges()
+		assert.Empty(t, result)
+	})
+
 	t.Run("returns Waybill with empty Commit in LastRun", func(t *testing.T) {
 		s := makeScheduler(map[string]*kubeapplierv1alpha1.Waybill{
 			"empty-commit": {
@@ -288,9 +337,9 @@ func createTestGitRepository(t *testing.T) (*git.Repository, string, testGitRepo
 	require.NoError(t, err)
 
 	ctx := context.Background()
-	appAHash, err := testRepo.HashForPath(ctx, filepath.Join(repoPath, "app-a"))
+	appAHash, err := testRepo.HashForPath(ctx, filepath.Join(repoPath, "app-a"), "")
 	require.NoError(t, err)
-	appAKHash, err := testRepo.HashForPath(ctx, filepath.Join(repoPath, "app-a-kustomize"))
+	appAKHash, err := testRepo.HashForPath(ctx, filepath.Join(repoPath, "app-a-kustomize"), "")
 	require.NoError(t, err)
 
 	return testRepo, repoPath, testGitRepoHashes{
@@ -0,0 +1,62 @@
+package run
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+func TestJitterOffset(t *testing.T) {
+	window := 6 * time.Minute
+	offsets := map[time.Duration]bool{}
+	for _, key := range []string{"ns-a/main", "ns-b/main", "ns-c/main", "ns-c/other"} {
+		offset := jitterOffset(key, window)
+		assert.GreaterOrEqual(t, offset, time.Duration(0))
+		assert.Less(t, offset, window)
+		// Offsets are deterministic
+		assert.Equal(t, offset, jitterOffset(key, window))
+		offsets[offset] = true
+	}
+	assert.Len(t, offsets, 4)
+}
+
+func TestScheduler_nextScheduledRun(t *testing.T) {
+	started := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	waybill := func(lastRun time.Time) *kubeapplierv1alpha1.Waybill {
+		return &kubeapplierv1alpha1.Waybill{
+			ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"},
+			Spec:       kubeapplierv1alpha1.WaybillSpec{RunInterval: 3600},
+			Status: kubeapplierv1alpha1.WaybillStatus{
+				LastRun: &kubeapplierv1alpha1.WaybillStatusRun{Started: metav1.NewTime(lastRun)},
+			},
+		}
+	}
+	offset := jitterOffset("foo/main", 6*time.Minute)
+
+	// Without jitter the period is maintained, even for overdue Waybills
+	s := &Scheduler{started: started}
+	assert.Equal(t, started.Add(-time.Hour), s.nextScheduledRun(waybill(started.Add(-2*time.Hour))))
+
+	s.ScheduledRunJitter = 0.1
+	// Overdue Waybills are spread over the jitter window
+	assert.Equal(t, started.Add(offset), s.nextScheduledRun(waybill(started.Add(-2*time.Hour))))
+	// Waybills that are not due within the window are not affected
+	assert.Equal(t, started.Add(30*time.Minute), s.nextScheduledRun(waybill(started.Add(-30*time.Minute))))
+}
+
+func TestScheduler_waitScheduledRunLimit(t *testing.T) {
+	s := &Scheduler{}
+	assert.True(t, s.waitScheduledRunLimit(nil))
+
+	s.scheduledRunLimiter = rate.NewLimiter(rate.Limit(1.0/60), 1)
+	stop := make(chan bool)
+	assert.True(t, s.waitScheduledRunLimit(stop))
+	// The next run is only allowed after a minute
+	close(stop)
+	assert.False(t, s.waitScheduledRunLimit(stop))
+}
@@ -53,36 +53,40 @@ Some error output has been omitted because it may contain sensitive data
 	metrics.ReconcileFromWaybillList(wbList)
 	metrics.UpdateResultSummary(wbList)
 
-	assertMetricValue(t, "kube_applier_waybill_spec_auto_apply", map[string]string{"namespace": "metrics-bar"}, 1)
-	assertMetricValue(t, "kube_applier_waybill_spec_auto_apply", map[string]string{"namespace": "metrics-foo"}, 1)
-	assertMetricValue(t, "kube_applier_waybill_spec_dry_run", map[string]string{"namespace": "metrics-bar"}, 0)
-	assertMetricValue(t, "kube_applier_waybill_spec_dry_run", map[string]string{"namespace": "metrics-foo"}, 0)
-	assertMetricValue(t, "kube_applier_waybill_spec_run_interval", map[string]string{"namespace": "metrics-bar"}, 3600)
-	assertMetricValue(t, "kube_applier_waybill_spec_run_interval", map[string]string{"namespace": "metrics-foo"}, 3600)
+	assertMetricValue(t, "kube_applier_waybill_spec_auto_apply", map[string]string{"namespace": "metrics-bar", "waybill": "main"}, 1)
+	assertMetricValue(t, "kube_applier_waybill_spec_auto_apply", map[string]string{"namespace": "metrics-foo", "waybill": "main"}, 1)
+	assertMetricValue(t, "kube_applier_waybill_spec_dry_run", map[string]string{"namespace": "metrics-bar", "waybill": "main"}, 0)
+	assertMetricValue(t, "kube_applier_waybill_spec_dry_run", map[string]string{"namespace": "metrics-foo", "waybill": "main"}, 0)
+	assertMetricValue(t, "kube_applier_waybill_spec_run_interval", map[string]string{"namespace": "metrics-bar", "waybill": "main"}, 3600)
+	assertMetricValue(t, "kube_applier_waybill_spec_run_interval", map[string]string{"namespace": "metrics-foo", "waybill": "main"}, 3600)
 
 	assertMetricValue(t, "kube_applier_result_summary", map[string]string{
 		"action":    "created",
 		"name":      "metrics-foo",
 		"namespace": "metrics-foo",
 		"type":      "namespace",
+		"waybill":   "main",
 	}, 1)
 	assertMetricValue(t, "kube_applier_result_summary", map[string]string{
 		"action":    "created",
 		"name":      "test-a",
 		"namespace": "metrics-foo",
 		"type":      "deployment.apps",
+		"waybill":   "main",
 	}, 1)
 	assertMetricValue(t, "kube_applier_result_summary", map[string]string{
 		"action":    "unchanged",
 		"name":      "test-b",
 		"namespace": "metrics-foo",
 		"type":      "deployment.apps",
+		"waybill":   "main",
 	}, 1)
 	assertMetricValue(t, "kube_applier_result_summary", map[string]string{
 		"action":    "configured",
 		"name":      "test-c",
 		"namespace": "metrics-foo",
 		"type":      "deployment.apps",
+		"waybill":   "main",
 	}, 1)
 }
 
@@ -119,17 +123,17 @@ func TestSchedulerMetrics_waybillSpecFromClusterState(t *testing.T) {
 
 	metrics.ReconcileFromWaybillList(wbList)
 
-	assertMetricValue(t, "kube_applier_waybill_spec_dry_run", map[string]string{"namespace": "spec-foo"}, 0)
-	assertMetricValue(t, "kube_applier_waybill_spec_auto_apply", map[string]string{"namespace": "spec-foo"}, 1)
-	assertMetricValue(t, "kube_applier_waybill_spec_run_interval", map[string]string{"namespace": "spec-foo"}, 5)
+	assertMetricValue(t, "kube_applier_waybill_spec_dry_run", map[string]string{"namespace": "spec-foo", "waybill": "main"}, 0)
+	assertMetricValue(t, "kube_applier_waybill_spec_auto_apply", map[string]string{"namespace": "spec-foo", "waybill": "main"}, 1)
+	assertMetricValue(t, "kube_applier_waybill_spec_run_interval", map[string]string{"namespace": "spec-foo", "waybill": "main"}, 5)
 
-	assertMetricValue(t, "kube_applier_waybill_spec_dry_run", map[string]string{"namespace": "spec-bar"}, 1)
-	assertMetricValue(t, "kube_applier_waybill_spec_auto_apply", map[string]string{"namespace": "spec-bar"}, 1)
-	assertMetricValue(t, "kube_applier_waybill_spec_run_interval", map[string]string{"namespace": "spec-bar"}, 3600)
+	assertMetricValue(t, "kube_applier_waybill_spec_dry_run", map[string]string{"namespace": "spec-bar", "waybill": "main"}, 1)
+	assertMetricValue(t, "kube_applier_waybill_spec_auto_apply", map[string]string{"namespace": "spec-bar", "waybill": "main"}, 1)
+	assertMetricValue(t, "kube_applier_waybill_spec_run_interval", map[string]string{"namespace": "spec-bar", "waybill": "main"}, 3600)
 
-	assertMetricValue(t, "kube_applier_waybill_spec_dry_run", map[string]string{"namespace": "spec-baz"}, 0)
-	assertMetricValue(t, "kube_applier_waybill_spec_auto_apply", map[string]string{"namespace": "spec-baz"}, 0)
-	assertMetricValue(t, "kube_applier_waybill_spec_run_interval", map[string]string{"namespace": "spec-baz"}, 3600)
+	assertMetricValue(t, "kube_applier_waybill_spec_dry_run", map[string]string{"namespace": "spec-baz", "waybill": "main"}, 0)
+	assertMetricValue(t, "kube_applier_waybill_spec_auto_apply", map[string]string{"namespace": "spec-baz", "waybill": "main"}, 0)
+	assertMetricValue(t, "kube_applier_waybill_spec_run_interval", map[string]string{"namespace": "spec-baz", "waybill": "main"}, 3600)
 }
 
 func assertMetricValue(t *testing.T, name string, labels map[string]string, expected float64) {
@@ -175,3 +179,28 @@ func labelsMatch(actual []*dto.LabelPair, expected map[string]string) bool {
 	}
 	return true
 }
+
+func TestNewCommitApplied(t *testing.T) {
+	run := func(commit string, success bool) *kubeapplierv1alpha1.WaybillStatusRun {
+		return &kubeapplierv1alpha1.WaybillStatusRun{Commit: commit, Success: success}
+	}
+	testCases := []struct {
+		name        string
+		lastRun     *kubeapplierv1alpha1.WaybillStatusRun
+		previousRun *kubeapplierv1alpha1.WaybillStatusRun
+		expected    bool
+	}{
+		{"first run", run("a", true), nil, true},
+		{"new commit", run("b", true), run("a", true), true},
+		{"same commit", run("a", true), run("a", true), false},
+		{"same commit after a failure", run("a", true), run("a", false), true},
+		{"failed run", run("b", false), run("a", true), false},
+		{"no commit", run("", true), nil, false},
+		{"no run", nil, run("a", true), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, newCommitApplied(tc.lastRun, tc.previousRun))
+		})
+	}
+}
@@ -19,16 +19,21 @@ import (
 	"github.com/utilitywarehouse/kube-applier/metrics"
 )
 
-func testSchedulerDrainRequests(requests <-chan Request) (func() []Request, func()) {
+func testSchedulerDrainRequests(requests *Queue) (func() []Request, func()) {
 	m := sync.Mutex{}
 	reqs := []Request{}
 	finished := make(chan bool)
 
 	go func() {
-		for r := range requests {
+		for {
+			r, ok := requests.Get()
+			if !ok {
+				break
+			}
 			m.Lock()
 			reqs = append(reqs, r)
 			m.Unlock()
+			requests.Done(r)
 		}
 		close(finished)
 	}()
@@ -48,14 +53,14 @@ func testSchedulerDrainRequests(requests <-chan Request) (func() []Request, func
 
 var _ = Describe("Scheduler", func() {
 	var (
-		testRunQueue              chan Request
+		testRunQueue              *Queue
 		testScheduler             Scheduler
 		testSchedulerRequests     func() []Request
 		testSchedulerRequestsWait func()
 	)
 
 	BeforeEach(func() {
-		testRunQueue = make(chan Request)
+		testRunQueue = NewQueue()
 		testSchedulerRequests, testSchedulerRequestsWait = testSchedulerDrainRequests(testRunQueue)
 		testScheduler = Scheduler{
 			WaybillPollInterval: 500 * time.Millisecond,
@@ -158,10 +163,48 @@ var _ = Describe("Scheduler", func() {
 			}))
 
 			testScheduler.Stop()
-			close(testRunQueue)
+			testRunQueue.ShutDown()
 			testSchedulerRequestsWait()
 		})
 
+		It("Should schedule multiple Waybills in the same namespace independently", func() {
+			wbList := []*kubeapplierv1alpha1.Waybill{
+				{
+					TypeMeta: metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "app",
+						Namespace: "multi",
+					},
+					Spec: kubeapplierv1alpha1.WaybillSpec{
+						RunInterval: 3600,
+					},
+				},
+				{
+					TypeMeta: metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "monitoring",
+						Namespace: "multi",
+					},
+					Spec: kubeapplierv1alpha1.WaybillSpec{
+						RunInterval: 3600,
+					},
+				},
+			}
+			testEnsureWaybills(wbList)
+			testWaitForSchedulerToUpdate(&testScheduler, wbList)
+
+			testWaitForRequests(testSchedulerRequests, MatchAllKeys(Keys{
+				// Both Waybills have no previous runs, so each of them
+				// triggers a run immediately.
+				"multi": MatchAllKeys(Keys{
+					ScheduledRun: Equal(2),
+				}),
+			}))
+
+			testScheduler.Stop()
+			testRunQueue.ShutDown()
+			testSchedulerRequestsWait()
+		})
 	})
 })
 
@@ -260,7 +303,7 @@ func testWaitForRequests(actual func() []Request, expected gomegatypes.GomegaMat
 func testSchedulerExpectedWaybillsMap(wbList []*kubeapplierv1alpha1.Waybill) map[string]*kubeapplierv1alpha1.Waybill {
 	expectedWaybillMap := map[string]*kubeapplierv1alpha1.Waybill{}
 	for i := range wbList {
-		expectedWaybillMap[wbList[i].Namespace] = wbList[i]
+		expectedWaybillMap[waybillKey(wbList[i])] = wbList[i]
 	}
 	return expectedWaybillMap
 }
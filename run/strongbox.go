@@ -43,26 +43,35 @@ func verifyKeyringNotEncrypted(secret *corev1.Secret) error {
 // strongboxInterface holds functions to configure strongbox for waybill runs
 type StrongboxInterface interface {
 	SetupGitConfigForStrongbox(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill, env []string) error
-	SetupStrongboxKeyring(ctx context.Context, kubeClient *client.Client, waybill *kubeapplierv1alpha1.Waybill, homeDir string) error
+	SetupStrongboxKeyring(ctx context.Context, kubeClient *client.Client, waybill *kubeapplierv1alpha1.Waybill, namespace, homeDir string) error
 }
 
 type strongboxBase struct{}
 
-func (sb *strongboxBase) SetupStrongboxKeyring(ctx context.Context, kubeClient *client.Client, waybill *kubeapplierv1alpha1.Waybill, homeDir string) error {
+// SetupStrongboxKeyring writes the strongbox keyring and identity referenced by
+// the Waybill to homeDir. The namespace is the one that the Secret defaults
+// to, if it is not specified in the Waybill.
+func (sb *strongboxBase) SetupStrongboxKeyring(ctx context.Context, kubeClient *client.Client, waybill *kubeapplierv1alpha1.Waybill, namespace, homeDir string) error {
 	if waybill.Spec.StrongboxKeyringSecretRef == nil {
 		return nil
 	}
 	sbNamespace := waybill.Spec.StrongboxKeyringSecretRef.Namespace
 	if sbNamespace == "" {
-		sbNamespace = waybill.Namespace
+		sbNamespace = namespace
 	}
 	secret, err := kubeClient.GetSecret(ctx, sbNamespace, waybill.Spec.StrongboxKeyringSecretRef.Name)
 	if err != nil {
 		return err
 	}
-	if err := checkSecretIsAllowed(waybill, secret); err != nil {
+	if err := checkSecretIsAllowed(namespace, secret); err != nil {
 		return err
 	}
+	return writeStrongboxKeyring(secret, homeDir)
+}
+
+// writeStrongboxKeyring writes the strongbox keyring and identity in the
+// Secret to homeDir.
+func writeStrongboxKeyring(secret *corev1.Secret, homeDir string) error {
 	if err := verifyKeyringNotEncrypted(secret); err != nil {
 		return err
 	}
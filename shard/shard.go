@@ -0,0 +1,424 @@
+// Package shard splits Waybills between multiple active replicas of
+// kube-applier.
+//
+// Replicas that belong to the same shard group announce themselves by
+// renewing a Lease each, labelled with the name of the group. Every replica
+// lists the Leases of its group to find the other members and assigns each
+// Waybill to one of them using rendezvous (highest random weight) hashing, a
+// form of consistent hashing: when a replica joins or leaves the group, only
+// the Waybills assigned to it move to a different replica.
+//
+// Replicas can also be limited to the Waybills that match a label selector,
+// for splitting Waybills into groups explicitly.
+//
+// While members join or leave the group, replicas might briefly disagree on
+// the owner of a Waybill, so each run also claims a Lease for its Waybill,
+// which ensures that only one replica applies it at a time.
+package shard
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/ptr"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/clock"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/metrics"
+)
+
+const (
+	// GroupLabel is set on the Leases of the members of a shard group, its
+	// value is the name of the group.
+	GroupLabel = "kube-applier.io/shard-group"
+
+	defaultLeaseDuration = 30 * time.Second
+	inClusterNamespace   = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// ErrClaimed is returned by Claim when another replica holds the Lease of the
+// Waybill.
+var ErrClaimed = errors.New("claimed by another replica")
+
+// LeaseClient is used by the Sharder to manage the Leases of shard group
+// members and Waybills.
+type LeaseClient interface {
+	ListLeases(ctx context.Context, namespace, selector string) ([]coordinationv1.Lease, error)
+	GetLease(ctx context.Context, namespace, name string) (*coordinationv1.Lease, error)
+	CreateLease(ctx context.Context, lease *coordinationv1.Lease) error
+	UpdateLease(ctx context.Context, lease *coordinationv1.Lease) error
+	RenewLease(ctx context.Context, lease *coordinationv1.Lease) error
+	DeleteLease(ctx context.Context, namespace, name string) error
+}
+
+// Status describes the shard group as seen by a replica.
+type Status struct {
+	// Identity is the name of the replica.
+	Identity string `json:"identity"`
+	// Members are the names of the replicas in the shard group, sorted.
+	Members []string `json:"members,omitempty"`
+	// Selector is the label selector that Waybills need to match to be
+	// applied by the replica.
+	Selector string `json:"selector,omitempty"`
+}
+
+// Sharder decides which Waybills are applied by this replica. A nil Sharder
+// owns every Waybill.
+type Sharder struct {
+	Clock clock.ClockInterface
+	// Group is the name of the shard group. Waybills are hashed between the
+	// members of the group, unless it is empty.
+	Group string
+	// Identity is the name of this replica, it must be unique within the
+	// shard group.
+	Identity   string
+	KubeClient LeaseClient
+	// LeaseDuration is how long a member is considered part of the group
+	// after it last renewed its Lease. Leases are renewed three times within
+	// this duration.
+	LeaseDuration time.Duration
+	// Namespace is the namespace of the Leases, defaults to the namespace
+	// that kube-applier runs in.
+	Namespace string
+	// Selector limits the Waybills of this replica to those that match it.
+	Selector  labels.Selector
+	changed   chan struct{}
+	members   []string
+	mutex     sync.RWMutex
+	stop      chan bool
+	waitGroup *sync.WaitGroup
+}
+
+// Start registers the replica in its shard group and starts a loop that
+// keeps its membership up to date. The members of the group are known when
+// Start returns.
+func (s *Sharder) Start() error {
+	if s.waitGroup != nil {
+		return nil
+	}
+	if s.LeaseDuration <= 0 {
+		s.LeaseDuration = defaultLeaseDuration
+	}
+	if s.Selector == nil {
+		s.Selector = labels.Everything()
+	}
+	s.changed = make(chan struct{}, 1)
+	s.members = []string{s.Identity}
+	if s.Group == "" {
+		return nil
+	}
+	if s.Identity == "" {
+		return fmt.Errorf("an identity is required for sharding")
+	}
+	if s.Namespace == "" {
+		ns, err := os.ReadFile(inClusterNamespace)
+		if err != nil {
+			return fmt.Errorf("cannot determine the namespace of the shard Leases: %w", err)
+		}
+		s.Namespace = strings.TrimSpace(string(ns))
+	}
+	if err := s.update(); err != nil {
+		return err
+	}
+	s.stop = make(chan bool)
+	s.waitGroup = &sync.WaitGroup{}
+	s.waitGroup.Add(1)
+	go s.loop()
+	return nil
+}
+
+// Stop leaves the shard group, so that the Waybills of the replica are
+// reassigned to the remaining members without waiting for its Lease to
+// expire.
+func (s *Sharder) Stop() {
+	if s == nil || s.waitGroup == nil {
+		return
+	}
+	close(s.stop)
+	s.waitGroup.Wait()
+	s.waitGroup = nil
+	ctx, cancel := context.WithTimeout(context.Background(), s.LeaseDuration/3)
+	defer cancel()
+	if err := s.KubeClient.DeleteLease(ctx, s.Namespace, s.leaseName()); err != nil {
+		log.Logger("shard").Warn("Could not delete Lease", "lease", s.leaseName(), "error", err)
+	}
+}
+
+func (s *Sharder) loop() {
+	defer s.waitGroup.Done()
+	ticker := time.NewTicker(s.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.update(); err != nil {
+				log.Logger("shard").Error("Could not update shard group membership", "group", s.Group, "error", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// leaseName returns the name of the Lease of this replica.
+func (s *Sharder) leaseName() string {
+	return fmt.Sprintf("%s-%s", s.Group, s.Identity)
+}
+
+// update renews the Lease of this replica and refreshes the members of the
+// shard group.
+func (s *Sharder) update() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.LeaseDuration/3)
+	defer cancel()
+	now := metav1.NewMicroTime(s.Clock.Now())
+	err := s.KubeClient.RenewLease(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.leaseName(),
+			Namespace: s.Namespace,
+			Labels:    map[string]string{GroupLabel: s.Group},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       ptr.To(s.Identity),
+			LeaseDurationSeconds: ptr.To(int32(s.LeaseDuration.Seconds())),
+			RenewTime:            &now,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot renew Lease: %w", err)
+	}
+	leases, err := s.KubeClient.ListLeases(ctx, s.Namespace, labels.SelectorFromSet(labels.Set{GroupLabel: s.Group}).String())
+	if err != nil {
+		return fmt.Errorf("cannot list Leases: %w", err)
+	}
+	s.setMembers(activeMembers(leases, s.Identity, now.Time))
+	return nil
+}
+
+// activeMembers returns the sorted holders of the Leases that have not
+// expired at the provided time. The identity of this replica is always
+// included.
+func activeMembers(leases []coordinationv1.Lease, identity string, now time.Time) []string {
+	members := []string{identity}
+	for _, l := range leases {
+		holder := ptr.Deref(l.Spec.HolderIdentity, "")
+		if holder == "" || holder == identity || leaseExpired(l, now) {
+			continue
+		}
+		members = append(members, holder)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// leaseExpired returns true if the Lease was not renewed within its duration
+// at the provided time.
+func leaseExpired(lease coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil {
+		return true
+	}
+	duration := time.Duration(ptr.Deref(lease.Spec.LeaseDurationSeconds, 0)) * time.Second
+	return lease.Spec.RenewTime.Add(duration).Before(now)
+}
+
+func (s *Sharder) setMembers(members []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	metrics.SetShardMembers(len(members))
+	if reflect.DeepEqual(s.members, members) {
+		return
+	}
+	log.Logger("shard").Info("Shard group members changed, rebalancing Waybills", "group", s.Group, "members", members)
+	s.members = members
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Changed returns a channel that receives a value when the members of the
+// shard group change, and the Waybills of the replica need to be updated.
+func (s *Sharder) Changed() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.changed
+}
+
+// Owner returns the identity of the replica that applies the Waybill, or an
+// empty string if the Waybill does not match the selector of this replica
+// and its owner is not known.
+func (s *Sharder) Owner(waybill *kubeapplierv1alpha1.Waybill) string {
+	if s == nil || !s.Selector.Matches(labels.Set(waybill.Labels)) {
+		return ""
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return owner(s.members, fmt.Sprintf("%s/%s", waybill.Namespace, waybill.Name))
+}
+
+// Owns returns true if the Waybill is applied by this replica.
+func (s *Sharder) Owns(waybill *kubeapplierv1alpha1.Waybill) bool {
+	if s == nil {
+		return true
+	}
+	return s.Owner(waybill) == s.Identity
+}
+
+// Claim takes the Lease of the Waybill for this replica, so that it is not
+// applied by another replica at the same time, and keeps renewing it until the
+// returned function is called, which releases it. It returns ErrClaimed if
+// another replica holds the Lease. Claim is a no-op if the replica is not part
+// of a shard group.
+func (s *Sharder) Claim(waybill *kubeapplierv1alpha1.Waybill) (func(), error) {
+	if s == nil || s.Group == "" {
+		return func() {}, nil
+	}
+	name := s.waybillLeaseName(waybill)
+	if err := s.claim(name); err != nil {
+		return nil, err
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(s.LeaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.claim(name); err != nil {
+					log.Logger("shard").Warn("Could not renew Waybill Lease", "lease", name, "error", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		s.release(name)
+	}, nil
+}
+
+// waybillLeaseName returns the name of the Lease claimed for runs of the
+// Waybill. Namespace and name are hashed to fit the length of Lease names.
+func (s *Sharder) waybillLeaseName(waybill *kubeapplierv1alpha1.Waybill) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s", waybill.Namespace, waybill.Name)))
+	return fmt.Sprintf("%s-waybill-%x", s.Group, sum[:8])
+}
+
+// claim creates or renews the Lease with the provided name for this replica,
+// unless another replica holds it.
+func (s *Sharder) claim(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.LeaseDuration/3)
+	defer cancel()
+	now := metav1.NewMicroTime(s.Clock.Now())
+	spec := coordinationv1.LeaseSpec{
+		AcquireTime:          &now,
+		HolderIdentity:       ptr.To(s.Identity),
+		LeaseDurationSeconds: ptr.To(int32(s.LeaseDuration.Seconds())),
+		RenewTime:            &now,
+	}
+	lease, err := s.KubeClient.GetLease(ctx, s.Namespace, name)
+	if apierrors.IsNotFound(err) {
+		err = s.KubeClient.CreateLease(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: s.Namespace},
+			Spec:       spec,
+		})
+		if apierrors.IsAlreadyExists(err) {
+			return ErrClaimed
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	holder := ptr.Deref(lease.Spec.HolderIdentity, "")
+	if holder != "" && holder != s.Identity && !leaseExpired(*lease, now.Time) {
+		return ErrClaimed
+	}
+	if holder == s.Identity && lease.Spec.AcquireTime != nil {
+		spec.AcquireTime = lease.Spec.AcquireTime
+	}
+	lease.Spec = spec
+	// A conflict means that another replica updated the Lease since it was
+	// read, most likely claiming it
+	if err := s.KubeClient.UpdateLease(ctx, lease); apierrors.IsConflict(err) {
+		return ErrClaimed
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// release clears the holder of the Lease with the provided name, if it is
+// still held by this replica, so that other replicas can claim it without
+// waiting for it to expire.
+func (s *Sharder) release(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.LeaseDuration/3)
+	defer cancel()
+	lease, err := s.KubeClient.GetLease(ctx, s.Namespace, name)
+	if err == nil && ptr.Deref(lease.Spec.HolderIdentity, "") == s.Identity {
+		lease.Spec.HolderIdentity = nil
+		lease.Spec.AcquireTime = nil
+		lease.Spec.RenewTime = nil
+		err = s.KubeClient.UpdateLease(ctx, lease)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Logger("shard").Warn("Could not release Waybill Lease", "lease", name, "error", err)
+	}
+}
+
+// Status returns the status of the shard group. It returns the zero value if
+// sharding is not enabled.
+func (s *Sharder) Status() Status {
+	if s == nil {
+		return Status{}
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	status := Status{
+		Identity: s.Identity,
+		Members:  append([]string(nil), s.members...),
+	}
+	if !s.Selector.Empty() {
+		status.Selector = s.Selector.String()
+	}
+	return status
+}
+
+// owner returns the member with the highest weight for the key.
+func owner(members []string, key string) string {
+	var (
+		best       string
+		bestWeight uint64
+	)
+	for _, m := range members {
+		if w := weight(m, key); best == "" || w > bestWeight {
+			best, bestWeight = m, w
+		}
+	}
+	return best
+}
+
+// weight returns the weight of the member for the key, used for rendezvous
+// hashing.
+func weight(member, key string) uint64 {
+	sum := sha256.Sum256([]byte(member + "\x00" + key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,245 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/ptr"
+
+	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time                  { return c.now }
+func (c *testClock) Since(t time.Time) time.Duration { return c.now.Sub(t) }
+func (c *testClock) Sleep(d time.Duration)           {}
+
+type testLeaseClient struct {
+	leases map[string]coordinationv1.Lease
+}
+
+func (c *testLeaseClient) ListLeases(ctx context.Context, namespace, selector string) ([]coordinationv1.Lease, error) {
+	s, err := labels.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+	var ret []coordinationv1.Lease
+	for _, l := range c.leases {
+		if l.Namespace == namespace && s.Matches(labels.Set(l.Labels)) {
+			ret = append(ret, l)
+		}
+	}
+	return ret, nil
+}
+
+func (c *testLeaseClient) GetLease(ctx context.Context, namespace, name string) (*coordinationv1.Lease, error) {
+	l, ok := c.leases[namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(coordinationv1.Resource("leases"), name)
+	}
+	return l.DeepCopy(), nil
+}
+
+func (c *testLeaseClient) CreateLease(ctx context.Context, lease *coordinationv1.Lease) error {
+	key := lease.Namespace + "/" + lease.Name
+	if _, ok := c.leases[key]; ok {
+		return apierrors.NewAlreadyExists(coordinationv1.Resource("leases"), lease.Name)
+	}
+	l := *lease.DeepCopy()
+	l.ResourceVersion = "1"
+	c.leases[key] = l
+	return nil
+}
+
+func (c *testLeaseClient) UpdateLease(ctx context.Context, lease *coordinationv1.Lease) error {
+	key := lease.Namespace + "/" + lease.Name
+	existing, ok := c.leases[key]
+	if !ok {
+		return apierrors.NewNotFound(coordinationv1.Resource("leases"), lease.Name)
+	}
+	if existing.ResourceVersion != lease.ResourceVersion {
+		return apierrors.NewConflict(coordinationv1.Resource("leases"), lease.Name, fmt.Errorf("resource version changed"))
+	}
+	rv, _ := strconv.Atoi(existing.ResourceVersion)
+	l := *lease.DeepCopy()
+	l.ResourceVersion = strconv.Itoa(rv + 1)
+	c.leases[key] = l
+	return nil
+}
+
+func (c *testLeaseClient) RenewLease(ctx context.Context, lease *coordinationv1.Lease) error {
+	c.leases[lease.Namespace+"/"+lease.Name] = *lease
+	return nil
+}
+
+func (c *testLeaseClient) DeleteLease(ctx context.Context, namespace, name string) error {
+	delete(c.leases, namespace+"/"+name)
+	return nil
+}
+
+func testLease(holder string, renewed time.Time) coordinationv1.Lease {
+	return coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kube-applier-" + holder,
+			Namespace: "kube-applier",
+			Labels:    map[string]string{GroupLabel: "kube-applier"},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       ptr.To(holder),
+			LeaseDurationSeconds: ptr.To(int32(30)),
+			RenewTime:            ptr.To(metav1.NewMicroTime(renewed)),
+		},
+	}
+}
+
+func TestOwner(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	owners := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 900; i++ {
+		key := fmt.Sprintf("ns-%d/main", i)
+		owners[key] = owner(members, key)
+		counts[owners[key]]++
+	}
+	// Waybills are spread between all the members
+	for _, m := range members {
+		assert.Greater(t, counts[m], 200, "member %s", m)
+	}
+	// Only the Waybills of a member that leaves are reassigned
+	for key, o := range owners {
+		if o != "c" {
+			assert.Equal(t, o, owner([]string{"a", "b"}, key))
+		}
+	}
+}
+
+func TestActiveMembers(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	leases := []coordinationv1.Lease{
+		testLease("b", now.Add(-10*time.Second)),
+		testLease("c", now.Add(-time.Minute)),
+		testLease("a", now),
+	}
+	assert.Equal(t, []string{"a", "b", "d"}, activeMembers(leases, "d", now))
+}
+
+func TestSharder(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	kubeClient := &testLeaseClient{leases: map[string]coordinationv1.Lease{}}
+	s := &Sharder{
+		Clock:      &testClock{now: now},
+		Group:      "kube-applier",
+		Identity:   "a",
+		KubeClient: kubeClient,
+		Namespace:  "kube-applier",
+	}
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+	assert.Contains(t, kubeClient.leases, "kube-applier/kube-applier-a")
+	assert.Equal(t, []string{"a"}, s.Status().Members)
+
+	wb := &kubeapplierv1alpha1.Waybill{ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"}}
+	assert.True(t, s.Owns(wb))
+
+	// A replica joins the group
+	kubeClient.leases["kube-applier/kube-applier-b"] = testLease("b", now)
+	assert.NoError(t, s.update())
+	assert.Equal(t, []string{"a", "b"}, s.Status().Members)
+	select {
+	case <-s.Changed():
+	default:
+		t.Fatal("members changed without a notification")
+	}
+	assert.Equal(t, owner([]string{"a", "b"}, "foo/main"), s.Owner(wb))
+
+	// Waybills that do not match the selector are not owned
+	s.Selector = labels.SelectorFromSet(labels.Set{"team": "billing"})
+	assert.False(t, s.Owns(wb))
+	assert.Equal(t, "", s.Owner(wb))
+	assert.Equal(t, "team=billing", s.Status().Selector)
+}
+
+func TestSharderClaim(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	kubeClient := &testLeaseClient{leases: map[string]coordinationv1.Lease{}}
+	clk := &testClock{now: now}
+	newSharder := func(identity string) *Sharder {
+		return &Sharder{
+			Clock:         clk,
+			Group:         "kube-applier",
+			Identity:      identity,
+			KubeClient:    kubeClient,
+			LeaseDuration: 30 * time.Second,
+			Namespace:     "kube-applier",
+		}
+	}
+	a, b := newSharder("a"), newSharder("b")
+	wb := &kubeapplierv1alpha1.Waybill{ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"}}
+	other := &kubeapplierv1alpha1.Waybill{ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "bar"}}
+	key := "kube-applier/" + a.waybillLeaseName(wb)
+
+	release, err := a.Claim(wb)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", ptr.Deref(kubeClient.leases[key].Spec.HolderIdentity, ""))
+	// Waybill Leases are not mistaken for members of the group
+	assert.Equal(t, []string{"b"}, activeMembers(mustListLeases(t, kubeClient), "b", now))
+
+	// Another replica cannot claim the Waybill while the Lease is held, but
+	// can claim other Waybills
+	_, err = b.Claim(wb)
+	assert.Equal(t, ErrClaimed, err)
+	releaseOther, err := b.Claim(other)
+	assert.NoError(t, err)
+	releaseOther()
+
+	// The Lease can be claimed once it is released
+	release()
+	assert.Nil(t, kubeClient.leases[key].Spec.HolderIdentity)
+	release, err = b.Claim(wb)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", ptr.Deref(kubeClient.leases[key].Spec.HolderIdentity, ""))
+
+	// Or once it expires, if the holder stops renewing it
+	clk.now = now.Add(time.Minute)
+	releaseExpired, err := a.Claim(wb)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", ptr.Deref(kubeClient.leases[key].Spec.HolderIdentity, ""))
+	// Releasing a Lease claimed by another replica does not affect it
+	release()
+	assert.Equal(t, "a", ptr.Deref(kubeClient.leases[key].Spec.HolderIdentity, ""))
+	releaseExpired()
+
+	// Claims are not needed outside of a shard group
+	var s *Sharder
+	release, err = s.Claim(wb)
+	assert.NoError(t, err)
+	release()
+}
+
+func mustListLeases(t *testing.T, c *testLeaseClient) []coordinationv1.Lease {
+	leases, err := c.ListLeases(context.Background(), "kube-applier", labels.SelectorFromSet(labels.Set{GroupLabel: "kube-applier"}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leases
+}
+
+func TestSharder_nil(t *testing.T) {
+	var s *Sharder
+	wb := &kubeapplierv1alpha1.Waybill{ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"}}
+	assert.True(t, s.Owns(wb))
+	assert.Equal(t, "", s.Owner(wb))
+	assert.Nil(t, s.Changed())
+	assert.Equal(t, Status{}, s.Status())
+}
@@ -6,7 +6,20 @@ $(document).ready(function() {
             $('.force-button').each(function(){ $(this).prop('disabled', true); });
             $('#force-alert').alert('close')
 
-            forceRun($(this).data('namespace'))
+            forceRun($(this).data('namespace'), $(this).data('name'))
+        });
+    });
+
+    $(".waybill-action-button").each(function(){
+        $(this).bind('click', function(){
+            var reason = prompt('Reason for this change (recorded on the Waybill):');
+            if (reason === null) {
+                return;
+            }
+            $('.force-button').each(function(){ $(this).prop('disabled', true); });
+            $('#force-alert').alert('close')
+
+            waybillAction($(this).data('namespace'), $(this).data('name'), $(this).data('action'), $(this).data('enabled'), reason)
         });
     });
 
@@ -20,12 +33,12 @@ $(document).ready(function() {
 });
 
 // Send an XHR request to the server to force a run.
-function forceRun(namespace) {
+function forceRun(namespace, name) {
     url =  '/api/v1/forceRun';
     $.ajax({
         type: 'POST',
         url: url,
-        data: {namespace: namespace},
+        data: {namespace: namespace, name: name},
         dataType: "json",
         success: function(data) {
             showForceAlert(true, data.message);
@@ -38,6 +51,32 @@ function forceRun(namespace) {
     });
 }
 
+// Send an XHR request to the server to pause, resume, toggle dry-run for, roll
+// back or clear the rollback of the given Waybill, or ClusterWaybill if the
+// namespace is empty. The page is reloaded on success to reflect the updated
+// Waybill.
+function waybillAction(namespace, name, action, enabled, reason) {
+    if (namespace) {
+        url = '/api/v1/waybills/' + encodeURIComponent(namespace) + '/' + encodeURIComponent(name) + '/' + action;
+    } else {
+        url = '/api/v1/clusterwaybills/' + encodeURIComponent(name) + '/' + action;
+    }
+    $.ajax({
+        type: 'POST',
+        url: url,
+        data: {enabled: enabled, reason: reason},
+        dataType: "json",
+        success: function(data) {
+            showForceAlert(true, data.message);
+            setTimeout(function(){ location.reload(); }, 1000);
+        },
+        error: function(xhr) {
+            showForceAlert(false, 'Error: ' +  xhr.responseJSON.message + '<br/>See container logs for more info.');
+            $('.force-button').each(function(){ $(this).prop('disabled', false); });
+        }
+    });
+}
+
 // Show a relevant alert message, styled based on the "success" of the associated response.
 function showForceAlert(success, message) {
     alertClass = success ? 'success' : 'warning';
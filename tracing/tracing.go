@@ -0,0 +1,68 @@
+// Package tracing configures OpenTelemetry tracing for kube-applier and
+// provides helpers for instrumenting apply runs.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName = "kube-applier"
+	tracerName  = "github.com/utilitywarehouse/kube-applier"
+)
+
+// Setup configures the global TracerProvider to export spans to the provided
+// OTLP/HTTP endpoint (eg. http://otel-collector:4318). If the endpoint is
+// empty, tracing is left disabled. It returns a function that flushes any
+// pending spans and shuts down the exporter.
+func Setup(ctx context.Context, endpoint, cluster string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	attrs := []attribute.KeyValue{attribute.String("service.name", serviceName)}
+	if cluster != "" {
+		attrs = append(attrs, attribute.String("k8s.cluster.name", cluster))
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the Tracer used to instrument kube-applier.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// End records the error on the span, if there is one, and ends the span.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the trace in the provided context, or an empty
+// string if the context does not contain a valid span.
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
@@ -12,10 +12,11 @@ import (
 const appName = "kube-applier"
 const appDescription = "Continuous deployment of Kubernetes objects by applying declarative configuration files from a Git repository to a Kubernetes cluster"
 
-func addStatusEndpoints(m *mux.Router) *mux.Router {
+func addStatusEndpoints(m *mux.Router, isLeader func() bool) *mux.Router {
 	m.PathPrefix("/__/").Handler(op.NewHandler(op.NewStatus(appName, appDescription).
 		AddOwner("Billing team", "#finance_billing").
 		AddLink("readme", fmt.Sprintf("https://github.com/utilitywarehouse/%s/blob/master/README.md", appName)).
+		AddChecker("leader-election", leaderElectionChecker(isLeader)).
 		ReadyAlways()))
 	m.PathPrefix("/debug/pprof/cmdline").HandlerFunc(pprof.Cmdline)
 	m.PathPrefix("/debug/pprof/profile").HandlerFunc(pprof.Profile)
@@ -31,3 +32,16 @@ func addStatusEndpoints(m *mux.Router) *mux.Router {
 	m.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
 	return m
 }
+
+// leaderElectionChecker reports whether this replica is the leader. Replicas
+// that are not the leader are healthy, they serve the status page and API
+// while waiting to take over.
+func leaderElectionChecker(isLeader func() bool) func(cr *op.CheckResponse) {
+	return func(cr *op.CheckResponse) {
+		if isLeader() {
+			cr.Healthy("leader, scheduling and applying Waybills")
+			return
+		}
+		cr.Healthy("follower, waiting for leadership")
+	}
+}
@@ -11,17 +11,31 @@ import (
 	"k8s.io/utils/ptr"
 
 	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/run"
+	"github.com/utilitywarehouse/kube-applier/shard"
 )
 
 var warningCheckReg = regexp.MustCompile("^Warning:.*")
 
 const appliedRecentlyWindow = 15 * time.Minute
 
+// clusterScope is used in place of the namespace of ClusterWaybills when
+// selecting the Waybills displayed on the status page, since ClusterWaybills
+// do not belong to a namespace.
+const clusterScope = "cluster"
+
 // namespace stores the current state of the waybill and events of a namespace.
 type Namespace struct {
 	Waybill       kubeapplierv1alpha1.Waybill
 	Events        []corev1.Event
 	DiffURLFormat string
+	// Blocked denotes that the Waybill has changes that are held back by a
+	// commit that failed signature verification.
+	Blocked bool
+	// ShardOwner is the replica that applies the Waybill, when Waybills are
+	// sharded between replicas.
+	ShardOwner string
 }
 
 // GetNamespaces will create Namespace object combining wayBill and its corresponding events
@@ -61,6 +75,8 @@ type Filtered struct {
 type pageData struct {
 	Namespaces        []Namespace
 	SelectedNamespace string
+	Shard             shard.Status
+	Verification      git.Verification
 }
 
 // sectionData wraps Filtered so the selected namespace name flows into the
@@ -99,32 +115,39 @@ func filter(Namespaces []Namespace, filteredBy string) Filtered {
 		}
 
 		// Following outcome(filters) only applies if DryRun is Disabled && autoApply is Enabled.
-		if !ns.Waybill.Spec.DryRun && isAutoApplyEnabled(ns) {
-			switch filteredBy {
-			case "pending":
-				if ns.Waybill.Status.LastRun == nil {
-					filtered.Namespaces = append(filtered.Namespaces, ns)
-				}
-			case "failure":
-				if ns.Waybill.Status.LastRun != nil && !ns.Waybill.Status.LastRun.Success {
-					filtered.Namespaces = append(filtered.Namespaces, ns)
-				}
-			case "warning":
-				if ns.Waybill.Status.LastRun != nil && ns.Waybill.Status.LastRun.Success &&
-					isOutcomeHasWarnings(ns.Waybill.Status.LastRun.Output) {
-					filtered.Namespaces = append(filtered.Namespaces, ns)
-				}
-			case "success":
-				if ns.Waybill.Status.LastRun != nil && ns.Waybill.Status.LastRun.Success &&
-					!isOutcomeHasWarnings(ns.Waybill.Status.LastRun.Output) {
-					filtered.Namespaces = append(filtered.Namespaces, ns)
-				}
-			}
+		if !ns.Waybill.Spec.DryRun && isAutoApplyEnabled(ns) && runOutcome(ns.Waybill) == filteredBy {
+			filtered.Namespaces = append(filtered.Namespaces, ns)
 		}
 	}
 	return filtered
 }
 
+// Outcome returns the outcome group that the Waybill is listed under on the
+// status page: "auto-apply-disabled", "dry-run", or the outcome of its last
+// run, which is one of "pending", "failure", "warning" or "success".
+func Outcome(wb kubeapplierv1alpha1.Waybill) string {
+	switch {
+	case !isAutoApplyEnabled(Namespace{Waybill: wb}):
+		return "auto-apply-disabled"
+	case wb.Spec.DryRun:
+		return "dry-run"
+	}
+	return runOutcome(wb)
+}
+
+// runOutcome returns the outcome of the last run of the Waybill.
+func runOutcome(wb kubeapplierv1alpha1.Waybill) string {
+	switch {
+	case wb.Status.LastRun == nil:
+		return "pending"
+	case !wb.Status.LastRun.Success:
+		return "failure"
+	case isOutcomeHasWarnings(wb.Status.LastRun.Output):
+		return "warning"
+	}
+	return "success"
+}
+
 // withSelect builds a sectionData from a selected namespace name and a Filtered
 // result, so the section template can pass the selected namespace down to each
 // namespace it renders.
@@ -158,6 +181,31 @@ func isOutcomeHasWarnings(output string) bool {
 
 // Helper functions used in templates
 
+// Scope returns the namespace of the Waybill, or "cluster" for ClusterWaybills.
+func scope(wb kubeapplierv1alpha1.Waybill) string {
+	if wb.IsClusterWaybill() {
+		return clusterScope
+	}
+	return wb.Namespace
+}
+
+// WaybillPath returns the path of the status page of the Waybill.
+func waybillPath(wb kubeapplierv1alpha1.Waybill) string {
+	if wb.IsClusterWaybill() {
+		return fmt.Sprintf("/cluster/%s", wb.Name)
+	}
+	return fmt.Sprintf("/ns/%s/%s", wb.Namespace, wb.Name)
+}
+
+// WaybillTitle returns the title that the Waybill is displayed with, in the
+// <namespace>/<name> format, or "ClusterWaybill <name>" for ClusterWaybills.
+func waybillTitle(wb kubeapplierv1alpha1.Waybill) string {
+	if wb.IsClusterWaybill() {
+		return fmt.Sprintf("ClusterWaybill %s", wb.Name)
+	}
+	return fmt.Sprintf("%s/%s", wb.Namespace, wb.Name)
+}
+
 // FormattedTime returns the Time in the format "YYYY-MM-DD hh:mm:ss -0000 GMT"
 func formattedTime(t metav1.Time) string {
 	return t.Time.Truncate(time.Second).String()
@@ -193,6 +241,49 @@ func status(wb kubeapplierv1alpha1.Waybill) string {
 	return fmt.Sprintf("(%s)", strings.Join(ret, ", "))
 }
 
+// lastAction returns a human-readable description of the last action performed
+// on the Waybill through the kube-applier API, such as pausing it, based on
+// its annotations. It returns an empty string if no action has been recorded.
+func lastAction(wb kubeapplierv1alpha1.Waybill) string {
+	action := wb.Annotations[kubeapplierv1alpha1.LastActionAnnotation]
+	if action == "" {
+		return ""
+	}
+	ret := action
+	if by := wb.Annotations[kubeapplierv1alpha1.LastActionByAnnotation]; by != "" {
+		ret = fmt.Sprintf("%s by %s", ret, by)
+	}
+	if t := wb.Annotations[kubeapplierv1alpha1.LastActionTimeAnnotation]; t != "" {
+		ret = fmt.Sprintf("%s at %s", ret, t)
+	}
+	if reason := wb.Annotations[kubeapplierv1alpha1.LastActionReasonAnnotation]; reason != "" {
+		ret = fmt.Sprintf("%s: %s", ret, reason)
+	}
+	return ret
+}
+
+// Pinned returns a human-readable description of the rollback that the
+// Waybill is pinned to, based on its annotations. It returns an empty string
+// if the Waybill is not pinned.
+func pinned(wb kubeapplierv1alpha1.Waybill) string {
+	commit := wb.Annotations[kubeapplierv1alpha1.RollbackCommitAnnotation]
+	if commit == "" {
+		return ""
+	}
+	ret := fmt.Sprintf("pinned to commit %s", commit)
+	if from := wb.Annotations[kubeapplierv1alpha1.RollbackFromAnnotation]; from != "" {
+		ret = fmt.Sprintf("%s by a rollback from %s", ret, from)
+	}
+	return ret
+}
+
+// CanRollback checks whether the run history of the Waybill contains a
+// commit that it can be rolled back to.
+func canRollback(wb kubeapplierv1alpha1.Waybill) bool {
+	_, ok := run.RollbackCommit(&wb)
+	return ok
+}
+
 // AppliedRecently checks whether the provided Waybill was applied in the last
 // 15 minutes.
 func appliedRecently(waybill kubeapplierv1alpha1.Waybill) bool {
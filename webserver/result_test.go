@@ -555,6 +555,50 @@ func TestResultAppliedRecently(t *testing.T) {
 	}
 }
 
+func TestResultLastAction(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		annotations map[string]string
+		e           string
+	}{
+		{
+			nil,
+			"",
+		},
+		{
+			map[string]string{
+				kubeapplierv1alpha1.LastActionByAnnotation: "foo@example.com",
+			},
+			"",
+		},
+		{
+			map[string]string{
+				kubeapplierv1alpha1.LastActionAnnotation: "paused",
+			},
+			"paused",
+		},
+		{
+			map[string]string{
+				kubeapplierv1alpha1.LastActionAnnotation:       "dry-run enabled",
+				kubeapplierv1alpha1.LastActionByAnnotation:     "foo@example.com",
+				kubeapplierv1alpha1.LastActionReasonAnnotation: "incident",
+				kubeapplierv1alpha1.LastActionTimeAnnotation:   "2022-04-26T13:36:05Z",
+			},
+			"dry-run enabled by foo@example.com at 2022-04-26T13:36:05Z: incident",
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(
+			tc.e,
+			lastAction(kubeapplierv1alpha1.Waybill{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations},
+			}),
+		)
+	}
+}
+
 func Test_isOutcomeHasWarnings(t *testing.T) {
 	type args struct {
 		output string
@@ -585,3 +629,41 @@ unable to recognize "STDIN": no matches for kind "Ingress" in version "extension
 		})
 	}
 }
+
+func TestOutcome(t *testing.T) {
+	expected := map[string]string{
+		"test-success":             "success",
+		"test-failure":             "failure",
+		"test-pending":             "pending",
+		"test-warning":             "warning",
+		"test-dryrun":              "dry-run",
+		"test-dryrun-warning":      "dry-run",
+		"test-dryrun-failure":      "dry-run",
+		"test-disabled-AA":         "auto-apply-disabled",
+		"test-disabled-AA-warning": "auto-apply-disabled",
+		"test-disabled-AA-failure": "auto-apply-disabled",
+	}
+	for _, wb := range waybills {
+		assert.Equal(t, expected[wb.Namespace], Outcome(wb), wb.Namespace)
+		// Waybills are listed under their outcome on the status page
+		filtered := filter(GetNamespaces([]kubeapplierv1alpha1.Waybill{wb}, nil, diffURL), Outcome(wb))
+		assert.Len(t, filtered.Namespaces, 1, wb.Namespace)
+	}
+
+	wb := kubeapplierv1alpha1.Waybill{Spec: kubeapplierv1alpha1.WaybillSpec{AutoApply: &varFalse, DryRun: true}}
+	assert.Equal(t, "auto-apply-disabled", Outcome(wb))
+}
+
+func TestResultWaybillPath(t *testing.T) {
+	assert := assert.New(t)
+
+	wb := kubeapplierv1alpha1.Waybill{ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"}}
+	assert.Equal("foo", scope(wb))
+	assert.Equal("/ns/foo/main", waybillPath(wb))
+	assert.Equal("foo/main", waybillTitle(wb))
+
+	cwb := kubeapplierv1alpha1.ClusterWaybill{ObjectMeta: metav1.ObjectMeta{Name: "main"}}
+	assert.Equal(clusterScope, scope(*cwb.Waybill()))
+	assert.Equal("/cluster/main", waybillPath(*cwb.Waybill()))
+	assert.Equal("ClusterWaybill main", waybillTitle(*cwb.Waybill()))
+}
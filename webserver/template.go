@@ -19,10 +19,17 @@ func createTemplate(templatePath string) (*template.Template, error) {
 			"latency":         latency,
 			"appliedRecently": appliedRecently,
 			"status":          status,
+			"lastAction":      lastAction,
+			"pinned":          pinned,
+			"canRollback":     canRollback,
+			"autoApply":       isAutoApplyEnabled,
 			"splitByNewline":  splitByNewline,
 			"getOutputClass":  getOutputClass,
 			"withSelect":      withSelect,
 			"nsWithSelect":    nsWithSelect,
+			"scope":           scope,
+			"waybillPath":     waybillPath,
+			"waybillTitle":    waybillTitle,
 		}).
 		ParseFiles(templatePath)
 	if err != nil {
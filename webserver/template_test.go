@@ -10,6 +10,8 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/shard"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -303,12 +305,198 @@ func Test_ExecuteTemplate_NamespacePage(t *testing.T) {
 	}
 
 	// Panel should be expanded because SelectedNamespace matches.
-	if !strings.Contains(output, `id="test-ns" class="panel-collapse collapse in"`) {
+	if !strings.Contains(output, `id="test-ns_main" class="panel-collapse collapse in"`) {
 		t.Errorf("namespace panel should be expanded on the namespace page")
 	}
 
 	// Toggle button should show '-' (expanded) on the single-ns page.
-	if !strings.Contains(output, `class="btn btn-default btn-xs ns-toggle" data-toggle="collapse" data-target="#test-ns" aria-expanded="true">-</button>`) {
+	if !strings.Contains(output, `class="btn btn-default btn-xs ns-toggle" data-toggle="collapse" data-target="#test-ns_main" aria-expanded="true">-</button>`) {
 		t.Errorf("namespace page should have the toggle button with '-' glyph for the expanded namespace")
 	}
 }
+
+func Test_ExecuteTemplate_ClusterWaybill(t *testing.T) {
+	cwb := &kubeapplierv1alpha1.ClusterWaybill{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "cluster-resources",
+		},
+		Spec: kubeapplierv1alpha1.ClusterWaybillSpec{
+			RepositoryPath: "cluster",
+		},
+		Status: kubeapplierv1alpha1.WaybillStatus{
+			LastRun: &kubeapplierv1alpha1.WaybillStatusRun{
+				Started:  metav1.Time{Time: fixedTime.Add(-time.Minute)},
+				Finished: metav1.Time{Time: fixedTime},
+				Type:     "Test run",
+			},
+		},
+	}
+	wbList := []kubeapplierv1alpha1.Waybill{*cwb.Waybill()}
+
+	result := GetNamespaces(wbList, nil, diffURL)
+
+	templt, err := createTemplate("../templates/status.html")
+	if err != nil {
+		t.Errorf("error parsing template: %v\n", err)
+		return
+	}
+
+	rendered := &bytes.Buffer{}
+	err = templt.ExecuteTemplate(rendered, "index", pageData{
+		Namespaces: result,
+	})
+	if err != nil {
+		t.Errorf("error executing template: %v\n", err)
+		return
+	}
+	output := rendered.String()
+
+	if !strings.Contains(output, `<a href="/cluster/cluster-resources">ClusterWaybill cluster-resources </a>`) {
+		t.Errorf("index page should link to the ClusterWaybill page")
+	}
+	// Panel should not be expanded on the index page.
+	if !strings.Contains(output, `id="_cluster-resources" class="panel-collapse collapse">`) {
+		t.Errorf("ClusterWaybill panel should be collapsed on the index page")
+	}
+
+	rendered = &bytes.Buffer{}
+	err = templt.ExecuteTemplate(rendered, "namespacePage", pageData{
+		Namespaces:        result,
+		SelectedNamespace: clusterScope,
+	})
+	if err != nil {
+		t.Errorf("error executing template: %v\n", err)
+		return
+	}
+	output = rendered.String()
+
+	// Panel should be expanded on the ClusterWaybill page.
+	if !strings.Contains(output, `id="_cluster-resources" class="panel-collapse collapse in"`) {
+		t.Errorf("ClusterWaybill panel should be expanded on the ClusterWaybill page")
+	}
+}
+
+func Test_ExecuteTemplate_Shard(t *testing.T) {
+	wbList := []kubeapplierv1alpha1.Waybill{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "test-ns"},
+		},
+	}
+	result := GetNamespaces(wbList, nil, diffURL)
+	result[0].ShardOwner = "kube-applier-1"
+
+	templt, err := createTemplate("../templates/status.html")
+	if err != nil {
+		t.Errorf("error parsing template: %v\n", err)
+		return
+	}
+
+	rendered := &bytes.Buffer{}
+	err = templt.ExecuteTemplate(rendered, "index", pageData{
+		Namespaces: result,
+		Shard: shard.Status{
+			Identity: "kube-applier-0",
+			Members:  []string{"kube-applier-0", "kube-applier-1"},
+			Selector: "team=billing",
+		},
+	})
+	if err != nil {
+		t.Errorf("error executing template: %v\n", err)
+		return
+	}
+	output := rendered.String()
+
+	if !strings.Contains(output, "Served by kube-applier-0, applying Waybills that match <code>team=billing</code>, sharded between kube-applier-0, kube-applier-1") {
+		t.Errorf("index page should show the shard group")
+	}
+	if !strings.Contains(output, "Applied by: kube-applier-1") {
+		t.Errorf("index page should show the replica that applies the Waybill")
+	}
+}
+
+func Test_ExecuteTemplate_Verification(t *testing.T) {
+	wbList := []kubeapplierv1alpha1.Waybill{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "test-ns"},
+		},
+	}
+	result := GetNamespaces(wbList, nil, diffURL)
+	result[0].Blocked = true
+
+	templt, err := createTemplate("../templates/status.html")
+	if err != nil {
+		t.Errorf("error parsing template: %v\n", err)
+		return
+	}
+
+	rendered := &bytes.Buffer{}
+	err = templt.ExecuteTemplate(rendered, "index", pageData{
+		Namespaces: result,
+		Verification: git.Verification{
+			Commit:           "b3ad10c",
+			Reason:           "the commit is not signed",
+			UnverifiedCommit: "b3ad10c",
+		},
+	})
+	if err != nil {
+		t.Errorf("error executing template: %v\n", err)
+		return
+	}
+	output := rendered.String()
+
+	if !strings.Contains(output, "Commit <code>b3ad10c</code> is held back: signature verification of commit <code>b3ad10c</code> failed, the commit is not signed") {
+		t.Errorf("index page should show the rejected commit")
+	}
+	if !strings.Contains(output, "Blocked: changes are held back") {
+		t.Errorf("index page should show that the Waybill is blocked")
+	}
+}
+
+func Test_ExecuteTemplate_Rollback(t *testing.T) {
+	wbList := []kubeapplierv1alpha1.Waybill{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "main",
+				Namespace: "test-ns",
+				Annotations: map[string]string{
+					kubeapplierv1alpha1.RollbackCommitAnnotation: "0123456789abcdef0123456789abcdef01234567",
+					kubeapplierv1alpha1.RollbackFromAnnotation:   "b3ad10c",
+				},
+			},
+			Status: kubeapplierv1alpha1.WaybillStatus{
+				History: []kubeapplierv1alpha1.WaybillStatusRunSummary{
+					{Commit: "0123456", Success: true},
+					{Commit: "b3ad10c", Success: true},
+					{Commit: "0123456", Success: true},
+				},
+				LastRun: &kubeapplierv1alpha1.WaybillStatusRun{Commit: "0123456"},
+			},
+		},
+	}
+	result := GetNamespaces(wbList, nil, diffURL)
+
+	templt, err := createTemplate("../templates/status.html")
+	if err != nil {
+		t.Errorf("error parsing template: %v\n", err)
+		return
+	}
+
+	rendered := &bytes.Buffer{}
+	err = templt.ExecuteTemplate(rendered, "index", pageData{Namespaces: result})
+	if err != nil {
+		t.Errorf("error executing template: %v\n", err)
+		return
+	}
+	output := rendered.String()
+
+	if !strings.Contains(output, "Rollback: pinned to commit 0123456789abcdef0123456789abcdef01234567 by a rollback from b3ad10c; polling runs are suspended") {
+		t.Errorf("index page should show the rollback pin")
+	}
+	if !strings.Contains(output, `data-action="unpin"`) {
+		t.Errorf("index page should allow clearing the rollback")
+	}
+	// Both commits in the history are either applied or rolled back from
+	if strings.Contains(output, `data-action="rollback"`) {
+		t.Errorf("index page should not allow rolling back further")
+	}
+}
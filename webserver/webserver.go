@@ -11,15 +11,21 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/ptr"
 
 	kubeapplierv1alpha1 "github.com/utilitywarehouse/kube-applier/apis/kubeapplier/v1alpha1"
 	"github.com/utilitywarehouse/kube-applier/client"
 	"github.com/utilitywarehouse/kube-applier/clock"
+	"github.com/utilitywarehouse/kube-applier/git"
 	"github.com/utilitywarehouse/kube-applier/log"
 	"github.com/utilitywarehouse/kube-applier/run"
+	"github.com/utilitywarehouse/kube-applier/shard"
 	"github.com/utilitywarehouse/kube-applier/webserver/oidc"
 )
 
@@ -34,7 +40,10 @@ type WebServer struct {
 	DiffURLFormat string
 	KubeClient    *client.Client
 	ListenPort    int
-	RunQueue      chan<- run.Request
+	RepoPath      string
+	Repository    *git.Repository
+	RunQueue      *run.Queue
+	Sharder       *shard.Sharder
 	StatusTimeout time.Duration
 	TemplatePath  string
 	server        *http.Server
@@ -47,6 +56,9 @@ type StatusPageHandler struct {
 	Clock         clock.ClockInterface
 	DiffURLFormat string
 	KubeClient    *client.Client
+	RepoPath      string
+	Repository    *git.Repository
+	Sharder       *shard.Sharder
 	Template      *template.Template
 	Timeout       time.Duration
 }
@@ -87,14 +99,22 @@ func (s *StatusPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	result := GetNamespaces(waybills, events, s.DiffURLFormat)
+	verification := s.Repository.Verification()
+	for i := range result {
+		result[i].ShardOwner = s.Sharder.Owner(&result[i].Waybill)
+		result[i].Blocked = verification.Blocks(run.WaybillPath(s.RepoPath, &result[i].Waybill))
+	}
 
 	selected := mux.Vars(r)["namespace"]
+	selectedName := mux.Vars(r)["name"]
 
-	if selected == "" {
+	if selected == "" && selectedName == "" {
 		// Main page: render full list of namespaces.
 		pageData := pageData{
 			Namespaces:        result,
 			SelectedNamespace: "",
+			Shard:             s.Sharder.Status(),
+			Verification:      verification,
 		}
 
 		rendered := &bytes.Buffer{}
@@ -111,22 +131,27 @@ func (s *StatusPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Single namespace page: find the requested namespace and render it alone.
-	var found *Namespace
+	// Single namespace page: find the Waybills of the requested namespace, or
+	// the requested Waybill if a name is provided, and render them alone.
+	var found []Namespace
 	for i := range result {
-		if result[i].Waybill.Namespace == selected {
-			found = &result[i]
-			break
+		if result[i].Waybill.Namespace == selected && (selectedName == "" || result[i].Waybill.Name == selectedName) {
+			found = append(found, result[i])
 		}
 	}
-	if found == nil {
+	if len(found) == 0 {
 		http.Error(w, "namespace not found", http.StatusNotFound)
 		return
 	}
 
 	pageData := pageData{
-		Namespaces:        []Namespace{*found},
+		Namespaces:        found,
 		SelectedNamespace: selected,
+		Shard:             s.Sharder.Status(),
+		Verification:      verification,
+	}
+	if selected == "" {
+		pageData.SelectedNamespace = clusterScope
 	}
 
 	rendered := &bytes.Buffer{}
@@ -146,8 +171,10 @@ func (s *StatusPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // endpoint for forcing a new run.
 type ForceRunHandler struct {
 	Authenticator *oidc.Authenticator
+	Clock         clock.ClockInterface
 	KubeClient    *client.Client
-	RunQueue      chan<- run.Request
+	RunQueue      *run.Queue
+	Sharder       *shard.Sharder
 }
 
 // ServeHTTP handles requests for forcing a run by attempting to add to the
@@ -185,8 +212,10 @@ func (f *ForceRunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
+		// ClusterWaybills are requested with an empty namespace and a name
 		ns := r.FormValue("namespace")
-		if ns == "" {
+		name := r.FormValue("name")
+		if ns == "" && name == "" {
 			data.Result = "error"
 			data.Message = "empty namespace value"
 			log.Logger("webserver").Error(data.Message)
@@ -203,16 +232,10 @@ func (f *ForceRunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		var waybill *kubeapplierv1alpha1.Waybill
-		for i := range waybills {
-			if waybills[i].Namespace == ns {
-				waybill = &waybills[i]
-				break
-			}
-		}
-		if waybill == nil {
+		waybill, err := FindWaybill(waybills, ns, name)
+		if err != nil {
 			data.Result = "error"
-			data.Message = fmt.Sprintf("cannot find Waybills in namespace '%s'", ns)
+			data.Message = err.Error()
 			w.WriteHeader(http.StatusBadRequest)
 			break
 		}
@@ -231,9 +254,35 @@ func (f *ForceRunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		run.Enqueue(f.RunQueue, run.ForcedRun, waybill)
+		if f.KubeClient.IsLeader() && f.Sharder.Owns(waybill) {
+			run.Enqueue(f.RunQueue, run.ForcedRun, waybill)
+			data.Result = "success"
+			data.Message = "Run queued"
+			w.WriteHeader(http.StatusOK)
+			break
+		}
+		// The Waybill is applied by the leader or by the replica that owns
+		// it, so the request is recorded on the Waybill for it to pick up
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			wb, err := f.KubeClient.GetWaybill(r.Context(), waybill.Namespace, waybill.Name)
+			if err != nil {
+				return err
+			}
+			if wb.Annotations == nil {
+				wb.Annotations = map[string]string{}
+			}
+			wb.Annotations[kubeapplierv1alpha1.ForceRunRequestedAnnotation] = f.Clock.Now().UTC().Format(time.RFC3339Nano)
+			return f.KubeClient.UpdateWaybill(r.Context(), wb)
+		})
+		if err != nil {
+			data.Result = "error"
+			data.Message = fmt.Sprintf("cannot request a run for waybill %s/%s", waybill.Namespace, waybill.Name)
+			log.Logger("webserver").Error(data.Message, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			break
+		}
 		data.Result = "success"
-		data.Message = "Run queued"
+		data.Message = "Run requested from the replica that applies the Waybill"
 		w.WriteHeader(http.StatusOK)
 	default:
 		data.Result = "error"
@@ -246,11 +295,308 @@ func (f *ForceRunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// WaybillActionHandler implements the http.Handler interface and serves API
+// endpoints for pausing and resuming a Waybill, toggling its dry-run mode, or
+// rolling it back.
+type WaybillActionHandler struct {
+	Authenticator *oidc.Authenticator
+	Clock         clock.ClockInterface
+	KubeClient    *client.Client
+	Repository    *git.Repository
+	RunQueue      *run.Queue
+	Sharder       *shard.Sharder
+}
+
+// ServeHTTP handles requests for modifying the autoApply and dryRun
+// attributes of a Waybill, or for rolling it back to the last successfully
+// applied commit and clearing the rollback. The user performing the action and
+// the reason provided are recorded in the Waybill's annotations.
+func (a *WaybillActionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Result  string `json:"result"`
+		Message string `json:"message"`
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	ns := mux.Vars(r)["namespace"]
+	name := mux.Vars(r)["name"]
+	action := mux.Vars(r)["action"]
+	log.Logger("webserver").Info("Waybill action requested", "namespace", ns, "name", name, "action", action)
+
+	switch r.Method {
+	case "POST":
+		userEmail := "anonymous"
+		if a.Authenticator != nil {
+			email, err := a.Authenticator.UserEmail(r.Context(), r)
+			if err != nil {
+				data.Result = "error"
+				data.Message = "not authenticated"
+				log.Logger("webserver").Error(data.Message, "error", err)
+				w.WriteHeader(http.StatusForbidden)
+				break
+			}
+			userEmail = email
+		}
+
+		if err := r.ParseForm(); err != nil {
+			data.Result = "error"
+			data.Message = "could not parse form data"
+			log.Logger("webserver").Error(data.Message, "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+
+		var (
+			mutate      func(*kubeapplierv1alpha1.Waybill)
+			description string
+			err         error
+		)
+		// The commit of a rollback is resolved once the Waybill is found
+		if action != "rollback" {
+			mutate, description, err = waybillActionMutation(action, r.FormValue("enabled"))
+			if err != nil {
+				data.Result = "error"
+				data.Message = err.Error()
+				w.WriteHeader(http.StatusBadRequest)
+				break
+			}
+		}
+
+		waybills, err := a.KubeClient.ListWaybills(r.Context())
+		if err != nil {
+			data.Result = "error"
+			data.Message = "cannot list Waybills"
+			log.Logger("webserver").Error(data.Message, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			break
+		}
+
+		waybill, err := FindWaybill(waybills, ns, name)
+		if err != nil {
+			data.Result = "error"
+			data.Message = err.Error()
+			w.WriteHeader(http.StatusBadRequest)
+			break
+		}
+
+		if a.Authenticator != nil {
+			hasAccess, err := a.KubeClient.HasAccess(r.Context(), waybill, userEmail, "patch")
+			if !hasAccess {
+				data.Result = "error"
+				data.Message = fmt.Sprintf("user %s is not allowed to modify waybill %s/%s", userEmail, waybill.Namespace, waybill.Name)
+				if err != nil {
+					log.Logger("webserver").Error(data.Message, "error", err)
+				}
+				w.WriteHeader(http.StatusForbidden)
+				break
+			}
+		}
+
+		if action == "rollback" {
+			mutate, description, err = a.rollbackMutation(r.Context(), waybill)
+			if err != nil {
+				data.Result = "error"
+				data.Message = err.Error()
+				log.Logger("webserver").Error(data.Message)
+				w.WriteHeader(http.StatusBadRequest)
+				break
+			}
+		}
+
+		reason := r.FormValue("reason")
+		now := a.Clock.Now().UTC()
+		// Rollbacks and clearing them change the commit that is applied, so
+		// a run is queued right away if this replica applies the Waybill, or
+		// requested from the replica that does otherwise
+		runRequested := action == "rollback" || action == "unpin"
+		enqueueRun := runRequested && a.KubeClient.IsLeader() && a.Sharder.Owns(waybill)
+		var updated *kubeapplierv1alpha1.Waybill
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			wb, err := a.KubeClient.GetWaybill(r.Context(), waybill.Namespace, waybill.Name)
+			if err != nil {
+				return err
+			}
+			if wb.Annotations == nil {
+				wb.Annotations = map[string]string{}
+			}
+			mutate(wb)
+			wb.Annotations[kubeapplierv1alpha1.LastActionAnnotation] = description
+			wb.Annotations[kubeapplierv1alpha1.LastActionByAnnotation] = userEmail
+			wb.Annotations[kubeapplierv1alpha1.LastActionReasonAnnotation] = reason
+			wb.Annotations[kubeapplierv1alpha1.LastActionTimeAnnotation] = now.Format(time.RFC3339)
+			if runRequested && !enqueueRun {
+				wb.Annotations[kubeapplierv1alpha1.ForceRunRequestedAnnotation] = now.Format(time.RFC3339Nano)
+			}
+			updated = wb
+			return a.KubeClient.UpdateWaybill(r.Context(), wb)
+		})
+		if err != nil {
+			data.Result = "error"
+			data.Message = fmt.Sprintf("cannot update waybill %s/%s", waybill.Namespace, waybill.Name)
+			log.Logger("webserver").Error(data.Message, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			break
+		}
+		message := fmt.Sprintf("Waybill %s by %s", description, userEmail)
+		if reason != "" {
+			message = fmt.Sprintf("%s: %s", message, reason)
+		}
+		eventReason := "WaybillUpdated"
+		if action == "rollback" {
+			eventReason = "WaybillRolledBack"
+		}
+		a.KubeClient.EmitWaybillEvent(waybill, corev1.EventTypeNormal, eventReason, "%s", message)
+		if enqueueRun {
+			run.Enqueue(a.RunQueue, run.ForcedRun, updated)
+		}
+
+		data.Result = "success"
+		data.Message = fmt.Sprintf("Waybill %s", description)
+		w.WriteHeader(http.StatusOK)
+	default:
+		data.Result = "error"
+		data.Message = "must be a POST request"
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Logger("webserver").Error("Failed encoding waybill action response", "error", err)
+	}
+}
+
+// QueueHandler implements the http.Handler interface and serves an API
+// endpoint that lists the pending run requests, in the order that they will be
+// applied.
+type QueueHandler struct {
+	Authenticator *oidc.Authenticator
+	RunQueue      *run.Queue
+}
+
+// ServeHTTP handles requests for listing the run queue.
+func (q *QueueHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Result   string              `json:"result"`
+		Message  string              `json:"message"`
+		Requests []run.QueuedRequest `json:"requests,omitempty"`
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	switch r.Method {
+	case "GET":
+		if q.Authenticator != nil {
+			if _, err := q.Authenticator.UserEmail(r.Context(), r); err != nil {
+				data.Result = "error"
+				data.Message = "not authenticated"
+				log.Logger("webserver").Error(data.Message, "error", err)
+				w.WriteHeader(http.StatusForbidden)
+				break
+			}
+		}
+		data.Requests = q.RunQueue.Pending()
+		data.Result = "success"
+		data.Message = fmt.Sprintf("%d run requests queued", len(data.Requests))
+		w.WriteHeader(http.StatusOK)
+	default:
+		data.Result = "error"
+		data.Message = "must be a GET request"
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Logger("webserver").Error("Failed encoding queue response", "error", err)
+	}
+}
+
+// FindWaybill returns the Waybill with the provided namespace and name from
+// the list. If name is empty, the namespace must contain a single Waybill. If
+// namespace is empty, the ClusterWaybill with the provided name is returned.
+func FindWaybill(waybills []kubeapplierv1alpha1.Waybill, namespace, name string) (*kubeapplierv1alpha1.Waybill, error) {
+	var found []*kubeapplierv1alpha1.Waybill
+	for i := range waybills {
+		if waybills[i].Namespace == namespace && (name == "" || waybills[i].Name == name) {
+			found = append(found, &waybills[i])
+		}
+	}
+	switch {
+	case len(found) == 0 && namespace == "":
+		return nil, fmt.Errorf("cannot find ClusterWaybill '%s'", name)
+	case len(found) == 0 && name != "":
+		return nil, fmt.Errorf("cannot find Waybill '%s/%s'", namespace, name)
+	case len(found) == 0:
+		return nil, fmt.Errorf("cannot find Waybills in namespace '%s'", namespace)
+	case len(found) > 1:
+		return nil, fmt.Errorf("multiple Waybills found in namespace '%s', a name is required", namespace)
+	}
+	return found[0], nil
+}
+
+// waybillActionMutation returns a function that applies the requested action
+// to a Waybill, along with a short description of the action. For the
+// "dryrun" action, the enabled value determines whether dry-run is turned on
+// or off.
+func waybillActionMutation(action, enabled string) (func(*kubeapplierv1alpha1.Waybill), string, error) {
+	switch action {
+	case "pause":
+		return func(wb *kubeapplierv1alpha1.Waybill) { wb.Spec.AutoApply = ptr.To(false) }, "paused", nil
+	case "resume":
+		return func(wb *kubeapplierv1alpha1.Waybill) { wb.Spec.AutoApply = ptr.To(true) }, "resumed", nil
+	case "unpin":
+		return func(wb *kubeapplierv1alpha1.Waybill) {
+			delete(wb.Annotations, kubeapplierv1alpha1.RollbackCommitAnnotation)
+			delete(wb.Annotations, kubeapplierv1alpha1.RollbackFromAnnotation)
+		}, "rollback cleared", nil
+	case "dryrun":
+		dryRun, err := strconv.ParseBool(enabled)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid value for enabled: '%s'", enabled)
+		}
+		description := "dry-run disabled"
+		if dryRun {
+			description = "dry-run enabled"
+		}
+		return func(wb *kubeapplierv1alpha1.Waybill) { wb.Spec.DryRun = dryRun }, description, nil
+	default:
+		return nil, "", fmt.Errorf("unknown action '%s'", action)
+	}
+}
+
+// rollbackMutation returns a function that pins the Waybill to the commit of
+// its last successful run, along with a short description of the rollback.
+// The abbreviated commit recorded in the run history is resolved, so that the
+// pin does not become ambiguous as the repository grows.
+func (a *WaybillActionHandler) rollbackMutation(ctx context.Context, waybill *kubeapplierv1alpha1.Waybill) (func(*kubeapplierv1alpha1.Waybill), string, error) {
+	// The commit that is rolled back from is that of the last run
+	if waybill.Status.LastRun == nil {
+		return nil, "", fmt.Errorf("no run is recorded for waybill %s/%s", waybill.Namespace, waybill.Name)
+	}
+	target, ok := run.RollbackCommit(waybill)
+	if !ok {
+		return nil, "", fmt.Errorf("no successful run at an earlier commit is recorded for waybill %s/%s", waybill.Namespace, waybill.Name)
+	}
+	commit, err := a.Repository.FullHash(ctx, target)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot find commit %s in the repository, it might be beyond the depth of the clone: %w", target, err)
+	}
+	from := waybill.Annotations[kubeapplierv1alpha1.RollbackFromAnnotation]
+	// Rolling back further keeps the commit that was originally rolled
+	// back from, so that the pin is only released by newer commits
+	if from == "" {
+		from = waybill.Status.LastRun.Commit
+	}
+	return func(wb *kubeapplierv1alpha1.Waybill) {
+		wb.Annotations[kubeapplierv1alpha1.RollbackCommitAnnotation] = commit
+		wb.Annotations[kubeapplierv1alpha1.RollbackFromAnnotation] = from
+	}, fmt.Sprintf("rolled back to commit %s", target), nil
+}
+
 // Start starts the webserver using the given port, and sets up handlers for:
 // 1. Status page
 // 2. Metrics
 // 3. Static content
 // 4. Endpoint for forcing a run
+// 5. Endpoints for pausing, resuming, toggling dry-run and rolling back
+// Waybills
+// 6. Endpoint for listing the run queue
 func (ws *WebServer) Start() error {
 	if ws.server != nil {
 		return fmt.Errorf("WebServer already running")
@@ -268,23 +614,46 @@ func (ws *WebServer) Start() error {
 	}
 
 	m := mux.NewRouter()
-	addStatusEndpoints(m)
+	addStatusEndpoints(m, ws.KubeClient.IsLeader)
 	statusPageHandler := &StatusPageHandler{
 		Authenticator: ws.Authenticator,
 		Clock:         ws.Clock,
 		DiffURLFormat: ws.DiffURLFormat,
 		KubeClient:    ws.KubeClient,
+		RepoPath:      ws.RepoPath,
+		Repository:    ws.Repository,
+		Sharder:       ws.Sharder,
 		Template:      template,
 		Timeout:       ws.StatusTimeout,
 	}
 	forceRunHandler := &ForceRunHandler{
 		Authenticator: ws.Authenticator,
+		Clock:         ws.Clock,
+		KubeClient:    ws.KubeClient,
+		RunQueue:      ws.RunQueue,
+		Sharder:       ws.Sharder,
+	}
+	waybillActionHandler := &WaybillActionHandler{
+		Authenticator: ws.Authenticator,
+		Clock:         ws.Clock,
 		KubeClient:    ws.KubeClient,
+		Repository:    ws.Repository,
+		RunQueue:      ws.RunQueue,
+		Sharder:       ws.Sharder,
+	}
+	queueHandler := &QueueHandler{
+		Authenticator: ws.Authenticator,
 		RunQueue:      ws.RunQueue,
 	}
 	m.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 	m.PathPrefix("/api/v1/forceRun").Handler(forceRunHandler)
+	m.Handle("/api/v1/queue", queueHandler)
+	m.Handle("/api/v1/waybills/{namespace}/{action}", waybillActionHandler)
+	m.Handle("/api/v1/waybills/{namespace}/{name}/{action}", waybillActionHandler)
+	m.Handle("/api/v1/clusterwaybills/{name}/{action}", waybillActionHandler)
 	m.HandleFunc("/ns/{namespace}", statusPageHandler.ServeHTTP)
+	m.HandleFunc("/ns/{namespace}/{name}", statusPageHandler.ServeHTTP)
+	m.HandleFunc("/cluster/{name}", statusPageHandler.ServeHTTP)
 	m.PathPrefix("/").Handler(statusPageHandler)
 
 	ws.server = &http.Server{
@@ -2,14 +2,19 @@ package webserver
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"testing"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -19,13 +24,18 @@ import (
 )
 
 // TODO: this is essentially duplication from the run package, can we share?
-func testWebServerDrainRequests(requests <-chan run.Request) func() []run.Request {
+func testWebServerDrainRequests(requests *run.Queue) func() []run.Request {
 	ret := []run.Request{}
 	finished := make(chan bool)
 
 	go func() {
-		for r := range requests {
+		for {
+			r, ok := requests.Get()
+			if !ok {
+				break
+			}
 			ret = append(ret, r)
+			requests.Done(r)
 		}
 		close(finished)
 	}()
@@ -38,13 +48,13 @@ func testWebServerDrainRequests(requests <-chan run.Request) func() []run.Reques
 
 var _ = Describe("WebServer", func() {
 	var (
-		testRunQueue          chan run.Request
+		testRunQueue          *run.Queue
 		testWebServer         WebServer
 		testWebServerRequests func() []run.Request
 	)
 
 	BeforeEach(func() {
-		testRunQueue = make(chan run.Request)
+		testRunQueue = run.NewQueue()
 		testWebServerRequests = testWebServerDrainRequests(testRunQueue)
 		testWebServer = WebServer{
 			ListenPort:    35432,
@@ -125,12 +135,157 @@ var _ = Describe("WebServer", func() {
 			Expect(body).To(MatchJSON(`{"result": "success", "message": "Run queued"}`))
 
 			testWebServer.Shutdown()
-			close(testRunQueue)
+			testRunQueue.ShutDown()
 
-			Expect(testWebServerRequests()).To(Equal([]run.Request{{
-				Type:    run.ForcedRun,
-				Waybill: &wbList[0],
-			}}))
+			Expect(testWebServerRequests()).To(ConsistOf(MatchAllFields(Fields{
+				"Type":    Equal(run.ForcedRun),
+				"Waybill": Equal(&wbList[0]),
+				"Queued":  Not(BeZero()),
+			})))
+		})
+
+		It("Should update the Waybill when a valid action request is made", func() {
+			testEnsureWaybills([]kubeapplierv1alpha1.Waybill{{
+				TypeMeta: metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "main",
+					Namespace: "action-foo",
+				},
+			}})
+
+			apiURL := fmt.Sprintf("http://localhost:%d/api/v1/waybills", testWebServer.ListenPort)
+
+			res, err := http.Get(fmt.Sprintf("%s/action-foo/pause", apiURL))
+			Expect(err).To(BeNil())
+			body, err := io.ReadAll(res.Body)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{"result": "error", "message": "must be a POST request"}`))
+
+			res, err = http.PostForm(fmt.Sprintf("%s/action-foo/invalid", apiURL), url.Values{})
+			Expect(err).To(BeNil())
+			body, err = io.ReadAll(res.Body)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{"result": "error", "message": "unknown action 'invalid'"}`))
+
+			res, err = http.PostForm(fmt.Sprintf("%s/action-foo/dryrun", apiURL), url.Values{"enabled": {"maybe"}})
+			Expect(err).To(BeNil())
+			body, err = io.ReadAll(res.Body)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{"result": "error", "message": "invalid value for enabled: 'maybe'"}`))
+
+			res, err = http.PostForm(fmt.Sprintf("%s/invalid/pause", apiURL), url.Values{})
+			Expect(err).To(BeNil())
+			body, err = io.ReadAll(res.Body)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{"result": "error", "message": "cannot find Waybills in namespace 'invalid'"}`))
+
+			res, err = http.PostForm(fmt.Sprintf("%s/action-foo/pause", apiURL), url.Values{"reason": {"testing"}})
+			Expect(err).To(BeNil())
+			body, err = io.ReadAll(res.Body)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"result": "success", "message": "Waybill paused"}`))
+
+			res, err = http.PostForm(fmt.Sprintf("%s/action-foo/dryrun", apiURL), url.Values{"enabled": {"true"}})
+			Expect(err).To(BeNil())
+			body, err = io.ReadAll(res.Body)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"result": "success", "message": "Waybill dry-run enabled"}`))
+
+			Eventually(
+				func() error {
+					wb, err := testKubeClient.GetWaybill(context.TODO(), "action-foo", "main")
+					if err != nil {
+						return err
+					}
+					if wb.Spec.AutoApply == nil || *wb.Spec.AutoApply {
+						return fmt.Errorf("expected autoApply to be false")
+					}
+					if !wb.Spec.DryRun {
+						return fmt.Errorf("expected dryRun to be true")
+					}
+					if wb.Annotations[kubeapplierv1alpha1.LastActionAnnotation] != "dry-run enabled" {
+						return fmt.Errorf("unexpected last action: %s", wb.Annotations[kubeapplierv1alpha1.LastActionAnnotation])
+					}
+					if wb.Annotations[kubeapplierv1alpha1.LastActionByAnnotation] != "anonymous" {
+						return fmt.Errorf("unexpected last action user: %s", wb.Annotations[kubeapplierv1alpha1.LastActionByAnnotation])
+					}
+					return nil
+				},
+				time.Second*15,
+				time.Second,
+			).Should(BeNil())
+
+			testWebServer.Shutdown()
+			testRunQueue.ShutDown()
+			Expect(testWebServerRequests()).To(Equal([]run.Request{}))
+		})
+
+		It("Should require a Waybill name in namespaces with multiple Waybills", func() {
+			multiList := []kubeapplierv1alpha1.Waybill{
+				{
+					TypeMeta:   metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
+					ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "multi-foo"},
+				},
+				{
+					TypeMeta:   metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"},
+					ObjectMeta: metav1.ObjectMeta{Name: "monitoring", Namespace: "multi-foo"},
+				},
+			}
+			testEnsureWaybills(multiList)
+
+			forceRunURL := fmt.Sprintf("http://localhost:%d/api/v1/forceRun", testWebServer.ListenPort)
+			v := url.Values{"namespace": {"multi-foo"}}
+			Eventually(
+				func() (string, error) {
+					res, err := http.PostForm(forceRunURL, v)
+					if err != nil {
+						return "", err
+					}
+					defer res.Body.Close()
+					body, err := io.ReadAll(res.Body)
+					return string(body), err
+				},
+				time.Second*15,
+				time.Second,
+			).Should(MatchJSON(`{"result": "error", "message": "multiple Waybills found in namespace 'multi-foo', a name is required"}`))
+
+			v.Set("name", "invalid")
+			res, err := http.PostForm(forceRunURL, v)
+			Expect(err).To(BeNil())
+			body, err := io.ReadAll(res.Body)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{"result": "error", "message": "cannot find Waybill 'multi-foo/invalid'"}`))
+
+			v.Set("name", "monitoring")
+			res, err = http.PostForm(forceRunURL, v)
+			Expect(err).To(BeNil())
+			body, err = io.ReadAll(res.Body)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"result": "success", "message": "Run queued"}`))
+
+			res, err = http.Get(fmt.Sprintf("http://localhost:%d/ns/multi-foo/app", testWebServer.ListenPort))
+			Expect(err).To(BeNil())
+			body, err = io.ReadAll(res.Body)
+			Expect(err).To(BeNil())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(string(body)).To(ContainSubstring("multi-foo/app"))
+			Expect(string(body)).ToNot(ContainSubstring("multi-foo/monitoring"))
+
+			testWebServer.Shutdown()
+			testRunQueue.ShutDown()
+			Expect(testWebServerRequests()).To(ConsistOf(MatchAllFields(Fields{
+				"Type":    Equal(run.ForcedRun),
+				"Waybill": Equal(&multiList[1]),
+				"Queued":  Not(BeZero()),
+			})))
 		})
 
 		It("Should render HTML on the root page", func() {
@@ -154,7 +309,7 @@ var _ = Describe("WebServer", func() {
 			Expect(body).ToNot(BeEmpty())
 
 			testWebServer.Shutdown()
-			close(testRunQueue)
+			testRunQueue.ShutDown()
 			Expect(testWebServerRequests()).To(Equal([]run.Request{}))
 		})
 
@@ -195,7 +350,7 @@ var _ = Describe("WebServer", func() {
 			Expect(res.StatusCode).To(Equal(http.StatusNotFound))
 
 			testWebServer.Shutdown()
-			close(testRunQueue)
+			testRunQueue.ShutDown()
 			Expect(testWebServerRequests()).To(Equal([]run.Request{}))
 		})
 	})
@@ -233,3 +388,54 @@ func testEnsureWaybills(wbList []kubeapplierv1alpha1.Waybill) {
 		wbList[i].TypeMeta = metav1.TypeMeta{APIVersion: "kube-applier.io/v1alpha1", Kind: "Waybill"}
 	}
 }
+
+func TestQueueHandler(t *testing.T) {
+	queue := run.NewQueue()
+	run.Enqueue(queue, run.ScheduledRun, &kubeapplierv1alpha1.Waybill{
+		ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"},
+	})
+	run.Enqueue(queue, run.ForcedRun, &kubeapplierv1alpha1.Waybill{
+		ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "bar"},
+	})
+	handler := &QueueHandler{RunQueue: queue}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/queue", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.JSONEq(t, `{"result": "error", "message": "must be a GET request"}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/queue", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var data struct {
+		Result   string
+		Message  string
+		Requests []run.QueuedRequest
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &data))
+	assert.Equal(t, "success", data.Result)
+	assert.Equal(t, "2 run requests queued", data.Message)
+	if assert.Len(t, data.Requests, 2) {
+		assert.Equal(t, 1, data.Requests[0].Position)
+		assert.Equal(t, "bar", data.Requests[0].Namespace)
+		assert.Equal(t, run.ForcedRun.String(), data.Requests[0].Type)
+		assert.Equal(t, 2, data.Requests[1].Position)
+		assert.Equal(t, "foo", data.Requests[1].Namespace)
+	}
+}
+
+func TestRollbackMutation_noLastRun(t *testing.T) {
+	waybill := &kubeapplierv1alpha1.Waybill{
+		ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "foo"},
+		Status: kubeapplierv1alpha1.WaybillStatus{
+			History: []kubeapplierv1alpha1.WaybillStatusRunSummary{
+				{Commit: "abc123", Success: true},
+				{Commit: "def456", Success: true},
+			},
+		},
+	}
+	handler := &WaybillActionHandler{}
+	mutate, _, err := handler.rollbackMutation(context.Background(), waybill)
+	assert.EqualError(t, err, "no run is recorded for waybill foo/main")
+	assert.Nil(t, mutate)
+}